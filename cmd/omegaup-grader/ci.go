@@ -1,14 +1,20 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/big"
 	"net/http"
 	"os"
 	"path"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	git "github.com/libgit2/git2go/v33"
@@ -16,11 +22,22 @@ import (
 	base "github.com/omegaup/go-base/v3"
 	"github.com/omegaup/quark/common"
 	"github.com/omegaup/quark/grader"
+	"github.com/omegaup/quark/runner"
 	"github.com/omegaup/quark/runner/ci"
+
+	"github.com/pkg/errors"
 )
 
 var (
-	ciURLRegexp = regexp.MustCompile(`^/ci/problem/([a-zA-Z0-9-_]+)/([0-9a-f]{40})/$`)
+	ciURLRegexp        = regexp.MustCompile(`^/ci/problem/([a-zA-Z0-9-_]+)/([0-9a-f]{40})/$`)
+	ciCompareURLRegexp = regexp.MustCompile(`^/ci/problem/([a-zA-Z0-9-_]+)/([0-9a-f]{40})/compare/([0-9a-f]{40})/$`)
+	ciHistoryURLRegexp = regexp.MustCompile(`^/ci/problem/([a-zA-Z0-9-_]+)/$`)
+)
+
+const (
+	// defaultCIHistoryLimit is the number of runs returned by the CI history
+	// endpoint when no limit is requested.
+	defaultCIHistoryLimit = 20
 )
 
 type reportWithPath struct {
@@ -32,8 +49,8 @@ type ciHandler struct {
 	ephemeralRunManager *grader.EphemeralRunManager
 	ctx                 *grader.Context
 	lruCache            *ci.LRUCache
-	stopChan            chan struct{}
-	reportChan          chan *reportWithPath
+	queue               *ciQueue
+	webhookClient       *http.Client
 	doneChan            chan struct{}
 }
 
@@ -52,6 +69,16 @@ func (h *ciHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if match := ciHistoryURLRegexp.FindStringSubmatch(r.URL.Path); match != nil {
+		h.serveHistory(ctx, w, r, match[1])
+		return
+	}
+
+	if match := ciCompareURLRegexp.FindStringSubmatch(r.URL.Path); match != nil {
+		h.serveComparison(ctx, w, match[1], match[2], match[3])
+		return
+	}
+
 	match := ciURLRegexp.FindStringSubmatch(r.URL.Path)
 	if match == nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -65,14 +92,17 @@ func (h *ciHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		State:      ci.StateWaiting,
 	}
 
-	reportPath := path.Join(
-		ctx.Config.Grader.RuntimePath,
-		"ci",
-		report.Problem,
-		report.CommitHash[:2],
-		report.CommitHash[2:],
-		"report.json.gz",
-	)
+	reportPath := ciReportPath(ctx, report.Problem, report.CommitHash)
+	if position := h.queue.position(reportPath); position != nil {
+		// The report file has the position from when the request was queued,
+		// so the current one is filled in.
+		waitingReport, err := ci.ReadReport(reportPath)
+		if err == nil && waitingReport.State == ci.StateWaiting {
+			waitingReport.QueuePosition = position
+			writeCIReport(ctx, w, waitingReport)
+			return
+		}
+	}
 	if fd, err := os.Open(reportPath); err == nil {
 		defer fd.Close()
 
@@ -95,6 +125,158 @@ func (h *ciHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if status := h.reserveCIRun(ctx, report, reportPath); status != http.StatusOK {
+		writeCIRunError(w, report, status)
+		return
+	}
+
+	writeCIReport(ctx, w, report)
+
+	// Transfer the run to processCIRequest.
+	h.queue.push(&reportWithPath{
+		report: report,
+		path:   reportPath,
+	})
+}
+
+// writeCIReport writes the report as the response.
+func writeCIReport(ctx *grader.Context, w http.ResponseWriter, report *ci.Report) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		ctx.Log.Error(
+			"Failed to write report",
+			map[string]any{
+				"err": err,
+			},
+		)
+	}
+}
+
+// ciReportPath returns the path of the report of the CI run of a commit.
+func ciReportPath(ctx *grader.Context, problem, commitHash string) string {
+	return path.Join(
+		ctx.Config.Grader.RuntimePath,
+		"ci",
+		problem,
+		commitHash[:2],
+		commitHash[2:],
+		"report.json.gz",
+	)
+}
+
+// ciComparison is the response of the CI comparison between two commits. The
+// comparison is only present once both CI runs have finished.
+type ciComparison struct {
+	Base       *ci.ReportSummary    `json:"base"`
+	Head       *ci.ReportSummary    `json:"head"`
+	Comparison *ci.ReportComparison `json:"comparison,omitempty"`
+}
+
+// loadOrStartCIRun returns the report of the CI run of a commit, starting the
+// run if it has not been requested before. A report of a run that is still
+// waiting or running is returned as-is, so its results are incomplete.
+func (h *ciHandler) loadOrStartCIRun(
+	ctx *grader.Context,
+	problem string,
+	commitHash string,
+) (*ci.Report, int) {
+	reportPath := ciReportPath(ctx, problem, commitHash)
+	if _, err := os.Stat(reportPath); err == nil {
+		report, err := ci.ReadReport(reportPath)
+		if err != nil {
+			ctx.Log.Error(
+				"Failed to read the report",
+				map[string]any{
+					"filename": reportPath,
+					"err":      err,
+				},
+			)
+			return nil, http.StatusInternalServerError
+		}
+		return report, http.StatusOK
+	}
+
+	report := &ci.Report{
+		Problem:    problem,
+		CommitHash: commitHash,
+		StartTime:  time.Now(),
+		State:      ci.StateWaiting,
+	}
+	if status := h.reserveCIRun(ctx, report, reportPath); status != http.StatusOK {
+		return report, status
+	}
+	// The queued report will be modified by processCIRequest, so a copy is
+	// returned.
+	snapshot := *report
+	h.queue.push(&reportWithPath{
+		report: report,
+		path:   reportPath,
+	})
+	return &snapshot, http.StatusOK
+}
+
+// serveComparison writes the differences between the CI runs of two commits
+// of a problem, starting any of them that has not been requested before.
+func (h *ciHandler) serveComparison(
+	ctx *grader.Context,
+	w http.ResponseWriter,
+	problem string,
+	baseCommitHash string,
+	headCommitHash string,
+) {
+	var reports []*ci.Report
+	for _, commitHash := range []string{baseCommitHash, headCommitHash} {
+		report, status := h.loadOrStartCIRun(ctx, problem, commitHash)
+		if status != http.StatusOK {
+			if report == nil {
+				w.WriteHeader(status)
+			} else {
+				writeCIRunError(w, report, status)
+			}
+			return
+		}
+		reports = append(reports, report)
+	}
+
+	response := ciComparison{
+		Base: reports[0].Summary(),
+		Head: reports[1].Summary(),
+	}
+	finished := func(report *ci.Report) bool {
+		return report.State != ci.StateWaiting && report.State != ci.StateRunning
+	}
+	if finished(reports[0]) && finished(reports[1]) {
+		response.Comparison = ci.CompareReports(reports[0], reports[1])
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(&response); err != nil {
+		ctx.Log.Error(
+			"Failed to write the CI comparison",
+			map[string]any{
+				"err": err,
+			},
+		)
+	}
+}
+
+// reserveCIRun validates the commit of the report, and reserves a place in the
+// queue for its CI run. If http.StatusOK is returned, the report has been
+// written to reportPath and the caller must push it to the queue. Otherwise,
+// the status describes the failure.
+func (h *ciHandler) reserveCIRun(
+	ctx *grader.Context,
+	report *ci.Report,
+	reportPath string,
+) int {
 	// Do the barest minimum checks before fully committing to making this CI
 	// run.
 	repository, err := git.OpenRepository(grader.GetRepositoryPath(
@@ -109,8 +291,7 @@ func (h *ciHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				"err":      err,
 			},
 		)
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return http.StatusNotFound
 	}
 	defer repository.Free()
 	commitID, err := git.NewOid(report.CommitHash)
@@ -123,8 +304,7 @@ func (h *ciHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				"err":      err,
 			},
 		)
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return http.StatusNotFound
 	}
 	commit, err := repository.LookupCommit(commitID)
 	if err != nil {
@@ -136,8 +316,7 @@ func (h *ciHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				"err":      err,
 			},
 		)
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return http.StatusNotFound
 	}
 	defer commit.Free()
 
@@ -151,8 +330,7 @@ func (h *ciHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				"err":      err,
 			},
 		)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError
 	}
 
 	stamp, err := os.OpenFile(
@@ -168,70 +346,92 @@ func (h *ciHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				"err":      err,
 			},
 		)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError
 	}
 	stamp.Close()
 
-	if err := report.Write(reportPath); err != nil {
+	position, err := h.queue.reserve()
+	if err != nil {
+		// The report is not persisted, so that the request can be made again
+		// once the queue has room.
+		ctx.Metrics.CounterAdd("grader_ci_jobs_rejected_total", 1)
 		ctx.Log.Error(
-			"Failed to create the report file",
+			"Rejecting CI request",
 			map[string]any{
 				"filename": reportPath,
 				"err":      err,
 			},
 		)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		os.Remove(path.Join(path.Dir(reportPath), ci.RunningStampFilename))
+		report.State = ci.StateError
+		report.ReportError = &ci.ReportError{Error: err}
+		{
+			finishTime := time.Now()
+			report.FinishTime = &finishTime
+			duration := base.Duration(report.FinishTime.Sub(report.StartTime))
+			report.Duration = &duration
+		}
+		return http.StatusServiceUnavailable
 	}
+	report.QueuePosition = &position
 
-	w.Header().Add("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	encoder := json.NewEncoder(w)
-	encoder.SetIndent("", "  ")
-	if err = encoder.Encode(report); err != nil {
+	if err := report.Write(reportPath); err != nil {
 		ctx.Log.Error(
-			"Failed to write report",
+			"Failed to create the report file",
 			map[string]any{
-				"err": err,
+				"filename": reportPath,
+				"err":      err,
 			},
 		)
+		h.queue.release()
+		return http.StatusInternalServerError
 	}
 
-	// Transfer the run to processCIRequest.
-	h.reportChan <- &reportWithPath{
-		report: report,
-		path:   reportPath,
+	return http.StatusOK
+}
+
+// writeCIRunError writes the response for a CI run that could not be
+// reserved. The report is only included if it has an error.
+func writeCIRunError(w http.ResponseWriter, report *ci.Report, status int) {
+	if report.ReportError == nil {
+		w.WriteHeader(status)
+		return
 	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
 }
 
-func (h *ciHandler) runTest(
+// runEphemeral runs the solution against the input as an ephemeral run, and
+// waits for it to finish. started is called with the ephemeral token once the
+// run is created, and running once a runner picks the run up. Either can be
+// nil. If no error is returned, the caller must either commit the run to the
+// ephemeral run manager or clean its artifacts.
+func (h *ciHandler) runEphemeral(
 	ctx *grader.Context,
-	testConfig *ci.TestConfig,
 	runs *grader.Queue,
-	report *ci.Report,
-	reportPath string,
-) error {
-	testConfig.Test.StartTime = time.Now()
-
+	solution *ci.SolutionConfig,
+	input *common.LiteralInput,
+	started func(ephemeralToken string),
+	running func(),
+) (*grader.RunInfo, error) {
 	ctx.Metrics.CounterAdd("grader_ephemeral_runs_total", 1)
 	ctx.Log.Debug(
 		"Adding new run",
 		map[string]any{
 			"run": &grader.EphemeralRunRequest{
-				Source:   testConfig.Solution.Source,
-				Language: testConfig.Solution.Language,
-				Input:    testConfig.Input,
+				Source:   solution.Source,
+				Language: solution.Language,
+				Input:    input,
 			},
 		},
 	)
 	maxScore := &big.Rat{}
-	for _, literalCase := range testConfig.Input.Cases {
+	for _, literalCase := range input.Cases {
 		maxScore.Add(maxScore, literalCase.Weight)
 	}
 	inputFactory, err := common.NewLiteralInputFactory(
-		testConfig.Input,
+		input,
 		ctx.Config.Grader.RuntimePath,
 		common.LiteralPersistGrader,
 	)
@@ -242,16 +442,16 @@ func (h *ciHandler) runTest(
 				"err": err,
 			},
 		)
-		return err
+		return nil, err
 	}
 
 	runInfo := grader.NewRunInfo()
 	runInfo.Run.InputHash = inputFactory.Hash()
 	runInfo.Run.MaxScore = maxScore
-	runInfo.Run.Language = testConfig.Solution.Language
-	runInfo.Run.Source = testConfig.Solution.Source
+	runInfo.Run.Language = solution.Language
+	runInfo.Run.Source = solution.Source
 	runInfo.Priority = grader.QueuePriorityEphemeral
-	testConfig.Test.EphemeralToken, err = h.ephemeralRunManager.SetEphemeral(runInfo)
+	ephemeralToken, err := h.ephemeralRunManager.SetEphemeral(runInfo)
 	if err != nil {
 		ctx.Log.Error(
 			"Error making run ephemeral",
@@ -259,46 +459,39 @@ func (h *ciHandler) runTest(
 				"err": err,
 			},
 		)
-		return err
+		return nil, err
+	}
+	if started != nil {
+		started(ephemeralToken)
 	}
 
-	committed := false
-	defer func(committed *bool) {
-		if *committed {
-			return
+	runWaitHandle, err := (func() (*grader.RunWaitHandle, error) {
+		inputRef, err := ctx.InputManager.Add(inputFactory.Hash(), inputFactory)
+		if err != nil {
+			ctx.Log.Error(
+				"Error adding input",
+				map[string]any{
+					"err": err,
+				},
+			)
+			return nil, err
 		}
-		err = runInfo.Artifacts.Clean()
+		runWaitHandle, err := runs.AddWaitableRun(&ctx.Context, runInfo, inputRef)
 		if err != nil {
 			ctx.Log.Error(
-				"Error cleaning up after run",
+				"Failed to add run",
 				map[string]any{
 					"err": err,
 				},
 			)
+			return nil, err
 		}
-	}(&committed)
-
-	inputRef, err := ctx.InputManager.Add(inputFactory.Hash(), inputFactory)
+		return runWaitHandle, nil
+	})()
 	if err != nil {
-		ctx.Log.Error(
-			"Error adding input",
-			map[string]any{
-				"err": err,
-			},
-		)
-		return err
+		cleanEphemeralRun(ctx, runInfo)
+		return nil, err
 	}
-	runWaitHandle, err := runs.AddWaitableRun(&ctx.Context, runInfo, inputRef)
-	if err != nil {
-		ctx.Log.Error(
-			"Failed to add run",
-			map[string]any{
-				"err": err,
-			},
-		)
-		return err
-	}
-
 	ctx.Log.Info(
 		"enqueued run",
 		map[string]any{
@@ -309,21 +502,68 @@ func (h *ciHandler) runTest(
 	// Wait until a runner has picked the run up, or the run has been finished.
 	select {
 	case <-runWaitHandle.Running():
-		testConfig.Test.State = ci.StateRunning
-		if err := report.Write(reportPath); err != nil {
-			ctx.Log.Error(
-				"Failed to write the report file",
-				map[string]any{
-					"filename": reportPath,
-					"err":      err,
-				},
-			)
+		if running != nil {
+			running()
 		}
 		break
 	case <-runWaitHandle.Ready():
 	}
 	<-runWaitHandle.Ready()
 
+	return runInfo, nil
+}
+
+// cleanEphemeralRun removes the artifacts of an ephemeral run that is not
+// going to be committed.
+func cleanEphemeralRun(ctx *grader.Context, runInfo *grader.RunInfo) {
+	if err := runInfo.Artifacts.Clean(); err != nil {
+		ctx.Log.Error(
+			"Error cleaning up after run",
+			map[string]any{
+				"err": err,
+			},
+		)
+	}
+}
+
+func (h *ciHandler) runTest(
+	ctx *grader.Context,
+	testConfig *ci.TestConfig,
+	runs *grader.Queue,
+	report *ci.Report,
+	reportPath string,
+) error {
+	testConfig.Test.StartTime = time.Now()
+
+	if testConfig.Stress != nil {
+		return h.runStressTest(ctx, testConfig, runs, report, reportPath)
+	}
+
+	runInfo, err := h.runEphemeral(
+		ctx,
+		runs,
+		&testConfig.Solution,
+		testConfig.Input,
+		func(ephemeralToken string) {
+			testConfig.Test.EphemeralToken = ephemeralToken
+		},
+		func() {
+			testConfig.Test.State = ci.StateRunning
+			if err := report.Write(reportPath); err != nil {
+				ctx.Log.Error(
+					"Failed to write the report file",
+					map[string]any{
+						"filename": reportPath,
+						"err":      err,
+					},
+				)
+			}
+		},
+	)
+	if err != nil {
+		return err
+	}
+
 	{
 		finishTime := time.Now()
 		testConfig.Test.FinishTime = &finishTime
@@ -358,11 +598,11 @@ func (h *ciHandler) runTest(
 				"err": err,
 			},
 		)
+		cleanEphemeralRun(ctx, runInfo)
 
 		return err
 	}
 	h.ephemeralRunManager.Commit(runInfo)
-	committed = true
 	ctx.Log.Info(
 		"Finished running ephemeral run",
 		map[string]any{
@@ -373,6 +613,119 @@ func (h *ciHandler) runTest(
 	return nil
 }
 
+// runStressTest runs all the stages of a stress test as ephemeral runs. Only
+// the outcome of the stress test is kept, so the runs are not committed.
+func (h *ciHandler) runStressTest(
+	ctx *grader.Context,
+	testConfig *ci.TestConfig,
+	runs *grader.Queue,
+	report *ci.Report,
+	reportPath string,
+) error {
+	testConfig.Test.State = ci.StateRunning
+	if err := report.Write(reportPath); err != nil {
+		ctx.Log.Error(
+			"Failed to write the report file",
+			map[string]any{
+				"filename": reportPath,
+				"err":      err,
+			},
+		)
+	}
+
+	err := ci.RunStressTest(
+		testConfig,
+		func(
+			solution *ci.SolutionConfig,
+			input *common.LiteralInput,
+		) (*runner.RunResult, map[string]string, error) {
+			runInfo, err := h.runEphemeral(ctx, runs, solution, input, nil, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer cleanEphemeralRun(ctx, runInfo)
+
+			outputs, err := readEphemeralRunOutputs(ctx, runInfo, input)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &runInfo.Result, outputs, nil
+		},
+	)
+
+	{
+		finishTime := time.Now()
+		testConfig.Test.FinishTime = &finishTime
+		duration := base.Duration(testConfig.Test.FinishTime.Sub(testConfig.Test.StartTime))
+		testConfig.Test.Duration = &duration
+	}
+	if err != nil {
+		return err
+	}
+	if err := report.Write(reportPath); err != nil {
+		ctx.Log.Error(
+			"Failed to write the report file",
+			map[string]any{
+				"filename": reportPath,
+				"err":      err,
+			},
+		)
+	}
+	return nil
+}
+
+// readEphemeralRunOutputs returns the outputs of the cases of the run, which
+// are stored in its files.zip artifact. The cases that did not produce an
+// output are omitted.
+func readEphemeralRunOutputs(
+	ctx *grader.Context,
+	runInfo *grader.RunInfo,
+	input *common.LiteralInput,
+) (map[string]string, error) {
+	outputs := make(map[string]string)
+	f, err := runInfo.Artifacts.Get(&ctx.Context, "files.zip")
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The run did not produce any files, which happens when it does
+			// not compile.
+			return outputs, nil
+		}
+		return nil, errors.Wrap(err, "failed to open files.zip")
+	}
+	defer f.Close()
+
+	contents, err := io.ReadAll(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read files.zip")
+	}
+	z, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open files.zip")
+	}
+	for _, zf := range z.File {
+		caseName := strings.TrimSuffix(zf.Name, ".out")
+		if caseName == zf.Name {
+			continue
+		}
+		if _, ok := input.Cases[caseName]; !ok {
+			continue
+		}
+		output, err := (func() ([]byte, error) {
+			r, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(r)
+		})()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", zf.Name)
+		}
+		outputs[caseName] = string(output)
+	}
+	return outputs, nil
+}
+
 func (h *ciHandler) processCIRequest(
 	report *ci.Report,
 	reportPath string,
@@ -477,6 +830,8 @@ func (h *ciHandler) processCIRequest(
 	}
 	report.State = ci.StatePassed
 	report.UpdateState()
+	report.AnalyzeTimeLimits(ciRunConfig)
+	report.AnalyzeTestSuiteStrength()
 
 	{
 		finishTime := time.Now()
@@ -523,6 +878,76 @@ func (h *ciHandler) processCIRequest(
 	)
 }
 
+// serveHistory writes the summaries of the most recent CI runs of the problem:
+// the ones that are waiting or running, and the finished ones that are still
+// in the cache. The number of runs can be limited with the limit query
+// parameter.
+func (h *ciHandler) serveHistory(
+	ctx *grader.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	problem string,
+) {
+	limit := defaultCIHistoryLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	runs := h.lruCache.History(problem, limit)
+	finished := make(map[string]struct{}, len(runs))
+	for _, summary := range runs {
+		finished[summary.CommitHash] = struct{}{}
+	}
+	for _, reportPath := range h.queue.reportPaths(problem) {
+		report, err := ci.ReadReport(reportPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				ctx.Log.Error(
+					"Failed to read the CI report",
+					map[string]any{
+						"path": reportPath,
+						"err":  err,
+					},
+				)
+			}
+			continue
+		}
+		if _, ok := finished[report.CommitHash]; ok {
+			// The run finished while the history was being read.
+			continue
+		}
+		runs = append(runs, report.Summary())
+	}
+	ci.SortReportSummaries(runs)
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(struct {
+		Problem string              `json:"problem"`
+		Runs    []*ci.ReportSummary `json:"runs"`
+	}{
+		Problem: problem,
+		Runs:    runs,
+	}); err != nil {
+		ctx.Log.Error(
+			"Failed to write the CI history",
+			map[string]any{
+				"problem": problem,
+				"err":     err,
+			},
+		)
+	}
+}
+
 func (h *ciHandler) run() {
 	ctx := h.ctx.Wrap(context.TODO())
 	runs, err := ctx.QueueManager.Get(grader.DefaultQueueName)
@@ -547,21 +972,36 @@ func (h *ciHandler) run() {
 		},
 	)
 
-	ctx.Log.Info("CI run manager ready", nil)
-	for {
-		select {
-		case <-h.stopChan:
-			close(h.doneChan)
-			return
-
-		case report := <-h.reportChan:
-			h.processCIRequest(report.report, report.path, runs)
-		}
+	ctx.Log.Info(
+		"CI run manager ready",
+		map[string]any{
+			"workers": ctx.Config.Grader.CI.Workers,
+		},
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < base.Max(1, ctx.Config.Grader.CI.Workers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				item, ok := h.queue.next()
+				if !ok {
+					return
+				}
+				h.processCIRequest(item.report, item.path, runs)
+				h.queue.done(item)
+				// The webhooks are sent in the background so that slow
+				// endpoints don't hold up the queue.
+				go sendCIWebhooks(ctx, h.webhookClient, item.report.Summary())
+			}
+		}()
 	}
+	wg.Wait()
+	close(h.doneChan)
 }
 
 func (h *ciHandler) Shutdown(ctx context.Context) error {
-	close(h.stopChan)
+	h.queue.stop()
 
 	select {
 	case <-ctx.Done():
@@ -580,8 +1020,8 @@ func registerCIHandlers(
 		ephemeralRunManager: ephemeralRunManager,
 		ctx:                 ctx,
 		lruCache:            ci.NewLRUCache(ctx.Config.Grader.CI.CISizeLimit, ctx.Log),
-		stopChan:            make(chan struct{}),
-		reportChan:          make(chan *reportWithPath, 128),
+		queue:               newCIQueue(ctx, ctx.Config.Grader.CI.QueueSize),
+		webhookClient:       &http.Client{},
 		doneChan:            make(chan struct{}),
 	}
 	mux.Handle(ctx.Tracing.WrapHandle("/ci/", ciHandler))
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/omegaup/quark/grader"
+
+	"github.com/pkg/errors"
+)
+
+var errCIQueueFull = errors.New("the CI queue is full")
+
+// ciQueue holds the CI requests that are waiting to be processed. Requests are
+// processed in order by a pool of workers, except that only one request of
+// each problem is processed at a time, so that two commits of the same problem
+// don't race with each other. The requests of other problems can overtake the
+// ones that are blocked behind a request of the same problem.
+type ciQueue struct {
+	sync.Mutex
+	ctx      *grader.Context
+	cond     *sync.Cond
+	capacity int
+
+	pending []*reportWithPath
+	// reserved is the number of requests that have a spot in the queue but
+	// have not been pushed yet.
+	reserved int
+	// active are the requests being processed, indexed by problem.
+	active  map[string]*reportWithPath
+	stopped bool
+}
+
+func newCIQueue(ctx *grader.Context, capacity int) *ciQueue {
+	q := &ciQueue{
+		ctx:      ctx,
+		capacity: capacity,
+		active:   make(map[string]*reportWithPath),
+	}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+// reserve makes room for one more request in the queue, and returns its
+// position. It returns errCIQueueFull if the queue is already at capacity.
+func (q *ciQueue) reserve() (int, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.pending)+q.reserved >= q.capacity {
+		return 0, errCIQueueFull
+	}
+	q.reserved++
+	return len(q.pending) + q.reserved, nil
+}
+
+// release gives back a spot that was reserved for a request that will not be
+// pushed.
+func (q *ciQueue) release() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.reserved--
+}
+
+// push adds a request for which reserve was previously called to the queue.
+func (q *ciQueue) push(item *reportWithPath) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.reserved--
+	q.pending = append(q.pending, item)
+	q.ctx.Metrics.GaugeAdd("grader_ci_jobs_waiting", 1)
+	q.cond.Broadcast()
+}
+
+// next blocks until there is a request whose problem is not being processed,
+// and removes it from the queue. It returns false once the queue is stopped.
+func (q *ciQueue) next() (*reportWithPath, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for {
+		if q.stopped {
+			return nil, false
+		}
+		for idx, item := range q.pending {
+			if _, ok := q.active[item.report.Problem]; ok {
+				continue
+			}
+			q.active[item.report.Problem] = item
+			q.pending = append(q.pending[:idx], q.pending[idx+1:]...)
+			item.report.QueuePosition = nil
+			q.ctx.Metrics.GaugeAdd("grader_ci_jobs_waiting", -1)
+			return item, true
+		}
+		q.cond.Wait()
+	}
+}
+
+// done marks the request as processed, so that the next request of the same
+// problem can be processed.
+func (q *ciQueue) done(item *reportWithPath) {
+	q.Lock()
+	defer q.Unlock()
+
+	delete(q.active, item.report.Problem)
+	q.cond.Broadcast()
+}
+
+// reportPaths returns the paths of the reports of the requests of the problem
+// that are waiting or being processed.
+func (q *ciQueue) reportPaths(problem string) []string {
+	q.Lock()
+	defer q.Unlock()
+
+	var paths []string
+	if item, ok := q.active[problem]; ok {
+		paths = append(paths, item.path)
+	}
+	for _, item := range q.pending {
+		if item.report.Problem == problem {
+			paths = append(paths, item.path)
+		}
+	}
+	return paths
+}
+
+// position returns the 1-based position in the queue of the waiting request
+// whose report is at reportPath, or nil if it is not waiting. Positions are
+// only kept in memory, since they change every time a request is pushed or
+// processed.
+func (q *ciQueue) position(reportPath string) *int {
+	q.Lock()
+	defer q.Unlock()
+
+	for idx, item := range q.pending {
+		if item.path == reportPath {
+			position := idx + 1
+			return &position
+		}
+	}
+	return nil
+}
+
+// stop makes all the workers return once they finish the request that they are
+// processing.
+func (q *ciQueue) stop() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.stopped = true
+	q.cond.Broadcast()
+}
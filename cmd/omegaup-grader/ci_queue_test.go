@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omegaup/quark/runner/ci"
+)
+
+func TestCIQueue(t *testing.T) {
+	ctx := newGraderContext(t)
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(path.Dir(ctx.Config.Grader.RuntimePath))
+	}
+
+	queue := newCIQueue(ctx, 3)
+	newItem := func(problem string, commit string) *reportWithPath {
+		return &reportWithPath{
+			report: &ci.Report{
+				Problem:    problem,
+				CommitHash: commit,
+				State:      ci.StateWaiting,
+			},
+			path: path.Join(ctx.Config.Grader.RuntimePath, "ci", problem, commit, "report.json.gz"),
+		}
+	}
+	items := []*reportWithPath{
+		newItem("a", "1"),
+		newItem("a", "2"),
+		newItem("b", "1"),
+	}
+	for i, item := range items {
+		position, err := queue.reserve()
+		if err != nil {
+			t.Fatalf("reserve() failed: %v", err)
+		}
+		if position != i+1 {
+			t.Errorf("reserve() = %d, want %d", position, i+1)
+		}
+		queue.push(item)
+	}
+	if _, err := queue.reserve(); err != errCIQueueFull {
+		t.Errorf("reserve() = %v, want %v", err, errCIQueueFull)
+	}
+
+	// The second request of problem a has to wait for the first one, but the
+	// request of problem b does not.
+	for _, want := range []*reportWithPath{items[0], items[2]} {
+		item, ok := queue.next()
+		if !ok || item != want {
+			t.Fatalf("next() = %v, want %v", item, want)
+		}
+		if item.report.QueuePosition != nil {
+			t.Errorf("%v: QueuePosition = %d, want nil", item, *item.report.QueuePosition)
+		}
+	}
+	if position := queue.position(items[1].path); position == nil || *position != 1 {
+		t.Errorf("position() = %v, want 1", position)
+	}
+	if position := queue.position(items[0].path); position != nil {
+		t.Errorf("position() = %d for a running request, want nil", *position)
+	}
+	if paths := queue.reportPaths("a"); !reflect.DeepEqual(paths, []string{items[0].path, items[1].path}) {
+		t.Errorf("reportPaths(\"a\") = %v, want the running and the waiting reports", paths)
+	}
+
+	next := make(chan *reportWithPath, 1)
+	go func() {
+		item, _ := queue.next()
+		next <- item
+	}()
+	select {
+	case item := <-next:
+		t.Fatalf("next() = %v while the problem was being processed", item)
+	case <-time.After(50 * time.Millisecond):
+	}
+	queue.done(items[0])
+	select {
+	case item := <-next:
+		if item != items[1] {
+			t.Errorf("next() = %v, want %v", item, items[1])
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("next() did not return after the problem was done")
+	}
+
+	queue.stop()
+	if item, ok := queue.next(); ok {
+		t.Errorf("next() = %v after stopping the queue", item)
+	}
+}
@@ -84,7 +84,7 @@ func TestCI(t *testing.T) {
 	mux := http.NewServeMux()
 	shutdowner := registerCIHandlers(ctx, mux, ephemeralRunManager)
 	defer shutdowner.Shutdown(context.Background())
-	registerRunnerHandlers(ctx, mux, nil, true)
+	registerRunnerHandlers(ctx, mux, nil, newRunnerConnectionRegistry(), true)
 	ts := httptest.NewServer(mux)
 	defer ts.Close()
 
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/omegaup/quark/grader"
+	"github.com/omegaup/quark/runner/ci"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ciWebhookSignatureHeader is the header that contains the HMAC-SHA256
+	// signature of the webhook request body, in the form sha256=<hex>.
+	ciWebhookSignatureHeader = "X-Omegaup-Signature"
+
+	// ciWebhookAttempts is the number of times that a webhook is attempted
+	// before giving up.
+	ciWebhookAttempts = 3
+)
+
+// ciWebhookRetryDelay is the time to wait before retrying a failed webhook,
+// which doubles after every attempt.
+var ciWebhookRetryDelay = time.Duration(5) * time.Second
+
+// signCIWebhookPayload returns the signature of the payload with the secret.
+func signCIWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// sendCIWebhooks sends the summary of a finished CI run to all the configured
+// webhooks, retrying each of them up to ciWebhookAttempts times. It returns
+// once all of them have been sent or have given up.
+func sendCIWebhooks(ctx *grader.Context, client *http.Client, summary *ci.ReportSummary) {
+	if len(ctx.Config.Grader.CI.WebhookURLs) == 0 {
+		return
+	}
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		ctx.Log.Error(
+			"Failed to serialize the CI webhook payload",
+			map[string]any{
+				"err": err,
+			},
+		)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, url := range ctx.Config.Grader.CI.WebhookURLs {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			retryDelay := ciWebhookRetryDelay
+			for attempt := 1; ; attempt++ {
+				ctx.Metrics.CounterAdd("grader_ci_webhooks_total", 1)
+				err := sendCIWebhook(ctx, client, url, payload)
+				if err == nil {
+					return
+				}
+				ctx.Metrics.CounterAdd("grader_ci_webhook_errors_total", 1)
+				ctx.Log.Error(
+					"Failed to send CI webhook",
+					map[string]any{
+						"url":     url,
+						"problem": summary.Problem,
+						"commit":  summary.CommitHash,
+						"attempt": attempt,
+						"err":     err,
+					},
+				)
+				if attempt == ciWebhookAttempts {
+					return
+				}
+				time.Sleep(retryDelay)
+				retryDelay *= 2
+			}
+		}(url)
+	}
+	wg.Wait()
+}
+
+func sendCIWebhook(ctx *grader.Context, client *http.Client, url string, payload []byte) error {
+	reqCtx, cancel := context.WithTimeout(
+		ctx.Context.Context,
+		time.Duration(ctx.Config.Grader.CI.WebhookTimeout),
+	)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ctx.Config.Grader.CI.WebhookSecret != "" {
+		req.Header.Set(
+			ciWebhookSignatureHeader,
+			signCIWebhookPayload(ctx.Config.Grader.CI.WebhookSecret, payload),
+		)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send request")
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
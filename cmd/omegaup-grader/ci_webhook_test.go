@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/omegaup/quark/runner/ci"
+)
+
+func TestSendCIWebhooks(t *testing.T) {
+	ctx := newGraderContext(t)
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(path.Dir(ctx.Config.Grader.RuntimePath))
+	}
+
+	type webhookRequest struct {
+		signature string
+		body      []byte
+	}
+	requests := make(chan webhookRequest, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Failed to read the request body: %v", err)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", r.Header.Get("Content-Type"))
+		}
+		requests <- webhookRequest{
+			signature: r.Header.Get(ciWebhookSignatureHeader),
+			body:      body,
+		}
+	}))
+	defer ts.Close()
+	var failedRequests int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failedRequests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	originalRetryDelay := ciWebhookRetryDelay
+	ciWebhookRetryDelay = time.Millisecond
+	defer func() {
+		ciWebhookRetryDelay = originalRetryDelay
+	}()
+
+	ctx.Config.Grader.CI.WebhookURLs = []string{failing.URL, ts.URL}
+	ctx.Config.Grader.CI.WebhookSecret = "secret"
+
+	report := &ci.Report{
+		Problem:    "sumas",
+		CommitHash: "0123456789abcdef0123456789abcdef01234567",
+		StartTime:  time.Unix(0, 0).UTC(),
+		State:      ci.StatePassed,
+		Tests: []*ci.ReportTest{
+			{Type: "solutions", Filename: "solutions/ac.py", State: ci.StatePassed},
+			{Type: "solutions", Filename: "solutions/wa.py", State: ci.StatePassed},
+		},
+	}
+	sendCIWebhooks(ctx, ts.Client(), report.Summary())
+
+	if n := atomic.LoadInt32(&failedRequests); n != ciWebhookAttempts {
+		t.Errorf("failing webhook attempted %d times, want %d", n, ciWebhookAttempts)
+	}
+
+	select {
+	case request := <-requests:
+		if expected := signCIWebhookPayload("secret", request.body); request.signature != expected {
+			t.Errorf("signature = %q, want %q", request.signature, expected)
+		}
+		var summary ci.ReportSummary
+		if err := json.Unmarshal(request.body, &summary); err != nil {
+			t.Fatalf("Failed to deserialize the summary: %v", err)
+		}
+		if summary.Problem != report.Problem || summary.CommitHash != report.CommitHash {
+			t.Errorf("summary = %v, want problem %q and commit %q", summary, report.Problem, report.CommitHash)
+		}
+		if summary.State != ci.StatePassed {
+			t.Errorf("State = %v, want %v", summary.State, ci.StatePassed)
+		}
+		if summary.Tests["passed"] != 2 {
+			t.Errorf("Tests = %v, want 2 passed", summary.Tests)
+		}
+	default:
+		t.Fatalf("The webhook was not sent")
+	}
+	if len(requests) != 0 {
+		t.Errorf("%d unexpected webhook requests", len(requests))
+	}
+
+	if signature := signCIWebhookPayload("other secret", []byte("{}")); signature == signCIWebhookPayload("secret", []byte("{}")) {
+		t.Errorf("signatures with different secrets match: %q", signature)
+	}
+}
@@ -160,7 +160,7 @@ func TestEphemeralGrader(t *testing.T) {
 	}
 	mux := http.NewServeMux()
 	registerEphemeralHandlers(ctx, mux, ephemeralRunManager)
-	registerRunnerHandlers(ctx, mux, nil, true)
+	registerRunnerHandlers(ctx, mux, nil, newRunnerConnectionRegistry(), true)
 	ts := httptest.NewServer(mux)
 	defer ts.Close()
 
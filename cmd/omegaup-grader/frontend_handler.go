@@ -40,8 +40,9 @@ var (
 )
 
 type graderRunningStatus struct {
-	RunnerName string `json:"name"`
-	ID         int64  `json:"id"`
+	RunnerName string              `json:"name"`
+	ID         int64               `json:"id"`
+	Progress   *runner.RunProgress `json:"progress,omitempty"`
 }
 
 type graderStatusQueue struct {
@@ -49,6 +50,7 @@ type graderStatusQueue struct {
 	RunQueueLength    int                   `json:"run_queue_length"`
 	RunnerQueueLength int                   `json:"runner_queue_length"`
 	Runners           []string              `json:"runners"`
+	Draining          []string              `json:"draining"`
 }
 
 type graderStatusResponse struct {
@@ -417,18 +419,40 @@ func runQueueLoop(
 	newRuns <-chan struct{},
 	db *sql.DB,
 	artifacts *grader.ArtifactManager,
+	restoredRuns []*grader.RunInfo,
 ) {
 	ctx.Log.Info("Starting run queue loop", nil)
+	// Runs that were restored from the queue journal are still queued (or
+	// being graded), so they should not be picked up again.
+	restoredFilter := ""
+	var restoredRunIDs []any
+	for _, runInfo := range restoredRuns {
+		if runInfo.ID == 0 {
+			continue
+		}
+		restoredRunIDs = append(restoredRunIDs, runInfo.ID)
+	}
+	if len(restoredRunIDs) > 0 {
+		restoredFilter = fmt.Sprintf(
+			"AND run_id NOT IN (%s)",
+			strings.TrimSuffix(strings.Repeat("?, ", len(restoredRunIDs)), ", "),
+		)
+	}
 	_, err := execWithRetry(
 		db,
-		`
-		UPDATE
-			Runs
-		SET
-			status = 'new'
-		WHERE
-			status != 'ready';
-		`,
+		fmt.Sprintf(
+			`
+			UPDATE
+				Runs
+			SET
+				status = 'new'
+			WHERE
+				status != 'ready'
+				%s;
+			`,
+			restoredFilter,
+		),
+		restoredRunIDs...,
 	)
 	if err != nil {
 		ctx.Log.Error(
@@ -670,12 +694,15 @@ func newRunInfoFromID(
 	err := queryRowWithRetry(
 		db,
 		`SELECT
-			s.guid, c.alias, s.problemset_id, c.penalty_type, c.score_mode,
-			s.language, p.alias, pp.points, r.version, r.submission_id
+			s.guid, i.username, c.alias, s.problemset_id, c.penalty_type,
+			c.score_mode, s.language, p.alias, pp.points, r.version,
+			r.submission_id
 		FROM
 			Runs r
 		INNER JOIN
 			Submissions s ON s.submission_id = r.submission_id
+		INNER JOIN
+			Identities i ON i.identity_id = s.identity_id
 		INNER JOIN
 			Problems p ON p.problem_id = s.problem_id
 		LEFT JOIN
@@ -686,6 +713,7 @@ func newRunInfoFromID(
 		WHERE
 			r.run_id = ?;`, runInfo.ID).Scan(
 		&runInfo.GUID,
+		&runInfo.Username,
 		&contestName,
 		&problemset,
 		&penaltyType,
@@ -842,12 +870,17 @@ func registerFrontendHandlers(
 	newRuns chan struct{},
 	db *sql.DB,
 	artifacts *grader.ArtifactManager,
+	restoredRuns []*grader.RunInfo,
+	runnerConnections *runnerConnectionRegistry,
 ) {
 	runs, err := ctx.QueueManager.Get(grader.DefaultQueueName)
 	if err != nil {
 		panic(err)
 	}
-	go runQueueLoop(ctx, runs, newRuns, db, artifacts)
+	go runQueueLoop(ctx, runs, newRuns, db, artifacts, restoredRuns)
+	ctx.RunnerHealth.SetQuarantineHandler(func(quarantine *grader.RunnerQuarantine) {
+		handleRunnerQuarantine(ctx, db, artifacts, runs, quarantine)
+	})
 
 	transport := &http.Transport{
 		Dial: (&net.Dialer{
@@ -896,14 +929,16 @@ func registerFrontendHandlers(
 		status := graderStatusResponse{
 			Status: "ok",
 			RunningQueue: graderStatusQueue{
-				Runners: []string{},
-				Running: make([]graderRunningStatus, len(runData)),
+				Runners:  runnerConnections.names(),
+				Draining: runnerConnections.drainingNames(),
+				Running:  make([]graderRunningStatus, len(runData)),
 			},
 		}
 
 		for i, data := range runData {
 			status.RunningQueue.Running[i].RunnerName = data.Runner
 			status.RunningQueue.Running[i].ID = data.ID
+			status.RunningQueue.Running[i].Progress = data.Progress
 		}
 		for _, queueInfo := range ctx.QueueManager.GetQueueInfo() {
 			for _, l := range queueInfo.Lengths {
@@ -1259,6 +1294,9 @@ func registerFrontendHandlers(
 	mux.Handle(ctx.Tracing.WrapHandle("/reload-config/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx = ctx.Wrap(r.Context())
 		ctx.Log.Info("/reload-config/", nil)
+		runnerConnections.broadcast(ctx, &runner.ConnectionMessage{
+			Type: runner.ConnectionMessageTypeReloadConfig,
+		})
 		w.Header().Set("Content-Type", "text/json; charset=utf-8")
 		fmt.Fprintf(w, "{\"status\":\"ok\"}")
 	})))
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/base64"
 	"expvar"
@@ -86,7 +87,13 @@ func graderContext() *grader.Context {
 	return globalContext.Load().(*grader.Context)
 }
 
-func peerName(r *http.Request, insecure bool) string {
+// runnerHostName returns the name of the runner process that sent the
+// request.
+func runnerHostName(r *http.Request, insecure bool) string {
+	if name, ok := r.Context().Value(runnerNameKey{}).(string); ok {
+		// The runner was already authenticated.
+		return name
+	}
 	peerName := r.Header.Get("OmegaUp-Runner-Name")
 	if peerName != "" {
 		return peerName
@@ -97,6 +104,17 @@ func peerName(r *http.Request, insecure bool) string {
 	return r.TLS.PeerCertificates[0].Subject.CommonName
 }
 
+// peerName returns the name of the runner that sent the request. Runner
+// processes that grade several runs concurrently report each one of their
+// slots as a separate runner.
+func peerName(r *http.Request, insecure bool) string {
+	name := runnerHostName(r, insecure)
+	if slot := r.Header.Get("OmegaUp-Runner-Slot"); runnerSlotRe.MatchString(slot) {
+		return fmt.Sprintf("%s:%s", name, slot)
+	}
+	return name
+}
+
 func readGzippedFile(filename string) (string, error) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -167,6 +185,21 @@ func queueEventsProcessor(events <-chan *grader.QueueEvent) {
 				ctx.Metrics.GaugeAdd("grader_runs_retry", 1)
 			case grader.QueueEventTypeAbandoned:
 				ctx.Metrics.GaugeAdd("grader_runs_abandoned", 1)
+			case grader.QueueEventTypeInputCacheHit:
+				ctx.Metrics.CounterAdd("grader_dispatch_input_cache_hits", 1)
+				ctx.Metrics.SummaryObserve("grader_dispatch_input_cache_hit_ratio", 1)
+			case grader.QueueEventTypeInputCacheMiss:
+				ctx.Metrics.CounterAdd("grader_dispatch_input_cache_misses", 1)
+				ctx.Metrics.SummaryObserve("grader_dispatch_input_cache_hit_ratio", 0)
+			case grader.QueueEventTypePromoted:
+				ctx.Metrics.CounterAdd("grader_queue_promotions_total", 1)
+				ctx.Log.Debug(
+					"Run promoted due to aging",
+					map[string]any{
+						"priority": event.Priority,
+						"wait":     event.Delta,
+					},
+				)
 			}
 		}
 	}
@@ -288,6 +321,26 @@ func main() {
 	}()
 
 	setupMetrics(ctx)
+
+	queueEventsChan := make(chan *grader.QueueEvent, 1)
+	graderContext().QueueManager.AddEventListener(queueEventsChan)
+	go queueEventsProcessor(queueEventsChan)
+	queueStatusEventsChan := make(chan *grader.QueueEvent, queueEventSubscriberBuffer)
+	graderContext().QueueManager.AddEventListener(queueStatusEventsChan)
+	queueEvents := newQueueEventBroadcaster(queueStatusEventsChan)
+
+	// Restore the runs that were queued or in-flight before the last shutdown.
+	// This needs to happen before any run is added or the runners can connect.
+	restoredRuns, err := grader.RestoreQueues(ctx, artifacts)
+	if err != nil {
+		ctx.Log.Error(
+			"Failed to restore the queues",
+			map[string]any{
+				"err": err,
+			},
+		)
+	}
+
 	var shutdowners []shutdowner
 	var wg sync.WaitGroup
 	{
@@ -308,14 +361,23 @@ func main() {
 			),
 		)
 	}
+	runnerConnections := newRunnerConnectionRegistry()
 	{
 		mux := http.NewServeMux()
-		registerRunnerHandlers(ctx, mux, db, *insecure)
+		registerRunnerHandlers(ctx, mux, db, runnerConnections, *insecure)
+		registerRunnerConnectionHandlers(ctx, mux, runnerConnections, *insecure)
+		clientAuth := tls.RequireAndVerifyClientCert
+		if ctx.Config.Grader.Runners.TokenAuthentication {
+			registerRunnerRegistrationHandlers(ctx, mux)
+			// Runners that use credentials don't have a client certificate.
+			clientAuth = tls.VerifyClientCertIfGiven
+		}
 		shutdowners = append(
 			shutdowners,
-			common.RunServer(
+			common.RunServerWithClientAuth(
 				&ctx.Config.TLS,
-				mux,
+				clientAuth,
+				authenticateRunners(ctx, mux, *insecure),
 				&wg,
 				fmt.Sprintf(":%d", ctx.Config.Grader.Port),
 				*insecure,
@@ -323,10 +385,6 @@ func main() {
 		)
 	}
 
-	queueEventsChan := make(chan *grader.QueueEvent, 1)
-	graderContext().QueueManager.AddEventListener(queueEventsChan)
-	go queueEventsProcessor(queueEventsChan)
-
 	// A channel that signals that there are pending runs.
 	newRuns := make(chan struct{}, 1)
 	// Seed the channel with one token so that the queue loop can start injecting
@@ -334,7 +392,11 @@ func main() {
 	newRuns <- struct{}{}
 	{
 		mux := http.DefaultServeMux
-		registerFrontendHandlers(graderContext(), mux, newRuns, db, artifacts)
+		registerFrontendHandlers(graderContext(), mux, newRuns, db, artifacts, restoredRuns, runnerConnections)
+		registerQueueStatusHandlers(graderContext(), mux, queueEvents)
+		registerRunnerAdminHandlers(graderContext(), mux, runnerConnections)
+		registerRunnerRegistryHandlers(graderContext(), mux, runnerConnections)
+		registerRunnerHealthHandlers(graderContext(), mux)
 		shutdowners = append(
 			shutdowners,
 			common.RunServer(
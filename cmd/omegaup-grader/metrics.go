@@ -90,6 +90,18 @@ var (
 			Help:      "The length of the high-priority queue",
 			Name:      "queue_high_length",
 		}),
+		"grader_runners_quarantined": prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "The number of runners that are quarantined",
+			Name:      "runners_quarantined",
+		}),
+		"grader_ci_jobs_waiting": prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "The number of CI jobs waiting to be processed",
+			Name:      "ci_jobs_waiting",
+		}),
 	}
 
 	gaugeVecs = map[string]*prometheus.GaugeVec{
@@ -117,6 +129,24 @@ var (
 			Help:      "Number of CI jobs",
 			Name:      "ci_jobs_total",
 		}),
+		"grader_ci_jobs_rejected_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "Number of CI jobs rejected because the queue was full",
+			Name:      "ci_jobs_rejected_total",
+		}),
+		"grader_ci_webhooks_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "Number of CI webhook requests",
+			Name:      "ci_webhooks_total",
+		}),
+		"grader_ci_webhook_errors_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "Number of CI webhook requests that failed",
+			Name:      "ci_webhook_errors_total",
+		}),
 		"grader_runs_total": prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: "quark",
 			Subsystem: "grader",
@@ -141,6 +171,30 @@ var (
 			Help:      "Number of runs that were JE",
 			Name:      "runs_je",
 		}),
+		"grader_dispatch_input_cache_hits": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "Number of runs dispatched to a runner that had the input cached",
+			Name:      "dispatch_input_cache_hits",
+		}),
+		"grader_dispatch_input_cache_misses": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "Number of runs dispatched to a runner that did not have the input cached",
+			Name:      "dispatch_input_cache_misses",
+		}),
+		"grader_queue_promotions_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "Number of runs that were promoted to a higher priority due to aging",
+			Name:      "queue_promotions_total",
+		}),
+		"grader_runner_quarantines_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "Number of times a runner was quarantined",
+			Name:      "runner_quarantines_total",
+		}),
 	}
 
 	summaries = map[string]prometheus.Summary{
@@ -179,6 +233,12 @@ var (
 			Name:       "queue_high_delay_seconds",
 			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
 		}),
+		"grader_dispatch_input_cache_hit_ratio": prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace: "quark",
+			Subsystem: "grader",
+			Help:      "The ratio of runs dispatched to a runner that had the input cached",
+			Name:      "dispatch_input_cache_hit_ratio",
+		}),
 	}
 )
 
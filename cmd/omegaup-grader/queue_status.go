@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/omegaup/quark/grader"
+)
+
+const (
+	// queueEventSubscriberBuffer is the number of events that can be pending
+	// to be sent to a single event stream client before events start being
+	// dropped for that client.
+	queueEventSubscriberBuffer = 128
+
+	// queueEventKeepaliveInterval is how often a comment is sent to idle event
+	// stream clients so that proxies do not close the connection.
+	queueEventKeepaliveInterval = time.Duration(15) * time.Second
+)
+
+type queuedRunStatus struct {
+	ID                int64   `json:"id"`
+	GUID              string  `json:"guid"`
+	Position          int     `json:"position"`
+	Priority          string  `json:"priority"`
+	Problem           string  `json:"problem"`
+	Language          string  `json:"language"`
+	AttemptsLeft      int     `json:"attempts_left"`
+	Age               float64 `json:"age"`
+	ETA               float64 `json:"eta"`
+	EstimatedDuration float64 `json:"estimated_duration"`
+}
+
+type queueStatusResponse struct {
+	Name    string             `json:"name"`
+	Runners int                `json:"runners"`
+	Runs    []*queuedRunStatus `json:"runs"`
+}
+
+type queueEventMessage struct {
+	Type     string  `json:"type"`
+	Priority string  `json:"priority"`
+	RunID    int64   `json:"run_id,omitempty"`
+	Delta    float64 `json:"delta"`
+}
+
+// queueEventBroadcaster fans out the QueueManager events to any number of
+// event stream clients. Slow clients miss events instead of blocking the
+// QueueManager.
+type queueEventBroadcaster struct {
+	sync.Mutex
+	subscribers map[chan *grader.QueueEvent]struct{}
+	closed      bool
+}
+
+func newQueueEventBroadcaster(events <-chan *grader.QueueEvent) *queueEventBroadcaster {
+	b := &queueEventBroadcaster{
+		subscribers: make(map[chan *grader.QueueEvent]struct{}),
+	}
+	go b.run(events)
+	return b
+}
+
+func (b *queueEventBroadcaster) run(events <-chan *grader.QueueEvent) {
+	for event := range events {
+		b.Lock()
+		for subscriber := range b.subscribers {
+			select {
+			case subscriber <- event:
+			default:
+			}
+		}
+		b.Unlock()
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.closed = true
+	for subscriber := range b.subscribers {
+		close(subscriber)
+		delete(b.subscribers, subscriber)
+	}
+}
+
+// subscribe returns a channel where all future events will be sent. It
+// returns false if the QueueManager is already closed.
+func (b *queueEventBroadcaster) subscribe() (chan *grader.QueueEvent, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return nil, false
+	}
+	subscriber := make(chan *grader.QueueEvent, queueEventSubscriberBuffer)
+	b.subscribers[subscriber] = struct{}{}
+	return subscriber, true
+}
+
+func (b *queueEventBroadcaster) unsubscribe(subscriber chan *grader.QueueEvent) {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := b.subscribers[subscriber]; ok {
+		close(subscriber)
+		delete(b.subscribers, subscriber)
+	}
+}
+
+func newQueueStatusResponse(status *grader.QueueStatus) *queueStatusResponse {
+	response := &queueStatusResponse{
+		Name:    status.Name,
+		Runners: status.Runners,
+		Runs:    make([]*queuedRunStatus, len(status.Runs)),
+	}
+	for i, run := range status.Runs {
+		response.Runs[i] = &queuedRunStatus{
+			ID:                run.ID,
+			GUID:              run.GUID,
+			Position:          run.Position,
+			Priority:          run.Priority.String(),
+			Problem:           run.Problem,
+			Language:          run.Language,
+			AttemptsLeft:      run.AttemptsLeft,
+			Age:               run.Age.Seconds(),
+			ETA:               run.ETA.Seconds(),
+			EstimatedDuration: run.EstimatedDuration.Seconds(),
+		}
+	}
+	return response
+}
+
+func registerQueueStatusHandlers(
+	ctx *grader.Context,
+	mux *http.ServeMux,
+	broadcaster *queueEventBroadcaster,
+) {
+	mux.Handle(ctx.Tracing.WrapHandle("/grader/queue/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = ctx.Wrap(r.Context())
+		queueName := r.URL.Query().Get("queue")
+		response := make(map[string]*queueStatusResponse)
+		for name, status := range ctx.QueueManager.GetQueueStatus(ctx.InflightMonitor) {
+			if queueName != "" && name != queueName {
+				continue
+			}
+			response[name] = newQueueStatusResponse(status)
+		}
+		if queueName != "" && len(response) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			ctx.Log.Error(
+				"Error writing /grader/queue/ response",
+				map[string]any{
+					"err": err,
+				},
+			)
+		}
+	})))
+
+	// The event stream is not traced, since the connection is long-lived.
+	mux.HandleFunc("/grader/queue/events/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := ctx.Wrap(r.Context())
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			ctx.Log.Error("Streaming is not supported", nil)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		events, ok := broadcaster.subscribe()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer broadcaster.unsubscribe(events)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepalive := time.NewTicker(queueEventKeepaliveInterval)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(&queueEventMessage{
+					Type:     event.Type.String(),
+					Priority: event.Priority.String(),
+					RunID:    event.RunID,
+					Delta:    event.Delta.Seconds(),
+				})
+				if err != nil {
+					ctx.Log.Error(
+						"Failed to marshal queue event",
+						map[string]any{
+							"err": err,
+						},
+					)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
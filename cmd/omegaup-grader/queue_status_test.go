@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/omegaup/quark/grader"
+)
+
+func TestQueueEventBroadcaster(t *testing.T) {
+	events := make(chan *grader.QueueEvent)
+	b := newQueueEventBroadcaster(events)
+
+	fast, ok := b.subscribe()
+	if !ok {
+		t.Fatalf("subscribe() failed")
+	}
+	slow, ok := b.subscribe()
+	if !ok {
+		t.Fatalf("subscribe() failed")
+	}
+
+	// A slow subscriber misses events instead of blocking everyone else.
+	for i := 0; i < 2*queueEventSubscriberBuffer; i++ {
+		events <- &grader.QueueEvent{RunID: int64(i)}
+		select {
+		case event := <-fast:
+			if event.RunID != int64(i) {
+				t.Fatalf("event.RunID == %d, want %d", event.RunID, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+	if len(slow) != queueEventSubscriberBuffer {
+		t.Errorf("len(slow) == %d, want %d", len(slow), queueEventSubscriberBuffer)
+	}
+	b.unsubscribe(slow)
+
+	close(events)
+	if _, ok := <-fast; ok {
+		t.Errorf("subscriber not closed after the events channel was closed")
+	}
+	if _, ok := b.subscribe(); ok {
+		t.Errorf("subscribe() succeeded after the events channel was closed")
+	}
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/quark/grader"
+	"github.com/omegaup/quark/runner"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// maxRunnerMessageSize is the maximum size of the messages sent by the runners
+// over the persistent connection, other than files.zip.
+const maxRunnerMessageSize = int64(16 * base.Mebibyte)
+
+var runnerUpgrader = websocket.Upgrader{
+	Subprotocols: []string{runner.ConnectionSubprotocol},
+}
+
+// runnerConnection is a persistent connection with a runner. The grader
+// pushes runs and commands over it, and the runner pushes heartbeats and
+// results.
+type runnerConnection struct {
+	ctx  *grader.Context
+	name string
+	conn *websocket.Conn
+
+	writeLock sync.Mutex
+	// closed is closed once the connection is no longer being read from. It is
+	// also used as the close notifier while waiting for runs, since a closed
+	// channel is always ready to be received from.
+	closed chan bool
+
+	attemptsLock sync.Mutex
+	// attempts are the in-flight attempts that were assigned to the runner
+	// through this connection.
+	attempts    map[uint64]struct{}
+	dispatching bool
+
+	// draining is closed once the runner reports that it is draining, so that
+	// no more runs are dispatched to it.
+	draining     chan bool
+	drainingOnce sync.Once
+}
+
+func newRunnerConnection(
+	ctx *grader.Context,
+	name string,
+	conn *websocket.Conn,
+) *runnerConnection {
+	return &runnerConnection{
+		ctx:      ctx,
+		name:     name,
+		conn:     conn,
+		closed:   make(chan bool),
+		attempts: make(map[uint64]struct{}),
+		draining: make(chan bool),
+	}
+}
+
+// send writes a message to the runner.
+func (c *runnerConnection) send(message *runner.ConnectionMessage) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(runner.ConnectionPingPeriod))
+	return c.conn.WriteJSON(message)
+}
+
+// close makes the read loop finish, which closes the connection.
+func (c *runnerConnection) close() {
+	c.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+		time.Now().Add(runner.ConnectionPingPeriod),
+	)
+	c.conn.Close()
+}
+
+func (c *runnerConnection) extendReadDeadline() error {
+	return c.conn.SetReadDeadline(time.Now().Add(2 * runner.ConnectionPingPeriod))
+}
+
+// serve processes all the messages sent by the runner until the connection is
+// closed.
+func (c *runnerConnection) serve(runs *grader.Queue) {
+	defer c.conn.Close()
+	defer close(c.closed)
+
+	c.conn.SetReadLimit(maxRunnerMessageSize)
+	c.extendReadDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		return c.extendReadDeadline()
+	})
+	go c.pingLoop()
+
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.ctx.Log.Error(
+					"Runner connection closed",
+					map[string]any{
+						"runner": c.name,
+						"err":    err,
+					},
+				)
+			}
+			return
+		}
+		c.extendReadDeadline()
+		if messageType != websocket.TextMessage {
+			c.ctx.Log.Error(
+				"Unexpected binary message from runner",
+				map[string]any{
+					"runner": c.name,
+				},
+			)
+			return
+		}
+		var message runner.ConnectionMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			c.ctx.Log.Error(
+				"Invalid message from runner",
+				map[string]any{
+					"runner": c.name,
+					"err":    err,
+				},
+			)
+			return
+		}
+
+		switch message.Type {
+		case runner.ConnectionMessageTypeReady:
+			hashes := make(map[string]struct{})
+			for _, hash := range message.InputHashes {
+				if inputHashRe.MatchString(hash) {
+					hashes[hash] = struct{}{}
+				}
+			}
+			c.attemptsLock.Lock()
+			if c.dispatching {
+				c.attemptsLock.Unlock()
+				continue
+			}
+			c.dispatching = true
+			c.attemptsLock.Unlock()
+			go c.dispatch(runs, hashes, message.Reserve)
+		case runner.ConnectionMessageTypeHeartbeat:
+			if !c.ctx.InflightMonitor.Heartbeat(message.AttemptID, c.name, message.Progress) {
+				c.cancel(message.AttemptID)
+			}
+		case runner.ConnectionMessageTypeResult:
+			if err := c.processResult(&message); err != nil {
+				c.ctx.Log.Error(
+					"Failed to receive the run results",
+					map[string]any{
+						"runner":     c.name,
+						"attempt_id": message.AttemptID,
+						"err":        err,
+					},
+				)
+				return
+			}
+		case runner.ConnectionMessageTypeDraining:
+			c.ctx.Log.Info(
+				"Runner draining",
+				map[string]any{
+					"runner": c.name,
+				},
+			)
+			c.drainingOnce.Do(func() {
+				close(c.draining)
+			})
+		default:
+			c.ctx.Log.Warn(
+				"Unknown message from runner",
+				map[string]any{
+					"runner": c.name,
+					"type":   message.Type,
+				},
+			)
+		}
+	}
+}
+
+func (c *runnerConnection) pingLoop() {
+	ticker := time.NewTicker(runner.ConnectionPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			err := c.conn.WriteControl(
+				websocket.PingMessage,
+				[]byte{},
+				time.Now().Add(runner.ConnectionPingPeriod),
+			)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// isDraining returns whether the runner reported that it is draining.
+func (c *runnerConnection) isDraining() bool {
+	select {
+	case <-c.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// dispatch waits for a run and assigns it to the runner. If reserve is set,
+// the runner is still grading another run, and the new one is only reserved.
+func (c *runnerConnection) dispatch(
+	runs *grader.Queue,
+	hashes map[string]struct{},
+	reserve bool,
+) {
+	defer func() {
+		c.attemptsLock.Lock()
+		c.dispatching = false
+		c.attemptsLock.Unlock()
+	}()
+
+	// Stop waiting for a run if the connection is closed or the runner starts
+	// draining.
+	closeNotifier := make(chan bool)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-c.closed:
+		case <-c.draining:
+		case <-stopped:
+			return
+		}
+		close(closeNotifier)
+	}()
+
+	if !c.ctx.RunnerHealth.WaitUntilHealthy(c.name, closeNotifier) {
+		return
+	}
+	getRun := runs.GetRunWithInputAffinity
+	if reserve {
+		getRun = runs.ReserveRunWithInputAffinity
+	}
+	runCtx, timeout, ok := getRun(
+		c.name,
+		hashes,
+		c.ctx.InflightMonitor,
+		closeNotifier,
+	)
+	if !ok {
+		return
+	}
+	attemptID := runCtx.RunInfo.Run.AttemptID
+	c.attemptsLock.Lock()
+	c.attempts[attemptID] = struct{}{}
+	c.attemptsLock.Unlock()
+
+	runCtx.Log.Debug(
+		"served run",
+		map[string]any{
+			"run":    runCtx,
+			"client": c.name,
+		},
+	)
+	if err := c.send(&runner.ConnectionMessage{
+		Type:      runner.ConnectionMessageTypeAssignment,
+		AttemptID: attemptID,
+		Run:       runCtx.RunInfo.Run,
+	}); err != nil {
+		runCtx.Log.Error(
+			"Failed to send the run to the runner. retrying",
+			map[string]any{
+				"runner": c.name,
+				"err":    err,
+			},
+		)
+		if c.untrack(attemptID) {
+			runCtx.Requeue(false)
+		}
+		return
+	}
+
+	go func() {
+		if _, didTimeout := <-timeout; didTimeout {
+			// The run has already been requeued, so tell the runner to stop
+			// working on it.
+			c.cancel(attemptID)
+		}
+	}()
+}
+
+// untrack removes the attempt from the ones assigned through this connection,
+// and returns whether it was present.
+func (c *runnerConnection) untrack(attemptID uint64) bool {
+	c.attemptsLock.Lock()
+	defer c.attemptsLock.Unlock()
+
+	_, ok := c.attempts[attemptID]
+	delete(c.attempts, attemptID)
+	return ok
+}
+
+// cancel tells the runner that the attempt is no longer assigned to it.
+func (c *runnerConnection) cancel(attemptID uint64) {
+	c.untrack(attemptID)
+	if err := c.send(&runner.ConnectionMessage{
+		Type:      runner.ConnectionMessageTypeCancel,
+		AttemptID: attemptID,
+	}); err != nil {
+		c.ctx.Log.Error(
+			"Failed to cancel the run",
+			map[string]any{
+				"runner":     c.name,
+				"attempt_id": attemptID,
+				"err":        err,
+			},
+		)
+	}
+}
+
+// processResult receives the results of a run. If the message says that there
+// are files, they are read from the next message into a temporary file, and
+// the rest of the processing, including uploading the files, happens in the
+// background so that the connection can keep being read. An error is only
+// returned if the connection can no longer be used.
+func (c *runnerConnection) processResult(message *runner.ConnectionMessage) error {
+	c.untrack(message.AttemptID)
+	runCtx, _, ok := c.ctx.InflightMonitor.Get(message.AttemptID)
+	if !ok {
+		c.ctx.Log.Warn(
+			"Received results for a run that is not in-flight",
+			map[string]any{
+				"runner":     c.name,
+				"attempt_id": message.AttemptID,
+			},
+		)
+		if message.HasFiles {
+			_, r, err := c.conn.NextReader()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(io.Discard, r)
+			return err
+		}
+		return nil
+	}
+
+	if message.Result == nil {
+		runCtx.Log.Error(
+			"Runner did not send the run result",
+			map[string]any{
+				"runner": c.name,
+			},
+		)
+		runCtx.RunInfo.Artifacts.Clean()
+		finishRun(runCtx, &processRunStatus{http.StatusBadRequest, true})
+		return nil
+	}
+	var files *os.File
+	if message.HasFiles {
+		var err error
+		files, err = c.receiveFiles()
+		if err != nil {
+			runCtx.RunInfo.Artifacts.Clean()
+			finishRun(runCtx, &processRunStatus{http.StatusBadRequest, true})
+			return err
+		}
+	}
+	go c.storeResult(runCtx, message, files)
+	return nil
+}
+
+// receiveFiles reads files.zip from the next message into a temporary file,
+// which is positioned at its start. The caller owns the file.
+func (c *runnerConnection) receiveFiles() (*os.File, error) {
+	// files.zip can be as large as the overall output limit, plus the
+	// compiler output.
+	c.conn.SetReadLimit(int64(c.ctx.Config.Runner.OverallOutputLimit) + maxRunnerMessageSize)
+	defer c.conn.SetReadLimit(maxRunnerMessageSize)
+
+	messageType, r, err := c.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	c.extendReadDeadline()
+	if messageType != websocket.BinaryMessage {
+		return nil, errors.Errorf("unexpected message type %d", messageType)
+	}
+	f, err := os.CreateTemp("", "files.*.zip")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the files.zip temporary file")
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "failed to receive files.zip")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "failed to rewind files.zip")
+	}
+	return f, nil
+}
+
+// storeResult uploads the files of the run, if any, and stores its results.
+func (c *runnerConnection) storeResult(
+	runCtx *grader.RunContext,
+	message *runner.ConnectionMessage,
+	files *os.File,
+) {
+	runCtx.RunInfo.Artifacts.Clean()
+	runCtx.RunInfo.Result = *message.Result
+	runCtx.RunInfo.Result.JudgedBy = c.name
+	if message.Logs != "" {
+		runCtx.AppendLogSection(c.name, []byte(message.Logs))
+	}
+	if files != nil {
+		defer os.Remove(files.Name())
+		defer files.Close()
+		if err := runCtx.RunInfo.Artifacts.Put(runCtx.Context, "files.zip", files); err != nil {
+			runCtx.Log.Error(
+				"Unable to upload results",
+				map[string]any{
+					"err":    err,
+					"runner": c.name,
+				},
+			)
+			finishRun(runCtx, &processRunStatus{http.StatusBadRequest, true})
+			return
+		}
+	}
+	finishRun(runCtx, processRunResult(c.ctx, runCtx, c.name))
+}
+
+// runnerConnectionRegistry keeps track of all the runners that have a
+// persistent connection with the grader, and of the runners that are draining.
+type runnerConnectionRegistry struct {
+	sync.Mutex
+	conns map[string]*runnerConnection
+
+	// drainRequested are the runners that poll for runs that have been asked
+	// to drain. They are told so the next time they ask for a run.
+	drainRequested map[string]struct{}
+	// draining are the runners without a persistent connection that reported
+	// that they are draining.
+	draining map[string]time.Time
+	// drainNotifiers are closed when the runner that polls for runs reports
+	// that it is draining or is asked to drain, so that its pending requests
+	// for runs are answered right away.
+	drainNotifiers map[string]chan struct{}
+}
+
+func newRunnerConnectionRegistry() *runnerConnectionRegistry {
+	return &runnerConnectionRegistry{
+		conns:          make(map[string]*runnerConnection),
+		drainRequested: make(map[string]struct{}),
+		draining:       make(map[string]time.Time),
+		drainNotifiers: make(map[string]chan struct{}),
+	}
+}
+
+// add registers the connection. Any previous connection from a runner with
+// the same name is closed.
+func (r *runnerConnectionRegistry) add(c *runnerConnection) {
+	r.Lock()
+	previous, ok := r.conns[c.name]
+	r.conns[c.name] = c
+	// A new connection means that the runner was restarted.
+	delete(r.draining, c.name)
+	r.Unlock()
+
+	if ok {
+		previous.close()
+	}
+}
+
+func (r *runnerConnectionRegistry) remove(c *runnerConnection) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.conns[c.name] == c {
+		delete(r.conns, c.name)
+		// Keep track of runners that disconnect after draining until they
+		// are restarted.
+		if c.isDraining() {
+			r.draining[c.name] = time.Now()
+		}
+	}
+}
+
+// disconnect closes the connection with the runner with the provided name, if
+// any.
+func (r *runnerConnectionRegistry) disconnect(name string) {
+	r.Lock()
+	c, ok := r.conns[name]
+	r.Unlock()
+
+	if ok {
+		c.close()
+	}
+}
+
+// names returns the sorted names of the connected runners.
+func (r *runnerConnectionRegistry) names() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	names := make([]string, 0, len(r.conns))
+	for name := range r.conns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// send sends a message to the runner with the provided name. It returns false
+// if the runner is not connected.
+func (r *runnerConnectionRegistry) send(name string, message *runner.ConnectionMessage) (bool, error) {
+	r.Lock()
+	c, ok := r.conns[name]
+	r.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, c.send(message)
+}
+
+// requestDrain asks the runner with the provided name to stop accepting runs
+// once it finishes the current one. Runners with a persistent connection are
+// told immediately, and the rest are told the next time they ask for a run.
+func (r *runnerConnectionRegistry) requestDrain(name string) error {
+	r.Lock()
+	c, ok := r.conns[name]
+	if !ok {
+		r.drainRequested[name] = struct{}{}
+		r.notifyDrainLocked(name)
+	}
+	r.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return c.send(&runner.ConnectionMessage{
+		Type: runner.ConnectionMessageTypeDrain,
+	})
+}
+
+// isDrainRequested returns whether the runner has been asked to drain and has
+// not acknowledged it yet.
+func (r *runnerConnectionRegistry) isDrainRequested(name string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	_, ok := r.drainRequested[name]
+	return ok
+}
+
+// setDraining records whether a runner that polls for runs is draining.
+func (r *runnerConnectionRegistry) setDraining(name string, draining bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if draining {
+		delete(r.drainRequested, name)
+		r.draining[name] = time.Now()
+		r.notifyDrainLocked(name)
+	} else {
+		delete(r.draining, name)
+	}
+}
+
+// drainNotifier returns a channel that is closed once the runner that polls
+// for runs reports that it is draining or is asked to drain.
+func (r *runnerConnectionRegistry) drainNotifier(name string) <-chan struct{} {
+	r.Lock()
+	defer r.Unlock()
+
+	notifier, ok := r.drainNotifiers[name]
+	if !ok {
+		notifier = make(chan struct{})
+		r.drainNotifiers[name] = notifier
+	}
+	return notifier
+}
+
+// notifyDrainLocked closes the drain notifier of the runner. The caller must
+// hold the lock.
+func (r *runnerConnectionRegistry) notifyDrainLocked(name string) {
+	if notifier, ok := r.drainNotifiers[name]; ok {
+		close(notifier)
+		delete(r.drainNotifiers, name)
+	}
+}
+
+// drainingNames returns the sorted names of the runners that are draining.
+func (r *runnerConnectionRegistry) drainingNames() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	names := make([]string, 0)
+	for name := range r.draining {
+		names = append(names, name)
+	}
+	for name, c := range r.conns {
+		if _, ok := r.draining[name]; !ok && c.isDraining() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// broadcast sends a message to all the connected runners.
+func (r *runnerConnectionRegistry) broadcast(ctx *grader.Context, message *runner.ConnectionMessage) {
+	for _, name := range r.names() {
+		if _, err := r.send(name, message); err != nil {
+			ctx.Log.Error(
+				"Failed to send message to runner",
+				map[string]any{
+					"runner": name,
+					"type":   message.Type,
+					"err":    err,
+				},
+			)
+		}
+	}
+}
+
+func registerRunnerConnectionHandlers(
+	ctx *grader.Context,
+	mux *http.ServeMux,
+	registry *runnerConnectionRegistry,
+	insecure bool,
+) {
+	runs, err := ctx.QueueManager.Get(grader.DefaultQueueName)
+	if err != nil {
+		panic(err)
+	}
+
+	// The connection is not traced, since it is long-lived.
+	mux.HandleFunc("/run/connect/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := ctx.Wrap(r.Context())
+		runnerName := peerName(r, insecure)
+
+		// Add the runner to the list of known runners.
+		if m, ok := ctx.Metrics.(*prometheusMetrics); ok {
+			remoteAddr := r.Header.Get("OmegaUp-Runner-PublicIP")
+			if remoteAddr != "" {
+				m.RunnerObserve(runnerName, remoteAddr+":6060")
+			}
+		}
+
+		conn, err := runnerUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			ctx.Log.Error(
+				"Failed to upgrade connection",
+				map[string]any{
+					"runner": runnerName,
+					"err":    err,
+				},
+			)
+			return
+		}
+		ctx.Log.Info(
+			"Runner connected",
+			map[string]any{
+				"runner": runnerName,
+			},
+		)
+
+		c := newRunnerConnection(ctx, runnerName, conn)
+		registry.add(c)
+		defer registry.remove(c)
+		c.serve(runs)
+	})
+
+	// Runners that poll for runs report that they are draining through this
+	// endpoint, since they don't have a connection to send it through.
+	mux.Handle(ctx.Tracing.WrapHandle("/runner/draining/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := ctx.Wrap(r.Context())
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		runnerName := peerName(r, insecure)
+		registry.setDraining(runnerName, true)
+		ctx.Log.Info(
+			"Runner draining",
+			map[string]any{
+				"runner": runnerName,
+			},
+		)
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		w.Write([]byte(`{"status":"ok"}`))
+	})))
+}
+
+func registerRunnerAdminHandlers(
+	ctx *grader.Context,
+	mux *http.ServeMux,
+	registry *runnerConnectionRegistry,
+) {
+	mux.Handle(ctx.Tracing.WrapHandle("/runner/drain/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = ctx.Wrap(r.Context())
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		runnerName := r.URL.Query().Get("name")
+		if runnerName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := registry.requestDrain(runnerName); err != nil {
+			ctx.Log.Error(
+				"Failed to drain runner",
+				map[string]any{
+					"runner": runnerName,
+					"err":    err,
+				},
+			)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		w.Write([]byte(`{"status":"ok"}`))
+	})))
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/grader"
+	"github.com/omegaup/quark/runner"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRunnerConnection(t *testing.T) {
+	ctx := newGraderContext(t)
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(path.Dir(ctx.Config.Grader.RuntimePath))
+	}
+	ephemeralRunManager := grader.NewEphemeralRunManager(ctx)
+	if err := ephemeralRunManager.Initialize(); err != nil {
+		t.Fatalf("Failed to fully initalize the ephemeral run manager: %s", err)
+	}
+	registry := newRunnerConnectionRegistry()
+	mux := http.NewServeMux()
+	registerRunnerConnectionHandlers(ctx, mux, registry, true)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	inputFactory, err := common.NewLiteralInputFactory(
+		&common.LiteralInput{
+			Cases: map[string]*common.LiteralCaseSettings{
+				"0": {Input: "1 2", ExpectedOutput: "3", Weight: big.NewRat(1, 1)},
+			},
+		},
+		ctx.Config.Grader.RuntimePath,
+		common.LiteralPersistGrader,
+	)
+	if err != nil {
+		t.Fatalf("Failed to create the input: %s", err)
+	}
+	inputRef, err := ctx.InputManager.Add(inputFactory.Hash(), inputFactory)
+	if err != nil {
+		t.Fatalf("Failed to add the input: %s", err)
+	}
+	runInfo := grader.NewRunInfo()
+	runInfo.Run.InputHash = inputFactory.Hash()
+	runInfo.Run.Language = "py"
+	runInfo.Run.MaxScore = big.NewRat(1, 1)
+	runInfo.Run.Source = "print 3"
+	runInfo.Priority = grader.QueuePriorityEphemeral
+	if _, err := ephemeralRunManager.SetEphemeral(runInfo); err != nil {
+		t.Fatalf("Failed to make the run ephemeral: %s", err)
+	}
+	runs, err := ctx.QueueManager.Get(grader.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("Failed to get the default queue: %s", err)
+	}
+	runWaitHandle, err := runs.AddWaitableRun(&ctx.Context, runInfo, inputRef)
+	if err != nil {
+		t.Fatalf("Failed to add the run: %s", err)
+	}
+
+	dialer := &websocket.Dialer{
+		Subprotocols: []string{runner.ConnectionSubprotocol},
+	}
+	conn, _, err := dialer.Dial(
+		"ws"+strings.TrimPrefix(ts.URL, "http")+"/run/connect/",
+		http.Header{"OmegaUp-Runner-Name": {"test-runner"}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(&runner.ConnectionMessage{
+		Type: runner.ConnectionMessageTypeReady,
+	}); err != nil {
+		t.Fatalf("Failed to send the ready message: %s", err)
+	}
+	var assignment runner.ConnectionMessage
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.ReadJSON(&assignment); err != nil {
+		t.Fatalf("Failed to read the assignment: %s", err)
+	}
+	if assignment.Type != runner.ConnectionMessageTypeAssignment {
+		t.Fatalf("message type = %q, want %q", assignment.Type, runner.ConnectionMessageTypeAssignment)
+	}
+	if assignment.Run == nil || assignment.Run.AttemptID != assignment.AttemptID {
+		t.Fatalf("unexpected assignment: %v", assignment)
+	}
+	if names := registry.names(); len(names) != 1 || names[0] != "test-runner" {
+		t.Errorf("registry.names() = %v, want [test-runner]", names)
+	}
+
+	if err := conn.WriteJSON(&runner.ConnectionMessage{
+		Type:      runner.ConnectionMessageTypeHeartbeat,
+		AttemptID: assignment.AttemptID,
+		Progress: &runner.RunProgress{
+			Phase: runner.ProgressPhaseRun,
+		},
+	}); err != nil {
+		t.Fatalf("Failed to send the heartbeat: %s", err)
+	}
+
+	result := runner.NewRunResult("AC", big.NewRat(1, 1))
+	result.Score = big.NewRat(1, 1)
+	result.ContestScore = big.NewRat(1, 1)
+	if err := conn.WriteJSON(&runner.ConnectionMessage{
+		Type:      runner.ConnectionMessageTypeResult,
+		AttemptID: assignment.AttemptID,
+		Result:    result,
+		HasFiles:  true,
+	}); err != nil {
+		t.Fatalf("Failed to send the result: %s", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("files")); err != nil {
+		t.Fatalf("Failed to send the files: %s", err)
+	}
+
+	select {
+	case <-runWaitHandle.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the run to finish")
+	}
+	if runInfo.Result.Verdict != "AC" {
+		t.Errorf("verdict = %q, want AC", runInfo.Result.Verdict)
+	}
+	if runInfo.Result.JudgedBy != "test-runner" {
+		t.Errorf("judged by = %q, want test-runner", runInfo.Result.JudgedBy)
+	}
+	f, err := runInfo.Artifacts.Get(&ctx.Context, "files.zip")
+	if err != nil {
+		t.Fatalf("Failed to get files.zip: %s", err)
+	}
+	defer f.Close()
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Failed to read files.zip: %s", err)
+	}
+	if string(contents) != "files" {
+		t.Errorf("files.zip = %q, want %q", contents, "files")
+	}
+}
+
+func TestRunnerDrain(t *testing.T) {
+	ctx := newGraderContext(t)
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(path.Dir(ctx.Config.Grader.RuntimePath))
+	}
+	registry := newRunnerConnectionRegistry()
+	mux := http.NewServeMux()
+	registerRunnerHandlers(ctx, mux, nil, registry, true)
+	registerRunnerConnectionHandlers(ctx, mux, registry, true)
+	registerRunnerAdminHandlers(ctx, mux, registry)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	post := func(url string, runnerName string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("POST", ts.URL+url, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %s", err)
+		}
+		req.Header.Set("OmegaUp-Runner-Name", runnerName)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %s", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Runners that poll for runs are told to drain the next time they ask for
+	// a run.
+	if resp := post("/runner/drain/?name=polling-runner", "admin"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("/runner/drain/ = %d, want 200", resp.StatusCode)
+	}
+	req, err := http.NewRequest("GET", ts.URL+"/run/request/", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	req.Header.Set("OmegaUp-Runner-Name", "polling-runner")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to request a run: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("OmegaUp-Runner-Drain") != "true" {
+		t.Errorf(
+			"/run/request/ = %d %q, want 503 %q",
+			resp.StatusCode,
+			resp.Header.Get("OmegaUp-Runner-Drain"),
+			"true",
+		)
+	}
+	if resp := post("/runner/draining/", "polling-runner"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("/runner/draining/ = %d, want 200", resp.StatusCode)
+	}
+	if registry.isDrainRequested("polling-runner") {
+		t.Errorf("drain still requested after the runner acknowledged it")
+	}
+
+	// Runners with a persistent connection are told right away.
+	dialer := &websocket.Dialer{
+		Subprotocols: []string{runner.ConnectionSubprotocol},
+	}
+	conn, _, err := dialer.Dial(
+		"ws"+strings.TrimPrefix(ts.URL, "http")+"/run/connect/",
+		http.Header{"OmegaUp-Runner-Name": {"connected-runner"}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(&runner.ConnectionMessage{
+		Type: runner.ConnectionMessageTypeReady,
+	}); err != nil {
+		t.Fatalf("Failed to send ready: %s", err)
+	}
+	for len(registry.names()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if resp := post("/runner/drain/?name=connected-runner", "admin"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("/runner/drain/ = %d, want 200", resp.StatusCode)
+	}
+	var message runner.ConnectionMessage
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatalf("Failed to read the drain message: %s", err)
+	}
+	if message.Type != runner.ConnectionMessageTypeDrain {
+		t.Fatalf("message.Type = %q, want %q", message.Type, runner.ConnectionMessageTypeDrain)
+	}
+	if err := conn.WriteJSON(&runner.ConnectionMessage{
+		Type: runner.ConnectionMessageTypeDraining,
+	}); err != nil {
+		t.Fatalf("Failed to send draining: %s", err)
+	}
+	conn.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+	)
+	for len(registry.names()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	draining := registry.drainingNames()
+	if len(draining) != 2 || draining[0] != "connected-runner" || draining[1] != "polling-runner" {
+		t.Errorf("drainingNames() = %v, want [connected-runner polling-runner]", draining)
+	}
+
+	// A pending request for a run is answered as soon as the runner reports
+	// that it is draining, so that it does not need to be cancelled.
+	pending := make(chan *http.Response, 1)
+	go func() {
+		req, err := http.NewRequest("GET", ts.URL+"/run/request/", nil)
+		if err != nil {
+			pending <- nil
+			return
+		}
+		req.Header.Set("OmegaUp-Runner-Name", "pending-runner")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			pending <- nil
+			return
+		}
+		resp.Body.Close()
+		pending <- resp
+	}()
+	select {
+	case resp := <-pending:
+		t.Fatalf("/run/request/ = %v before the runner drained", resp)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if resp := post("/runner/draining/", "pending-runner"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("/runner/draining/ = %d, want 200", resp.StatusCode)
+	}
+	select {
+	case resp := <-pending:
+		if resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("OmegaUp-Runner-Drain") != "true" {
+			t.Errorf("/run/request/ = %v, want 503 with the drain header", resp)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("/run/request/ was not answered after the runner drained")
+	}
+}
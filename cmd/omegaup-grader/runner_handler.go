@@ -11,6 +11,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/omegaup/quark/common"
@@ -18,7 +19,35 @@ import (
 	"github.com/omegaup/quark/runner"
 )
 
+const maxInputManifestSize = 16 * 1024 * 1024
+
+var (
+	inputHashRe  = regexp.MustCompile("^[a-f0-9]{40}$")
+	runnerSlotRe = regexp.MustCompile("^[0-9]{1,4}$")
+)
+
+// parseRunnerInputHashes returns the set of input hashes that the runner
+// reported as being cached. Returns nil if the runner did not report them.
+func parseRunnerInputHashes(r *http.Request) map[string]struct{} {
+	values := r.Header.Values("OmegaUp-Runner-Input-Hashes")
+	if len(values) == 0 {
+		return nil
+	}
+	hashes := make(map[string]struct{})
+	for _, value := range values {
+		for _, hash := range strings.Split(value, ",") {
+			hash = strings.TrimSpace(hash)
+			if !inputHashRe.MatchString(hash) {
+				continue
+			}
+			hashes[hash] = struct{}{}
+		}
+	}
+	return hashes
+}
+
 func processRun(
+	ctx *grader.Context,
 	r *http.Request,
 	attemptID uint64,
 	runCtx *grader.RunContext,
@@ -110,6 +139,16 @@ func processRun(
 			}
 		}
 	}
+	return processRunResult(ctx, runCtx, runnerName)
+}
+
+// processRunResult decides whether the run needs to be retried once all its
+// results have been received, and records the outcome in the runner's health.
+func processRunResult(
+	ctx *grader.Context,
+	runCtx *grader.RunContext,
+	runnerName string,
+) *processRunStatus {
 	runCtx.Log.Info(
 		"Finished processing run",
 		map[string]any{
@@ -120,6 +159,7 @@ func processRun(
 		},
 	)
 	if runCtx.RunInfo.Result.Verdict == "JE" {
+		ctx.RunnerHealth.Record(runnerName, runCtx.RunInfo.ID, grader.RunnerOutcomeJE)
 		// Retry the run in case it is some transient problem.
 		runCtx.Log.Info(
 			"Judge Error. Re-attempting run.",
@@ -131,13 +171,35 @@ func processRun(
 		)
 		return &processRunStatus{http.StatusOK, true}
 	}
+	ctx.RunnerHealth.Record(runnerName, runCtx.RunInfo.ID, grader.RunnerOutcomeOK)
 	return &processRunStatus{http.StatusOK, false}
 }
 
+// finishRun closes the run if it is done, or requeues it if it needs to be
+// retried.
+func finishRun(runCtx *grader.RunContext, result *processRunStatus) {
+	if !result.retry {
+		// The run either finished correctly or encountered a fatal error.
+		// Close the context and write the results to disk.
+		runCtx.Close()
+		return
+	}
+	runCtx.Log.Error(
+		"run errored out. retrying",
+		map[string]any{
+			"context": runCtx,
+		},
+	)
+	// status is OK only when the runner successfully sent a JE verdict.
+	lastAttempt := result.status == http.StatusOK
+	runCtx.Requeue(lastAttempt)
+}
+
 func registerRunnerHandlers(
 	ctx *grader.Context,
 	mux *http.ServeMux,
 	db *sql.DB,
+	runnerConnections *runnerConnectionRegistry,
 	insecure bool,
 ) {
 	runs, err := ctx.QueueManager.Get(grader.DefaultQueueName)
@@ -195,12 +257,56 @@ func registerRunnerHandlers(
 			}
 		}
 
-		runCtx, _, ok := runs.GetRun(
-			runnerName,
-			ctx.InflightMonitor,
-			w.(http.CloseNotifier).CloseNotify(),
-		)
+		// The request is answered as soon as the runner drains, instead of
+		// having the runner cancel it, which could orphan a run that was
+		// already dequeued for it.
+		drained := runnerConnections.drainNotifier(runnerName)
+		// A runner that was draining and asks for runs again was restarted.
+		runnerConnections.setDraining(runnerName, false)
+		if runnerConnections.isDrainRequested(runnerName) {
+			w.Header().Set("OmegaUp-Runner-Drain", "true")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		clientGone := w.(http.CloseNotifier).CloseNotify()
+		closeNotifier := make(chan bool)
+		requestDone := make(chan struct{})
+		defer close(requestDone)
+		go func() {
+			select {
+			case <-clientGone:
+			case <-drained:
+			case <-requestDone:
+				return
+			}
+			close(closeNotifier)
+		}()
+		// Quarantined runners don't get any runs until they are released.
+		ok = ctx.RunnerHealth.WaitUntilHealthy(runnerName, closeNotifier)
+		// Runners that are still grading another run reserve the next one, so
+		// that they can fetch its input in the meantime.
+		getRun := runs.GetRunWithInputAffinity
+		if r.URL.Query().Get("reserve") == "true" {
+			getRun = runs.ReserveRunWithInputAffinity
+		}
+		var runCtx *grader.RunContext
+		if ok {
+			runCtx, _, ok = getRun(
+				runnerName,
+				parseRunnerInputHashes(r),
+				ctx.InflightMonitor,
+				closeNotifier,
+			)
+		}
 		if !ok {
+			select {
+			case <-drained:
+				w.Header().Set("OmegaUp-Runner-Drain", "true")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			default:
+			}
 			ctx.Log.Debug(
 				"client gone",
 				map[string]any{
@@ -226,9 +332,35 @@ func registerRunnerHandlers(
 	})))
 
 	runRe := regexp.MustCompile("/run/([0-9]+)/results/?")
+	heartbeatRe := regexp.MustCompile("/run/([0-9]+)/heartbeat/?")
 	mux.Handle(ctx.Tracing.WrapHandle("/run/", http.TimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx = ctx.Wrap(r.Context())
 		defer r.Body.Close()
+		if res := heartbeatRe.FindStringSubmatch(r.URL.Path); res != nil {
+			if r.Method != "POST" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			attemptID, _ := strconv.ParseUint(res[1], 10, 64)
+			var progress runner.RunProgress
+			if err := json.NewDecoder(r.Body).Decode(&progress); err != nil && err != io.EOF {
+				ctx.Log.Error(
+					"Invalid heartbeat",
+					map[string]any{
+						"attempt_id": attemptID,
+						"err":        err,
+					},
+				)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !ctx.InflightMonitor.Heartbeat(attemptID, peerName(r, insecure), &progress) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 		res := runRe.FindStringSubmatch(r.URL.Path)
 		if res == nil {
 			w.WriteHeader(http.StatusNotFound)
@@ -240,23 +372,9 @@ func registerRunnerHandlers(
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		result := processRun(r, attemptID, runCtx, insecure)
+		result := processRun(ctx, r, attemptID, runCtx, insecure)
 		w.WriteHeader(result.status)
-		if !result.retry {
-			// The run either finished correctly or encountered a fatal error.
-			// Close the context and write the results to disk.
-			runCtx.Close()
-			return
-		}
-		runCtx.Log.Error(
-			"run errored out. retrying",
-			map[string]any{
-				"context": runCtx,
-			},
-		)
-		// status is OK only when the runner successfully sent a JE verdict.
-		lastAttempt := result.status == http.StatusOK
-		runCtx.Requeue(lastAttempt)
+		finishRun(runCtx, result)
 	}), time.Duration(5*time.Minute), "Request timed out")))
 
 	inputRe := regexp.MustCompile("/input/(?:([a-zA-Z0-9_-]*)/)?([a-f0-9]{40})/?")
@@ -296,6 +414,46 @@ func registerRunnerHandlers(
 			return
 		}
 		defer inputRef.Release()
+		if deltaInput, ok := inputRef.Input.(common.DeltaTransmittableInput); ok && r.Method == http.MethodPost {
+			// The runner sent the manifest of a previous version of this
+			// problem's input, so only the files that changed need to be sent.
+			manifest, err := common.ReadInputManifest(http.MaxBytesReader(w, r.Body, maxInputManifestSize))
+			if err != nil {
+				ctx.Log.Error(
+					"Error reading input manifest",
+					map[string]any{
+						"hash": hash,
+						"err":  err,
+					},
+				)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := deltaInput.TransmitDelta(w, manifest); err != nil {
+				ctx.Log.Error(
+					"Error transmitting input delta",
+					map[string]any{
+						"hash": hash,
+						"err":  err,
+					},
+				)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		if rangeInput, ok := inputRef.Input.(common.RangeTransmittableInput); ok {
+			if err := rangeInput.TransmitRange(w, r); err != nil {
+				ctx.Log.Error(
+					"Error transmitting input",
+					map[string]any{
+						"hash": hash,
+						"err":  err,
+					},
+				)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
 		if err := inputRef.Input.(common.TransmittableInput).Transmit(w); err != nil {
 			ctx.Log.Error(
 				"Error transmitting input",
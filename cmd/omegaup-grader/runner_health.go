@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/omegaup/quark/grader"
+)
+
+// handleRunnerQuarantine is called whenever a runner is quarantined. Besides
+// alerting, it optionally re-runs the runs that the runner graded recently
+// without a JE verdict, since their results are also suspicious.
+func handleRunnerQuarantine(
+	ctx *grader.Context,
+	db *sql.DB,
+	artifacts *grader.ArtifactManager,
+	runs *grader.Queue,
+	quarantine *grader.RunnerQuarantine,
+) {
+	ctx.Log.Error(
+		"Runner quarantined",
+		map[string]any{
+			"runner":       quarantine.Runner,
+			"je_rate":      quarantine.JERate,
+			"timeout_rate": quarantine.TimeoutRate,
+			"samples":      quarantine.Samples,
+		},
+	)
+	ctx.Metrics.CounterAdd("grader_runner_quarantines_total", 1)
+	ctx.Metrics.GaugeAdd("grader_runners_quarantined", 1)
+
+	if !ctx.Config.Grader.Quarantine.RerunResults || db == nil {
+		return
+	}
+	for _, runID := range quarantine.RecentRunIDs {
+		runInfo, err := newRunInfoFromID(ctx, db, runID, artifacts)
+		if err != nil {
+			ctx.Log.Error(
+				"Error getting run information",
+				map[string]any{
+					"err":   err,
+					"runId": runID,
+				},
+			)
+			continue
+		}
+		if err := injectRun(ctx, artifacts, runs, grader.QueuePriorityLow, runInfo); err != nil {
+			ctx.Log.Error(
+				"Error re-running run",
+				map[string]any{
+					"err":   err,
+					"runId": runID,
+				},
+			)
+			continue
+		}
+		ctx.Log.Info(
+			"Re-running run graded by a quarantined runner",
+			map[string]any{
+				"runId":  runID,
+				"runner": quarantine.Runner,
+			},
+		)
+	}
+}
+
+// registerRunnerHealthHandlers adds the administrative handlers to list the
+// quarantined runners and to release them.
+func registerRunnerHealthHandlers(
+	ctx *grader.Context,
+	mux *http.ServeMux,
+) {
+	mux.Handle(ctx.Tracing.WrapHandle("/runner/quarantines/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := ctx.Wrap(r.Context())
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(map[string]any{"quarantines": ctx.RunnerHealth.Quarantines()}); err != nil {
+			ctx.Log.Error(
+				"Error writing /runner/quarantines/ response",
+				map[string]any{
+					"err": err,
+				},
+			)
+		}
+	})))
+
+	mux.Handle(ctx.Tracing.WrapHandle("/runner/unquarantine/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := ctx.Wrap(r.Context())
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		runnerName := r.URL.Query().Get("name")
+		if runnerName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !ctx.RunnerHealth.Unquarantine(runnerName) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ctx.Metrics.GaugeAdd("grader_runners_quarantined", -1)
+		ctx.Log.Info(
+			"Runner unquarantined",
+			map[string]any{
+				"runner": runnerName,
+			},
+		)
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		w.Write([]byte(`{"status":"ok"}`))
+	})))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/omegaup/quark/grader"
+)
+
+var runnerNameRe = regexp.MustCompile("^[a-zA-Z0-9_.-]{1,64}$")
+
+// runnerNameKey is the key of the authenticated runner name in the request's
+// context.
+type runnerNameKey struct{}
+
+type runnerRegistrationRequest struct {
+	Token        string   `json:"token"`
+	Name         string   `json:"name"`
+	PublicIP     string   `json:"public_ip"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type runnerRegistrationResponse struct {
+	Name       string `json:"name"`
+	Credential string `json:"credential"`
+}
+
+type runnerJoinTokenResponse struct {
+	Token      string    `json:"token"`
+	Expiration time.Time `json:"expiration"`
+}
+
+type runnerRegistryEntry struct {
+	*grader.RunnerRegistration
+	Connected bool `json:"connected"`
+}
+
+// runnerCredential returns the credential in the request's Authorization
+// header, if any.
+func runnerCredential(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+}
+
+// authenticateRunners wraps the runner handlers so that only runners that
+// have a valid credential or TLS client certificate, and that have not been
+// disabled or revoked, can talk to the grader. The name of the runner is
+// stored in the request's context so that peerName can return it.
+func authenticateRunners(
+	ctx *grader.Context,
+	handler http.Handler,
+	insecure bool,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/runner/register/" {
+			// Runners that register don't have a credential yet.
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		publicIP := r.Header.Get("OmegaUp-Runner-PublicIP")
+		var runnerName string
+		if credential := runnerCredential(r); credential != "" {
+			if !ctx.Config.Grader.Runners.TokenAuthentication {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			name, err := ctx.RunnerRegistry.Authenticate(credential, publicIP)
+			if err != nil {
+				ctx.Log.Warn(
+					"Rejected runner credential",
+					map[string]any{
+						"remote_addr": r.RemoteAddr,
+						"err":         err,
+					},
+				)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			runnerName = name
+		} else {
+			if ctx.Config.Grader.Runners.RequireCredentials ||
+				(!insecure && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0)) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			runnerName = runnerHostName(r, insecure)
+			if err := ctx.RunnerRegistry.Check(runnerName, publicIP); err != nil {
+				ctx.Log.Warn(
+					"Rejected runner",
+					map[string]any{
+						"runner": runnerName,
+						"err":    err,
+					},
+				)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), runnerNameKey{}, runnerName)))
+	})
+}
+
+// registerRunnerRegistrationHandlers adds the handler where runners exchange
+// a join token for a credential.
+func registerRunnerRegistrationHandlers(ctx *grader.Context, mux *http.ServeMux) {
+	mux.Handle(ctx.Tracing.WrapHandle("/runner/register/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = ctx.Wrap(r.Context())
+		defer r.Body.Close()
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var request runnerRegistrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			ctx.Log.Error(
+				"Invalid runner registration request",
+				map[string]any{
+					"err": err,
+				},
+			)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !runnerNameRe.MatchString(request.Name) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		credential, err := ctx.RunnerRegistry.Register(
+			request.Token,
+			request.Name,
+			request.PublicIP,
+			request.Capabilities,
+		)
+		if err == grader.ErrInvalidJoinToken || err == grader.ErrRunnerDisabled {
+			ctx.Log.Warn(
+				"Rejected runner registration",
+				map[string]any{
+					"runner": request.Name,
+					"err":    err,
+				},
+			)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			ctx.Log.Error(
+				"Failed to register runner",
+				map[string]any{
+					"runner": request.Name,
+					"err":    err,
+				},
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ctx.Log.Info(
+			"Runner registered",
+			map[string]any{
+				"runner":       request.Name,
+				"public_ip":    request.PublicIP,
+				"capabilities": request.Capabilities,
+			},
+		)
+
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		json.NewEncoder(w).Encode(&runnerRegistrationResponse{
+			Name:       request.Name,
+			Credential: credential,
+		})
+	})))
+}
+
+// registerRunnerRegistryHandlers adds the administrative handlers to create
+// join tokens, and to list, disable, enable, and revoke runners.
+func registerRunnerRegistryHandlers(
+	ctx *grader.Context,
+	mux *http.ServeMux,
+	connections *runnerConnectionRegistry,
+) {
+	mux.Handle(ctx.Tracing.WrapHandle("/runner/token/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = ctx.Wrap(r.Context())
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		token, expiration, err := ctx.RunnerRegistry.CreateJoinToken(
+			time.Duration(ctx.Config.Grader.Runners.JoinTokenTTL),
+		)
+		if err != nil {
+			ctx.Log.Error(
+				"Failed to create join token",
+				map[string]any{
+					"err": err,
+				},
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		json.NewEncoder(w).Encode(&runnerJoinTokenResponse{
+			Token:      token,
+			Expiration: expiration,
+		})
+	})))
+
+	mux.Handle(ctx.Tracing.WrapHandle("/runner/list/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = ctx.Wrap(r.Context())
+		connected := make(map[string]struct{})
+		for _, name := range connections.names() {
+			connected[name] = struct{}{}
+		}
+		entries := make([]*runnerRegistryEntry, 0)
+		for _, registration := range ctx.RunnerRegistry.List() {
+			_, ok := connected[registration.Name]
+			entries = append(entries, &runnerRegistryEntry{
+				RunnerRegistration: registration,
+				Connected:          ok,
+			})
+		}
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(map[string]any{"runners": entries}); err != nil {
+			ctx.Log.Error(
+				"Error writing /runner/list/ response",
+				map[string]any{
+					"err": err,
+				},
+			)
+		}
+	})))
+
+	actions := map[string]func(name string) error{
+		"/runner/disable/": func(name string) error {
+			return ctx.RunnerRegistry.SetDisabled(name, true)
+		},
+		"/runner/enable/": func(name string) error {
+			return ctx.RunnerRegistry.SetDisabled(name, false)
+		},
+		"/runner/revoke/": ctx.RunnerRegistry.Revoke,
+	}
+	for pattern, action := range actions {
+		pattern, action := pattern, action
+		mux.Handle(ctx.Tracing.WrapHandle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := ctx.Wrap(r.Context())
+			if r.Method != "POST" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			runnerName := r.URL.Query().Get("name")
+			if runnerName == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := action(runnerName); err == grader.ErrRunnerNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if err != nil {
+				ctx.Log.Error(
+					"Failed to update runner",
+					map[string]any{
+						"runner": runnerName,
+						"action": pattern,
+						"err":    err,
+					},
+				)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			ctx.Log.Info(
+				"Runner updated",
+				map[string]any{
+					"runner": runnerName,
+					"action": pattern,
+				},
+			)
+			if pattern != "/runner/enable/" {
+				// Persistent connections are authenticated only once, so they
+				// need to be closed for the change to take effect immediately.
+				connections.disconnect(runnerName)
+			}
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			w.Write([]byte(`{"status":"ok"}`))
+		})))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateRunners(t *testing.T) {
+	ctx := newGraderContext(t)
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(path.Dir(ctx.Config.Grader.RuntimePath))
+	}
+	ctx.Config.Grader.Runners.TokenAuthentication = true
+
+	mux := http.NewServeMux()
+	registerRunnerRegistrationHandlers(ctx, mux)
+	mux.HandleFunc("/whoami/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(peerName(r, true)))
+	})
+	ts := httptest.NewServer(authenticateRunners(ctx, mux, true))
+	defer ts.Close()
+
+	whoami := func(credential string, header string, slot ...string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", ts.URL+"/whoami/", nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %s", err)
+		}
+		if credential != "" {
+			req.Header.Set("Authorization", "Bearer "+credential)
+		}
+		if header != "" {
+			req.Header.Set("OmegaUp-Runner-Name", header)
+		}
+		for _, s := range slot {
+			req.Header.Set("OmegaUp-Runner-Slot", s)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %s", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response: %s", err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	token, _, err := ctx.RunnerRegistry.CreateJoinToken(time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create a join token: %s", err)
+	}
+	body, err := json.Marshal(&runnerRegistrationRequest{
+		Token:        token,
+		Name:         "runner-1",
+		Capabilities: []string{"arch:amd64"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal the request: %s", err)
+	}
+	resp, err := ts.Client().Post(ts.URL+"/runner/register/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+	var registration runnerRegistrationResponse
+	err = json.NewDecoder(resp.Body).Decode(&registration)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode the registration: %s", err)
+	}
+
+	// The name comes from the credential, not from the header.
+	if status, name := whoami(registration.Credential, "impostor"); status != http.StatusOK || name != "runner-1" {
+		t.Errorf("whoami() = %d %q, want 200 %q", status, name, "runner-1")
+	}
+	if status, _ := whoami("bogus", ""); status != http.StatusForbidden {
+		t.Errorf("whoami() with a bogus credential = %d, want 403", status)
+	}
+	if status, name := whoami("", "runner-2"); status != http.StatusOK || name != "runner-2" {
+		t.Errorf("whoami() without a credential = %d %q, want 200 %q", status, name, "runner-2")
+	}
+
+	// Each slot is a separate runner.
+	if status, name := whoami(registration.Credential, "", "1"); status != http.StatusOK || name != "runner-1:1" {
+		t.Errorf("whoami() with a slot = %d %q, want 200 %q", status, name, "runner-1:1")
+	}
+	if status, name := whoami("", "runner-2", "invalid"); status != http.StatusOK || name != "runner-2" {
+		t.Errorf("whoami() with an invalid slot = %d %q, want 200 %q", status, name, "runner-2")
+	}
+
+	if err := ctx.RunnerRegistry.SetDisabled("runner-1", true); err != nil {
+		t.Fatalf("Failed to disable the runner: %s", err)
+	}
+	if status, _ := whoami(registration.Credential, ""); status != http.StatusForbidden {
+		t.Errorf("whoami() with a disabled runner = %d, want 403", status)
+	}
+	if err := ctx.RunnerRegistry.SetDisabled("runner-2", true); err != nil {
+		t.Fatalf("Failed to disable the runner: %s", err)
+	}
+	if status, _ := whoami("", "runner-2"); status != http.StatusForbidden {
+		t.Errorf("whoami() with a disabled runner = %d, want 403", status)
+	}
+
+	ctx.Config.Grader.Runners.RequireCredentials = true
+	if status, _ := whoami("", "runner-3"); status != http.StatusUnauthorized {
+		t.Errorf("whoami() without a required credential = %d, want 401", status)
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// newConnectionDialer returns a WebSocket dialer that uses the same TLS
+// configuration as the HTTP client.
+func newConnectionDialer(tlsConfig *tls.Config) *websocket.Dialer {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: time.Duration(10) * time.Second,
+		Subprotocols:     []string{runner.ConnectionSubprotocol},
+	}
+	if tlsConfig != nil {
+		dialer.TLSClientConfig = tlsConfig.Clone()
+		// WebSockets can only be established over HTTP/1.1.
+		dialer.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	}
+	return dialer
+}
+
+// graderConnection is the runner side of a persistent connection with the
+// grader. Runs are pushed by the grader instead of being polled.
+type graderConnection struct {
+	ctx     *common.Context
+	slot    *runnerSlot
+	client  *http.Client
+	dialer  *websocket.Dialer
+	baseURL *url.URL
+	// credential is used to authenticate with the grader instead of the TLS
+	// client certificate, if set.
+	credential string
+	drain      *runnerDrain
+
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+}
+
+// connectionRun is a run that the grader assigned through the persistent
+// connection.
+type connectionRun struct {
+	attemptID uint64
+	cancelled int32
+	// cancel stops grading the run once the grader cancels it.
+	cancel context.CancelFunc
+}
+
+// deadlineWriter extends the write deadline of the connection before every
+// write, so that large messages can take longer than a single ping period as
+// long as they keep making progress.
+type deadlineWriter struct {
+	conn *websocket.Conn
+	w    io.Writer
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(runner.ConnectionPingPeriod))
+	return w.w.Write(p)
+}
+
+func connectionLoop(
+	slot *runnerSlot,
+	wg *sync.WaitGroup,
+	client *http.Client,
+	dialer *websocket.Dialer,
+	baseURL *url.URL,
+	credential string,
+	drain *runnerDrain,
+) {
+	wg.Add(1)
+	defer wg.Done()
+	var sleepTime float32 = 1
+
+	c := &graderConnection{
+		ctx:        slot.ctx,
+		slot:       slot,
+		client:     client,
+		dialer:     dialer,
+		baseURL:    baseURL,
+		credential: credential,
+		drain:      drain,
+	}
+	for {
+		if drain.isDraining() {
+			return
+		}
+		connected, err := c.serve()
+		if c.ctx.Context.Err() != nil || (err == nil && drain.isDraining()) {
+			return
+		}
+		if connected {
+			sleepTime = 1
+		}
+		c.ctx.Log.Error(
+			"Connection with the grader lost",
+			map[string]any{
+				"err": err,
+			},
+		)
+		// Randomized exponential backoff.
+		select {
+		case <-c.ctx.Context.Done():
+			return
+		case <-time.After(time.Duration(rand.Float32()*sleepTime) * time.Second):
+			// continue with the loop.
+		}
+		if sleepTime < 64 {
+			sleepTime *= 2
+		}
+	}
+}
+
+func (c *graderConnection) connectURL() (string, error) {
+	connectURL, err := c.baseURL.Parse("run/connect/")
+	if err != nil {
+		return "", err
+	}
+	switch connectURL.Scheme {
+	case "http":
+		connectURL.Scheme = "ws"
+	case "https":
+		connectURL.Scheme = "wss"
+	}
+	return connectURL.String(), nil
+}
+
+func (c *graderConnection) extendReadDeadline() error {
+	return c.conn.SetReadDeadline(time.Now().Add(2 * runner.ConnectionPingPeriod))
+}
+
+// send writes a message to the grader. If files is not nil, its contents are
+// streamed as a binary message right after the message.
+func (c *graderConnection) send(message *runner.ConnectionMessage, files io.Reader) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(runner.ConnectionPingPeriod))
+	if err := c.conn.WriteJSON(message); err != nil {
+		return err
+	}
+	if files == nil {
+		return nil
+	}
+	w, err := c.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(&deadlineWriter{conn: c.conn, w: w}, files); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// closeNormally lets the grader know that the runner is closing the
+// connection on purpose.
+func (c *graderConnection) closeNormally() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(runner.ConnectionPingPeriod),
+	)
+}
+
+func (c *graderConnection) sendReady() error {
+	if c.drain.isDraining() {
+		return nil
+	}
+	return c.send(&runner.ConnectionMessage{
+		Type:        runner.ConnectionMessageTypeReady,
+		InputHashes: inputManager.Hashes(),
+	}, nil)
+}
+
+// sendReserve asks the grader to reserve the next run while the current one
+// is being graded, so that its input can be prefetched.
+func (c *graderConnection) sendReserve(ctx *common.Context) {
+	if !ctx.Config.Runner.PrefetchNextRun || c.drain.isDraining() {
+		return
+	}
+	if err := c.send(&runner.ConnectionMessage{
+		Type:        runner.ConnectionMessageTypeReady,
+		InputHashes: inputManager.Hashes(),
+		Reserve:     true,
+	}, nil); err != nil {
+		ctx.Log.Error(
+			"Failed to reserve the next run",
+			map[string]any{
+				"err": err,
+			},
+		)
+	}
+}
+
+// sendDraining lets the grader know that the runner is draining, so that it
+// stops dispatching runs to it.
+func (c *graderConnection) sendDraining() {
+	if err := c.send(&runner.ConnectionMessage{
+		Type: runner.ConnectionMessageTypeDraining,
+	}, nil); err != nil {
+		c.ctx.Log.Error(
+			"Failed to report that the runner is draining",
+			map[string]any{
+				"err": err,
+			},
+		)
+	}
+}
+
+// readLoop sends all the messages received from the grader to the messages
+// channel, which is closed once the connection can no longer be read or done
+// is closed.
+func (c *graderConnection) readLoop(
+	messages chan<- *runner.ConnectionMessage,
+	done <-chan struct{},
+	readErr *error,
+) {
+	defer close(messages)
+	for {
+		var message runner.ConnectionMessage
+		if err := c.conn.ReadJSON(&message); err != nil {
+			*readErr = err
+			return
+		}
+		c.extendReadDeadline()
+		select {
+		case messages <- &message:
+		case <-done:
+			return
+		}
+	}
+}
+
+// serve connects with the grader and grades the runs that it sends until the
+// connection is lost, the runner is shutting down, or the runner finished
+// draining. It returns whether the connection was successfully established.
+func (c *graderConnection) serve() (bool, error) {
+	connectURL, err := c.connectURL()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create the connection URL")
+	}
+	header := http.Header{}
+	if c.ctx.Config.Runner.Hostname != "" {
+		header.Add("OmegaUp-Runner-Name", c.ctx.Config.Runner.Hostname)
+	}
+	if c.ctx.Config.Runner.PublicIP != "" {
+		header.Add("OmegaUp-Runner-PublicIP", c.ctx.Config.Runner.PublicIP)
+	}
+	if c.credential != "" {
+		header.Add("Authorization", "Bearer "+c.credential)
+	}
+	c.slot.addHeaders(header)
+	conn, _, err := c.dialer.DialContext(c.ctx.Context, connectURL, header)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to connect to the grader")
+	}
+	defer conn.Close()
+	c.conn = conn
+
+	c.extendReadDeadline()
+	conn.SetPingHandler(func(data string) error {
+		c.extendReadDeadline()
+		return conn.WriteControl(
+			websocket.PongMessage,
+			[]byte(data),
+			time.Now().Add(runner.ConnectionPingPeriod),
+		)
+	})
+	var readErr error
+	messages := make(chan *runner.ConnectionMessage)
+	done := make(chan struct{})
+	defer close(done)
+	go c.readLoop(messages, done, &readErr)
+
+	c.ctx.Log.Info(
+		"Connected to the grader",
+		map[string]any{
+			"url": connectURL,
+		},
+	)
+
+	if err := c.sendReady(); err != nil {
+		return true, err
+	}
+
+	// next is the run that was reserved while current is being graded.
+	var current, next *connectionRun
+	var nextRun *common.Run
+	finished := make(chan error, 1)
+	startRun := func(run *common.Run, r *connectionRun) {
+		current = r
+		// The run is only cancelled by the grader, and not when the runner
+		// shuts down, so that its results are not lost.
+		runContext, cancel := context.WithCancel(context.Background())
+		r.cancel = cancel
+		go func(ctx *common.Context) {
+			defer cancel()
+			finished <- c.gradeRun(ctx, run, r)
+		}(c.ctx.Wrap(runContext))
+	}
+	drain := c.drain.done()
+	for {
+		select {
+		case <-c.ctx.Context.Done():
+			if current != nil {
+				// Let the current run finish so that its results are not lost.
+				<-finished
+			}
+			c.closeNormally()
+			return true, nil
+
+		case <-drain:
+			// The drain only needs to be reported once.
+			drain = nil
+			c.sendDraining()
+			if current == nil {
+				c.closeNormally()
+				return true, nil
+			}
+
+		case err := <-finished:
+			current = nil
+			if err != nil {
+				return true, err
+			}
+			if next != nil {
+				// The reserved run is graded even if the runner is draining,
+				// since the grader already handed it off.
+				startRun(nextRun, next)
+				next, nextRun = nil, nil
+				continue
+			}
+			if c.drain.isDraining() {
+				if drain != nil {
+					c.sendDraining()
+				}
+				c.closeNormally()
+				return true, nil
+			}
+			if err := c.sendReady(); err != nil {
+				return true, err
+			}
+
+		case message, ok := <-messages:
+			if !ok {
+				if current != nil {
+					<-finished
+				}
+				return true, readErr
+			}
+			switch message.Type {
+			case runner.ConnectionMessageTypeAssignment:
+				if next != nil || message.Run == nil {
+					c.ctx.Log.Error(
+						"Unexpected run assignment",
+						map[string]any{
+							"attempt_id": message.AttemptID,
+						},
+					)
+					continue
+				}
+				if current != nil {
+					// This run was reserved while the current one is being
+					// graded.
+					next = &connectionRun{attemptID: message.AttemptID}
+					nextRun = message.Run
+					go prefetchInput(c.ctx, c.slot, c.client, nextRun)
+					continue
+				}
+				startRun(message.Run, &connectionRun{attemptID: message.AttemptID})
+
+			case runner.ConnectionMessageTypeCancel:
+				if current != nil && current.attemptID == message.AttemptID {
+					c.ctx.Log.Warn(
+						"The grader cancelled the run",
+						map[string]any{
+							"attempt_id": message.AttemptID,
+						},
+					)
+					atomic.StoreInt32(&current.cancelled, 1)
+					current.cancel()
+				}
+				if next != nil && next.attemptID == message.AttemptID {
+					c.ctx.Log.Warn(
+						"The grader cancelled the reserved run",
+						map[string]any{
+							"attempt_id": message.AttemptID,
+						},
+					)
+					next, nextRun = nil, nil
+				}
+
+			case runner.ConnectionMessageTypeReloadConfig:
+				ctx, err := reloadContext(c.ctx)
+				if err != nil {
+					c.ctx.Log.Error(
+						"Failed to reload the configuration",
+						map[string]any{
+							"err": err,
+						},
+					)
+					continue
+				}
+				// The run that is currently being graded keeps the previous
+				// configuration.
+				c.ctx = c.slot.configure(ctx)
+				c.ctx.Log.Info("Configuration reloaded", nil)
+
+			case runner.ConnectionMessageTypeDrain:
+				c.drain.start(c.ctx, "grader")
+
+			default:
+				c.ctx.Log.Warn(
+					"Unknown message from the grader",
+					map[string]any{
+						"type": message.Type,
+					},
+				)
+			}
+		}
+	}
+}
+
+// gradeRun grades the run and sends its results over the connection, unless
+// the grader cancelled it in the meantime. files.zip is written to a temporary
+// file and streamed from it, so that it is never completely held in memory.
+func (c *graderConnection) gradeRun(
+	parentCtx *common.Context,
+	run *common.Run,
+	current *connectionRun,
+) error {
+	ctx := parentCtx.DebugContext(nil)
+	ctx.Transaction = ctx.Tracing.StartTransaction("run")
+	defer ctx.Transaction.End()
+
+	heartbeat := startHeartbeat(
+		ctx,
+		time.Duration(ctx.Config.Runner.HeartbeatInterval),
+		func(progress *runner.RunProgress) error {
+			return c.send(&runner.ConnectionMessage{
+				Type:      runner.ConnectionMessageTypeHeartbeat,
+				AttemptID: current.attemptID,
+				Progress:  progress,
+			}, nil)
+		},
+	)
+
+	files, err := os.CreateTemp(ctx.Config.Runner.RuntimePath, ".files.*.zip")
+	if err != nil {
+		heartbeat.stop()
+		return errors.Wrap(err, "failed to create the files.zip temporary file")
+	}
+	defer os.Remove(files.Name())
+	defer files.Close()
+
+	result, err := gradeRun(
+		ctx,
+		c.slot,
+		c.client,
+		run,
+		files,
+		heartbeat.update,
+		func() {
+			c.sendReserve(parentCtx)
+		},
+	)
+	heartbeat.stop()
+	if err != nil {
+		// Still try to send the details
+		ctx.Log.Error(
+			"Error grading run",
+			map[string]any{
+				"err": err,
+			},
+		)
+		result = runner.NewRunResult("JE", run.MaxScore)
+	}
+
+	if *noop {
+		runner.NoopSandboxFixupResult(result)
+	}
+
+	if atomic.LoadInt32(&current.cancelled) != 0 {
+		return nil
+	}
+
+	message := &runner.ConnectionMessage{
+		Type:      runner.ConnectionMessageTypeResult,
+		AttemptID: current.attemptID,
+		Result:    result,
+		Logs:      string(ctx.LogBuffer()),
+	}
+	var filesReader io.Reader
+	if size, err := files.Seek(0, io.SeekCurrent); err != nil {
+		return errors.Wrap(err, "failed to get the size of files.zip")
+	} else if size > 0 {
+		if _, err := files.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "failed to rewind files.zip")
+		}
+		message.HasFiles = true
+		filesReader = files
+	}
+	return c.send(message, filesReader)
+}
+
+// reloadContext reads the configuration file again and returns a copy of the
+// context that uses it.
+func reloadContext(ctx *common.Context) (*common.Context, error) {
+	f, err := os.Open(*configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, err := common.NewConfig(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the configuration")
+	}
+	// The public IP is not part of the configuration file.
+	config.Runner.PublicIP = ctx.Config.Runner.PublicIP
+
+	reloaded := *ctx
+	reloaded.Config = *config
+	return &reloaded, nil
+}
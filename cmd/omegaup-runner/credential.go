@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/omegaup/quark/common"
+
+	"github.com/pkg/errors"
+)
+
+type registrationRequest struct {
+	Token        string   `json:"token"`
+	Name         string   `json:"name"`
+	PublicIP     string   `json:"public_ip"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type registrationResponse struct {
+	Name       string `json:"name"`
+	Credential string `json:"credential"`
+}
+
+// credentialTransport is an http.RoundTripper that authenticates all requests
+// with the runner's credential.
+type credentialTransport struct {
+	base       http.RoundTripper
+	credential string
+}
+
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.credential)
+	return t.base.RoundTrip(req)
+}
+
+func credentialPath(ctx *common.Context) string {
+	if ctx.Config.Runner.CredentialFile != "" {
+		return ctx.Config.Runner.CredentialFile
+	}
+	return path.Join(ctx.Config.Runner.RuntimePath, "credential")
+}
+
+// usesCredential returns whether the runner authenticates with a credential
+// instead of a TLS client certificate.
+func usesCredential(ctx *common.Context) bool {
+	if ctx.Config.Runner.JoinToken != "" {
+		return true
+	}
+	_, err := os.Stat(credentialPath(ctx))
+	return err == nil
+}
+
+// runnerCapabilities returns what the grader is told about this runner when
+// it registers.
+func runnerCapabilities(ctx *common.Context) []string {
+	capabilities := []string{
+		fmt.Sprintf("arch:%s", runtime.GOARCH),
+		fmt.Sprintf("cpus:%d", runtime.NumCPU()),
+	}
+	if *noop {
+		capabilities = append(capabilities, "sandbox:noop")
+	} else {
+		capabilities = append(capabilities, "sandbox:omegajail")
+	}
+	if ctx.Config.Runner.PersistentConnection {
+		capabilities = append(capabilities, "persistent-connection")
+	}
+	return capabilities
+}
+
+// loadCredential returns the credential that the runner uses to authenticate
+// with the grader. If there is none yet and a join token was configured, the
+// runner registers with the grader to obtain one and stores it. An empty
+// credential means that the runner authenticates with its TLS client
+// certificate.
+func loadCredential(ctx *common.Context, client *http.Client, baseURL *url.URL) (string, error) {
+	filename := credentialPath(ctx)
+	contents, err := os.ReadFile(filename)
+	if err == nil {
+		return strings.TrimSpace(string(contents)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "failed to read the credential")
+	}
+	if ctx.Config.Runner.JoinToken == "" {
+		return "", nil
+	}
+
+	name := ctx.Config.Runner.Hostname
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			return "", errors.Wrap(err, "failed to get the hostname")
+		}
+	}
+	registerURL, err := baseURL.Parse("runner/register/")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create the registration URL")
+	}
+	body, err := json.Marshal(&registrationRequest{
+		Token:        ctx.Config.Runner.JoinToken,
+		Name:         name,
+		PublicIP:     ctx.Config.Runner.PublicIP,
+		Capabilities: runnerCapabilities(ctx),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal the registration request")
+	}
+	resp, err := client.Post(registerURL.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to register with the grader")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("the grader rejected the registration: %d", resp.StatusCode)
+	}
+	var response registrationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", errors.Wrap(err, "failed to parse the registration response")
+	}
+	if err := os.WriteFile(filename, []byte(response.Credential), 0600); err != nil {
+		return "", errors.Wrap(err, "failed to store the credential")
+	}
+	ctx.Log.Info(
+		"Registered with the grader",
+		map[string]any{
+			"name": response.Name,
+		},
+	)
+	return response.Credential, nil
+}
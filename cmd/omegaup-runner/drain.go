@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/omegaup/quark/common"
+
+	"github.com/pkg/errors"
+)
+
+// drainRequestTimeout is how long a draining runner waits for the grader to
+// answer a pending request for a run, once it reports that it is draining,
+// before cancelling it.
+var drainRequestTimeout = 30 * time.Second
+
+// errDrainRequested is returned when the grader asks the runner to drain
+// instead of sending it a run.
+var errDrainRequested = errors.New("the grader requested the runner to drain")
+
+// runnerDrain keeps track of whether the runner is draining. A draining runner
+// finishes the run that it is currently grading and uploads its results, but
+// does not ask for any more runs.
+type runnerDrain struct {
+	once     sync.Once
+	draining chan struct{}
+}
+
+func newRunnerDrain() *runnerDrain {
+	return &runnerDrain{
+		draining: make(chan struct{}),
+	}
+}
+
+// start makes the runner drain. It is safe to call it more than once.
+func (d *runnerDrain) start(ctx *common.Context, reason string) {
+	d.once.Do(func() {
+		ctx.Log.Info(
+			"Draining runner",
+			map[string]any{
+				"reason": reason,
+			},
+		)
+		close(d.draining)
+	})
+}
+
+// done returns a channel that is closed once the runner starts draining.
+func (d *runnerDrain) done() <-chan struct{} {
+	return d.draining
+}
+
+// isDraining returns whether the runner started draining.
+func (d *runnerDrain) isDraining() bool {
+	select {
+	case <-d.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// reportDraining lets the grader know that the runner is draining, so that it
+// is no longer considered part of the pool.
+func reportDraining(
+	ctx *common.Context,
+	slot *runnerSlot,
+	client *http.Client,
+	baseURL *url.URL,
+) error {
+	drainingURL, err := baseURL.Parse("runner/draining/")
+	if err != nil {
+		return errors.Wrap(err, "failed to create the draining URL")
+	}
+	req, err := http.NewRequest("POST", drainingURL.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the draining request")
+	}
+	if ctx.Config.Runner.Hostname != "" {
+		req.Header.Add("OmegaUp-Runner-Name", ctx.Config.Runner.Hostname)
+	}
+	slot.addHeaders(req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("the grader rejected the draining report: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// registerDrainHandler adds an administrative endpoint to make the runner
+// drain with a local POST request, and to query whether it is draining with a
+// GET request.
+func registerDrainHandler(ctx *common.Context, mux *http.ServeMux, drain *runnerDrain) {
+	mux.HandleFunc("/drain/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST":
+			// The metrics port might be reachable from other hosts, so only
+			// local requests are allowed to drain the runner.
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			drain.start(ctx, "admin")
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]any{
+			"draining": drain.isDraining(),
+		})
+	})
+}
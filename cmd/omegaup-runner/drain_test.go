@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+)
+
+func TestFetchRunDrain(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		drainingCode int
+		wantRun      bool
+	}{
+		{
+			// The grader had already dequeued a run when the runner started
+			// draining, so the runner still gets it.
+			name:         "pending request is answered",
+			drainingCode: http.StatusOK,
+			wantRun:      true,
+		},
+		{
+			name:         "pending request is cancelled",
+			drainingCode: http.StatusInternalServerError,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newSlotsTestContext(t)
+			inputManager = common.NewInputManager(ctx)
+			slots, err := newRunnerSlots(ctx, &runner.NoopSandbox{})
+			if err != nil {
+				t.Fatalf("newRunnerSlots() failed: %v", err)
+			}
+
+			drained := make(chan struct{})
+			mux := http.NewServeMux()
+			mux.HandleFunc("/runner/draining/", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.drainingCode)
+				if tc.drainingCode == http.StatusOK {
+					close(drained)
+				}
+			})
+			mux.HandleFunc("/run/request/", func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-drained:
+				case <-r.Context().Done():
+					return
+				}
+				json.NewEncoder(w).Encode(&common.Run{AttemptID: 1})
+			})
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			baseURL, err := url.Parse(ts.URL + "/")
+			if err != nil {
+				t.Fatalf("Failed to parse URL: %v", err)
+			}
+
+			drain := newRunnerDrain()
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				drain.start(ctx, "test")
+			}()
+			run, _, err := fetchRun(ctx, slots[0], ts.Client(), baseURL, drain.done(), false)
+			if tc.wantRun {
+				if err != nil || run == nil || run.AttemptID != 1 {
+					t.Errorf("fetchRun() = %v, %v, want the dequeued run", run, err)
+				}
+			} else if err == nil {
+				t.Errorf("fetchRun() = %v, want the request to be cancelled", run)
+			}
+		})
+	}
+}
@@ -34,6 +34,7 @@ import (
 	"github.com/omegaup/quark/runner/ci"
 
 	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/gorilla/websocket"
 	"github.com/newrelic/go-agent/v3/newrelic"
 	errors "github.com/pkg/errors"
 	"golang.org/x/net/http2"
@@ -54,6 +55,10 @@ var (
 		"With -oneshot={run,ci}, the path to the directory to copy the results to.")
 	outputsDirectory = flag.String("outputs", "",
 		"With -oneshot=ci and an output generator, the path to the directory to copy the .out files to.")
+	polygon = flag.Bool("polygon", false,
+		"With -oneshot=ci, treat -input as an unpacked Polygon package instead of a checkout of a problem.")
+	reportFormat = flag.String("format", "json",
+		"With -oneshot=ci, the format of the report. Valid values are 'json', 'junit', and 'tap'.")
 	debug = flag.Bool("debug", false, "Enables debug in oneshot mode.")
 
 	version    = flag.Bool("version", false, "Print the version and exit")
@@ -62,8 +67,9 @@ var (
 	configPath = flag.String("config", "/etc/omegaup/runner/config.json",
 		"Runner configuration file")
 	globalContext atomic.Value
-	ioLock        sync.Mutex
+	ioLock        sync.RWMutex
 	inputManager  *common.InputManager
+	binaryCache   *runner.BinaryCache
 	sandbox       runner.Sandbox
 
 	// ProgramVersion is the version of the code from which the binary was built from.
@@ -407,6 +413,31 @@ func runOneshotCI(ctx *common.Context, sandbox runner.Sandbox) *ci.Report {
 		report.ReportError = &ci.ReportError{Error: err}
 		return report
 	}
+	if *polygon {
+		var warnings []string
+		problemFiles, warnings, err = common.NewProblemFilesFromPolygon(problemFiles)
+		for _, warning := range warnings {
+			ctx.Log.Warn(
+				"Polygon feature not imported",
+				map[string]any{
+					"path":    *input,
+					"warning": warning,
+				},
+			)
+		}
+		if err != nil {
+			ctx.Log.Error(
+				"Error importing the Polygon package",
+				map[string]any{
+					"path": *input,
+					"err":  err,
+				},
+			)
+			report.State = ci.StateSkipped
+			report.ReportError = &ci.ReportError{Error: err}
+			return report
+		}
+	}
 	runConfig, err := ci.NewRunConfig(problemFiles, *outputsDirectory != "")
 	if err != nil {
 		ctx.Log.Error(
@@ -511,6 +542,8 @@ func runOneshotCI(ctx *common.Context, sandbox runner.Sandbox) *ci.Report {
 				)
 			}
 
+			runConfig.OutGeneratorConfig.Result = result
+
 			for pathCaseName := range runConfig.OutGeneratorConfig.Input.Cases {
 				if strings.HasPrefix(pathCaseName, "cases/") {
 					srcPath := path.Join(runRoot, fmt.Sprintf("%s.out", pathCaseName))
@@ -615,6 +648,29 @@ func runOneshotCI(ctx *common.Context, sandbox runner.Sandbox) *ci.Report {
 				testConfig.Test.Duration = &duration
 			}()
 
+			if testConfig.Stress != nil {
+				if err := ci.RunStressTest(
+					testConfig,
+					newOneshotStressStageRunner(
+						ctx,
+						sandbox,
+						report.Problem,
+						uint64(len(runConfig.TestConfigs)+1),
+					),
+				); err != nil {
+					ctx.Log.Error(
+						"Error running stress test",
+						map[string]any{
+							"test": testConfig,
+							"err":  err,
+						},
+					)
+					testConfig.Test.State = ci.StateError
+					testConfig.Test.ReportError = &ci.ReportError{Error: err}
+				}
+				return
+			}
+
 			factory, err := common.NewLiteralInputFactory(
 				testConfig.Input,
 				ctx.Config.Grader.RuntimePath,
@@ -708,9 +764,94 @@ func runOneshotCI(ctx *common.Context, sandbox runner.Sandbox) *ci.Report {
 		})()
 		report.Tests = append(report.Tests, testConfig.Test)
 	}
+	report.AnalyzeTimeLimits(runConfig)
+	report.AnalyzeTestSuiteStrength()
 	return report
 }
 
+// newOneshotStressStageRunner returns a ci.StressStageRunner that grades each
+// stage of a stress test locally. Each stage uses a new attempt ID, starting
+// from attemptID.
+func newOneshotStressStageRunner(
+	ctx *common.Context,
+	sandbox runner.Sandbox,
+	problemName string,
+	attemptID uint64,
+) ci.StressStageRunner {
+	return func(
+		solution *ci.SolutionConfig,
+		input *common.LiteralInput,
+	) (*runner.RunResult, map[string]string, error) {
+		factory, err := common.NewLiteralInputFactory(
+			input,
+			ctx.Config.Grader.RuntimePath,
+			common.LiteralPersistRunner,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		run := common.Run{
+			InputHash:   factory.Hash(),
+			AttemptID:   attemptID,
+			MaxScore:    big.NewRat(1, 1),
+			Source:      solution.Source,
+			Language:    solution.Language,
+			ProblemName: problemName,
+		}
+		attemptID++
+		if *debug {
+			run.Debug = true
+		}
+
+		inputRef, err := inputManager.Add(
+			run.InputHash,
+			factory,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer inputRef.Release()
+
+		runRoot := path.Join(
+			ctx.Config.Runner.RuntimePath,
+			"grade",
+			strconv.FormatUint(run.AttemptID, 10),
+		)
+		if !ctx.Config.Runner.PreserveFiles {
+			defer os.RemoveAll(runRoot)
+		}
+
+		result, err := runner.Grade(ctx, nil, &run, inputRef.Input, sandbox)
+		if err != nil {
+			return nil, nil, err
+		}
+		outputs := make(map[string]string)
+		for caseName := range input.Cases {
+			contents, err := os.ReadFile(path.Join(runRoot, fmt.Sprintf("%s.out", caseName)))
+			if err != nil {
+				continue
+			}
+			outputs[caseName] = string(contents)
+		}
+		return result, outputs, nil
+	}
+}
+
+// writeReport writes the CI report in the requested format.
+func writeReport(w io.Writer, report *ci.Report, format string) error {
+	switch format {
+	case "junit":
+		return ci.WriteJUnit(w, report)
+	case "tap":
+		return ci.WriteTAP(w, report)
+	default:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+}
+
 func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 	flag.Parse()
@@ -800,14 +941,22 @@ func main() {
 			if *outputsDirectory != "" {
 				ctx.Config.Runner.PreserveFiles = true
 			}
+			if *reportFormat != "json" && *reportFormat != "junit" && *reportFormat != "tap" {
+				ctx.Log.Error(
+					"Unknown report format",
+					map[string]any{
+						"format": *reportFormat,
+					},
+				)
+				os.Exit(ci.StateError.ExitCode())
+			}
 			report := runOneshotCI(ctx, sandbox)
-			encoder := json.NewEncoder(os.Stdout)
-			encoder.SetIndent("", "  ")
-			if err := encoder.Encode(report); err != nil {
+			if err := writeReport(os.Stdout, report, *reportFormat); err != nil {
 				ctx.Log.Error(
-					"Failed to encode JSON",
+					"Failed to write the report",
 					map[string]any{
-						"err": err,
+						"format": *reportFormat,
+						"err":    err,
 					},
 				)
 			}
@@ -848,6 +997,7 @@ func main() {
 					}
 				}
 			}
+			os.Exit(report.State.ExitCode())
 		} else {
 			ctx.Log.Error(
 				"Unknown oneshot mode",
@@ -864,6 +1014,22 @@ func main() {
 		runner.NewCachedInputFactory(inputPath),
 		&ioLock,
 	)
+	if ctx.Config.Runner.BinaryCacheSize > 0 {
+		cache, err := runner.NewBinaryCache(
+			path.Join(ctx.Config.Runner.RuntimePath, "binaries"),
+			ctx.Config.Runner.BinaryCacheSize,
+		)
+		if err != nil {
+			ctx.Log.Error(
+				"Failed to create the binary cache, binaries will not be cached",
+				map[string]any{
+					"err": err,
+				},
+			)
+		} else {
+			binaryCache = cache
+		}
+	}
 	transport := &http.Transport{
 		Dial: (&net.Dialer{
 			Timeout:   30 * time.Second,
@@ -879,17 +1045,21 @@ func main() {
 		}
 		certPool := x509.NewCertPool()
 		certPool.AppendCertsFromPEM(cert)
-		keyPair, err := tls.LoadX509KeyPair(
-			ctx.Config.TLS.CertFile,
-			ctx.Config.TLS.KeyFile,
-		)
 		transport.TLSClientConfig = &tls.Config{
-			Certificates: []tls.Certificate{keyPair},
-			RootCAs:      certPool,
-			ClientAuth:   tls.RequireAndVerifyClientCert,
+			RootCAs:    certPool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
 		}
-		if err != nil {
-			panic(err)
+		// Runners that authenticate with a credential don't need a client
+		// certificate.
+		if !usesCredential(ctx) {
+			keyPair, err := tls.LoadX509KeyPair(
+				ctx.Config.TLS.CertFile,
+				ctx.Config.TLS.KeyFile,
+			)
+			if err != nil {
+				panic(err)
+			}
+			transport.TLSClientConfig.Certificates = []tls.Certificate{keyPair}
 		}
 		if err := http2.ConfigureTransport(transport); err != nil {
 			panic(err)
@@ -903,35 +1073,93 @@ func main() {
 		panic(err)
 	}
 
+	credential, err := loadCredential(ctx, client, baseURL)
+	if err != nil {
+		ctx.Log.Error(
+			"Failed to obtain the runner credential",
+			map[string]any{
+				"err": err,
+			},
+		)
+		os.Exit(1)
+	}
+	if credential != "" {
+		client.Transport = &credentialTransport{
+			base:       transport,
+			credential: credential,
+		}
+	}
+
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
 	cancelContext, cancel := context.WithCancel(ctx.Context)
 	ctx.Context = cancelContext
 
-	setupMetrics(ctx)
+	drain := newRunnerDrain()
+	setupMetrics(ctx, drain)
+
+	slots, err := newRunnerSlots(ctx, sandbox)
+	if err != nil {
+		ctx.Log.Error(
+			"Failed to create the runner slots",
+			map[string]any{
+				"err": err,
+			},
+		)
+		os.Exit(1)
+	}
+	if !*noop {
+		slots = validateSlots(ctx, slots)
+	}
+
 	var wg sync.WaitGroup
 	if !*noop {
 		// Only run the benchmark loop if the sandbox is actually running.
 		// Otherwise the results are moot.
-		go benchmarkLoop(ctx, &wg)
+		go benchmarkLoop(slots[0], &wg, drain)
+	}
+	var dialer *websocket.Dialer
+	if ctx.Config.Runner.PersistentConnection {
+		dialer = newConnectionDialer(transport.TLSClientConfig)
+	}
+	for _, slot := range slots {
+		if ctx.Config.Runner.PersistentConnection {
+			go connectionLoop(slot, &wg, client, dialer, baseURL, credential, drain)
+		} else {
+			go runnerLoop(slot, &wg, client, baseURL, drain)
+		}
 	}
-	go runnerLoop(ctx, &wg, client, baseURL)
 
 	ctx.Log.Info(
 		"omegaUp runner ready",
 		map[string]any{
 			"version": ProgramVersion,
+			"slots":   len(slots),
 		},
 	)
 	daemon.SdNotify(false, "READY=1")
 
-	<-stopChan
+	sig := <-stopChan
 
 	daemon.SdNotify(false, "STOPPING=1")
 	ctx.Log.Info("Shutting down server...", nil)
 
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	if sig == syscall.SIGTERM {
+		// Let the current run finish and upload its results before stopping.
+		// A second signal stops the runner right away.
+		drain.start(ctx, "signal")
+		select {
+		case <-stopped:
+		case <-stopChan:
+		}
+	}
 	cancel()
-	wg.Wait()
+	<-stopped
 
 	ctx.Close()
 	ctx.Log.Info("Server gracefully stopped.", nil)
@@ -24,6 +24,18 @@ var (
 			Help:      "Number of validator errors",
 			Name:      "validator_errors",
 		}),
+		"runner_binary_cache_hits": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "quark",
+			Subsystem: "runner",
+			Help:      "Number of problemsetter binaries reused from the cache",
+			Name:      "binary_cache_hits",
+		}),
+		"runner_binary_cache_misses": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "quark",
+			Subsystem: "runner",
+			Help:      "Number of problemsetter binaries that had to be compiled",
+			Name:      "binary_cache_misses",
+		}),
 	}
 
 	gauges = map[string]prometheus.Gauge{
@@ -128,7 +140,7 @@ func (p *prometheusMetrics) CounterAdd(name string, value float64) {
 func (p *prometheusMetrics) SummaryObserve(name string, value float64) {
 }
 
-func setupMetrics(ctx *common.Context) {
+func setupMetrics(ctx *common.Context, drain *runnerDrain) {
 	for _, gauge := range gauges {
 		prometheus.MustRegister(gauge)
 	}
@@ -151,6 +163,7 @@ func setupMetrics(ctx *common.Context) {
 
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
+	registerDrainHandler(ctx, metricsMux, drain)
 	go func() {
 		addr := fmt.Sprintf(":%d", ctx.Config.Metrics.Port)
 		err := http.ListenAndServe(addr, metricsMux)
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,14 +22,17 @@ import (
 	"github.com/pkg/errors"
 )
 
-func benchmarkLoop(ctx *common.Context, wg *sync.WaitGroup) {
+func benchmarkLoop(slot *runnerSlot, wg *sync.WaitGroup, drain *runnerDrain) {
 	wg.Add(1)
 	defer wg.Done()
+	ctx := slot.ctx
 	for {
+		// The benchmark takes the I/O lock, so it waits until no other slot is
+		// grading a run.
 		results, err := runner.RunHostBenchmark(
 			ctx,
 			inputManager,
-			sandbox,
+			slot.sandbox,
 			&ioLock,
 		)
 		if err != nil {
@@ -49,19 +55,67 @@ func benchmarkLoop(ctx *common.Context, wg *sync.WaitGroup) {
 		select {
 		case <-ctx.Context.Done():
 			return
+		case <-drain.done():
+			return
 		case <-time.After(time.Duration(1) * time.Minute):
 			// continue with the loop.
 		}
 	}
 }
 
-func runnerLoop(ctx *common.Context, wg *sync.WaitGroup, client *http.Client, baseURL *url.URL) {
+func runnerLoop(
+	slot *runnerSlot,
+	wg *sync.WaitGroup,
+	client *http.Client,
+	baseURL *url.URL,
+	drain *runnerDrain,
+) {
 	wg.Add(1)
 	defer wg.Done()
+	ctx := slot.ctx
 	var sleepTime float32 = 1
 
+	// next is the pending request for the next run, which is made while the
+	// current run is being graded.
+	var next <-chan *runRequest
 	for {
-		if err := processRun(ctx, client, baseURL); err != nil {
+		if next == nil {
+			if drain.isDraining() {
+				if err := reportDraining(ctx, slot, client, baseURL); err != nil {
+					ctx.Log.Error(
+						"Failed to report that the runner is draining",
+						map[string]any{
+							"err": err,
+						},
+					)
+				}
+				return
+			}
+			next = requestRun(ctx, slot, client, baseURL, drain.done(), false)
+		}
+		request := <-next
+		next = nil
+		err := request.err
+		if err == nil {
+			var reserveNext func()
+			if ctx.Config.Runner.PrefetchNextRun && !drain.isDraining() {
+				// The next run is reserved once the input of this one is ready,
+				// so that its input is downloaded while this run is graded.
+				reserveNext = func() {
+					next = requestRun(ctx, slot, client, baseURL, drain.done(), true)
+				}
+			}
+			err = processRun(ctx, slot, client, baseURL, request, reserveNext)
+		}
+		if err != nil {
+			if drain.isDraining() {
+				// The request for a run was interrupted by the drain.
+				continue
+			}
+			if err == errDrainRequested {
+				drain.start(ctx, "grader")
+				continue
+			}
 			if err, ok := err.(net.Error); ok && err.Timeout() {
 				// Timeouts are expected. Just retry.
 				sleepTime = 1
@@ -168,56 +222,209 @@ func (cb *channelBuffer) Read(buf []byte) (int, error) {
 	return written, nil
 }
 
-func processRun(
-	parentCtx *common.Context,
+// runRequest is the outcome of asking the grader for a run.
+type runRequest struct {
+	run    *common.Run
+	header http.Header
+	err    error
+}
+
+// requestRun asks the grader for a run in the background. If reserve is set,
+// the slot is still grading another run, so the grader only reserves the new
+// run for it, and its input is fetched while the other run is being graded.
+func requestRun(
+	ctx *common.Context,
+	slot *runnerSlot,
 	client *http.Client,
 	baseURL *url.URL,
-) error {
+	drain <-chan struct{},
+	reserve bool,
+) <-chan *runRequest {
+	result := make(chan *runRequest, 1)
+	go func() {
+		run, header, err := fetchRun(ctx, slot, client, baseURL, drain, reserve)
+		if err == nil && reserve {
+			prefetchInput(ctx, slot, client, run)
+		}
+		result <- &runRequest{
+			run:    run,
+			header: header,
+			err:    err,
+		}
+	}()
+	return result
+}
+
+func fetchRun(
+	ctx *common.Context,
+	slot *runnerSlot,
+	client *http.Client,
+	baseURL *url.URL,
+	drain <-chan struct{},
+	reserve bool,
+) (*common.Run, http.Header, error) {
 	requestURL, err := baseURL.Parse("run/request/")
 	if err != nil {
 		panic(err)
 	}
-	req, err := http.NewRequestWithContext(parentCtx.Context, "GET", requestURL.String(), nil)
+	if reserve {
+		requestURL.RawQuery = url.Values{"reserve": []string{"true"}}.Encode()
+	}
+	requestCtx, cancelRequest := context.WithCancel(ctx.Context)
+	defer cancelRequest()
+	req, err := http.NewRequestWithContext(requestCtx, "GET", requestURL.String(), nil)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if parentCtx.Config.Runner.Hostname != "" {
-		req.Header.Add("OmegaUp-Runner-Name", parentCtx.Config.Runner.Hostname)
+	if ctx.Config.Runner.Hostname != "" {
+		req.Header.Add("OmegaUp-Runner-Name", ctx.Config.Runner.Hostname)
 	}
-	if parentCtx.Config.Runner.PublicIP != "" {
-		req.Header.Add("OmegaUp-Runner-PublicIP", parentCtx.Config.Runner.PublicIP)
+	if ctx.Config.Runner.PublicIP != "" {
+		req.Header.Add("OmegaUp-Runner-PublicIP", ctx.Config.Runner.PublicIP)
 	}
+	slot.addHeaders(req.Header)
+	// Let the grader know which inputs are already cached so that it can prefer
+	// sending runs that don't need to download anything.
+	req.Header.Add("OmegaUp-Runner-Input-Hashes", strings.Join(inputManager.Hashes(), ","))
+	requested := make(chan struct{})
+	go func() {
+		select {
+		case <-drain:
+		case <-requested:
+			return
+		}
+		// Cancelling the request could orphan a run that the grader already
+		// dequeued for this runner, so the grader is asked to answer it
+		// instead. The request is only cancelled if that does not work.
+		if err := reportDraining(ctx, slot, client, baseURL); err != nil {
+			ctx.Log.Error(
+				"Failed to report that the runner is draining",
+				map[string]any{
+					"err": err,
+				},
+			)
+			cancelRequest()
+			return
+		}
+		select {
+		case <-time.After(drainRequestTimeout):
+			cancelRequest()
+		case <-requested:
+		}
+	}()
 	resp, err := client.Do(req)
+	close(requested)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("OmegaUp-Runner-Drain") == "true" {
+		return nil, nil, errDrainRequested
+	}
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return errors.Errorf("non-2xx error code returned: %d", resp.StatusCode)
+		return nil, nil, errors.Errorf("non-2xx error code returned: %d", resp.StatusCode)
 	}
 
-	ctx := parentCtx.DebugContext(nil)
-	ctx.Transaction = ctx.Tracing.StartTransaction("run")
-	ctx.Transaction.AcceptDistributedTraceHeaders(tracing.TransportQueue, resp.Header)
-	defer ctx.Transaction.End()
-
 	decoder := json.NewDecoder(resp.Body)
 	var run common.Run
 	if err := decoder.Decode(&run); err != nil {
-		return errors.Wrap(err, "failed to parse the run request body")
+		return nil, nil, errors.Wrap(err, "failed to parse the run request body")
+	}
+	return &run, resp.Header, nil
+}
+
+// prefetchLimiter allows only one input to be prefetched at a time, so that
+// the downloads of several slots do not compete with each other.
+var prefetchLimiter = make(chan struct{}, 1)
+
+// prefetchInput downloads the input of a run that was reserved while another
+// run is being graded, so that it is already cached once the run starts. The
+// download happens while the current run is being graded, just like the input
+// downloads of the other slots, so it does not take the ioLock.
+func prefetchInput(
+	ctx *common.Context,
+	slot *runnerSlot,
+	client *http.Client,
+	run *common.Run,
+) {
+	prefetchLimiter <- struct{}{}
+	defer func() { <-prefetchLimiter }()
+
+	inputRef, err := inputManager.Add(run.InputHash, newRunInputFactory(ctx, slot, client, run))
+	if err != nil {
+		ctx.Log.Warn(
+			"Failed to prefetch the input of the next run",
+			map[string]any{
+				"attempt_id": run.AttemptID,
+				"input_hash": run.InputHash,
+				"err":        err,
+			},
+		)
+		return
+	}
+	inputRef.Release()
+}
+
+// newRunInputFactory returns the InputFactory that downloads the input of the
+// run from the grader.
+func newRunInputFactory(
+	ctx *common.Context,
+	slot *runnerSlot,
+	client *http.Client,
+	run *common.Run,
+) common.InputFactory {
+	baseURL, err := url.Parse(ctx.Config.Runner.GraderURL)
+	if err != nil {
+		panic(err)
 	}
+	return runner.NewInputFactory(client, slot.inputConfig(ctx), baseURL, run.ProblemName)
+}
+
+func processRun(
+	parentCtx *common.Context,
+	slot *runnerSlot,
+	client *http.Client,
+	baseURL *url.URL,
+	request *runRequest,
+	inputReady func(),
+) error {
+	// The grader cannot cancel runs that are requested over HTTP, and the run
+	// is not cancelled when the runner shuts down either, so that its results
+	// are uploaded instead of a JE that would count against the runner.
+	ctx := parentCtx.Wrap(context.Background()).DebugContext(nil)
+	ctx.Transaction = ctx.Tracing.StartTransaction("run")
+	ctx.Transaction.AcceptDistributedTraceHeaders(tracing.TransportQueue, request.header)
+	defer ctx.Transaction.End()
+
+	run := request.run
 	uploadURL, err := baseURL.Parse(fmt.Sprintf("run/%d/results/", run.AttemptID))
 	if err != nil {
 		return errors.Wrap(err, "failed to create the result upload URL")
 	}
+	heartbeatURL, err := baseURL.Parse(fmt.Sprintf("run/%d/heartbeat/", run.AttemptID))
+	if err != nil {
+		return errors.Wrap(err, "failed to create the heartbeat URL")
+	}
+
+	// The first heartbeat needs to be sent before the results upload starts so
+	// that the grader knows that this runner sends heartbeats.
+	heartbeat := startHeartbeat(
+		ctx,
+		time.Duration(ctx.Config.Runner.HeartbeatInterval),
+		httpHeartbeatSender(ctx, slot, client, heartbeatURL.String()),
+	)
+	defer heartbeat.stop()
 
 	finished := make(chan error, 1)
 
 	if err = gradeAndUploadResults(
 		ctx,
+		slot,
 		client,
 		uploadURL.String(),
-		&run,
+		run,
+		heartbeat.update,
+		inputReady,
 		finished,
 	); err != nil {
 		return err
@@ -228,9 +435,12 @@ func processRun(
 
 func gradeAndUploadResults(
 	ctx *common.Context,
+	slot *runnerSlot,
 	client *http.Client,
 	uploadURL string,
 	run *common.Run,
+	progress func(*runner.RunProgress),
+	inputReady func(),
 	finished chan<- error,
 ) error {
 	requestBody := newChannelBuffer()
@@ -248,6 +458,7 @@ func gradeAndUploadResults(
 		if ctx.Config.Runner.Hostname != "" {
 			req.Header.Add("OmegaUp-Runner-Name", ctx.Config.Runner.Hostname)
 		}
+		slot.addHeaders(req.Header)
 		req.Header.Add("Content-Type", multipartWriter.FormDataContentType())
 		response, err := client.Do(req)
 		if err != nil {
@@ -261,7 +472,7 @@ func gradeAndUploadResults(
 	}()
 
 	filesWriter := newFilesZipWriter(multipartWriter)
-	result, err := gradeRun(ctx, client, run, filesWriter)
+	result, err := gradeRun(ctx, slot, client, run, filesWriter, progress, inputReady)
 	filesWriter.Close()
 	if err != nil {
 		// Still try to send the details
@@ -390,34 +601,158 @@ func (w *filesZipWriter) Close() error {
 	return w.wErr
 }
 
+// gradeRun grades the run in the slot. inputReady, if not nil, is called once
+// the input of the run is available.
 func gradeRun(
 	ctx *common.Context,
+	slot *runnerSlot,
 	client *http.Client,
 	run *common.Run,
 	filesWriter io.Writer,
+	progress func(*runner.RunProgress),
+	inputReady func(),
 ) (*runner.RunResult, error) {
 	defer ctx.Transaction.StartSegment("grade").End()
 
-	// Make sure no other I/O is being made while we grade this run.
+	// Make sure no inputs are being preloaded and no benchmark is running while
+	// we grade this run. Other slots can grade runs at the same time, since
+	// they use their own CPUs.
 	ioLockSegment := ctx.Transaction.StartSegment("I/O lock")
-	ioLock.Lock()
-	defer ioLock.Unlock()
+	ioLock.RLock()
+	defer ioLock.RUnlock()
 	ioLockSegment.End()
 
 	inputSegment := ctx.Transaction.StartSegment("input")
-	baseURL, err := url.Parse(ctx.Config.Runner.GraderURL)
-	if err != nil {
-		panic(err)
-	}
-	inputRef, err := inputManager.Add(
-		run.InputHash,
-		runner.NewInputFactory(client, &ctx.Config, baseURL, run.ProblemName),
-	)
+	inputRef, err := inputManager.Add(run.InputHash, newRunInputFactory(ctx, slot, client, run))
 	if err != nil {
 		return nil, err
 	}
 	defer inputRef.Release()
 	inputSegment.End()
+	if inputReady != nil {
+		inputReady()
+	}
+
+	return runner.GradeWithProgress(
+		ctx,
+		filesWriter,
+		run,
+		inputRef.Input,
+		slot.sandbox,
+		progress,
+		binaryCache,
+	)
+}
+
+// runHeartbeat periodically lets the grader know that the runner is still
+// working on a run, and how far along it is.
+type runHeartbeat struct {
+	sync.Mutex
+	ctx      *common.Context
+	sendFunc func(*runner.RunProgress) error
+	progress *runner.RunProgress
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// startHeartbeat sends the first heartbeat and then keeps sending them every
+// interval until stop is called. A non-positive interval disables heartbeats.
+func startHeartbeat(
+	ctx *common.Context,
+	interval time.Duration,
+	sendFunc func(*runner.RunProgress) error,
+) *runHeartbeat {
+	h := &runHeartbeat{
+		ctx:      ctx,
+		sendFunc: sendFunc,
+		progress: &runner.RunProgress{},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(h.stopped)
+		return h
+	}
+	h.send()
+	go func() {
+		defer close(h.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-ticker.C:
+				h.send()
+			}
+		}
+	}()
+	return h
+}
+
+// update sets the progress that will be reported in the next heartbeat.
+func (h *runHeartbeat) update(progress *runner.RunProgress) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.progress = progress
+}
+
+func (h *runHeartbeat) send() {
+	h.Lock()
+	progress := h.progress
+	h.Unlock()
+	if err := h.sendFunc(progress); err != nil {
+		h.ctx.Log.Warn(
+			"Failed to send the heartbeat",
+			map[string]any{
+				"err": err,
+			},
+		)
+	}
+}
 
-	return runner.Grade(ctx, filesWriter, run, inputRef.Input, sandbox)
+// stop stops sending heartbeats.
+func (h *runHeartbeat) stop() {
+	select {
+	case <-h.stopped:
+		return
+	default:
+	}
+	close(h.done)
+	<-h.stopped
+}
+
+// httpHeartbeatSender returns a function that sends heartbeats to the grader
+// as HTTP requests.
+func httpHeartbeatSender(
+	ctx *common.Context,
+	slot *runnerSlot,
+	client *http.Client,
+	url string,
+) func(*runner.RunProgress) error {
+	return func(progress *runner.RunProgress) error {
+		body, err := json.Marshal(progress)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal the heartbeat")
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrap(err, "failed to create the heartbeat request")
+		}
+		if ctx.Config.Runner.Hostname != "" {
+			req.Header.Add("OmegaUp-Runner-Name", ctx.Config.Runner.Hostname)
+		}
+		slot.addHeaders(req.Header)
+		req.Header.Add("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("the grader rejected the heartbeat: %d", resp.StatusCode)
+		}
+		return nil
+	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+)
+
+func TestPrefetchInputWhileGrading(t *testing.T) {
+	ctx := newSlotsTestContext(t)
+	inputManager = common.NewInputManager(ctx)
+	slots, err := newRunnerSlots(ctx, &runner.NoopSandbox{})
+	if err != nil {
+		t.Fatalf("newRunnerSlots() failed: %v", err)
+	}
+
+	requested := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	ctx.Config.Runner.GraderURL = ts.URL + "/"
+
+	// Another run is being graded, which must not keep the input of the
+	// reserved run from being downloaded.
+	ioLock.RLock()
+	defer ioLock.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		prefetchInput(ctx, slots[0], ts.Client(), &common.Run{
+			AttemptID:   1,
+			ProblemName: "sumas",
+			InputHash:   "0000000000000000000000000000000000000000",
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("prefetchInput() did not finish while a run was being graded")
+	}
+	select {
+	case <-requested:
+	default:
+		t.Errorf("prefetchInput() did not request the input from the grader")
+	}
+}
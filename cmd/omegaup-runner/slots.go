@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"sync"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// runnerSlot grades one run at a time. A runner can have several slots that
+// grade runs concurrently, each pinned to its own set of CPUs and with its own
+// runtime subdirectory. Each slot is reported to the grader as a separate
+// runner.
+type runnerSlot struct {
+	// id identifies the slot with the grader. It is empty if the runner only
+	// has one slot.
+	id      string
+	ctx     *common.Context
+	sandbox runner.Sandbox
+	cpus    []int
+
+	// inputRuntimePath is the runtime path of the runner, where the inputs
+	// shared by all the slots are stored.
+	inputRuntimePath string
+}
+
+// newRunnerSlots divides the CPUs among the configured number of slots. Every
+// slot can use up to the hard memory limit, so the number of slots is reduced
+// if the memory budget is not enough for all of them.
+func newRunnerSlots(ctx *common.Context, sandbox runner.Sandbox) ([]*runnerSlot, error) {
+	count := ctx.Config.Runner.Slots.Count
+	if count > 1 && ctx.Config.Runner.HardMemoryLimit > 0 {
+		memoryBudget := ctx.Config.Runner.Slots.MemoryBudget
+		if memoryBudget == 0 {
+			v, err := mem.VirtualMemory()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to get the amount of RAM")
+			}
+			memoryBudget = base.Byte(v.Total)
+		}
+		if maxCount := int(memoryBudget / ctx.Config.Runner.HardMemoryLimit); maxCount < count {
+			ctx.Log.Warn(
+				"Not enough memory for all the slots to use the hard memory limit, reducing the slot count",
+				map[string]any{
+					"slots":             count,
+					"max_slots":         maxCount,
+					"memory_budget":     memoryBudget,
+					"hard_memory_limit": ctx.Config.Runner.HardMemoryLimit,
+				},
+			)
+			count = maxCount
+		}
+	}
+	if count <= 1 {
+		return []*runnerSlot{{
+			ctx:              ctx,
+			sandbox:          sandbox,
+			inputRuntimePath: ctx.Config.Runner.RuntimePath,
+		}}, nil
+	}
+
+	cpus := ctx.Config.Runner.Slots.CPUs
+	if len(cpus) == 0 {
+		for cpu := 0; cpu < runtime.NumCPU(); cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	cpusPerSlot := len(cpus) / count
+	if cpusPerSlot == 0 {
+		return nil, errors.Errorf(
+			"not enough CPUs for %d slots: %d available",
+			count,
+			len(cpus),
+		)
+	}
+
+	slots := make([]*runnerSlot, count)
+	for i := range slots {
+		slotCPUs := cpus[i*cpusPerSlot : (i+1)*cpusPerSlot]
+		slotSandbox := sandbox
+		if oj, ok := sandbox.(*runner.OmegajailSandbox); ok {
+			pinnedSandbox := *oj
+			pinnedSandbox.CPUs = slotCPUs
+			slotSandbox = &pinnedSandbox
+		}
+		slots[i] = &runnerSlot{
+			id:               strconv.Itoa(i),
+			sandbox:          slotSandbox,
+			cpus:             slotCPUs,
+			inputRuntimePath: ctx.Config.Runner.RuntimePath,
+		}
+		slots[i].ctx = slots[i].configure(ctx)
+		if err := os.MkdirAll(slots[i].ctx.Config.Runner.RuntimePath, 0755); err != nil {
+			return nil, errors.Wrap(err, "failed to create the slot runtime path")
+		}
+	}
+	return slots, nil
+}
+
+// configure returns a copy of the context with the slot's runtime path.
+func (s *runnerSlot) configure(ctx *common.Context) *common.Context {
+	if s.id == "" {
+		return ctx
+	}
+	slotCtx := *ctx
+	slotCtx.Config.Runner.RuntimePath = path.Join(s.inputRuntimePath, "slots", s.id)
+	return &slotCtx
+}
+
+// inputConfig returns the configuration used to store inputs, which are shared
+// by all the slots.
+func (s *runnerSlot) inputConfig(ctx *common.Context) *common.Config {
+	config := ctx.Config
+	config.Runner.RuntimePath = s.inputRuntimePath
+	return &config
+}
+
+// addHeaders adds the headers that let the grader tell the slots apart.
+func (s *runnerSlot) addHeaders(header http.Header) {
+	if s.id != "" {
+		header.Add("OmegaUp-Runner-Slot", s.id)
+	}
+}
+
+// nopLocker is a sync.Locker that does nothing, for when the caller already
+// holds the lock.
+type nopLocker struct{}
+
+func (nopLocker) Lock()   {}
+func (nopLocker) Unlock() {}
+
+// benchmarkTime returns the total CPU time of the benchmark results.
+func benchmarkTime(results runner.BenchmarkResults) float64 {
+	total := 0.0
+	for _, result := range results {
+		total += result.Time
+	}
+	return total
+}
+
+// validateSlots runs the benchmark alone and then in all the slots
+// concurrently, and drops slots until the concurrent runs are not slower than
+// allowed, since otherwise the time measurements of the runs would depend on
+// what the other slots are doing.
+func validateSlots(ctx *common.Context, slots []*runnerSlot) []*runnerSlot {
+	if len(slots) <= 1 {
+		return slots
+	}
+
+	// Nothing else should be running while the benchmarks run.
+	ioLock.Lock()
+	defer ioLock.Unlock()
+
+	baseline, err := runner.RunHostBenchmark(
+		slots[0].ctx,
+		inputManager,
+		slots[0].sandbox,
+		nopLocker{},
+	)
+	if err != nil {
+		ctx.Log.Error(
+			"Failed to run the baseline benchmark, using a single slot",
+			map[string]any{
+				"err": err,
+			},
+		)
+		return slots[:1]
+	}
+	maxTime := benchmarkTime(baseline) * (1 + ctx.Config.Runner.Slots.MaxBenchmarkSlowdown)
+
+	for count := len(slots); count > 1; count-- {
+		times := make([]float64, count)
+		errs := make([]error, count)
+		var wg sync.WaitGroup
+		for i, slot := range slots[:count] {
+			wg.Add(1)
+			go func(i int, slot *runnerSlot) {
+				defer wg.Done()
+				results, err := runner.RunHostBenchmark(
+					slot.ctx,
+					inputManager,
+					slot.sandbox,
+					nopLocker{},
+				)
+				times[i], errs[i] = benchmarkTime(results), err
+			}(i, slot)
+		}
+		wg.Wait()
+
+		valid := true
+		for i := range times {
+			if errs[i] != nil || times[i] > maxTime {
+				valid = false
+			}
+		}
+		if valid {
+			ctx.Log.Info(
+				"Slot count validated",
+				map[string]any{
+					"slots": count,
+					"times": times,
+				},
+			)
+			return slots[:count]
+		}
+		ctx.Log.Warn(
+			"The benchmark is too slow when running concurrently, reducing the slot count",
+			map[string]any{
+				"slots":    count,
+				"times":    times,
+				"max_time": maxTime,
+				"errs":     errs,
+			},
+		)
+	}
+	return slots[:1]
+}
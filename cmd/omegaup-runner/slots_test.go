@@ -0,0 +1,282 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+)
+
+func newSlotsTestContext(t *testing.T) *common.Context {
+	t.Helper()
+	dirname, err := os.MkdirTemp("/tmp", strings.ReplaceAll(t.Name(), "/", "_"))
+	if err != nil {
+		t.Fatalf("Failed to create the runtime directory: %v", err)
+	}
+	config := common.DefaultConfig()
+	if testing.Verbose() {
+		config.Logging.Level = "debug"
+	}
+	config.InputManager.CacheSize = 1024
+	config.Runner.RuntimePath = dirname
+	ctx, err := common.NewContext(&config)
+	if err != nil {
+		t.Fatalf("Failed to create the context: %v", err)
+	}
+	ctx.Config.Runner.PreserveFiles = os.Getenv("PRESERVE") != ""
+	t.Cleanup(func() {
+		ctx.Close()
+		if !ctx.Config.Runner.PreserveFiles {
+			os.RemoveAll(dirname)
+		}
+	})
+	return ctx
+}
+
+func TestNewRunnerSlots(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		count        int
+		cpus         []int
+		memoryBudget base.Byte
+		wantCPUs     [][]int
+		wantErr      bool
+	}{
+		{
+			name:         "single slot",
+			count:        1,
+			cpus:         []int{0, 1, 2, 3},
+			memoryBudget: 4 * base.Gibibyte,
+			wantCPUs:     [][]int{nil},
+		},
+		{
+			name:         "cpus are divided",
+			count:        2,
+			cpus:         []int{0, 1, 2, 3, 4},
+			memoryBudget: 4 * base.Gibibyte,
+			wantCPUs:     [][]int{{0, 1}, {2, 3}},
+		},
+		{
+			name:         "memory budget caps the slot count",
+			count:        4,
+			cpus:         []int{0, 1, 2, 3},
+			memoryBudget: 2 * base.Gibibyte,
+			wantCPUs:     [][]int{{0, 1}, {2, 3}},
+		},
+		{
+			name:         "memory budget for a single slot",
+			count:        2,
+			cpus:         []int{0, 1},
+			memoryBudget: 3 * base.Gibibyte / 2,
+			wantCPUs:     [][]int{nil},
+		},
+		{
+			name:         "not enough cpus",
+			count:        3,
+			cpus:         []int{0, 1},
+			memoryBudget: 4 * base.Gibibyte,
+			wantErr:      true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newSlotsTestContext(t)
+			ctx.Config.Runner.HardMemoryLimit = base.Gibibyte
+			ctx.Config.Runner.Slots.Count = tc.count
+			ctx.Config.Runner.Slots.CPUs = tc.cpus
+			ctx.Config.Runner.Slots.MemoryBudget = tc.memoryBudget
+
+			slots, err := newRunnerSlots(ctx, &runner.NoopSandbox{})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("newRunnerSlots() = %v, want an error", slots)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newRunnerSlots() failed: %v", err)
+			}
+			if len(slots) != len(tc.wantCPUs) {
+				t.Fatalf("len(newRunnerSlots()) = %d, want %d", len(slots), len(tc.wantCPUs))
+			}
+			for i, slot := range slots {
+				if !reflect.DeepEqual(slot.cpus, tc.wantCPUs[i]) {
+					t.Errorf("slot %d: cpus = %v, want %v", i, slot.cpus, tc.wantCPUs[i])
+				}
+				if slot.ctx.Config.Runner.HardMemoryLimit != base.Gibibyte {
+					t.Errorf(
+						"slot %d: HardMemoryLimit = %v, want %v",
+						i,
+						slot.ctx.Config.Runner.HardMemoryLimit,
+						base.Gibibyte,
+					)
+				}
+				wantRuntimePath := ctx.Config.Runner.RuntimePath
+				if len(slots) > 1 {
+					wantRuntimePath = path.Join(wantRuntimePath, "slots", slot.id)
+				}
+				if slot.ctx.Config.Runner.RuntimePath != wantRuntimePath {
+					t.Errorf(
+						"slot %d: RuntimePath = %q, want %q",
+						i,
+						slot.ctx.Config.Runner.RuntimePath,
+						wantRuntimePath,
+					)
+				}
+				if slot.inputRuntimePath != ctx.Config.Runner.RuntimePath {
+					t.Errorf(
+						"slot %d: inputRuntimePath = %q, want %q",
+						i,
+						slot.inputRuntimePath,
+						ctx.Config.Runner.RuntimePath,
+					)
+				}
+			}
+		})
+	}
+}
+
+func TestRunnerSlotConfigure(t *testing.T) {
+	ctx := newSlotsTestContext(t)
+	// The reloaded configuration is kept, other than the runtime path.
+	reloaded := *ctx
+	reloaded.Config.Runner.HardMemoryLimit = 2 * base.Gibibyte
+	reloaded.Config.Runner.RuntimePath = "/reloaded"
+
+	for _, tc := range []struct {
+		name            string
+		slot            *runnerSlot
+		wantRuntimePath string
+	}{
+		{
+			name:            "single slot",
+			slot:            &runnerSlot{inputRuntimePath: "/runtime"},
+			wantRuntimePath: "/reloaded",
+		},
+		{
+			name:            "one of several slots",
+			slot:            &runnerSlot{id: "1", inputRuntimePath: "/runtime"},
+			wantRuntimePath: "/runtime/slots/1",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			slotCtx := tc.slot.configure(&reloaded)
+			if slotCtx.Config.Runner.RuntimePath != tc.wantRuntimePath {
+				t.Errorf("RuntimePath = %q, want %q", slotCtx.Config.Runner.RuntimePath, tc.wantRuntimePath)
+			}
+			if slotCtx.Config.Runner.HardMemoryLimit != 2*base.Gibibyte {
+				t.Errorf("HardMemoryLimit = %v, want %v", slotCtx.Config.Runner.HardMemoryLimit, 2*base.Gibibyte)
+			}
+			if reloaded.Config.Runner.RuntimePath != "/reloaded" {
+				t.Errorf("configure() modified the original context")
+			}
+		})
+	}
+}
+
+// benchmarkSandbox is a NoopSandbox whose runs take longer when more than
+// maxConcurrent of them run at the same time.
+type benchmarkSandbox struct {
+	runner.NoopSandbox
+	unsupported   bool
+	maxConcurrent int32
+	active        int32
+}
+
+func (s *benchmarkSandbox) Supported() bool {
+	return !s.unsupported
+}
+
+func (s *benchmarkSandbox) Run(
+	ctx *common.Context,
+	limits *common.LimitsSettings,
+	lang, chdir, inputFile, outputFile, errorFile, metaFile, target string,
+	originalInputFile, originalOutputFile, runMetaFile *string,
+	extraParams []string,
+	extraMountPoints map[string]string,
+) (*runner.RunMetadata, error) {
+	atomic.AddInt32(&s.active, 1)
+	defer atomic.AddInt32(&s.active, -1)
+	time.Sleep(20 * time.Millisecond)
+	concurrent := atomic.LoadInt32(&s.active)
+
+	meta, err := s.NoopSandbox.Run(
+		ctx,
+		limits,
+		lang, chdir, inputFile, outputFile, errorFile, metaFile, target,
+		originalInputFile, originalOutputFile, runMetaFile,
+		extraParams,
+		extraMountPoints,
+	)
+	if err != nil {
+		return nil, err
+	}
+	meta.Time = 0.1
+	if concurrent > s.maxConcurrent {
+		meta.Time = 1
+	}
+	return meta, nil
+}
+
+func TestValidateSlots(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		count   int
+		sandbox *benchmarkSandbox
+		want    int
+	}{
+		{
+			name:    "single slot",
+			count:   1,
+			sandbox: &benchmarkSandbox{maxConcurrent: 1},
+			want:    1,
+		},
+		{
+			name:    "baseline benchmark fails",
+			count:   3,
+			sandbox: &benchmarkSandbox{unsupported: true, maxConcurrent: 3},
+			want:    1,
+		},
+		{
+			name:    "no slowdown",
+			count:   3,
+			sandbox: &benchmarkSandbox{maxConcurrent: 3},
+			want:    3,
+		},
+		{
+			name:    "slowdown",
+			count:   3,
+			sandbox: &benchmarkSandbox{maxConcurrent: 2},
+			want:    2,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newSlotsTestContext(t)
+			ctx.Config.Runner.Slots.Count = tc.count
+			ctx.Config.Runner.Slots.CPUs = []int{0, 1, 2}
+			ctx.Config.Runner.Slots.MemoryBudget = 4 * ctx.Config.Runner.HardMemoryLimit
+			inputManager = common.NewInputManager(ctx)
+
+			slots, err := newRunnerSlots(ctx, tc.sandbox)
+			if err != nil {
+				t.Fatalf("newRunnerSlots() failed: %v", err)
+			}
+			validated := validateSlots(ctx, slots)
+			if len(validated) != tc.want {
+				t.Errorf("len(validateSlots()) = %d, want %d", len(validated), tc.want)
+			}
+			if !reflect.DeepEqual(validated, slots[:len(validated)]) {
+				t.Errorf("validateSlots() = %v, want a prefix of %v", validated, slots)
+			}
+		})
+	}
+}
@@ -12,6 +12,8 @@ import (
 	base "github.com/omegaup/go-base/v3"
 	"github.com/omegaup/go-base/v3/logging"
 	"github.com/omegaup/go-base/v3/tracing"
+
+	"github.com/pkg/errors"
 )
 
 // BroadcasterConfig represents the configuration for the Broadcaster.
@@ -60,6 +62,63 @@ type GraderEphemeralConfig struct {
 // GraderCIConfig represents the configuration for the Grader CI.
 type GraderCIConfig struct {
 	CISizeLimit base.Byte
+	// Workers is the number of CI requests that are processed concurrently.
+	// Requests for the same problem are always processed one at a time.
+	Workers int
+	// QueueSize is the maximum number of CI requests that can be waiting to
+	// be processed. Requests beyond that are rejected.
+	QueueSize int
+	// WebhookURLs are sent a POST request with the summary of every CI run
+	// once it finishes.
+	WebhookURLs []string
+	// WebhookSecret is used to sign the webhook requests with HMAC-SHA256.
+	// The signature is sent in the X-Omegaup-Signature header.
+	WebhookSecret string
+	// WebhookTimeout is the maximum time that each webhook request can take.
+	WebhookTimeout base.Duration
+}
+
+// GraderMaxQueueWaitConfig represents the maximum amount of time that a run
+// can wait in each priority before being promoted to the next higher
+// priority. A zero duration disables aging for that priority.
+type GraderMaxQueueWaitConfig struct {
+	Normal    base.Duration
+	Low       base.Duration
+	Ephemeral base.Duration
+}
+
+// GraderHeartbeatConfig represents how the grader decides that a runner is no
+// longer working on a run. Runners must send a heartbeat at least every
+// Timeout, and the run must be finished within DeadlineBase plus
+// WallTimeFactor times the problem's overall wall time limit.
+type GraderHeartbeatConfig struct {
+	Timeout        base.Duration
+	DeadlineBase   base.Duration
+	WallTimeFactor float64
+}
+
+// GraderRunnersConfig represents how the grader authenticates runners.
+// Runners can exchange a one-time join token, valid for JoinTokenTTL, for a
+// credential instead of using a TLS client certificate. If
+// RequireCredentials is set, runners without a credential are rejected, so it
+// can only be set together with TokenAuthentication.
+type GraderRunnersConfig struct {
+	TokenAuthentication bool
+	RequireCredentials  bool
+	JoinTokenTTL        base.Duration
+}
+
+// GraderQuarantineConfig represents when the grader stops dispatching runs
+// to a runner. A runner is quarantined when at least MinSamples of its runs
+// finished within Window and at least Threshold of them were JE or timed out.
+// A non-positive Threshold disables quarantines. If RerunResults is set, the
+// runs that the runner graded without a JE verdict within Window are graded
+// again by other runners.
+type GraderQuarantineConfig struct {
+	Window       base.Duration
+	MinSamples   int
+	Threshold    float64
+	RerunResults bool
 }
 
 // GraderConfig represents the configuration for the Grader.
@@ -75,6 +134,12 @@ type GraderConfig struct {
 	Ephemeral              GraderEphemeralConfig
 	CI                     GraderCIConfig
 	UseS3                  bool
+	InputAffinityDelay     base.Duration
+	FairShareKey           string
+	MaxQueueWait           GraderMaxQueueWaitConfig
+	Heartbeat              GraderHeartbeatConfig
+	Runners                GraderRunnersConfig
+	Quarantine             GraderQuarantineConfig
 }
 
 // TLSConfig represents the configuration for TLS.
@@ -83,6 +148,27 @@ type TLSConfig struct {
 	KeyFile  string
 }
 
+// RunnerSlotsConfig represents the configuration for grading several runs
+// concurrently in the same Runner.
+type RunnerSlotsConfig struct {
+	// Count is the number of slots. Each slot grades one run at a time, is
+	// pinned to its own set of CPUs, and has its own runtime subdirectory.
+	Count int
+	// CPUs are the CPUs that are divided among the slots. If empty, all the
+	// CPUs in the system are used.
+	CPUs []int
+	// MemoryBudget is the total amount of memory that the programs in all the
+	// slots can use. Every slot can use up to HardMemoryLimit, so the number
+	// of slots is reduced until all of them fit in the budget. If zero, the
+	// total amount of RAM in the system is used.
+	MemoryBudget base.Byte
+	// MaxBenchmarkSlowdown is the fraction by which the benchmark can be slower
+	// when all the slots run it concurrently than when it runs alone. The
+	// number of slots is reduced until this holds, so that time measurements
+	// stay accurate.
+	MaxBenchmarkSlowdown float64
+}
+
 // RunnerConfig represents the configuration for the Runner.
 type RunnerConfig struct {
 	Hostname           string
@@ -95,6 +181,24 @@ type RunnerConfig struct {
 	OverallOutputLimit base.Byte
 	OmegajailRoot      string
 	PreserveFiles      bool
+	HeartbeatInterval  base.Duration
+	// PersistentConnection makes the runner keep a WebSocket connection open
+	// with the grader instead of polling for runs over HTTP.
+	PersistentConnection bool
+	// JoinToken is exchanged with the grader for a credential, which is stored
+	// in CredentialFile. If CredentialFile is empty, the credential is stored
+	// in RuntimePath.
+	JoinToken      string
+	CredentialFile string
+	Slots          RunnerSlotsConfig
+	// PrefetchNextRun makes the runner reserve its next run while it grades
+	// the current one, so that the next run's input is downloaded while the
+	// current one is being graded and the next run can start right after it,
+	// without asking the grader again. It is disabled by default.
+	PrefetchNextRun bool
+	// BinaryCacheSize is the maximum size of the cache of compiled
+	// problemsetter binaries. Zero disables the cache.
+	BinaryCacheSize base.Byte
 }
 
 // DbConfig represents the configuration for the database.
@@ -196,19 +300,53 @@ var defaultConfig = Config{
 			WriteDeadline: base.Duration(time.Duration(5) * time.Second),
 		},
 		CI: GraderCIConfig{
-			CISizeLimit: base.Byte(256) * base.Mebibyte,
+			CISizeLimit:    base.Byte(256) * base.Mebibyte,
+			Workers:        4,
+			QueueSize:      128,
+			WebhookTimeout: base.Duration(time.Duration(10) * time.Second),
+		},
+		UseS3:              false,
+		InputAffinityDelay: base.Duration(time.Duration(10) * time.Second),
+		FairShareKey:       "none",
+		MaxQueueWait: GraderMaxQueueWaitConfig{
+			Normal:    base.Duration(0),
+			Low:       base.Duration(time.Duration(30) * time.Minute),
+			Ephemeral: base.Duration(time.Duration(10) * time.Minute),
+		},
+		Heartbeat: GraderHeartbeatConfig{
+			Timeout:        base.Duration(time.Duration(30) * time.Second),
+			DeadlineBase:   base.Duration(time.Duration(5) * time.Minute),
+			WallTimeFactor: 2,
+		},
+		Runners: GraderRunnersConfig{
+			TokenAuthentication: false,
+			RequireCredentials:  false,
+			JoinTokenTTL:        base.Duration(time.Duration(1) * time.Hour),
+		},
+		Quarantine: GraderQuarantineConfig{
+			Window:       base.Duration(time.Duration(10) * time.Minute),
+			MinSamples:   10,
+			Threshold:    0.5,
+			RerunResults: false,
 		},
-		UseS3: false,
 	},
 	Runner: RunnerConfig{
-		RuntimePath:        "/var/lib/omegaup/runner",
-		GraderURL:          "https://omegaup.com:11302",
-		CompileTimeLimit:   base.Duration(time.Duration(30) * time.Second),
-		CompileOutputLimit: base.Byte(10) * base.Mebibyte,
-		HardMemoryLimit:    base.Byte(640) * base.Mebibyte,
-		OverallOutputLimit: base.Byte(100) * base.Mebibyte,
-		OmegajailRoot:      "/var/lib/omegajail",
-		PreserveFiles:      false,
+		RuntimePath:          "/var/lib/omegaup/runner",
+		GraderURL:            "https://omegaup.com:11302",
+		CompileTimeLimit:     base.Duration(time.Duration(30) * time.Second),
+		CompileOutputLimit:   base.Byte(10) * base.Mebibyte,
+		HardMemoryLimit:      base.Byte(640) * base.Mebibyte,
+		OverallOutputLimit:   base.Byte(100) * base.Mebibyte,
+		OmegajailRoot:        "/var/lib/omegajail",
+		PreserveFiles:        false,
+		HeartbeatInterval:    base.Duration(time.Duration(10) * time.Second),
+		PersistentConnection: false,
+		Slots: RunnerSlotsConfig{
+			Count:                1,
+			MaxBenchmarkSlowdown: 0.05,
+		},
+		PrefetchNextRun: false,
+		BinaryCacheSize: base.Byte(256) * base.Mebibyte,
 	},
 	TLS: TLSConfig{
 		CertFile: "/etc/omegaup/grader/certificate.pem",
@@ -249,10 +387,25 @@ func NewConfig(reader io.Reader) (*Config, error) {
 	if err := decoder.Decode(&config); err != nil {
 		return nil, err
 	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
 
+// validate returns an error if the Config has settings that contradict each
+// other.
+func (config *Config) validate() error {
+	runners := config.Grader.Runners
+	if runners.RequireCredentials && !runners.TokenAuthentication {
+		return errors.New(
+			"Grader.Runners.RequireCredentials requires Grader.Runners.TokenAuthentication, since no runner could get a credential otherwise",
+		)
+	}
+	return nil
+}
+
 // NewContext creates a new Context from the specified Config. This also
 // creates a Logger.
 func NewContext(config *Config) (*Context, error) {
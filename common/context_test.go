@@ -42,3 +42,31 @@ func TestConfigSerializability(t *testing.T) {
 		t.Errorf("Serialized config empty")
 	}
 }
+
+func TestConfigRequireCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			name:   "token authentication",
+			config: `{"Grader": {"Runners": {"TokenAuthentication": true, "RequireCredentials": true}}}`,
+		},
+		{
+			name:    "no token authentication",
+			config:  `{"Grader": {"Runners": {"RequireCredentials": true}}}`,
+			wantErr: true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := NewConfig(bytes.NewBufferString(tc.config))
+			if tc.wantErr && err == nil {
+				t.Errorf("NewConfig() = %v, want an error", config)
+			} else if !tc.wantErr && err != nil {
+				t.Errorf("NewConfig() failed: %v", err)
+			}
+		})
+	}
+}
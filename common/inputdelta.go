@@ -0,0 +1,121 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// InputDeltaHeader is the name of the HTTP header that signals that the
+	// response to an Input request contains an InputDelta instead of the full
+	// Input.
+	InputDeltaHeader = "X-Content-Delta"
+
+	// InputDeltaManifestName is the name of the first entry in the .tar.gz
+	// stream of an InputDelta, which contains the JSON-encoded InputDelta.
+	InputDeltaManifestName = ".omegaup-delta.json"
+)
+
+var (
+	manifestLineRe = regexp.MustCompile("^\\s*([a-f0-9]{40}) [ *](.+?)\\s*$")
+)
+
+// InputDelta describes the differences between an Input that is already
+// present in the runner and a newer version of it. All paths are relative to
+// the root of the Input.
+type InputDelta struct {
+	// Files is the SHA-1 hash of every file in the new Input. Files that are
+	// also present in the .tar.gz stream need to be written, and the rest of
+	// them can be taken from the old Input.
+	Files map[string]string `json:"files"`
+
+	// Deleted is the list of files from the old Input that are no longer part
+	// of the new Input.
+	Deleted []string `json:"deleted"`
+}
+
+// NewInputDelta returns the InputDelta needed to go from the Input described
+// by oldFiles to the Input described by newFiles, as well as the list of files
+// that need to be transmitted.
+func NewInputDelta(oldFiles, newFiles map[string]string) (*InputDelta, []string) {
+	delta := &InputDelta{
+		Files:   newFiles,
+		Deleted: make([]string, 0),
+	}
+	var modified []string
+	for filename, hash := range newFiles {
+		if oldHash, ok := oldFiles[filename]; !ok || oldHash != hash {
+			modified = append(modified, filename)
+		}
+	}
+	for filename := range oldFiles {
+		if _, ok := newFiles[filename]; !ok {
+			delta.Deleted = append(delta.Deleted, filename)
+		}
+	}
+	sort.Strings(modified)
+	sort.Strings(delta.Deleted)
+	return delta, modified
+}
+
+// DeltaTransmittableInput is an input that can be transmitted over HTTP as the
+// difference against another version of the Input that the recipient already
+// has.
+type DeltaTransmittableInput interface {
+	TransmittableInput
+
+	// TransmitDelta sends a .tar.gz file with the InputDeltaHeader set. The
+	// first entry of the file is the JSON-encoded InputDelta (named
+	// InputDeltaManifestName) and the rest of the entries are the files that
+	// are not present (or are different) in the provided manifest.
+	TransmitDelta(w http.ResponseWriter, manifest map[string]string) error
+}
+
+// ReadInputManifest reads a manifest of an Input's files in the format
+// generated by sha1sum(1), and returns a mapping of relative paths to their
+// SHA-1 hashes.
+func ReadInputManifest(r io.Reader) (map[string]string, error) {
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		res := manifestLineRe.FindStringSubmatch(scanner.Text())
+		if res == nil {
+			return nil, fmt.Errorf("manifest format error: %q", scanner.Text())
+		}
+		filename := path.Clean(res[2])
+		if path.IsAbs(filename) || filename == ".." || strings.HasPrefix(filename, "../") {
+			return nil, fmt.Errorf("path is outside expected directory: %q", res[2])
+		}
+		result[filename] = res[1]
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+	return result, nil
+}
+
+// WriteInputManifest writes a manifest of an Input's files in the format
+// generated by sha1sum(1), in lexicographic order.
+func WriteInputManifest(w io.Writer, manifest map[string]string) error {
+	filenames := make([]string, 0, len(manifest))
+	for filename := range manifest {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		if _, err := fmt.Fprintf(w, "%s *%s\n", manifest[filename], filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInputManifest(t *testing.T) {
+	manifest := map[string]string{
+		"settings.json": strings.Repeat("1", 40),
+		"cases/0.in":    strings.Repeat("2", 40),
+		"cases/0.out":   strings.Repeat("3", 40),
+	}
+
+	var buf bytes.Buffer
+	if err := WriteInputManifest(&buf, manifest); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	expected := strings.Repeat("2", 40) + " *cases/0.in\n" +
+		strings.Repeat("3", 40) + " *cases/0.out\n" +
+		strings.Repeat("1", 40) + " *settings.json\n"
+	if buf.String() != expected {
+		t.Errorf("WriteInputManifest() == %q, want %q", buf.String(), expected)
+	}
+
+	decoded, err := ReadInputManifest(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if !reflect.DeepEqual(manifest, decoded) {
+		t.Errorf("ReadInputManifest() == %v, want %v", decoded, manifest)
+	}
+
+	for _, invalid := range []string{
+		"not a manifest\n",
+		strings.Repeat("1", 40) + " *../settings.json\n",
+		strings.Repeat("1", 40) + " */etc/passwd\n",
+	} {
+		if _, err := ReadInputManifest(strings.NewReader(invalid)); err == nil {
+			t.Errorf("ReadInputManifest(%q) succeeded, expected failure", invalid)
+		}
+	}
+}
+
+func TestNewInputDelta(t *testing.T) {
+	oldFiles := map[string]string{
+		"settings.json": strings.Repeat("1", 40),
+		"cases/0.in":    strings.Repeat("2", 40),
+		"cases/0.out":   strings.Repeat("3", 40),
+		"cases/1.in":    strings.Repeat("4", 40),
+		"cases/1.out":   strings.Repeat("5", 40),
+	}
+	newFiles := map[string]string{
+		"settings.json": strings.Repeat("1", 40),
+		"cases/0.in":    strings.Repeat("2", 40),
+		"cases/0.out":   strings.Repeat("6", 40),
+		"cases/2.in":    strings.Repeat("4", 40),
+		"cases/2.out":   strings.Repeat("5", 40),
+	}
+
+	delta, modified := NewInputDelta(oldFiles, newFiles)
+	if !reflect.DeepEqual(newFiles, delta.Files) {
+		t.Errorf("delta.Files == %v, want %v", delta.Files, newFiles)
+	}
+	expectedDeleted := []string{"cases/1.in", "cases/1.out"}
+	if !reflect.DeepEqual(expectedDeleted, delta.Deleted) {
+		t.Errorf("delta.Deleted == %v, want %v", delta.Deleted, expectedDeleted)
+	}
+	expectedModified := []string{"cases/0.out", "cases/2.in", "cases/2.out"}
+	if !reflect.DeepEqual(expectedModified, modified) {
+		t.Errorf("modified == %v, want %v", modified, expectedModified)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"sync"
 )
 
@@ -75,6 +76,18 @@ type TransmittableInput interface {
 	Transmit(http.ResponseWriter) error
 }
 
+// RangeTransmittableInput is an input that can be transmitted over HTTP, and
+// supports HTTP range requests so that interrupted transfers can be resumed.
+type RangeTransmittableInput interface {
+	TransmittableInput
+
+	// TransmitRange sends the same serialized version of the Input as Transmit,
+	// but honors the Range and If-Range headers of the request. The ETag
+	// header is set to a strong validator derived from the hash and length of
+	// the serialized Input.
+	TransmitRange(http.ResponseWriter, *http.Request) error
+}
+
 // InputRef represents a reference to an Input
 type InputRef struct {
 	Input Input
@@ -150,6 +163,28 @@ func (input *BaseInput) Settings() *ProblemSettings {
 type InputManager struct {
 	ctx      *Context
 	lruCache *base.LRUCache[Input]
+
+	hashesLock sync.Mutex
+	hashes     map[string]struct{}
+}
+
+// managedInput is a wrapper around an Input that lets the InputManager know
+// when the Input has been evicted, so that it can keep track of the set of
+// hashes that it holds.
+type managedInput struct {
+	Input
+	hash string
+	mgr  *InputManager
+}
+
+// Release removes the Input from the set of hashes held by the InputManager
+// and then releases the underlying Input.
+func (input *managedInput) Release() {
+	input.mgr.hashesLock.Lock()
+	delete(input.mgr.hashes, input.hash)
+	input.mgr.hashesLock.Unlock()
+
+	input.Input.Release()
 }
 
 // inputEntry represents an entry in the InputManager.
@@ -261,6 +296,7 @@ func NewInputManager(ctx *Context) *InputManager {
 	return &InputManager{
 		ctx:      ctx,
 		lruCache: base.NewLRUCache[Input](base.Byte(ctx.Config.InputManager.CacheSize)),
+		hashes:   make(map[string]struct{}),
 	}
 }
 
@@ -281,7 +317,7 @@ func (mgr *InputManager) Add(hash string, factory InputFactory) (*InputRef, erro
 			input := factory.NewInput(hash, mgr)
 			if input.Committed() {
 				// No further processing necessary.
-				return input, nil
+				return mgr.manage(hash, input), nil
 			}
 			// This operation can take a while.
 			if err := input.Verify(); err != nil {
@@ -320,19 +356,48 @@ func (mgr *InputManager) Add(hash string, factory InputFactory) (*InputRef, erro
 					},
 				)
 			}
-			return input, nil
+			return mgr.manage(hash, input), nil
 		},
 	)
 	if err != nil {
 		return nil, err
 	}
 	return &InputRef{
-		Input: entryRef.Value,
+		Input: entryRef.Value.(*managedInput).Input,
 		mgr:   mgr,
 		ref:   entryRef,
 	}, nil
 }
 
+// manage wraps the Input so that its hash is tracked by the InputManager
+// until it is evicted.
+func (mgr *InputManager) manage(hash string, input Input) Input {
+	mgr.hashesLock.Lock()
+	mgr.hashes[hash] = struct{}{}
+	mgr.hashesLock.Unlock()
+
+	return &managedInput{
+		Input: input,
+		hash:  hash,
+		mgr:   mgr,
+	}
+}
+
+// Hashes returns the sorted list of hashes of all the Inputs that are
+// currently held by the InputManager, regardless of whether they are being
+// used or not.
+func (mgr *InputManager) Hashes() []string {
+	mgr.hashesLock.Lock()
+	hashes := make([]string, 0, len(mgr.hashes))
+	for hash := range mgr.hashes {
+		hashes = append(hashes, hash)
+	}
+	mgr.hashesLock.Unlock()
+
+	sort.Strings(hashes)
+	return hashes
+}
+
 // Size returns the total size of Inputs in the InputManager.
 func (mgr *InputManager) Size() base.Byte {
 	return mgr.lruCache.Size()
@@ -161,6 +161,9 @@ func TestInputManager(t *testing.T) {
 		inputRef.Release()
 		t.Errorf("InputManager.Add(\"0\", &CacheOnlyInputFactoryForTesting{}) == %q, want !nil", err)
 	}
+	if hashes := inputManager.Hashes(); len(hashes) != 1 || hashes[0] != "1" {
+		t.Errorf("InputManager.Hashes() == %v, want %v", hashes, []string{"1"})
+	}
 }
 
 func TestPreloadInputs(t *testing.T) {
@@ -0,0 +1,590 @@
+package common
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/pkg/errors"
+)
+
+var (
+	polygonNameRegexp = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+	// polygonStandardCheckers are the testlib standard checkers that have an
+	// equivalent omegaUp validator.
+	polygonStandardCheckers = map[string]ValidatorSettings{
+		"std::wcmp.cpp":   {Name: ValidatorNameToken},
+		"std::lcmp.cpp":   {Name: ValidatorNameToken},
+		"std::fcmp.cpp":   {Name: ValidatorNameLiteral},
+		"std::hcmp.cpp":   {Name: ValidatorNameToken},
+		"std::ncmp.cpp":   {Name: ValidatorNameTokenNumeric},
+		"std::icmp.cpp":   {Name: ValidatorNameTokenNumeric},
+		"std::rcmp.cpp":   {Name: ValidatorNameTokenNumeric, Tolerance: polygonTolerance(1.5e-6)},
+		"std::acmp.cpp":   {Name: ValidatorNameTokenNumeric, Tolerance: polygonTolerance(1.5e-6)},
+		"std::dcmp.cpp":   {Name: ValidatorNameTokenNumeric, Tolerance: polygonTolerance(1e-6)},
+		"std::rcmp4.cpp":  {Name: ValidatorNameTokenNumeric, Tolerance: polygonTolerance(1e-4)},
+		"std::rcmp6.cpp":  {Name: ValidatorNameTokenNumeric, Tolerance: polygonTolerance(1e-6)},
+		"std::rcmp9.cpp":  {Name: ValidatorNameTokenNumeric, Tolerance: polygonTolerance(1e-9)},
+		"std::yesno.cpp":  {Name: ValidatorNameTokenCaseless},
+		"std::nyesno.cpp": {Name: ValidatorNameTokenCaseless},
+	}
+)
+
+func polygonTolerance(tolerance float64) *float64 {
+	return &tolerance
+}
+
+type polygonSource struct {
+	Path string `xml:"path,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type polygonTest struct {
+	Method string `xml:"method,attr"`
+	Cmd    string `xml:"cmd,attr"`
+	Sample bool   `xml:"sample,attr"`
+	Points string `xml:"points,attr"`
+	Group  string `xml:"group,attr"`
+}
+
+type polygonGroup struct {
+	Name         string `xml:"name,attr"`
+	Points       string `xml:"points,attr"`
+	PointsPolicy string `xml:"points-policy,attr"`
+	Dependencies []struct {
+		Group string `xml:"group,attr"`
+	} `xml:"dependencies>dependency"`
+}
+
+type polygonTestset struct {
+	Name              string         `xml:"name,attr"`
+	TimeLimit         int64          `xml:"time-limit"`
+	MemoryLimit       int64          `xml:"memory-limit"`
+	InputPathPattern  string         `xml:"input-path-pattern"`
+	AnswerPathPattern string         `xml:"answer-path-pattern"`
+	Tests             []polygonTest  `xml:"tests>test"`
+	Groups            []polygonGroup `xml:"groups>group"`
+}
+
+type polygonProblem struct {
+	XMLName   xml.Name `xml:"problem"`
+	ShortName string   `xml:"short-name,attr"`
+	Judging   struct {
+		InputFile  string           `xml:"input-file,attr"`
+		OutputFile string           `xml:"output-file,attr"`
+		Testsets   []polygonTestset `xml:"testset"`
+	} `xml:"judging"`
+	Statements  []polygonSource `xml:"statements>statement"`
+	Executables []polygonSource `xml:"files>executables>executable>source"`
+	Checker     *struct {
+		Name   string        `xml:"name,attr"`
+		Source polygonSource `xml:"source"`
+	} `xml:"assets>checker"`
+	Interactor *struct {
+		Source polygonSource `xml:"source"`
+	} `xml:"assets>interactor"`
+	Validators []polygonSource `xml:"assets>validators>validator>source"`
+	Solutions  []struct {
+		Tag    string        `xml:"tag,attr"`
+		Source polygonSource `xml:"source"`
+	} `xml:"assets>solutions>solution"`
+}
+
+// polygonLanguage returns the omegaUp language of a Polygon source type (e.g.
+// cpp.g++17 or python.3), or an empty string if it is not supported.
+func polygonLanguage(sourceType string) string {
+	switch {
+	case strings.HasPrefix(sourceType, "cpp."):
+		for _, standard := range []string{"20", "2a", "23"} {
+			if strings.Contains(sourceType, "++"+standard) {
+				return "cpp20-gcc"
+			}
+		}
+		if strings.Contains(sourceType, "++17") {
+			return "cpp17-gcc"
+		}
+		return "cpp11"
+	case strings.HasPrefix(sourceType, "c."):
+		return "c11-gcc"
+	case strings.HasPrefix(sourceType, "java"):
+		return "java"
+	case strings.HasPrefix(sourceType, "kotlin"):
+		return "kt"
+	case strings.HasPrefix(sourceType, "python.2"), strings.HasPrefix(sourceType, "python.pypy2"):
+		return "py2"
+	case strings.HasPrefix(sourceType, "python."):
+		return "py3"
+	case strings.HasPrefix(sourceType, "pascal."):
+		return "pas"
+	case strings.HasPrefix(sourceType, "ruby"):
+		return "rb"
+	case strings.HasPrefix(sourceType, "csharp"):
+		return "cs"
+	case strings.HasPrefix(sourceType, "go"):
+		return "go"
+	case strings.HasPrefix(sourceType, "rust"):
+		return "rs"
+	case strings.HasPrefix(sourceType, "haskell"):
+		return "hs"
+	}
+	return ""
+}
+
+// formatPolygonWeight formats a weight for the testplan.
+func formatPolygonWeight(weight *big.Rat) string {
+	if weight.IsInt() {
+		return weight.Num().String()
+	}
+	return strings.TrimRight(weight.FloatString(6), "0")
+}
+
+// polygonProblemFiles is a ProblemFiles that exposes a Polygon package in
+// omegaUp's layout. The files that are synthesized from problem.xml are kept
+// in memory, and the rest are read from the package.
+type polygonProblemFiles struct {
+	files ProblemFiles
+
+	// contents are the synthesized files.
+	contents map[string]string
+	// mapping maps the omegaUp paths to the paths in the package.
+	mapping map[string]string
+
+	fileList []string
+}
+
+var _ ProblemFiles = &polygonProblemFiles{}
+
+// String implements the fmt.Stringer interface.
+func (f *polygonProblemFiles) String() string {
+	return fmt.Sprintf("polygon:%s", f.files.String())
+}
+
+func (f *polygonProblemFiles) Files() []string {
+	return f.fileList
+}
+
+func (f *polygonProblemFiles) GetContents(path string) ([]byte, error) {
+	if contents, ok := f.contents[path]; ok {
+		return []byte(contents), nil
+	}
+	if packagePath, ok := f.mapping[path]; ok {
+		return f.files.GetContents(packagePath)
+	}
+	return nil, f.notExistError(path)
+}
+
+func (f *polygonProblemFiles) GetStringContents(path string) (string, error) {
+	if contents, ok := f.contents[path]; ok {
+		return contents, nil
+	}
+	if packagePath, ok := f.mapping[path]; ok {
+		return f.files.GetStringContents(packagePath)
+	}
+	return "", f.notExistError(path)
+}
+
+func (f *polygonProblemFiles) Open(path string) (io.ReadCloser, error) {
+	if contents, ok := f.contents[path]; ok {
+		return io.NopCloser(strings.NewReader(contents)), nil
+	}
+	if packagePath, ok := f.mapping[path]; ok {
+		return f.files.Open(packagePath)
+	}
+	return nil, f.notExistError(path)
+}
+
+func (f *polygonProblemFiles) Close() error {
+	return f.files.Close()
+}
+
+func (f *polygonProblemFiles) notExistError(path string) error {
+	return os.NewSyscallError(
+		fmt.Sprintf("open %q in %q", path, f.String()),
+		os.ErrNotExist,
+	)
+}
+
+// polygonImporter holds the state of the import of a Polygon package.
+type polygonImporter struct {
+	packageFiles map[string]struct{}
+	result       *polygonProblemFiles
+
+	// unsupported are the features that prevent the problem from being
+	// judged like in Polygon.
+	unsupported []string
+	// warnings are the features that were not imported, or that were
+	// imported with a different behavior.
+	warnings []string
+}
+
+func (i *polygonImporter) unsupportedf(format string, args ...any) {
+	i.unsupported = append(i.unsupported, fmt.Sprintf(format, args...))
+}
+
+func (i *polygonImporter) warnf(format string, args ...any) {
+	i.warnings = append(i.warnings, fmt.Sprintf(format, args...))
+}
+
+// hasFile returns whether a file is in the package.
+func (i *polygonImporter) hasFile(path string) bool {
+	_, ok := i.packageFiles[path]
+	return ok
+}
+
+func (i *polygonImporter) addJSON(path string, value any) error {
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal %s", path)
+	}
+	i.result.contents[path] = string(contents) + "\n"
+	return nil
+}
+
+// importTests maps the tests of the testset to cases, and returns their
+// weights.
+func (i *polygonImporter) importTests(testset *polygonTestset) CaseWeightMapping {
+	groups := make(map[string]*polygonGroup)
+	for j := range testset.Groups {
+		group := &testset.Groups[j]
+		groups[group.Name] = group
+		if len(group.Dependencies) > 0 {
+			var dependencies []string
+			for _, dependency := range group.Dependencies {
+				dependencies = append(dependencies, dependency.Group)
+			}
+			i.warnf(
+				"group %q depends on groups %s, but its score will not depend on them",
+				group.Name,
+				strings.Join(dependencies, ", "),
+			)
+		}
+	}
+
+	pointsEnabled := false
+	for _, test := range testset.Tests {
+		pointsEnabled = pointsEnabled || test.Points != ""
+	}
+	for _, group := range testset.Groups {
+		pointsEnabled = pointsEnabled || group.Points != ""
+	}
+
+	width := base.Max(2, len(strconv.Itoa(len(testset.Tests))))
+	var missingInputs []string
+	var missingAnswers []string
+	caseWeights := NewCaseWeightMapping()
+	// The names of the cases of every group whose points are given for the
+	// group as a whole.
+	groupCases := make(map[string][]string)
+	for j, test := range testset.Tests {
+		testNumber := j + 1
+		caseName := fmt.Sprintf("%0*d", width, testNumber)
+		if test.Group != "" {
+			groupName := polygonNameRegexp.ReplaceAllString(test.Group, "_")
+			if group, ok := groups[test.Group]; ok && group.PointsPolicy == "each-test" {
+				// Every test is scored independently, so it needs to be its own
+				// group.
+				caseName = fmt.Sprintf("%s-%s", groupName, caseName)
+			} else {
+				caseName = fmt.Sprintf("%s.%s", groupName, caseName)
+				groupCases[test.Group] = append(groupCases[test.Group], caseName)
+			}
+		}
+
+		weight := big.NewRat(1, 1)
+		if pointsEnabled {
+			weight = &big.Rat{}
+			if test.Points != "" {
+				points, err := base.ParseRational(test.Points)
+				if err != nil {
+					i.unsupportedf("test %d has invalid points %q", testNumber, test.Points)
+				} else {
+					weight = points
+				}
+			}
+		}
+
+		inputPath := fmt.Sprintf(testset.InputPathPattern, testNumber)
+		if !i.hasFile(inputPath) {
+			if test.Method == "generated" {
+				missingInputs = append(missingInputs, fmt.Sprintf("%d (%s)", testNumber, test.Cmd))
+			} else {
+				missingInputs = append(missingInputs, strconv.Itoa(testNumber))
+			}
+			continue
+		}
+		caseWeights.AddCaseName(caseName, weight, true)
+		i.result.mapping[fmt.Sprintf("cases/%s.in", caseName)] = inputPath
+		answerPath := fmt.Sprintf(testset.AnswerPathPattern, testNumber)
+		hasAnswer := i.hasFile(answerPath)
+		if hasAnswer {
+			i.result.mapping[fmt.Sprintf("cases/%s.out", caseName)] = answerPath
+		} else {
+			missingAnswers = append(missingAnswers, strconv.Itoa(testNumber))
+		}
+		if test.Sample {
+			i.result.mapping[fmt.Sprintf("examples/%s.in", caseName)] = inputPath
+			if hasAnswer {
+				i.result.mapping[fmt.Sprintf("examples/%s.out", caseName)] = answerPath
+			}
+		}
+	}
+	if len(missingInputs) > 0 {
+		i.unsupportedf(
+			"the inputs of tests %s are not in the package, use a full package that includes the generated tests",
+			strings.Join(missingInputs, ", "),
+		)
+	}
+	if len(missingAnswers) > 0 {
+		i.warnf(
+			"the answers of tests %s are not in the package, they have to be generated with the official solution",
+			strings.Join(missingAnswers, ", "),
+		)
+	}
+
+	// Polygon can also assign the points to a group as a whole, instead of to
+	// its tests, so they are split among its cases.
+	for _, group := range testset.Groups {
+		cases := groupCases[group.Name]
+		if group.Points == "" || len(cases) == 0 {
+			continue
+		}
+		points, err := base.ParseRational(group.Points)
+		if err != nil {
+			i.unsupportedf("group %q has invalid points %q", group.Name, group.Points)
+			continue
+		}
+		groupName := strings.SplitN(cases[0], ".", 2)[0]
+		total := &big.Rat{}
+		for _, caseName := range cases {
+			if weight, ok := caseWeights[groupName][caseName]; ok {
+				total.Add(total, weight)
+			}
+		}
+		if total.Sign() != 0 || points.Sign() == 0 {
+			continue
+		}
+		remaining := new(big.Rat).Set(points)
+		for j, caseName := range cases {
+			if _, ok := caseWeights[groupName][caseName]; !ok {
+				continue
+			}
+			weight := new(big.Rat).Set(remaining)
+			if j < len(cases)-1 {
+				weight, _ = new(big.Rat).SetString(
+					new(big.Rat).Quo(points, big.NewRat(int64(len(cases)), 1)).FloatString(6),
+				)
+			}
+			remaining.Sub(remaining, weight)
+			caseWeights[groupName][caseName] = weight
+		}
+	}
+
+	return caseWeights
+}
+
+// importSolutions maps the official solution to solutions/solution.* and the
+// rest of the solutions to tests/solutions/, and returns the expectations
+// that can be represented in tests/tests.json.
+func (i *polygonImporter) importSolutions(problem *polygonProblem) []SolutionSettings {
+	solutionSettings := []SolutionSettings{}
+	for _, solution := range problem.Solutions {
+		language := polygonLanguage(solution.Source.Type)
+		if language == "" {
+			i.warnf(
+				"solution %s uses the unsupported language %q",
+				solution.Source.Path,
+				solution.Source.Type,
+			)
+			continue
+		}
+		extension := LanguageFileExtension(language)
+		if solution.Tag == "main" {
+			i.result.mapping[fmt.Sprintf("solutions/solution.%s", extension)] = solution.Source.Path
+			continue
+		}
+
+		filename := fmt.Sprintf(
+			"solutions/%s.%s",
+			strings.TrimSuffix(path.Base(solution.Source.Path), path.Ext(solution.Source.Path)),
+			extension,
+		)
+		i.result.mapping[path.Join("tests", filename)] = solution.Source.Path
+		setting := SolutionSettings{
+			Filename: filename,
+			Language: language,
+		}
+		switch solution.Tag {
+		case "accepted":
+			setting.Verdict = "AC"
+		case "time-limit-exceeded":
+			setting.Verdict = "TLE"
+		case "memory-limit-exceeded":
+			setting.Verdict = "MLE"
+		default:
+			i.warnf(
+				"solution %s has the tag %q, which has no equivalent in tests/tests.json, so its expected results have to be added by hand",
+				solution.Source.Path,
+				solution.Tag,
+			)
+			continue
+		}
+		solutionSettings = append(solutionSettings, setting)
+	}
+	return solutionSettings
+}
+
+// NewProblemFilesFromPolygon returns a ProblemFiles that exposes a Polygon
+// package (the contents of the .zip file that Polygon builds, with a
+// problem.xml at the top level) in omegaUp's layout, with a synthesized
+// settings.json, testplan and tests/tests.json. The tests are mapped to cases,
+// and the official solution and the solutions with a tag that can be
+// represented in tests/tests.json are mapped to solutions/ and tests/,
+// respectively.
+//
+// Features of the package that prevent the problem from being judged like in
+// Polygon (interactors, custom checkers, file input/output, missing tests)
+// make it return an error that lists all of them. The rest of the features
+// that were not imported, or that behave differently in omegaUp, are returned
+// as warnings so that the problem setter can port them by hand.
+func NewProblemFilesFromPolygon(files ProblemFiles) (ProblemFiles, []string, error) {
+	problemXML, err := files.GetContents("problem.xml")
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to read problem.xml from %s", files.String())
+	}
+	var problem polygonProblem
+	if err := xml.Unmarshal(problemXML, &problem); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to parse problem.xml from %s", files.String())
+	}
+
+	i := &polygonImporter{
+		packageFiles: make(map[string]struct{}),
+		result: &polygonProblemFiles{
+			files:    files,
+			contents: make(map[string]string),
+			mapping:  make(map[string]string),
+		},
+	}
+	for _, filename := range files.Files() {
+		i.packageFiles[filename] = struct{}{}
+	}
+
+	if len(problem.Judging.Testsets) == 0 {
+		return nil, nil, errors.Errorf("problem.xml from %s has no testsets", files.String())
+	}
+	testset := &problem.Judging.Testsets[0]
+	for j := range problem.Judging.Testsets {
+		if problem.Judging.Testsets[j].Name == "tests" {
+			testset = &problem.Judging.Testsets[j]
+		}
+	}
+	for _, otherTestset := range problem.Judging.Testsets {
+		if otherTestset.Name != testset.Name {
+			i.warnf("testset %q was not imported, only %q", otherTestset.Name, testset.Name)
+		}
+	}
+
+	if problem.Judging.InputFile != "" || problem.Judging.OutputFile != "" {
+		i.unsupportedf("reading from or writing to files instead of stdin and stdout")
+	}
+	if problem.Interactor != nil {
+		i.unsupportedf("interactors (%s)", problem.Interactor.Source.Path)
+	}
+
+	problemSettings := ProblemSettings{
+		Limits:    DefaultLimits,
+		Validator: ValidatorSettings{Name: ValidatorNameToken},
+	}
+	if testset.TimeLimit > 0 {
+		problemSettings.Limits.TimeLimit = base.Duration(time.Duration(testset.TimeLimit) * time.Millisecond)
+	}
+	if testset.MemoryLimit > 0 {
+		problemSettings.Limits.MemoryLimit = base.Byte(testset.MemoryLimit)
+	}
+	if problem.Checker != nil {
+		validator, ok := polygonStandardCheckers[problem.Checker.Name]
+		if !ok {
+			i.unsupportedf(
+				"custom checkers (%s), only the standard testlib checkers are supported",
+				problem.Checker.Source.Path,
+			)
+		}
+		if problem.Checker.Name == "std::lcmp.cpp" {
+			i.warnf(
+				"the checker %s compares the outputs line by line, but the token validator ignores line breaks",
+				problem.Checker.Name,
+			)
+		}
+		problemSettings.Validator = validator
+	}
+
+	caseWeights := i.importTests(testset)
+	problemSettings.Cases = caseWeights.ToGroupSettings()
+
+	testsSettings := TestsSettings{
+		Solutions: i.importSolutions(&problem),
+	}
+
+	if len(problem.Validators) > 0 {
+		var validators []string
+		for _, validator := range problem.Validators {
+			validators = append(validators, validator.Path)
+		}
+		i.warnf("the testlib input validators (%s) were not imported", strings.Join(validators, ", "))
+	}
+	if len(problem.Executables) > 0 {
+		var executables []string
+		for _, executable := range problem.Executables {
+			executables = append(executables, executable.Path)
+		}
+		i.warnf(
+			"the generators and other executables (%s) were not imported, only the tests in the package",
+			strings.Join(executables, ", "),
+		)
+	}
+	if len(problem.Statements) > 0 {
+		i.warnf("the statements were not imported")
+	}
+
+	if len(i.unsupported) > 0 {
+		return nil, i.warnings, errors.Errorf(
+			"%s uses features that are not supported: %s",
+			files.String(),
+			strings.Join(i.unsupported, "; "),
+		)
+	}
+
+	if err := i.addJSON("settings.json", &problemSettings); err != nil {
+		return nil, nil, err
+	}
+	if err := i.addJSON("tests/tests.json", &testsSettings); err != nil {
+		return nil, nil, err
+	}
+	var testplan strings.Builder
+	for _, group := range problemSettings.Cases {
+		for _, c := range group.Cases {
+			fmt.Fprintf(&testplan, "%s %s\n", c.Name, formatPolygonWeight(c.Weight))
+		}
+	}
+	i.result.contents["testplan"] = testplan.String()
+
+	for filename := range i.result.contents {
+		i.result.fileList = append(i.result.fileList, filename)
+	}
+	for filename := range i.result.mapping {
+		i.result.fileList = append(i.result.fileList, filename)
+	}
+	sort.Strings(i.result.fileList)
+
+	return i.result, i.warnings, nil
+}
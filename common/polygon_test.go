@@ -0,0 +1,320 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	base "github.com/omegaup/go-base/v3"
+)
+
+const testPolygonProblemXML = `<?xml version="1.0" encoding="utf-8" standalone="no"?>
+<problem revision="3" short-name="sums">
+  <names>
+    <name language="english" value="Sums"/>
+  </names>
+  <statements>
+    <statement charset="UTF-8" language="english" path="statements/english/problem.tex" type="application/x-tex"/>
+  </statements>
+  <judging input-file="" output-file="">
+    <testset name="tests">
+      <time-limit>2000</time-limit>
+      <memory-limit>268435456</memory-limit>
+      <test-count>6</test-count>
+      <input-path-pattern>tests/%02d</input-path-pattern>
+      <answer-path-pattern>tests/%02d.a</answer-path-pattern>
+      <tests>
+        <test method="manual" sample="true" group="samples"/>
+        <test method="generated" cmd="gen 1" group="1"/>
+        <test method="generated" cmd="gen 2" group="1"/>
+        <test method="generated" cmd="gen 3" group="1"/>
+        <test method="generated" cmd="gen 4" group="2" points="35"/>
+        <test method="generated" cmd="gen 5" group="2" points="35"/>
+      </tests>
+      <groups>
+        <group name="samples" points="0" points-policy="complete-group"/>
+        <group name="1" points="30" points-policy="complete-group"/>
+        <group name="2" points-policy="each-test">
+          <dependencies>
+            <dependency group="1"/>
+          </dependencies>
+        </group>
+      </groups>
+    </testset>
+  </judging>
+  <files>
+    <executables>
+      <executable>
+        <source path="files/gen.cpp" type="cpp.g++17"/>
+      </executable>
+    </executables>
+  </files>
+  <assets>
+    <checker name="std::rcmp6.cpp" type="testlib">
+      <source path="files/check.cpp" type="cpp.g++17"/>
+    </checker>
+    <validators>
+      <validator>
+        <source path="files/val.cpp" type="cpp.g++17"/>
+      </validator>
+    </validators>
+    <solutions>
+      <solution tag="main">
+        <source path="solutions/sums.cpp" type="cpp.g++17"/>
+      </solution>
+      <solution tag="accepted">
+        <source path="solutions/sums.py" type="python.3"/>
+      </solution>
+      <solution tag="time-limit-exceeded">
+        <source path="solutions/slow.cpp" type="cpp.g++20"/>
+      </solution>
+      <solution tag="wrong-answer">
+        <source path="solutions/wa.java" type="java11"/>
+      </solution>
+    </solutions>
+  </assets>
+</problem>
+`
+
+func newTestPolygonPackage(problemXML string) ProblemFiles {
+	contents := map[string]string{
+		"problem.xml":                    problemXML,
+		"files/check.cpp":                "// checker\n",
+		"files/gen.cpp":                  "// generator\n",
+		"files/val.cpp":                  "// validator\n",
+		"solutions/sums.cpp":             "// main\n",
+		"solutions/sums.py":              "# accepted\n",
+		"solutions/slow.cpp":             "// tle\n",
+		"solutions/wa.java":              "// wa\n",
+		"statements/english/problem.tex": "Sums\n",
+	}
+	for i := 1; i <= 6; i++ {
+		contents[fmt.Sprintf("tests/%02d", i)] = fmt.Sprintf("%d %d\n", i, i)
+		contents[fmt.Sprintf("tests/%02d.a", i)] = fmt.Sprintf("%d\n", 2*i)
+	}
+	return NewProblemFilesFromMap(contents, ":polygon:")
+}
+
+func TestProblemFilesFromPolygon(t *testing.T) {
+	f, warnings, err := NewProblemFilesFromPolygon(newTestPolygonPackage(testPolygonProblemXML))
+	if err != nil {
+		t.Fatalf("Failed to import Polygon package: %v", err)
+	}
+	defer f.Close()
+
+	for _, want := range []string{
+		`group "2" depends on groups 1`,
+		"the testlib input validators (files/val.cpp)",
+		"the generators and other executables (files/gen.cpp)",
+		`solution solutions/wa.java has the tag "wrong-answer"`,
+		"the statements were not imported",
+	} {
+		found := false
+		for _, warning := range warnings {
+			found = found || strings.Contains(warning, want)
+		}
+		if !found {
+			t.Errorf("warnings = %q, want one that contains %q", warnings, want)
+		}
+	}
+
+	expectedFiles := []string{
+		"cases/1.02.in", "cases/1.02.out",
+		"cases/1.03.in", "cases/1.03.out",
+		"cases/1.04.in", "cases/1.04.out",
+		"cases/2-05.in", "cases/2-05.out",
+		"cases/2-06.in", "cases/2-06.out",
+		"cases/samples.01.in", "cases/samples.01.out",
+		"examples/samples.01.in", "examples/samples.01.out",
+		"settings.json",
+		"solutions/solution.cpp",
+		"testplan",
+		"tests/solutions/slow.cpp",
+		"tests/solutions/sums.py",
+		"tests/solutions/wa.java",
+		"tests/tests.json",
+	}
+	if !reflect.DeepEqual(expectedFiles, f.Files()) {
+		t.Errorf("Files() = %v, want %v", f.Files(), expectedFiles)
+	}
+
+	for path, want := range map[string]string{
+		"cases/1.03.in":           "3 3\n",
+		"cases/2-06.out":          "12\n",
+		"examples/samples.01.in":  "1 1\n",
+		"solutions/solution.cpp":  "// main\n",
+		"tests/solutions/wa.java": "// wa\n",
+		"testplan": "1.02 10\n1.03 10\n1.04 10\n" +
+			"2-05 35\n2-06 35\n" +
+			"samples.01 0\n",
+	} {
+		contents, err := f.GetStringContents(path)
+		if err != nil {
+			t.Errorf("Failed to get contents of %q: %v", path, err)
+		} else if contents != want {
+			t.Errorf("Contents of %q = %q, want %q", path, contents, want)
+		}
+	}
+	if _, err := f.GetContents("tests/01"); !os.IsNotExist(err) {
+		t.Errorf("Package file unexpectedly found: want os.ErrNotExist; got %v", err)
+	}
+
+	var problemSettings ProblemSettings
+	settingsJSON, err := f.GetContents("settings.json")
+	if err != nil {
+		t.Fatalf("Failed to get settings.json: %v", err)
+	}
+	if err := json.Unmarshal(settingsJSON, &problemSettings); err != nil {
+		t.Fatalf("Failed to parse settings.json: %v", err)
+	}
+	if problemSettings.Limits.TimeLimit != base.Duration(2*time.Second) {
+		t.Errorf("TimeLimit = %v, want 2s", problemSettings.Limits.TimeLimit)
+	}
+	if problemSettings.Limits.MemoryLimit != 256*base.Mebibyte {
+		t.Errorf("MemoryLimit = %v, want 256MiB", problemSettings.Limits.MemoryLimit)
+	}
+	if problemSettings.Validator.Name != ValidatorNameTokenNumeric ||
+		problemSettings.Validator.Tolerance == nil ||
+		*problemSettings.Validator.Tolerance != 1e-6 {
+		t.Errorf("Validator = %+v, want token-numeric with a tolerance of 1e-6", problemSettings.Validator)
+	}
+	if len(problemSettings.Cases) != 4 {
+		t.Errorf("Cases = %v, want 4 groups", problemSettings.Cases)
+	}
+
+	var testsSettings TestsSettings
+	testsJSON, err := f.GetContents("tests/tests.json")
+	if err != nil {
+		t.Fatalf("Failed to get tests/tests.json: %v", err)
+	}
+	if err := json.Unmarshal(testsJSON, &testsSettings); err != nil {
+		t.Fatalf("Failed to parse tests/tests.json: %v", err)
+	}
+	expectedSolutions := []SolutionSettings{
+		{Filename: "solutions/sums.py", Language: "py3", Verdict: "AC"},
+		{Filename: "solutions/slow.cpp", Language: "cpp20-gcc", Verdict: "TLE"},
+	}
+	if !reflect.DeepEqual(expectedSolutions, testsSettings.Solutions) {
+		t.Errorf("Solutions = %v, want %v", testsSettings.Solutions, expectedSolutions)
+	}
+}
+
+func TestProblemFilesFromPolygonUnsupported(t *testing.T) {
+	problemXML := strings.NewReplacer(
+		`input-file=""`, `input-file="input.txt"`,
+		`name="std::rcmp6.cpp"`, ``,
+		`</validators>`, `</validators><interactor><source path="files/interactor.cpp" type="cpp.g++17"/></interactor>`,
+	).Replace(testPolygonProblemXML)
+	contents := newTestPolygonPackage(problemXML)
+	// Remove one of the generated tests.
+	files := make(map[string]string)
+	for _, filename := range contents.Files() {
+		if filename == "tests/03" {
+			continue
+		}
+		files[filename], _ = contents.GetStringContents(filename)
+	}
+
+	_, _, err := NewProblemFilesFromPolygon(NewProblemFilesFromMap(files, ":polygon:"))
+	if err == nil {
+		t.Fatalf("Importing the Polygon package unexpectedly succeeded")
+	}
+	for _, want := range []string{
+		"reading from or writing to files",
+		"interactors (files/interactor.cpp)",
+		"custom checkers (files/check.cpp)",
+		"the inputs of tests 3 (gen 2) are not in the package",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %q, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestProblemFilesFromPolygonCheckers(t *testing.T) {
+	for _, tc := range []struct {
+		checker       string
+		wantValidator ValidatorName
+		wantWarning   bool
+	}{
+		{checker: "std::wcmp.cpp", wantValidator: ValidatorNameToken},
+		{checker: "std::lcmp.cpp", wantValidator: ValidatorNameToken, wantWarning: true},
+		{checker: "std::fcmp.cpp", wantValidator: ValidatorNameLiteral},
+	} {
+		tc := tc
+		t.Run(tc.checker, func(t *testing.T) {
+			problemXML := strings.ReplaceAll(
+				testPolygonProblemXML,
+				`name="std::rcmp6.cpp"`,
+				fmt.Sprintf("name=%q", tc.checker),
+			)
+			f, warnings, err := NewProblemFilesFromPolygon(newTestPolygonPackage(problemXML))
+			if err != nil {
+				t.Fatalf("Failed to import Polygon package: %v", err)
+			}
+			defer f.Close()
+
+			var problemSettings ProblemSettings
+			settingsJSON, err := f.GetContents("settings.json")
+			if err != nil {
+				t.Fatalf("Failed to get settings.json: %v", err)
+			}
+			if err := json.Unmarshal(settingsJSON, &problemSettings); err != nil {
+				t.Fatalf("Failed to parse settings.json: %v", err)
+			}
+			if problemSettings.Validator.Name != tc.wantValidator {
+				t.Errorf("Validator = %+v, want %s", problemSettings.Validator, tc.wantValidator)
+			}
+			found := false
+			for _, warning := range warnings {
+				found = found || strings.Contains(warning, tc.checker)
+			}
+			if found != tc.wantWarning {
+				t.Errorf("warnings = %q, want a warning about %s: %v", warnings, tc.checker, tc.wantWarning)
+			}
+		})
+	}
+}
+
+func TestProblemFilesFromPolygonUnevenPoints(t *testing.T) {
+	problemXML := strings.ReplaceAll(
+		testPolygonProblemXML,
+		`<group name="1" points="30" points-policy="complete-group"/>`,
+		`<group name="1" points="100" points-policy="complete-group"/>`,
+	)
+	f, _, err := NewProblemFilesFromPolygon(newTestPolygonPackage(problemXML))
+	if err != nil {
+		t.Fatalf("Failed to import Polygon package: %v", err)
+	}
+	defer f.Close()
+
+	testplan, err := f.GetStringContents("testplan")
+	if err != nil {
+		t.Fatalf("Failed to get testplan: %v", err)
+	}
+	total := &big.Rat{}
+	var weights []string
+	for _, line := range strings.Split(strings.TrimSpace(testplan), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "1.") {
+			continue
+		}
+		weight, ok := new(big.Rat).SetString(fields[1])
+		if !ok {
+			t.Fatalf("invalid weight in testplan line %q", line)
+		}
+		total.Add(total, weight)
+		weights = append(weights, fields[1])
+	}
+	if want := []string{"33.333333", "33.333333", "33.333334"}; !reflect.DeepEqual(weights, want) {
+		t.Errorf("weights = %v, want %v", weights, want)
+	}
+	if total.Cmp(big.NewRat(100, 1)) != 0 {
+		t.Errorf("sum of the weights of group 1 = %s, want 100", total.FloatString(6))
+	}
+}
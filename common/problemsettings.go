@@ -199,6 +199,15 @@ var (
 		OverallWallTimeLimit: base.Duration(time.Duration(1) * time.Minute),
 		TimeLimit:            base.Duration(time.Duration(1) * time.Second),
 	}
+
+	// DefaultTimeLimitSafetyMargin is the default TimeLimitSettings.SafetyMargin.
+	DefaultTimeLimitSafetyMargin = 0.5
+
+	// DefaultTimeLimitMinHeadroom is the default TimeLimitSettings.MinHeadroom.
+	DefaultTimeLimitMinHeadroom = 0.25
+
+	// DefaultStressIterations is the default StressSettings.Iterations.
+	DefaultStressIterations int64 = 100
 )
 
 // ScoreRange represents a minimum and a maximum score.
@@ -242,14 +251,35 @@ func (r *ScoreRange) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// GroupSolutionSettings represents the expected score range and/or verdict of
+// a solution in the groups whose names match Group, which is a pattern in the
+// syntax of path.Match (e.g. "easy", "sub*" or "*"). The score range is
+// relative to the maximum score of each group, and the verdict of a group is
+// the worst verdict of its cases.
+type GroupSolutionSettings struct {
+	Group      string      `json:"group"`
+	ScoreRange *ScoreRange `json:"score_range,omitempty"`
+	Verdict    string      `json:"verdict,omitempty"`
+}
+
+// String returns a string representation of the GroupSolutionSettings.
+func (s *GroupSolutionSettings) String() string {
+	if s == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%+v", *s)
+}
+
 // SolutionSettings represents a single testcase with an expected score range
-// and/or verdict. At least one of those must be present.
+// and/or verdict, either overall or per group. At least one of those must be
+// present.
 type SolutionSettings struct {
-	Filename                   string      `json:"filename"`
-	ScoreRange                 *ScoreRange `json:"score_range,omitempty"`
-	Verdict                    string      `json:"verdict,omitempty"`
-	Language                   string      `json:"language,omitempty"`
-	AllowFractionalPercentages bool        `json:"allow_fractional_percentages,omitempty"`
+	Filename                   string                  `json:"filename"`
+	ScoreRange                 *ScoreRange             `json:"score_range,omitempty"`
+	Verdict                    string                  `json:"verdict,omitempty"`
+	Groups                     []GroupSolutionSettings `json:"groups,omitempty"`
+	Language                   string                  `json:"language,omitempty"`
+	AllowFractionalPercentages bool                    `json:"allow_fractional_percentages,omitempty"`
 }
 
 // String returns a string representation of the SolutionSettings.
@@ -266,12 +296,56 @@ type InputsValidatorSettings struct {
 	Language string `json:"language,omitempty"`
 }
 
+// StressSettings represent a stress test, in which random inputs are created
+// by a generator and the outputs of a solution for them are compared against
+// the ones of a (slower, but simpler) brute-force solution. The generator
+// reads the seed from stdin and writes the input to stdout. All filenames are
+// relative to the tests/ directory.
+type StressSettings struct {
+	Generator          string `json:"generator"`
+	GeneratorLanguage  string `json:"generator_language,omitempty"`
+	BruteForce         string `json:"brute_force"`
+	BruteForceLanguage string `json:"brute_force_language,omitempty"`
+
+	// Solution is the solution that is tested. Defaults to the official
+	// solution in solutions/solution.*.
+	Solution         string `json:"solution,omitempty"`
+	SolutionLanguage string `json:"solution_language,omitempty"`
+
+	MinSeed int64 `json:"min_seed"`
+	MaxSeed int64 `json:"max_seed"`
+
+	// Iterations is the maximum number of seeds that are tried, starting
+	// from MinSeed. Defaults to DefaultStressIterations.
+	Iterations int64 `json:"iterations,omitempty"`
+}
+
+// TimeLimitSettings control the analysis of the solution timings that is
+// used to recommend a time limit for the problem.
+type TimeLimitSettings struct {
+	// SafetyMargin is the fraction of the slowest accepted time that is added
+	// to it to get the recommended time limit. Defaults to
+	// DefaultTimeLimitSafetyMargin.
+	SafetyMargin float64 `json:"safety_margin,omitempty"`
+
+	// MinHeadroom is the fraction of the current time limit that the slowest
+	// accepted solution must leave unused. Defaults to
+	// DefaultTimeLimitMinHeadroom.
+	MinHeadroom float64 `json:"min_headroom,omitempty"`
+
+	// FailOnInsufficientHeadroom makes the CI run fail when the slowest
+	// accepted solution leaves less than MinHeadroom of the time limit unused.
+	FailOnInsufficientHeadroom bool `json:"fail_on_insufficient_headroom,omitempty"`
+}
+
 // TestsSettings represent the tests that are to be run against the problem
 // itself. They are stored in tests/settings.json.
 type TestsSettings struct {
 	Solutions        []SolutionSettings       `json:"solutions"`
 	InputsValidator  *InputsValidatorSettings `json:"inputs,omitempty"`
 	ExpectedMaxScore *base.Rat                `json:"max_score,omitempty"`
+	TimeLimit        *TimeLimitSettings       `json:"time_limit,omitempty"`
+	Stress           *StressSettings          `json:"stress,omitempty"`
 }
 
 var (
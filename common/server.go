@@ -17,6 +17,26 @@ func RunServer(
 	wg *sync.WaitGroup,
 	addr string,
 	insecure bool,
+) *http.Server {
+	return RunServerWithClientAuth(
+		tlsConfig,
+		tls.RequireAndVerifyClientCert,
+		handler,
+		wg,
+		addr,
+		insecure,
+	)
+}
+
+// RunServerWithClientAuth is like RunServer, but allows choosing the policy
+// for TLS client certificates.
+func RunServerWithClientAuth(
+	tlsConfig *TLSConfig,
+	clientAuth tls.ClientAuthType,
+	handler http.Handler,
+	wg *sync.WaitGroup,
+	addr string,
+	insecure bool,
 ) *http.Server {
 	server := &http.Server{
 		Addr:    addr,
@@ -41,7 +61,7 @@ func RunServer(
 
 		config := &tls.Config{
 			ClientCAs:  certPool,
-			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientAuth: clientAuth,
 		}
 		config.BuildNameToCertificate()
 		server.TLSConfig = config
@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/omegaup/quark/common"
 )
@@ -17,6 +19,8 @@ type Context struct {
 	QueueManager          *QueueManager
 	InflightMonitor       *InflightMonitor
 	InputManager          *common.InputManager
+	RunnerRegistry        *RunnerRegistry
+	RunnerHealth          *RunnerHealthMonitor
 	LibinteractiveVersion string
 }
 
@@ -60,14 +64,51 @@ func NewContext(reader io.Reader) (*Context, error) {
 		return nil, err
 	}
 
+	queueManager := NewQueueManager(
+		ctx.Config.Grader.ChannelLength,
+		ctx.Config.Grader.RuntimePath,
+	)
+	queueManager.SetInputAffinityDelay(
+		time.Duration(ctx.Config.Grader.InputAffinityDelay),
+	)
+	if err := queueManager.SetFairShareKey(ctx.Config.Grader.FairShareKey); err != nil {
+		return nil, err
+	}
+	queueManager.SetMaxQueueWait([QueueCount]time.Duration{
+		QueuePriorityNormal:    time.Duration(ctx.Config.Grader.MaxQueueWait.Normal),
+		QueuePriorityLow:       time.Duration(ctx.Config.Grader.MaxQueueWait.Low),
+		QueuePriorityEphemeral: time.Duration(ctx.Config.Grader.MaxQueueWait.Ephemeral),
+	})
+
+	inflightMonitor := NewInflightMonitor()
+	inflightMonitor.SetTimeouts(
+		time.Duration(ctx.Config.Grader.Heartbeat.Timeout),
+		time.Duration(ctx.Config.Grader.Heartbeat.DeadlineBase),
+		ctx.Config.Grader.Heartbeat.WallTimeFactor,
+	)
+
+	runnerHealth := NewRunnerHealthMonitor()
+	runnerHealth.SetThresholds(
+		time.Duration(ctx.Config.Grader.Quarantine.Window),
+		ctx.Config.Grader.Quarantine.MinSamples,
+		ctx.Config.Grader.Quarantine.Threshold,
+	)
+	inflightMonitor.SetRunnerHealthMonitor(runnerHealth)
+
+	runnerRegistry, err := NewRunnerRegistry(
+		path.Join(ctx.Config.Grader.RuntimePath, RunnerRegistryFilename),
+	)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Context{
-		Context: *ctx,
-		QueueManager: NewQueueManager(
-			ctx.Config.Grader.ChannelLength,
-			ctx.Config.Grader.RuntimePath,
-		),
-		InflightMonitor:       NewInflightMonitor(),
+		Context:               *ctx,
+		QueueManager:          queueManager,
+		InflightMonitor:       inflightMonitor,
 		InputManager:          common.NewInputManager(ctx),
+		RunnerRegistry:        runnerRegistry,
+		RunnerHealth:          runnerHealth,
 		LibinteractiveVersion: libinteractiveVersion,
 	}, nil
 }
@@ -1,7 +1,10 @@
 package grader
 
 import (
+	"archive/tar"
 	"bufio"
+	"compress/gzip"
+	"crypto/sha1"
 	"encoding/json"
 	stderrors "errors"
 	"fmt"
@@ -197,10 +200,71 @@ func (input *graderBaseInput) getStoredLength() (int64, error) {
 	return strconv.ParseInt(scanner.Text(), 10, 64)
 }
 
+// getFileHashes returns the SHA-1 hashes of all the files contained in the
+// archive. Since this requires reading the whole archive, the result is
+// stored alongside it so that it's only calculated once.
+func (input *graderBaseInput) getFileHashes() (map[string]string, error) {
+	manifestPath := fmt.Sprintf("%s.files.sha1", input.archivePath)
+	if manifestFd, err := os.Open(manifestPath); err == nil {
+		defer manifestFd.Close()
+		return common.ReadInputManifest(manifestFd)
+	}
+
+	fd, err := os.Open(input.archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	archive := tar.NewReader(gz)
+
+	manifest := make(map[string]string)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		hasher := sha1.New()
+		if _, err := io.Copy(hasher, archive); err != nil {
+			return nil, err
+		}
+		manifest[path.Clean(hdr.Name)] = fmt.Sprintf("%0x", hasher.Sum(nil))
+	}
+
+	// Multiple runners might be requesting this at the same time, so each one
+	// of them gets its own temporary file.
+	manifestFd, err := os.CreateTemp(path.Dir(manifestPath), path.Base(manifestPath)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := manifestFd.Name()
+	defer os.Remove(tmpPath)
+	err = common.WriteInputManifest(manifestFd, manifest)
+	manifestFd.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
 func (input *graderBaseInput) Delete() error {
 	os.Remove(fmt.Sprintf("%s.tmp", input.archivePath))
 	os.Remove(fmt.Sprintf("%s.sha1", input.archivePath))
 	os.Remove(fmt.Sprintf("%s.len", input.archivePath))
+	os.Remove(fmt.Sprintf("%s.files.sha1", input.archivePath))
 	return os.Remove(input.archivePath)
 }
 
@@ -227,6 +291,116 @@ func (input *graderBaseInput) Transmit(w http.ResponseWriter) error {
 	return err
 }
 
+// TransmitRange sends a serialized version of the Input to the runner,
+// honoring any range request so that runners can resume interrupted
+// transfers. The ETag is derived from the stored hash and the length of the
+// archive, so it changes whenever the contents do.
+func (input *graderBaseInput) TransmitRange(w http.ResponseWriter, r *http.Request) error {
+	fd, err := os.Open(input.archivePath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	stat, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	w.Header().Add("Content-Type", "application/x-gzip")
+	w.Header().Add("Content-SHA1", input.storedHash)
+	w.Header().Add(
+		"X-Content-Uncompressed-Size", strconv.FormatInt(input.uncompressedSize, 10),
+	)
+	w.Header().Set("ETag", fmt.Sprintf("\"%s-%d\"", input.storedHash, stat.Size()))
+	http.ServeContent(w, r, "", time.Time{}, fd)
+	return nil
+}
+
+// TransmitDelta sends only the files that differ from the ones described in
+// the runner-provided manifest, preceded by the common.InputDelta that
+// describes how to reconstruct the Input from the files the runner already
+// has.
+func (input *graderBaseInput) TransmitDelta(
+	w http.ResponseWriter,
+	manifest map[string]string,
+) error {
+	fileHashes, err := input.getFileHashes()
+	if err != nil {
+		return err
+	}
+	delta, modified := common.NewInputDelta(manifest, fileHashes)
+	modifiedSet := make(map[string]struct{}, len(modified))
+	for _, filename := range modified {
+		modifiedSet[filename] = struct{}{}
+	}
+	encodedDelta, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.Open(input.archivePath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	archive := tar.NewReader(gz)
+
+	w.Header().Add("Content-Type", "application/x-gzip")
+	w.Header().Add(common.InputDeltaHeader, "1")
+	w.WriteHeader(http.StatusOK)
+
+	gzw := gzip.NewWriter(w)
+	defer gzw.Close()
+	archiveWriter := tar.NewWriter(gzw)
+	defer archiveWriter.Close()
+
+	if err := archiveWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     common.InputDeltaManifestName,
+		Mode:     0644,
+		Size:     int64(len(encodedDelta)),
+	}); err != nil {
+		return err
+	}
+	if _, err := archiveWriter.Write(encodedDelta); err != nil {
+		return err
+	}
+
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		filename := path.Clean(hdr.Name)
+		if _, ok := modifiedSet[filename]; !ok {
+			continue
+		}
+		if err := archiveWriter.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filename,
+			Mode:     hdr.Mode,
+			Size:     hdr.Size,
+			ModTime:  hdr.ModTime,
+		}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(archiveWriter, archive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Input is a common.Input generated from a git repository that is then stored
 // in a .tar.gz file that can be sent to a runner.
 type Input struct {
@@ -306,6 +480,21 @@ func (input *Input) Transmit(w http.ResponseWriter) error {
 	return input.graderBaseInput.Transmit(w)
 }
 
+// TransmitRange sends a serialized version of the Input to the runner,
+// honoring any range request.
+func (input *Input) TransmitRange(w http.ResponseWriter, r *http.Request) error {
+	return input.graderBaseInput.TransmitRange(w, r)
+}
+
+// TransmitDelta sends the files of the Input that differ from the ones in the
+// provided manifest to the runner.
+func (input *Input) TransmitDelta(
+	w http.ResponseWriter,
+	manifest map[string]string,
+) error {
+	return input.graderBaseInput.TransmitDelta(w, manifest)
+}
+
 // InputFactory is a common.InputFactory that can store specific versions of a
 // problem's git repository into a .tar.gz file that can be easily shipped to
 // runners.
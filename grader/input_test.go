@@ -1,8 +1,14 @@
 package grader
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
+	"crypto/sha1"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"net/http"
@@ -285,3 +291,151 @@ func TestTransmitInput(t *testing.T) {
 		}
 	}
 }
+
+func TestTransmitInputDelta(t *testing.T) {
+	dirname, err := ioutil.TempDir("/tmp", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %q", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	files := []struct {
+		name, contents string
+	}{
+		{"cases/0.in", "1 2"},
+		{"cases/0.out", "3"},
+		{"settings.json", "{}"},
+	}
+	archivePath := path.Join(dirname, "input.tar.gz")
+	archiveFd, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %q", err)
+	}
+	gz := gzip.NewWriter(archiveFd)
+	archive := tar.NewWriter(gz)
+	for _, file := range files {
+		if err := archive.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Mode:     0644,
+			Size:     int64(len(file.contents)),
+		}); err != nil {
+			t.Fatalf("Failed to write header: %q", err)
+		}
+		if _, err := archive.Write([]byte(file.contents)); err != nil {
+			t.Fatalf("Failed to write file: %q", err)
+		}
+	}
+	archive.Close()
+	gz.Close()
+	archiveFd.Close()
+
+	input := &graderBaseInput{archivePath: archivePath}
+	w := httptest.NewRecorder()
+	if err := input.TransmitDelta(w, map[string]string{
+		// Unchanged.
+		"cases/0.in": fmt.Sprintf("%0x", sha1.Sum([]byte("1 2"))),
+		// Modified.
+		"cases/0.out": fmt.Sprintf("%0x", sha1.Sum([]byte("4"))),
+		// Deleted.
+		"cases/1.in": fmt.Sprintf("%0x", sha1.Sum([]byte("2 3"))),
+	}); err != nil {
+		t.Fatalf("Failed to transmit input delta: %q", err)
+	}
+	if w.Header().Get(common.InputDeltaHeader) == "" {
+		t.Fatalf("Missing %s header", common.InputDeltaHeader)
+	}
+
+	gzr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Failed to open delta: %q", err)
+	}
+	deltaArchive := tar.NewReader(gzr)
+	hdr, err := deltaArchive.Next()
+	if err != nil || hdr.Name != common.InputDeltaManifestName {
+		t.Fatalf("Unexpected first entry %v: %q", hdr, err)
+	}
+	var delta common.InputDelta
+	if err := json.NewDecoder(deltaArchive).Decode(&delta); err != nil {
+		t.Fatalf("Failed to decode delta: %q", err)
+	}
+	if len(delta.Files) != len(files) {
+		t.Errorf("delta.Files == %v, want %d entries", delta.Files, len(files))
+	}
+	if !reflect.DeepEqual(delta.Deleted, []string{"cases/1.in"}) {
+		t.Errorf("delta.Deleted == %v, want %v", delta.Deleted, []string{"cases/1.in"})
+	}
+	var transmitted []string
+	for {
+		hdr, err := deltaArchive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read delta: %q", err)
+		}
+		transmitted = append(transmitted, hdr.Name)
+	}
+	if !reflect.DeepEqual(transmitted, []string{"cases/0.out", "settings.json"}) {
+		t.Errorf("transmitted == %v, want %v", transmitted, []string{"cases/0.out", "settings.json"})
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("%s.files.sha1", archivePath)); err != nil {
+		t.Errorf("Failed to cache the file hashes: %q", err)
+	}
+}
+
+func TestTransmitInputRange(t *testing.T) {
+	dirname, err := ioutil.TempDir("/tmp", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %q", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	contents := []byte(strings.Repeat("0123456789", 10))
+	archivePath := path.Join(dirname, "input.tar.gz")
+	if err := ioutil.WriteFile(archivePath, contents, 0644); err != nil {
+		t.Fatalf("Failed to create archive: %q", err)
+	}
+	input := &graderBaseInput{
+		archivePath:      archivePath,
+		storedHash:       fmt.Sprintf("%0x", sha1.Sum(contents)),
+		uncompressedSize: int64(len(contents)),
+	}
+
+	w := httptest.NewRecorder()
+	if err := input.TransmitRange(w, httptest.NewRequest("GET", "/input/", nil)); err != nil {
+		t.Fatalf("Failed to transmit input: %q", err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("status == %d, want %d", w.Code, http.StatusOK)
+	}
+	etag := w.Header().Get("ETag")
+	expectedETag := fmt.Sprintf("\"%s-%d\"", input.storedHash, len(contents))
+	if etag != expectedETag {
+		t.Fatalf("ETag == %q, want %q", etag, expectedETag)
+	}
+
+	for _, tc := range []struct {
+		ifRange      string
+		expectedCode int
+		expectedBody []byte
+	}{
+		{etag, http.StatusPartialContent, contents[40:]},
+		{"\"stale\"", http.StatusOK, contents},
+	} {
+		r := httptest.NewRequest("GET", "/input/", nil)
+		r.Header.Set("Range", "bytes=40-")
+		r.Header.Set("If-Range", tc.ifRange)
+		w := httptest.NewRecorder()
+		if err := input.TransmitRange(w, r); err != nil {
+			t.Fatalf("Failed to transmit input: %q", err)
+		}
+		if w.Code != tc.expectedCode {
+			t.Errorf("If-Range %s: status == %d, want %d", tc.ifRange, w.Code, tc.expectedCode)
+		}
+		if !reflect.DeepEqual(w.Body.Bytes(), tc.expectedBody) {
+			t.Errorf("If-Range %s: body == %q, want %q", tc.ifRange, w.Body.Bytes(), tc.expectedBody)
+		}
+	}
+}
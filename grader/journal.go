@@ -0,0 +1,720 @@
+package grader
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
+	"github.com/omegaup/quark/common"
+	"github.com/pkg/errors"
+)
+
+const (
+	// QueueJournalFilename is the name of the file in the grader runtime path
+	// where the queue write-ahead journal is stored.
+	QueueJournalFilename = "queue.journal"
+
+	// journalCompactionThreshold is the minimum number of records that need to
+	// be written to the journal before it is considered for compaction.
+	journalCompactionThreshold = 10000
+)
+
+// journalRecordType is the type of a record in the queue journal.
+type journalRecordType string
+
+const (
+	// journalRecordEnqueue is written when a run is added to a Queue for the
+	// first time.
+	journalRecordEnqueue = journalRecordType("enqueue")
+	// journalRecordDequeue is written when a run is handed off to a runner.
+	journalRecordDequeue = journalRecordType("dequeue")
+	// journalRecordRequeue is written when a run is added back to a Queue after
+	// an unsuccessful attempt.
+	journalRecordRequeue = journalRecordType("requeue")
+	// journalRecordPromote is written when a run that waited for too long is
+	// moved to a higher priority.
+	journalRecordPromote = journalRecordType("promote")
+	// journalRecordClose is written when a run is finished.
+	journalRecordClose = journalRecordType("close")
+)
+
+// journaledRun is the serializable subset of a RunInfo that is needed to
+// reconstruct it after the grader restarts.
+type journaledRun struct {
+	ID            int64         `json:"id,omitempty"`
+	SubmissionID  int64         `json:"submission_id,omitempty"`
+	GUID          string        `json:"guid,omitempty"`
+	Username      string        `json:"username,omitempty"`
+	Contest       *string       `json:"contest,omitempty"`
+	Problemset    *int64        `json:"problemset,omitempty"`
+	Priority      QueuePriority `json:"priority"`
+	PenaltyType   string        `json:"penalty_type,omitempty"`
+	ScoreMode     string        `json:"score_mode,omitempty"`
+	CreationTime  time.Time     `json:"creation_time"`
+	ArtifactsPath string        `json:"artifacts_path,omitempty"`
+
+	Source      string   `json:"source"`
+	Language    string   `json:"language"`
+	ProblemName string   `json:"problem,omitempty"`
+	Commit      string   `json:"commit,omitempty"`
+	InputHash   string   `json:"input_hash"`
+	MaxScore    *big.Rat `json:"max_score"`
+	Debug       bool     `json:"debug,omitempty"`
+}
+
+func newJournaledRun(runInfo *RunInfo) *journaledRun {
+	run := &journaledRun{
+		ID:           runInfo.ID,
+		SubmissionID: runInfo.SubmissionID,
+		GUID:         runInfo.GUID,
+		Username:     runInfo.Username,
+		Contest:      runInfo.Contest,
+		Problemset:   runInfo.Problemset,
+		Priority:     runInfo.Priority,
+		PenaltyType:  runInfo.PenaltyType,
+		ScoreMode:    runInfo.ScoreMode,
+		CreationTime: runInfo.CreationTime,
+
+		Source:      runInfo.Run.Source,
+		Language:    runInfo.Run.Language,
+		ProblemName: runInfo.Run.ProblemName,
+		Commit:      runInfo.Run.Commit,
+		InputHash:   runInfo.Run.InputHash,
+		MaxScore:    runInfo.Run.MaxScore,
+		Debug:       runInfo.Run.Debug,
+	}
+	if artifacts, ok := runInfo.Artifacts.(*localGraderArtifacts); ok {
+		run.ArtifactsPath = artifacts.gradeDir
+	}
+	return run
+}
+
+// runInfo reconstructs the RunInfo. The artifacts still need to be set by the
+// caller.
+func (run *journaledRun) runInfo() *RunInfo {
+	maxScore := run.MaxScore
+	if maxScore == nil {
+		maxScore = big.NewRat(1, 1)
+	}
+	runInfo := NewRunInfo()
+	runInfo.ID = run.ID
+	runInfo.SubmissionID = run.SubmissionID
+	runInfo.GUID = run.GUID
+	runInfo.Username = run.Username
+	runInfo.Contest = run.Contest
+	runInfo.Problemset = run.Problemset
+	runInfo.Priority = run.Priority
+	runInfo.PenaltyType = run.PenaltyType
+	runInfo.ScoreMode = run.ScoreMode
+	runInfo.CreationTime = run.CreationTime
+	runInfo.Run.Source = run.Source
+	runInfo.Run.Language = run.Language
+	runInfo.Run.ProblemName = run.ProblemName
+	runInfo.Run.Commit = run.Commit
+	runInfo.Run.InputHash = run.InputHash
+	runInfo.Run.MaxScore = maxScore
+	runInfo.Run.Debug = run.Debug
+	runInfo.Result.MaxScore = maxScore
+	return runInfo
+}
+
+// journalRecord is a single entry in the queue journal.
+type journalRecord struct {
+	Type         journalRecordType `json:"type"`
+	ID           uint64            `json:"id"`
+	Queue        string            `json:"queue,omitempty"`
+	Priority     QueuePriority     `json:"priority"`
+	AttemptsLeft int               `json:"attempts_left,omitempty"`
+	AttemptID    uint64            `json:"attempt_id,omitempty"`
+	QueueTime    *time.Time        `json:"queue_time,omitempty"`
+	Runner       string            `json:"runner,omitempty"`
+	Run          *journaledRun     `json:"run,omitempty"`
+}
+
+// journalEntry is the state of a run that has not been closed yet, as
+// reconstructed from the journal.
+type journalEntry struct {
+	// seq is the position in the journal of the last time the run was added to
+	// a queue, used to restore the queue order.
+	seq uint64
+
+	id           uint64
+	queue        string
+	priority     QueuePriority
+	attemptsLeft int
+	attemptID    uint64
+	queueTime    time.Time
+	run          *journaledRun
+
+	// runner is the name of the runner that has the run in-flight, or empty if
+	// the run is sitting on a queue.
+	runner string
+}
+
+// applyJournalRecord updates the journal entries with the provided record.
+func applyJournalRecord(
+	entries map[uint64]*journalEntry,
+	seq uint64,
+	record *journalRecord,
+) error {
+	switch record.Type {
+	case journalRecordEnqueue:
+		if record.Run == nil {
+			return errors.Errorf("enqueue record for run %d without run information", record.ID)
+		}
+		queueTime := record.Run.CreationTime
+		if record.QueueTime != nil {
+			queueTime = *record.QueueTime
+		}
+		entries[record.ID] = &journalEntry{
+			seq:          seq,
+			id:           record.ID,
+			queue:        record.Queue,
+			priority:     record.Priority,
+			attemptsLeft: record.AttemptsLeft,
+			attemptID:    record.AttemptID,
+			queueTime:    queueTime,
+			run:          record.Run,
+		}
+		return nil
+	case journalRecordClose:
+		delete(entries, record.ID)
+		return nil
+	}
+
+	entry, ok := entries[record.ID]
+	if !ok {
+		// The enqueue record could not be written, so this run cannot be
+		// restored anyways.
+		return nil
+	}
+	switch record.Type {
+	case journalRecordDequeue:
+		entry.attemptID = record.AttemptID
+		entry.runner = record.Runner
+	case journalRecordRequeue:
+		entry.seq = seq
+		entry.priority = record.Priority
+		entry.attemptsLeft = record.AttemptsLeft
+		entry.attemptID = record.AttemptID
+		entry.runner = ""
+		if record.QueueTime != nil {
+			entry.queueTime = *record.QueueTime
+		}
+	case journalRecordPromote:
+		entry.priority = record.Priority
+	default:
+		return errors.Errorf("unknown record type %q", record.Type)
+	}
+	return nil
+}
+
+// replayJournal reads all the records in the journal and returns the runs that
+// were not closed, in the order in which they were added to their queues. A
+// truncated last record (e.g. due to the grader crashing in the middle of a
+// write) is ignored.
+func replayJournal(r io.Reader) ([]*journalEntry, error) {
+	entries := make(map[uint64]*journalEntry)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var seq uint64
+	var pendingErr error
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if pendingErr != nil {
+			// Only the very last record is allowed to be corrupted.
+			return nil, pendingErr
+		}
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			pendingErr = errors.Wrapf(err, "failed to parse record %d", seq)
+			continue
+		}
+		if err := applyJournalRecord(entries, seq, &record); err != nil {
+			return nil, err
+		}
+		seq++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read journal")
+	}
+
+	result := make([]*journalEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].seq < result[j].seq
+	})
+	return result, nil
+}
+
+// queueJournal is a write-ahead journal of all the state changes of the runs
+// in the QueueManager, so that they can be restored when the grader restarts.
+// All the methods are safe to call on a nil *queueJournal, in which case they
+// do nothing.
+//
+// Records are written under the lock, but synced to disk outside of it: the
+// callers that wait for their records to be synced while another sync is in
+// progress are all covered by a single sync once it finishes.
+type queueJournal struct {
+	sync.Mutex
+	path    string
+	f       *os.File
+	log     logging.Logger
+	entries map[uint64]*journalEntry
+	nextID  uint64
+	seq     uint64
+	written int
+
+	// appended is the number of records that have been written to the journal
+	// file since it was opened, and synced is how many of those are known to
+	// be on disk. Both are guarded by the lock.
+	appended uint64
+	synced   uint64
+	// syncLock makes sure that only one sync is in progress at a time.
+	syncLock sync.Mutex
+}
+
+// openQueueJournal replays the journal found in the provided path, rewrites
+// it so that it only contains the runs that are still alive, and opens it for
+// appending.
+func openQueueJournal(
+	journalPath string,
+	log logging.Logger,
+) (*queueJournal, []*journalEntry, error) {
+	var entries []*journalEntry
+	f, err := os.Open(journalPath)
+	if err == nil {
+		entries, err = replayJournal(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to replay %s", journalPath)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, errors.Wrapf(err, "failed to open %s", journalPath)
+	}
+
+	journal := &queueJournal{
+		path:    journalPath,
+		log:     log,
+		entries: make(map[uint64]*journalEntry),
+	}
+	for _, entry := range entries {
+		journal.entries[entry.id] = entry
+		if entry.id >= journal.nextID {
+			journal.nextID = entry.id + 1
+		}
+	}
+	if journal.nextID == 0 {
+		journal.nextID = 1
+	}
+	if err := journal.compact(); err != nil {
+		return nil, nil, err
+	}
+	return journal, entries, nil
+}
+
+// compact rewrites the journal so that it only contains the runs that are
+// still alive. The caller must hold the lock.
+func (journal *queueJournal) compact() error {
+	entries := make([]*journalEntry, 0, len(journal.entries))
+	for _, entry := range journal.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	f, err := os.CreateTemp(path.Dir(journal.path), fmt.Sprintf(".%s~", path.Base(journal.path)))
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary journal")
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	journal.seq = 0
+	for _, entry := range entries {
+		entry.seq = journal.seq
+		journal.seq++
+		records := []*journalRecord{{
+			Type:         journalRecordEnqueue,
+			ID:           entry.id,
+			Queue:        entry.queue,
+			Priority:     entry.priority,
+			AttemptsLeft: entry.attemptsLeft,
+			AttemptID:    entry.attemptID,
+			QueueTime:    &entry.queueTime,
+			Run:          entry.run,
+		}}
+		if entry.runner != "" {
+			records = append(records, &journalRecord{
+				Type:      journalRecordDequeue,
+				ID:        entry.id,
+				AttemptID: entry.attemptID,
+				Runner:    entry.runner,
+			})
+			journal.seq++
+		}
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				f.Close()
+				return errors.Wrap(err, "failed to write journal")
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write journal")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to sync journal")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close journal")
+	}
+	if err := os.Rename(f.Name(), journal.path); err != nil {
+		return errors.Wrap(err, "failed to rename journal")
+	}
+
+	if journal.f != nil {
+		journal.f.Close()
+	}
+	journal.f, err = os.OpenFile(journal.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		journal.f = nil
+		return errors.Wrap(err, "failed to reopen journal")
+	}
+	journal.written = int(journal.seq)
+	// Everything that was appended so far is in the compacted journal, which
+	// was already synced.
+	journal.synced = journal.appended
+	return nil
+}
+
+// append durably writes a record to the journal. Any errors are logged, since
+// failing to write to the journal should not prevent runs from being graded.
+func (journal *queueJournal) append(record *journalRecord) {
+	if journal == nil {
+		return
+	}
+	if target, ok := journal.write(record); ok {
+		journal.sync(target)
+	}
+}
+
+// write applies the record and writes it to the journal file, without syncing
+// it. It returns the number of appended records that need to be synced for
+// this one to be on disk, and whether a sync is needed at all.
+func (journal *queueJournal) write(record *journalRecord) (uint64, bool) {
+	journal.Lock()
+	defer journal.Unlock()
+
+	if err := applyJournalRecord(journal.entries, journal.seq, record); err != nil {
+		journal.log.Error(
+			"Invalid queue journal record",
+			map[string]any{
+				"record": record,
+				"err":    err,
+			},
+		)
+		return 0, false
+	}
+	journal.seq++
+
+	if journal.written >= journalCompactionThreshold &&
+		journal.written >= 4*len(journal.entries) {
+		// The record is already reflected in the entries, so there is no need to
+		// write it separately.
+		if err := journal.compact(); err != nil {
+			journal.log.Error(
+				"Failed to compact queue journal",
+				map[string]any{
+					"path": journal.path,
+					"err":  err,
+				},
+			)
+		}
+		return 0, false
+	}
+	if journal.f == nil {
+		return 0, false
+	}
+
+	line, err := json.Marshal(record)
+	if err == nil {
+		_, err = journal.f.Write(append(line, '\n'))
+	}
+	if err != nil {
+		journal.log.Error(
+			"Failed to write queue journal record",
+			map[string]any{
+				"path":   journal.path,
+				"record": record,
+				"err":    err,
+			},
+		)
+		return 0, false
+	}
+	journal.written++
+	journal.appended++
+	return journal.appended, true
+}
+
+// sync makes sure that at least target appended records are on disk. If
+// another sync is in progress, it waits for it, since it might have already
+// covered them.
+func (journal *queueJournal) sync(target uint64) {
+	journal.syncLock.Lock()
+	defer journal.syncLock.Unlock()
+
+	journal.Lock()
+	if journal.synced >= target || journal.f == nil {
+		journal.Unlock()
+		return
+	}
+	f, appended := journal.f, journal.appended
+	journal.Unlock()
+
+	err := f.Sync()
+
+	journal.Lock()
+	defer journal.Unlock()
+	if journal.f != f {
+		// The journal was compacted or closed in the meantime, and the
+		// compacted journal already has these records.
+		err = nil
+	}
+	if err != nil {
+		journal.log.Error(
+			"Failed to sync queue journal",
+			map[string]any{
+				"path": journal.path,
+				"err":  err,
+			},
+		)
+		return
+	}
+	if appended > journal.synced {
+		journal.synced = appended
+	}
+}
+
+// enqueue records that the run has been added to a Queue for the first time,
+// and assigns it an ID in the journal.
+func (journal *queueJournal) enqueue(runCtx *RunContext, queue string) {
+	if journal == nil {
+		return
+	}
+	journal.Lock()
+	runCtx.journalID = journal.nextID
+	journal.nextID++
+	journal.Unlock()
+
+	now := time.Now()
+	journal.append(&journalRecord{
+		Type:         journalRecordEnqueue,
+		ID:           runCtx.journalID,
+		Queue:        queue,
+		Priority:     runCtx.RunInfo.Priority,
+		AttemptsLeft: runCtx.attemptsLeft,
+		AttemptID:    runCtx.RunInfo.Run.AttemptID,
+		QueueTime:    &now,
+		Run:          newJournaledRun(runCtx.RunInfo),
+	})
+}
+
+// dequeue records that the run has been handed off to a runner.
+func (journal *queueJournal) dequeue(runCtx *RunContext, runner string) {
+	if journal == nil || runCtx.journalID == 0 {
+		return
+	}
+	journal.append(&journalRecord{
+		Type:      journalRecordDequeue,
+		ID:        runCtx.journalID,
+		AttemptID: runCtx.RunInfo.Run.AttemptID,
+		Runner:    runner,
+	})
+}
+
+// requeue records that the run has been added back to its Queue with the
+// provided priority.
+func (journal *queueJournal) requeue(runCtx *RunContext, priority QueuePriority) {
+	if journal == nil || runCtx.journalID == 0 {
+		return
+	}
+	now := time.Now()
+	journal.append(&journalRecord{
+		Type:         journalRecordRequeue,
+		ID:           runCtx.journalID,
+		Priority:     priority,
+		AttemptsLeft: runCtx.attemptsLeft,
+		AttemptID:    runCtx.RunInfo.Run.AttemptID,
+		QueueTime:    &now,
+	})
+}
+
+// promote records that the run was moved to the provided higher priority.
+func (journal *queueJournal) promote(runCtx *RunContext, priority QueuePriority) {
+	if journal == nil || runCtx.journalID == 0 {
+		return
+	}
+	journal.append(&journalRecord{
+		Type:     journalRecordPromote,
+		ID:       runCtx.journalID,
+		Priority: priority,
+	})
+}
+
+// close records that the run has finished.
+func (journal *queueJournal) close(runCtx *RunContext) {
+	if journal == nil || runCtx.journalID == 0 {
+		return
+	}
+	journal.append(&journalRecord{
+		Type: journalRecordClose,
+		ID:   runCtx.journalID,
+	})
+}
+
+// Close closes the underlying file.
+func (journal *queueJournal) Close() error {
+	if journal == nil {
+		return nil
+	}
+	journal.Lock()
+	defer journal.Unlock()
+	if journal.f == nil {
+		return nil
+	}
+	err := journal.f.Close()
+	journal.f = nil
+	return err
+}
+
+// RestoreQueues replays the queue journal stored in the grader runtime path
+// and adds all the runs that had not finished back to their queues, in the
+// same order and with the same priorities and remaining attempts as before.
+// Runs that were being graded by a runner are added back to the
+// InflightMonitor with their original attempt ID, so that their results are
+// still accepted if they arrive after the restart. From this point on, all
+// changes in the state of the runs are recorded in the journal. Returns the
+// RunInfos of the runs that were restored.
+func RestoreQueues(ctx *Context, artifacts *ArtifactManager) ([]*RunInfo, error) {
+	manager := ctx.QueueManager
+	journal, entries, err := openQueueJournal(
+		path.Join(manager.runtimePath, QueueJournalFilename),
+		ctx.Log,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var restored []*RunInfo
+	cachePath := path.Join(ctx.Config.Grader.RuntimePath, "cache")
+	for _, entry := range entries {
+		runInfo := entry.run.runInfo()
+		runInfo.Run.AttemptID = entry.attemptID
+		runInfo.QueueTime = entry.queueTime
+		if entry.run.ArtifactsPath != "" {
+			runInfo.Artifacts = &localGraderArtifacts{
+				gradeDir: entry.run.ArtifactsPath,
+				token:    path.Base(entry.run.ArtifactsPath),
+			}
+		} else if runInfo.ID != 0 {
+			runInfo.Artifacts = artifacts.Grader(&ctx.Context, runInfo.ID)
+		} else {
+			ctx.Log.Error(
+				"Unable to restore the artifacts of a run",
+				map[string]any{
+					"run": entry.run,
+				},
+			)
+			delete(journal.entries, entry.id)
+			continue
+		}
+
+		var factory common.InputFactory
+		if runInfo.Run.ProblemName != "" {
+			factory = NewInputFactory(runInfo.Run.ProblemName, &ctx.Config)
+		} else {
+			// Literal inputs are persisted in the cache directory.
+			factory = NewCachedInputFactory(cachePath)
+		}
+		inputRef, err := ctx.InputManager.Add(runInfo.Run.InputHash, factory)
+		if err != nil {
+			ctx.Log.Error(
+				"Unable to restore the input of a run",
+				map[string]any{
+					"run": entry.run,
+					"err": err,
+				},
+			)
+			delete(journal.entries, entry.id)
+			continue
+		}
+
+		queue, err := manager.Get(entry.queue)
+		if err != nil {
+			queue = manager.Add(entry.queue)
+		}
+		runCtx := queue.newRunContext(&ctx.Context, runInfo, inputRef, nil)
+		runCtx.attemptsLeft = entry.attemptsLeft
+		runCtx.journalID = entry.id
+		runCtx.queue = queue
+
+		if entry.runner != "" {
+			ctx.InflightMonitor.Add(runCtx, entry.runner)
+		} else if !queue.enqueueAt(runCtx, entry.priority, runInfo.QueueTime) {
+			ctx.Log.Error(
+				"Unable to restore a run: queue is full",
+				map[string]any{
+					"run": entry.run,
+				},
+			)
+			delete(journal.entries, entry.id)
+			// Closing the run would post-process it as a JE, so only release its
+			// resources. Runs from the database will be picked up again from there.
+			runCtx.queueManager.AddEvent(&QueueEvent{
+				Delta:    time.Now().Sub(runCtx.RunInfo.CreationTime),
+				Priority: runCtx.RunInfo.Priority,
+				Type:     QueueEventTypeManagerRemoved,
+				RunID:    runCtx.RunInfo.ID,
+			})
+			runCtx.inputRef.Release()
+			runCtx.Context.Transaction.End()
+			runCtx.Context.Close()
+			continue
+		}
+		restored = append(restored, runInfo)
+	}
+
+	journal.Lock()
+	err = journal.compact()
+	journal.Unlock()
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+	manager.setJournal(journal)
+
+	ctx.Log.Info(
+		"Restored queues from journal",
+		map[string]any{
+			"runs": len(restored),
+		},
+	)
+	return restored, nil
+}
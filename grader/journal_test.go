@@ -0,0 +1,262 @@
+package grader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omegaup/quark/common"
+)
+
+func TestReplayJournal(t *testing.T) {
+	journal := strings.Join([]string{
+		`{"type":"enqueue","id":1,"queue":"default","priority":1,"attempts_left":3,"attempt_id":10,"run":{"source":"","language":"py3","input_hash":"","max_score":"1"}}`,
+		`{"type":"enqueue","id":2,"queue":"default","priority":1,"attempts_left":3,"attempt_id":20,"run":{"source":"","language":"py3","input_hash":"","max_score":"1"}}`,
+		`{"type":"enqueue","id":3,"queue":"default","priority":2,"attempts_left":3,"attempt_id":30,"run":{"source":"","language":"py3","input_hash":"","max_score":"1"}}`,
+		`{"type":"enqueue","id":4,"queue":"default","priority":2,"attempts_left":3,"attempt_id":40,"run":{"source":"","language":"py3","input_hash":"","max_score":"1"}}`,
+		`{"type":"dequeue","id":1,"attempt_id":10,"runner":"runner1"}`,
+		`{"type":"promote","id":4,"priority":1}`,
+		`{"type":"dequeue","id":2,"attempt_id":20,"runner":"runner2"}`,
+		`{"type":"requeue","id":1,"priority":0,"attempts_left":2,"attempt_id":11}`,
+		`{"type":"close","id":3}`,
+		`{"type":"close","id`,
+	}, "\n")
+
+	entries, err := replayJournal(strings.NewReader(journal))
+	if err != nil {
+		t.Fatalf("Failed to replay journal: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("len(entries) == %d, want 3", len(entries))
+	}
+	if entries[0].id != 2 || entries[0].runner != "runner2" || entries[0].attemptID != 20 {
+		t.Errorf("entries[0] == %+v, want in-flight run 2", entries[0])
+	}
+	if entries[1].id != 4 || entries[1].priority != QueuePriorityNormal {
+		t.Errorf("entries[1] == %+v, want promoted run 4", entries[1])
+	}
+	if entries[2].id != 1 || entries[2].runner != "" || entries[2].attemptID != 11 ||
+		entries[2].priority != QueuePriorityHigh || entries[2].attemptsLeft != 2 {
+		t.Errorf("entries[2] == %+v, want requeued run 1", entries[2])
+	}
+
+	// Only the last record is allowed to be corrupted.
+	if _, err := replayJournal(strings.NewReader("{\"type\n" + journal)); err == nil {
+		t.Errorf("replayJournal succeeded with a corrupted record, expected failure")
+	}
+}
+
+func TestRestoreQueues(t *testing.T) {
+	ctx, err := newGraderContext(t)
+	if err != nil {
+		t.Fatalf("GraderContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Grader.RuntimePath)
+	}
+
+	artifacts := NewArtifactManager(nil)
+	restored, err := RestoreQueues(ctx, artifacts)
+	if err != nil {
+		t.Fatalf("Failed to restore queues: %v", err)
+	}
+	if len(restored) != 0 {
+		t.Fatalf("len(restored) == %d, want 0", len(restored))
+	}
+
+	queue, err := ctx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+	inflightRun := addRun(t, ctx, queue, QueuePriorityNormal)
+	queuedRun := addRun(t, ctx, queue, QueuePriorityNormal)
+	slowRun := addRun(t, ctx, queue, QueuePriorityLow)
+
+	runCtx, _, ok := queue.GetRun("runner1", ctx.InflightMonitor, make(chan bool))
+	if !ok || runCtx.RunInfo.ID != inflightRun.ID {
+		t.Fatalf("GetRun() == %v, want run %d", runCtx, inflightRun.ID)
+	}
+	attemptID := runCtx.RunInfo.Run.AttemptID
+
+	// restart simulates a grader restart that reuses the same runtime path.
+	restart := func() (*Context, []*RunInfo) {
+		ctx.QueueManager.getJournal().Close()
+		restartedCtx := &Context{
+			Context:         ctx.Context,
+			QueueManager:    NewQueueManager(ctx.Config.Grader.ChannelLength, ctx.Config.Grader.RuntimePath),
+			InflightMonitor: NewInflightMonitor(),
+			InputManager:    common.NewInputManager(&ctx.Context),
+		}
+		restored, err := RestoreQueues(restartedCtx, artifacts)
+		if err != nil {
+			t.Fatalf("Failed to restore queues: %v", err)
+		}
+		return restartedCtx, restored
+	}
+
+	restartedCtx, restored := restart()
+	defer restartedCtx.Close()
+	if len(restored) != 3 {
+		t.Fatalf("len(restored) == %d, want 3", len(restored))
+	}
+	restartedQueue, err := restartedCtx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+	lengths := restartedQueue.lengths()
+	if lengths[QueuePriorityNormal] != 1 || lengths[QueuePriorityLow] != 1 {
+		t.Fatalf("lengths() == %v, want one normal and one low priority run", lengths)
+	}
+	if restartedQueue.runs[QueuePriorityNormal][0].RunInfo.ID != queuedRun.ID {
+		t.Errorf(
+			"queued run ID == %d, want %d",
+			restartedQueue.runs[QueuePriorityNormal][0].RunInfo.ID,
+			queuedRun.ID,
+		)
+	}
+	if restartedQueue.runs[QueuePriorityLow][0].RunInfo.ID != slowRun.ID {
+		t.Errorf(
+			"slow run ID == %d, want %d",
+			restartedQueue.runs[QueuePriorityLow][0].RunInfo.ID,
+			slowRun.ID,
+		)
+	}
+
+	// The results of the in-flight run arrive after the restart.
+	restoredRunCtx, _, ok := restartedCtx.InflightMonitor.Get(attemptID)
+	if !ok {
+		t.Fatalf("in-flight attempt %d not restored", attemptID)
+	}
+	if restoredRunCtx.RunInfo.ID != inflightRun.ID {
+		t.Errorf("in-flight run ID == %d, want %d", restoredRunCtx.RunInfo.ID, inflightRun.ID)
+	}
+	restoredRunCtx.Close()
+
+	ctx = restartedCtx
+	secondCtx, restored := restart()
+	defer secondCtx.Close()
+	if len(restored) != 2 {
+		t.Fatalf("len(restored) == %d, want 2", len(restored))
+	}
+	if _, _, ok := secondCtx.InflightMonitor.Get(attemptID); ok {
+		t.Errorf("closed attempt %d was restored", attemptID)
+	}
+}
+
+func TestRestoreQueuesPromoted(t *testing.T) {
+	ctx, err := newGraderContext(t)
+	if err != nil {
+		t.Fatalf("GraderContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Grader.RuntimePath)
+	}
+
+	artifacts := NewArtifactManager(nil)
+	if _, err := RestoreQueues(ctx, artifacts); err != nil {
+		t.Fatalf("Failed to restore queues: %v", err)
+	}
+	queue, err := ctx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+	ctx.QueueManager.SetMaxQueueWait([QueueCount]time.Duration{
+		QueuePriorityLow: time.Minute,
+	})
+	slowRun := addRun(t, ctx, queue, QueuePriorityLow)
+	queue.age(time.Now().Add(time.Hour))
+	if lengths := queue.lengths(); lengths[QueuePriorityNormal] != 1 {
+		t.Fatalf("lengths() == %v, want one promoted run", lengths)
+	}
+
+	ctx.QueueManager.getJournal().Close()
+	restartedCtx := &Context{
+		Context:         ctx.Context,
+		QueueManager:    NewQueueManager(ctx.Config.Grader.ChannelLength, ctx.Config.Grader.RuntimePath),
+		InflightMonitor: NewInflightMonitor(),
+		InputManager:    common.NewInputManager(&ctx.Context),
+	}
+	defer restartedCtx.Close()
+	if _, err := RestoreQueues(restartedCtx, artifacts); err != nil {
+		t.Fatalf("Failed to restore queues: %v", err)
+	}
+	restartedQueue, err := restartedCtx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+	lengths := restartedQueue.lengths()
+	if lengths[QueuePriorityNormal] != 1 || lengths[QueuePriorityLow] != 0 {
+		t.Fatalf("lengths() == %v, want the run restored with its promoted priority", lengths)
+	}
+	if restartedQueue.runs[QueuePriorityNormal][0].RunInfo.ID != slowRun.ID {
+		t.Errorf(
+			"promoted run ID == %d, want %d",
+			restartedQueue.runs[QueuePriorityNormal][0].RunInfo.ID,
+			slowRun.ID,
+		)
+	}
+}
+
+// failingArtifacts is an Artifacts that cannot store anything.
+type failingArtifacts struct {
+	Artifacts
+}
+
+func (failingArtifacts) Put(ctx *common.Context, filename string, r io.Reader) error {
+	return errors.New("failed to store the artifact")
+}
+
+func TestRestoreQueuesUnpersisted(t *testing.T) {
+	ctx, err := newGraderContext(t)
+	if err != nil {
+		t.Fatalf("GraderContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Grader.RuntimePath)
+	}
+
+	artifacts := NewArtifactManager(nil)
+	if _, err := RestoreQueues(ctx, artifacts); err != nil {
+		t.Fatalf("Failed to restore queues: %v", err)
+	}
+	queue, err := ctx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+	run := addRun(t, ctx, queue, QueuePriorityNormal)
+	runCtx, _, ok := queue.GetRun("runner1", ctx.InflightMonitor, make(chan bool))
+	if !ok || runCtx.RunInfo.ID != run.ID {
+		t.Fatalf("GetRun() == %v, want run %d", runCtx, run.ID)
+	}
+	attemptID := runCtx.RunInfo.Run.AttemptID
+
+	// The results of the run could not be stored, so it must not be marked as
+	// done in the journal.
+	runCtx.RunInfo.Artifacts = failingArtifacts{Artifacts: runCtx.RunInfo.Artifacts}
+	runCtx.Close()
+
+	ctx.QueueManager.getJournal().Close()
+	restartedCtx := &Context{
+		Context:         ctx.Context,
+		QueueManager:    NewQueueManager(ctx.Config.Grader.ChannelLength, ctx.Config.Grader.RuntimePath),
+		InflightMonitor: NewInflightMonitor(),
+		InputManager:    common.NewInputManager(&ctx.Context),
+	}
+	defer restartedCtx.Close()
+	restored, err := RestoreQueues(restartedCtx, artifacts)
+	if err != nil {
+		t.Fatalf("Failed to restore queues: %v", err)
+	}
+	if len(restored) != 1 {
+		t.Fatalf("len(restored) == %d, want 1", len(restored))
+	}
+	if _, _, ok := restartedCtx.InflightMonitor.Get(attemptID); !ok {
+		t.Errorf("attempt %d with unpersisted results was not restored", attemptID)
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -47,6 +49,16 @@ const (
 	// DefaultQueueName is the default queue name.
 	DefaultQueueName = "default"
 
+	// FairShareKeyNone disables fair-share scheduling, so runs with the same
+	// priority are dispatched in FIFO order.
+	FairShareKeyNone = "none"
+	// FairShareKeyUser shares the runners fairly among users.
+	FairShareKeyUser = "user"
+	// FairShareKeyProblemset shares the runners fairly among problemsets.
+	FairShareKeyProblemset = "problemset"
+	// FairShareKeyContest shares the runners fairly among contests.
+	FairShareKeyContest = "contest"
+
 	// QueueEventTypeManagerAdded represents when a run is added to the QueueManager.
 	QueueEventTypeManagerAdded QueueEventType = iota
 
@@ -64,8 +76,64 @@ const (
 
 	// QueueEventTypeAbandoned represents when a run is abandoned due to too many retries.
 	QueueEventTypeAbandoned
+
+	// QueueEventTypeInputCacheHit represents when a run is dispatched to a
+	// runner that already has its input cached.
+	QueueEventTypeInputCacheHit
+
+	// QueueEventTypeInputCacheMiss represents when a run is dispatched to a
+	// runner that does not have its input cached.
+	QueueEventTypeInputCacheMiss
+
+	// QueueEventTypePromoted represents when a run is moved to the next higher
+	// priority due to having waited for too long in the queue.
+	QueueEventTypePromoted
 )
 
+// agingInterval is how often the QueueManager checks whether any run needs to
+// be promoted due to aging.
+const agingInterval = time.Duration(1) * time.Second
+
+// String returns the name of the QueuePriority.
+func (p QueuePriority) String() string {
+	switch p {
+	case QueuePriorityHigh:
+		return "high"
+	case QueuePriorityNormal:
+		return "normal"
+	case QueuePriorityLow:
+		return "low"
+	case QueuePriorityEphemeral:
+		return "ephemeral"
+	}
+	return fmt.Sprintf("QueuePriority(%d)", int(p))
+}
+
+// String returns the name of the QueueEventType.
+func (t QueueEventType) String() string {
+	switch t {
+	case QueueEventTypeManagerAdded:
+		return "manager_added"
+	case QueueEventTypeManagerRemoved:
+		return "manager_removed"
+	case QueueEventTypeQueueAdded:
+		return "queue_added"
+	case QueueEventTypeQueueRemoved:
+		return "queue_removed"
+	case QueueEventTypeRetried:
+		return "retried"
+	case QueueEventTypeAbandoned:
+		return "abandoned"
+	case QueueEventTypeInputCacheHit:
+		return "input_cache_hit"
+	case QueueEventTypeInputCacheMiss:
+		return "input_cache_miss"
+	case QueueEventTypePromoted:
+		return "promoted"
+	}
+	return fmt.Sprintf("QueueEventType(%d)", int(t))
+}
+
 // A EphemeralRunRequest represents a client's request to run some code.
 type EphemeralRunRequest struct {
 	Source   string               `json:"source"`
@@ -285,6 +353,7 @@ type RunInfo struct {
 	ID           int64
 	SubmissionID int64
 	GUID         string
+	Username     string
 	Contest      *string
 	Problemset   *int64
 	Run          *common.Run
@@ -337,6 +406,17 @@ type RunContext struct {
 	queue        *Queue
 	queueManager *QueueManager
 	monitor      *InflightMonitor
+	// journalID is the ID of the run in the QueueManager's journal, or zero if
+	// the run is not being journaled.
+	journalID uint64
+	// fairShareKey is the bucket the run belongs to for fair-share scheduling.
+	fairShareKey string
+	// priorityTime is the time at which the run was added to its current
+	// priority in the queue, used for aging.
+	priorityTime time.Time
+	// dispatchTime is the time at which the run was last handed off to a
+	// runner, used to estimate how long grading takes.
+	dispatchTime time.Time
 
 	runWaitHandle *RunWaitHandle
 }
@@ -381,17 +461,25 @@ func (runCtx *RunContext) Close() {
 			"context": runCtx,
 		},
 	)
+	persisted := false
 	defer func() {
 		runCtx.queueManager.AddEvent(&QueueEvent{
 			Delta:    time.Now().Sub(runCtx.RunInfo.CreationTime),
 			Priority: runCtx.RunInfo.Priority,
 			Type:     QueueEventTypeManagerRemoved,
+			RunID:    runCtx.RunInfo.ID,
 		})
 
 		if runCtx.runWaitHandle != nil {
 			close(runCtx.runWaitHandle.ready)
 		}
 		runCtx.queueManager.PostProcessor.PostProcess(runCtx.RunInfo)
+		// The run is only marked as done in the journal once its results have
+		// been persisted and handed off for post-processing, so that it is
+		// graded again if the grader crashes before that.
+		if persisted {
+			runCtx.queueManager.getJournal().close(runCtx)
+		}
 
 		runCtx.Context.Close()
 	}()
@@ -402,6 +490,13 @@ func (runCtx *RunContext) Close() {
 		runCtx.inputRef.Release()
 		runCtx.inputRef = nil
 	}
+	if !runCtx.dispatchTime.IsZero() && runCtx.RunInfo.Result.Verdict != "JE" {
+		runCtx.queueManager.gradingDurations.observe(
+			runCtx.RunInfo.Run.ProblemName,
+			runCtx.RunInfo.Run.Language,
+			time.Now().Sub(runCtx.dispatchTime),
+		)
+	}
 
 	// Results
 	{
@@ -461,6 +556,7 @@ func (runCtx *RunContext) Close() {
 			return
 		}
 	}
+	persisted = true
 }
 
 // Requeue adds a RunContext back to the Queue from where it came from, if it
@@ -476,6 +572,7 @@ func (runCtx *RunContext) Requeue(lastAttempt bool) bool {
 			Delta:    time.Now().Sub(runCtx.RunInfo.CreationTime),
 			Priority: runCtx.RunInfo.Priority,
 			Type:     QueueEventTypeAbandoned,
+			RunID:    runCtx.RunInfo.ID,
 		})
 		runCtx.Log.Error("run errored out too many times. giving up", nil)
 		runCtx.Close()
@@ -488,6 +585,7 @@ func (runCtx *RunContext) Requeue(lastAttempt bool) bool {
 		runCtx.attemptsLeft = 1
 	}
 	runCtx.RunInfo.Run.UpdateAttemptID()
+	runCtx.queueManager.getJournal().requeue(runCtx, QueuePriorityHigh)
 	// Since it was already ready to be executed, place it in the high-priority
 	// queue.
 	if !runCtx.queue.enqueue(runCtx, QueuePriorityHigh) {
@@ -496,6 +594,7 @@ func (runCtx *RunContext) Requeue(lastAttempt bool) bool {
 			Delta:    time.Now().Sub(runCtx.RunInfo.CreationTime),
 			Priority: runCtx.RunInfo.Priority,
 			Type:     QueueEventTypeAbandoned,
+			RunID:    runCtx.RunInfo.ID,
 		})
 		runCtx.Log.Error("The high-priority queue is full. giving up", nil)
 		runCtx.Close()
@@ -505,6 +604,7 @@ func (runCtx *RunContext) Requeue(lastAttempt bool) bool {
 		Delta:    time.Now().Sub(runCtx.RunInfo.CreationTime),
 		Priority: runCtx.RunInfo.Priority,
 		Type:     QueueEventTypeRetried,
+		RunID:    runCtx.RunInfo.ID,
 	})
 	return true
 }
@@ -519,12 +619,28 @@ func (runCtx *RunContext) String() string {
 	)
 }
 
-// Queue represents a RunContext queue with three discrete priorities.
+// Queue represents a RunContext queue with three discrete priorities. Within
+// each priority, runs are grouped into buckets (by user, problemset, or
+// contest) and the buckets take turns to be dispatched, so that a single
+// bucket with many runs cannot starve all the others.
 type Queue struct {
+	sync.Mutex
 	Name         string
-	runs         [QueueCount]chan *RunContext
+	runs         [QueueCount][]*RunContext
+	slots        [QueueCount]chan struct{}
 	ready        chan struct{}
 	queueManager *QueueManager
+
+	// enqueued is closed and replaced every time a run is added to the queue,
+	// so that the runners that are waiting for the runs that are held back for
+	// other runners can look for a new run right away.
+	enqueued chan struct{}
+
+	// served is the number of runs that have been dispatched from each bucket
+	// that currently has runs in the queue, and pending is the number of runs
+	// that each bucket has in the queue.
+	served  [QueueCount]map[string]uint64
+	pending [QueueCount]map[string]int
 }
 
 // GetRun dequeues a RunContext from the queue and adds it to the global
@@ -535,36 +651,310 @@ func (queue *Queue) GetRun(
 	monitor *InflightMonitor,
 	closeNotifier <-chan bool,
 ) (*RunContext, <-chan struct{}, bool) {
-	select {
-	case <-closeNotifier:
-		return nil, nil, false
-	case <-queue.ready:
-	}
+	return queue.GetRunWithInputAffinity(runner, nil, monitor, closeNotifier)
+}
 
-	for i := range queue.runs {
+// GetRunWithInputAffinity dequeues a RunContext from the queue and adds it to
+// the global InflightMonitor, preferring runs whose input is already present
+// in cachedInputs. Runs whose input is cached by another runner are held back
+// for that runner for up to the QueueManager's input affinity delay, after
+// which any runner can pick them up. Runs are never taken out of priority
+// order. A nil cachedInputs means that the runner did not report its cached
+// inputs, and the run at the head of the queue is returned. This function will
+// block if there are no RunContext objects in the queue.
+func (queue *Queue) GetRunWithInputAffinity(
+	runner string,
+	cachedInputs map[string]struct{},
+	monitor *InflightMonitor,
+	closeNotifier <-chan bool,
+) (*RunContext, <-chan struct{}, bool) {
+	return queue.getRun(runner, cachedInputs, monitor, closeNotifier, false)
+}
+
+// ReserveRunWithInputAffinity is like GetRunWithInputAffinity, but it is
+// called by a runner that is still grading another run, so the run is added to
+// the InflightMonitor as reserved. The runner can fetch the run's input ahead
+// of time, and the run starts once the runner sends its first heartbeat or
+// starts uploading its results.
+func (queue *Queue) ReserveRunWithInputAffinity(
+	runner string,
+	cachedInputs map[string]struct{},
+	monitor *InflightMonitor,
+	closeNotifier <-chan bool,
+) (*RunContext, <-chan struct{}, bool) {
+	return queue.getRun(runner, cachedInputs, monitor, closeNotifier, true)
+}
+
+func (queue *Queue) getRun(
+	runner string,
+	cachedInputs map[string]struct{},
+	monitor *InflightMonitor,
+	closeNotifier <-chan bool,
+	reserve bool,
+) (*RunContext, <-chan struct{}, bool) {
+	queue.queueManager.observeRunner(runner, time.Now())
+	if cachedInputs != nil {
+		queue.queueManager.updateRunnerInputs(runner, cachedInputs)
+	}
+	for {
 		select {
-		case runCtx := <-queue.runs[i]:
-			inflight := monitor.Add(runCtx, runner)
-			return runCtx, inflight.timeout, true
-		default:
+		case <-closeNotifier:
+			return nil, nil, false
+		case <-queue.ready:
 		}
+
+		queue.age(time.Now())
+		enqueued := queue.enqueuedNotifier()
+		runCtx, wait := queue.dequeue(runner, cachedInputs)
+		if runCtx == nil {
+			// All the eligible runs are being held for other runners. Give the
+			// token back and try again once the earliest one is up for grabs,
+			// or as soon as a new run is added.
+			queue.ready <- struct{}{}
+			timer := time.NewTimer(wait)
+			select {
+			case <-closeNotifier:
+				timer.Stop()
+				return nil, nil, false
+			case <-enqueued:
+				timer.Stop()
+			case <-timer.C:
+			}
+			continue
+		}
+
+		if cachedInputs != nil {
+			eventType := QueueEventTypeInputCacheMiss
+			if _, ok := cachedInputs[runCtx.RunInfo.Run.InputHash]; ok {
+				eventType = QueueEventTypeInputCacheHit
+			}
+			queue.queueManager.AddEvent(&QueueEvent{
+				Delta:    time.Now().Sub(runCtx.RunInfo.QueueTime),
+				Priority: runCtx.RunInfo.Priority,
+				Type:     eventType,
+				RunID:    runCtx.RunInfo.ID,
+			})
+		}
+		var inflight *InflightRun
+		if reserve {
+			inflight = monitor.Reserve(runCtx, runner)
+		} else {
+			inflight = monitor.Add(runCtx, runner)
+		}
+		queue.queueManager.getJournal().dequeue(runCtx, runner)
+		return runCtx, inflight.timeout, true
+	}
+}
+
+// dequeue removes the best candidate RunContext for the runner from the
+// highest non-empty priority. If there is no suitable candidate, it returns
+// nil and the amount of time until one of the runs becomes available for
+// this runner.
+func (queue *Queue) dequeue(
+	runner string,
+	cachedInputs map[string]struct{},
+) (*RunContext, time.Duration) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	for priority := range queue.runs {
+		runs := queue.runs[priority]
+		if len(runs) == 0 {
+			continue
+		}
+
+		order := queue.fairOrder(QueuePriority(priority))
+		idx := order[0]
+		var wait time.Duration
+		if cachedInputs != nil {
+			idx, wait = queue.queueManager.pickRun(runner, cachedInputs, runs, order)
+			if idx == -1 {
+				return nil, wait
+			}
+		}
+
+		runCtx := queue.remove(QueuePriority(priority), idx)
+		queue.served[priority][runCtx.fairShareKey]++
+		queue.untrack(runCtx, QueuePriority(priority))
+		<-queue.slots[priority]
+		return runCtx, 0
 	}
 	panic("unreachable")
 }
 
-// AddRun adds a new RunContext to the current Queue.
-func (queue *Queue) AddRun(
+// enqueuedNotifier returns a channel that will be closed once a run is added
+// to the queue.
+func (queue *Queue) enqueuedNotifier() <-chan struct{} {
+	queue.Lock()
+	defer queue.Unlock()
+
+	return queue.enqueued
+}
+
+// notifyEnqueuedLocked wakes up the runners that are waiting for a run to be
+// added to the queue. The caller must hold the lock.
+func (queue *Queue) notifyEnqueuedLocked() {
+	close(queue.enqueued)
+	queue.enqueued = make(chan struct{})
+}
+
+// remove removes the run at position idx from the runs with the provided
+// priority. The caller must hold the lock.
+func (queue *Queue) remove(priority QueuePriority, idx int) *RunContext {
+	runs := queue.runs[priority]
+	runCtx := runs[idx]
+	copy(runs[idx:], runs[idx+1:])
+	runs[len(runs)-1] = nil
+	queue.runs[priority] = runs[:len(runs)-1]
+	return runCtx
+}
+
+// track adds the run to the fair-share accounting of the provided priority.
+// The caller must hold the lock.
+func (queue *Queue) track(runCtx *RunContext, priority QueuePriority) {
+	if _, ok := queue.pending[priority][runCtx.fairShareKey]; !ok {
+		// New buckets start at the same level as the least-served bucket, so
+		// that they can neither claim the runners for themselves nor wait
+		// behind all the runs that were queued before them.
+		var minServed uint64
+		first := true
+		for _, served := range queue.served[priority] {
+			if first || served < minServed {
+				minServed = served
+				first = false
+			}
+		}
+		queue.served[priority][runCtx.fairShareKey] = minServed
+	}
+	queue.pending[priority][runCtx.fairShareKey]++
+}
+
+// untrack removes the run from the fair-share accounting of the provided
+// priority. The caller must hold the lock.
+func (queue *Queue) untrack(runCtx *RunContext, priority QueuePriority) {
+	queue.pending[priority][runCtx.fairShareKey]--
+	if queue.pending[priority][runCtx.fairShareKey] == 0 {
+		// Buckets do not accumulate credit while they are idle.
+		delete(queue.pending[priority], runCtx.fairShareKey)
+		delete(queue.served[priority], runCtx.fairShareKey)
+	}
+}
+
+// age promotes all the runs that have been waiting in their current priority
+// for longer than the QueueManager's maximum wait for that priority to the
+// next higher priority, and notifies the QueueManager about the promotions.
+func (queue *Queue) age(now time.Time) {
+	queue.Lock()
+	promoted, events := queue.promote(now, queue.queueManager.getMaxQueueWait())
+	queue.Unlock()
+
+	journal := queue.queueManager.getJournal()
+	for i, event := range events {
+		journal.promote(promoted[i], event.Priority)
+		queue.queueManager.AddEvent(event)
+	}
+}
+
+// promote moves all the runs that have been waiting in their current priority
+// for longer than maxWait for that priority to the next higher priority.
+// Promoted runs are placed in the order in which they were originally queued,
+// ahead of any runs that were queued after them. A run is not promoted if the
+// higher priority is full. Returns the promoted runs and their promotion
+// events. The caller must hold the lock.
+func (queue *Queue) promote(
+	now time.Time,
+	maxWait [QueueCount]time.Duration,
+) ([]*RunContext, []*QueueEvent) {
+	var promoted []*RunContext
+	var events []*QueueEvent
+	for priority := QueuePriorityNormal; priority < QueueCount; priority++ {
+		if maxWait[priority] <= 0 {
+			continue
+		}
+		for idx := 0; idx < len(queue.runs[priority]); {
+			runCtx := queue.runs[priority][idx]
+			if now.Sub(runCtx.priorityTime) < maxWait[priority] {
+				idx++
+				continue
+			}
+			select {
+			case queue.slots[priority-1] <- struct{}{}:
+			default:
+				// The higher priority is full.
+				idx++
+				continue
+			}
+			queue.remove(priority, idx)
+			queue.untrack(runCtx, priority)
+			<-queue.slots[priority]
+
+			runCtx.priorityTime = now
+			higher := queue.runs[priority-1]
+			pos := sort.Search(len(higher), func(i int) bool {
+				return higher[i].RunInfo.QueueTime.After(runCtx.RunInfo.QueueTime)
+			})
+			higher = append(higher, nil)
+			copy(higher[pos+1:], higher[pos:])
+			higher[pos] = runCtx
+			queue.runs[priority-1] = higher
+			queue.track(runCtx, priority-1)
+
+			promoted = append(promoted, runCtx)
+			events = append(events, &QueueEvent{
+				Delta:    now.Sub(runCtx.RunInfo.QueueTime),
+				Priority: priority - 1,
+				Type:     QueueEventTypePromoted,
+				RunID:    runCtx.RunInfo.ID,
+			})
+		}
+	}
+	return promoted, events
+}
+
+// fairOrder returns the indices of the runs with the provided priority in the
+// order in which they should be dispatched. Each run is assigned a virtual
+// dispatch time equal to the number of runs that have been dispatched from its
+// bucket plus the number of runs ahead of it in the same bucket, so that
+// buckets take turns. Ties are broken by the order in which the runs were
+// queued. The caller must hold the lock.
+func (queue *Queue) fairOrder(priority QueuePriority) []int {
+	runs := queue.runs[priority]
+	order := make([]int, len(runs))
+	for idx := range runs {
+		order[idx] = idx
+	}
+	if len(queue.pending[priority]) <= 1 {
+		return order
+	}
+
+	tags := make([]uint64, len(runs))
+	rank := make(map[string]uint64)
+	for idx, runCtx := range runs {
+		tags[idx] = queue.served[priority][runCtx.fairShareKey] + rank[runCtx.fairShareKey]
+		rank[runCtx.fairShareKey]++
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return tags[order[i]] < tags[order[j]]
+	})
+	return order
+}
+
+// newRunContext creates a new RunContext for the provided RunInfo that will
+// be added to the current Queue.
+func (queue *Queue) newRunContext(
 	ctx *common.Context,
 	runInfo *RunInfo,
 	inputRef *common.InputRef,
-) error {
+	runWaitHandle *RunWaitHandle,
+) *RunContext {
 	runCtx := &RunContext{
 		RunInfo:  runInfo,
 		Context:  ctx.DebugContext(map[string]any{"id": runInfo.ID}),
 		inputRef: inputRef,
 
-		attemptsLeft: ctx.Config.Grader.MaxGradeRetries,
-		queueManager: queue.queueManager,
+		attemptsLeft:  ctx.Config.Grader.MaxGradeRetries,
+		queueManager:  queue.queueManager,
+		runWaitHandle: runWaitHandle,
 	}
 	runCtx.Context.Transaction = runCtx.Context.Tracing.StartTransaction(
 		"run",
@@ -577,8 +967,21 @@ func (queue *Queue) AddRun(
 		Delta:    time.Now().Sub(runCtx.RunInfo.CreationTime),
 		Priority: runCtx.RunInfo.Priority,
 		Type:     QueueEventTypeManagerAdded,
+		RunID:    runCtx.RunInfo.ID,
 	})
 
+	return runCtx
+}
+
+// AddRun adds a new RunContext to the current Queue.
+func (queue *Queue) AddRun(
+	ctx *common.Context,
+	runInfo *RunInfo,
+	inputRef *common.InputRef,
+) error {
+	runCtx := queue.newRunContext(ctx, runInfo, inputRef, nil)
+	queue.queueManager.getJournal().enqueue(runCtx, queue.Name)
+
 	if runInfo.Priority == QueuePriorityEphemeral {
 		if !queue.enqueue(runCtx, runInfo.Priority) {
 			runCtx.Close()
@@ -602,30 +1005,11 @@ func (queue *Queue) AddWaitableRun(
 	runInfo *RunInfo,
 	inputRef *common.InputRef,
 ) (*RunWaitHandle, error) {
-	runCtx := &RunContext{
-		RunInfo:  runInfo,
-		Context:  ctx.DebugContext(map[string]any{"id": runInfo.ID}),
-		inputRef: inputRef,
-
-		attemptsLeft: ctx.Config.Grader.MaxGradeRetries,
-		queueManager: queue.queueManager,
-		runWaitHandle: &RunWaitHandle{
-			running: make(chan struct{}),
-			ready:   make(chan struct{}),
-		},
-	}
-	runCtx.Context.Transaction = runCtx.Context.Tracing.StartTransaction(
-		"run",
-		tracing.Arg{Name: "id", Value: runInfo.ID},
-		tracing.Arg{Name: "submission", Value: runInfo.SubmissionID},
-		tracing.Arg{Name: "guid", Value: runInfo.GUID},
-	)
-
-	runCtx.queueManager.AddEvent(&QueueEvent{
-		Delta:    time.Now().Sub(runCtx.RunInfo.CreationTime),
-		Priority: runCtx.RunInfo.Priority,
-		Type:     QueueEventTypeManagerAdded,
+	runCtx := queue.newRunContext(ctx, runInfo, inputRef, &RunWaitHandle{
+		running: make(chan struct{}),
+		ready:   make(chan struct{}),
 	})
+	queue.queueManager.getJournal().enqueue(runCtx, queue.Name)
 
 	if !queue.enqueue(runCtx, runInfo.Priority) {
 		runCtx.Close()
@@ -641,25 +1025,35 @@ func (queue *Queue) enqueueBlocking(runCtx *RunContext) {
 		panic("null RunContext")
 	}
 	runCtx.queue = queue
-	queue.runs[runCtx.RunInfo.Priority] <- runCtx
-	queue.ready <- struct{}{}
-	runCtx.RunInfo.QueueTime = time.Now()
+	queue.slots[runCtx.RunInfo.Priority] <- struct{}{}
+	queue.append(runCtx, runCtx.RunInfo.Priority)
 	queue.queueManager.AddEvent(&QueueEvent{
 		Delta:    time.Now().Sub(runCtx.RunInfo.CreationTime),
 		Priority: runCtx.RunInfo.Priority,
 		Type:     QueueEventTypeQueueAdded,
+		RunID:    runCtx.RunInfo.ID,
 	})
 }
 
 // enqueue adds a run to the queue, returns true if possible.
 func (queue *Queue) enqueue(runCtx *RunContext, priority QueuePriority) bool {
+	return queue.enqueueAt(runCtx, priority, time.Now())
+}
+
+// enqueueAt adds a run to the queue as if it had been added at queueTime,
+// returns true if possible.
+func (queue *Queue) enqueueAt(
+	runCtx *RunContext,
+	priority QueuePriority,
+	queueTime time.Time,
+) bool {
 	if runCtx == nil {
 		panic("null RunContext")
 	}
 	runCtx.queue = queue
 	select {
-	case queue.runs[priority] <- runCtx:
-		queue.ready <- struct{}{}
+	case queue.slots[priority] <- struct{}{}:
+		queue.appendAt(runCtx, priority, queueTime)
 		return true
 	default:
 		// There is no space left in the queue.
@@ -667,6 +1061,43 @@ func (queue *Queue) enqueue(runCtx *RunContext, priority QueuePriority) bool {
 	}
 }
 
+// append adds a run at the end of the queue with the specified priority and
+// signals that there is a run ready. A slot for that priority must have been
+// acquired beforehand.
+func (queue *Queue) append(runCtx *RunContext, priority QueuePriority) {
+	queue.appendAt(runCtx, priority, time.Now())
+}
+
+// appendAt is like append, but sets the time at which the run was queued to
+// queueTime.
+func (queue *Queue) appendAt(
+	runCtx *RunContext,
+	priority QueuePriority,
+	queueTime time.Time,
+) {
+	runCtx.fairShareKey = queue.queueManager.fairShareBucket(runCtx.RunInfo)
+	queue.Lock()
+	runCtx.RunInfo.QueueTime = queueTime
+	runCtx.priorityTime = queueTime
+	queue.runs[priority] = append(queue.runs[priority], runCtx)
+	queue.track(runCtx, priority)
+	queue.notifyEnqueuedLocked()
+	queue.Unlock()
+	queue.ready <- struct{}{}
+}
+
+// lengths returns the number of runs in each of the priorities.
+func (queue *Queue) lengths() [QueueCount]int {
+	queue.Lock()
+	defer queue.Unlock()
+
+	var lengths [QueueCount]int
+	for i := range queue.runs {
+		lengths[i] = len(queue.runs[i])
+	}
+	return lengths
+}
+
 // InflightRun is a wrapper around a RunContext when it is handed off a queue
 // and a runner has been assigned to it.
 type InflightRun struct {
@@ -674,106 +1105,352 @@ type InflightRun struct {
 	runner       string
 	creationTime time.Time
 	connected    chan struct{}
+	heartbeat    chan struct{}
 	ready        chan struct{}
 	timeout      chan struct{}
+
+	// The following fields are guarded by the monitor's lock. progress is the
+	// last progress reported by the runner, or nil if the runner has not sent
+	// any heartbeats. reserved is true while the runner is still grading
+	// another run.
+	reserved      bool
+	deadline      time.Time
+	progress      *runner.RunProgress
+	lastHeartbeat time.Time
 }
 
 // InflightMonitor manages all in-flight Runs (Runs that have been picked up by
 // a runner) and tracks their state in case the runner becomes unresponsive.
+//
+// Until the runner sends its first heartbeat, it is treated as a runner that
+// never sends heartbeats: it must start uploading the results within
+// connectTimeout, and finish uploading them within readyTimeout. Once the
+// runner sends a heartbeat, it must keep sending one at least every
+// heartbeatTimeout, and the run must finish within deadlineBase, which is
+// extended by wallTimeFactor times the problem's overall wall time limit that
+// the runner reports in its heartbeats.
+//
+// Runs can also be reserved by a runner that is still grading another run.
+// Heartbeats are not expected for reserved runs, which only have to be started
+// within deadlineBase after the runner's current run's deadline. The run
+// starts, and the timeouts above start to apply, once the runner sends its
+// first heartbeat for it or starts uploading its results.
 type InflightMonitor struct {
 	sync.Mutex
-	mapping        map[uint64]*InflightRun
-	connectTimeout time.Duration
-	readyTimeout   time.Duration
+	mapping          map[uint64]*InflightRun
+	connectTimeout   time.Duration
+	readyTimeout     time.Duration
+	heartbeatTimeout time.Duration
+	deadlineBase     time.Duration
+	wallTimeFactor   float64
+	runnerHealth     *RunnerHealthMonitor
 }
 
 // RunData represents the data of a single run.
 type RunData struct {
-	AttemptID    uint64
-	ID           int64
-	GUID         string
-	Queue        string
-	AttemptsLeft int
-	Runner       string
-	Time         int64
-	Elapsed      int64
+	AttemptID     uint64
+	ID            int64
+	GUID          string
+	Queue         string
+	AttemptsLeft  int
+	Runner        string
+	Time          int64
+	Elapsed       int64
+	Deadline      int64
+	LastHeartbeat int64
+	Reserved      bool
+	Progress      *runner.RunProgress
 }
 
 // NewInflightMonitor returns a new InflightMonitor.
 func NewInflightMonitor() *InflightMonitor {
 	return &InflightMonitor{
-		mapping:        make(map[uint64]*InflightRun),
-		connectTimeout: time.Duration(10) * time.Minute,
-		readyTimeout:   time.Duration(10) * time.Minute,
+		mapping:          make(map[uint64]*InflightRun),
+		connectTimeout:   time.Duration(10) * time.Minute,
+		readyTimeout:     time.Duration(10) * time.Minute,
+		heartbeatTimeout: time.Duration(30) * time.Second,
+		deadlineBase:     time.Duration(5) * time.Minute,
+		wallTimeFactor:   2,
 	}
 }
 
+// SetTimeouts sets the maximum amount of time between heartbeats, and the
+// deadline for runs, which is deadlineBase plus wallTimeFactor times the
+// overall wall time limit of the problem.
+func (monitor *InflightMonitor) SetTimeouts(
+	heartbeatTimeout time.Duration,
+	deadlineBase time.Duration,
+	wallTimeFactor float64,
+) {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	monitor.heartbeatTimeout = heartbeatTimeout
+	monitor.deadlineBase = deadlineBase
+	monitor.wallTimeFactor = wallTimeFactor
+}
+
+// SetRunnerHealthMonitor sets the RunnerHealthMonitor that is notified
+// whenever a run times out.
+func (monitor *InflightMonitor) SetRunnerHealthMonitor(runnerHealth *RunnerHealthMonitor) {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	monitor.runnerHealth = runnerHealth
+}
+
 // Add creates an InflightRun wrapper for the specified RunContext, adds it to
 // the InflightMonitor, and monitors it for timeouts. A RunContext can be later
 // accesssed through its attempt ID.
 func (monitor *InflightMonitor) Add(
 	runCtx *RunContext,
 	runner string,
+) *InflightRun {
+	return monitor.add(runCtx, runner, false)
+}
+
+// Reserve is like Add, but the run is reserved by a runner that is still
+// grading another run, so heartbeats are not expected until the runner starts
+// the run.
+func (monitor *InflightMonitor) Reserve(
+	runCtx *RunContext,
+	runner string,
+) *InflightRun {
+	return monitor.add(runCtx, runner, true)
+}
+
+func (monitor *InflightMonitor) add(
+	runCtx *RunContext,
+	runner string,
+	reserved bool,
 ) *InflightRun {
 	if atomic.SwapInt32(&runCtx.runningFlag, 1) == 0 && runCtx.runWaitHandle != nil {
 		close(runCtx.runWaitHandle.running)
 	}
 	monitor.Lock()
 	defer monitor.Unlock()
+	now := time.Now()
 	inflight := &InflightRun{
 		runCtx:       runCtx,
 		runner:       runner,
-		creationTime: time.Now(),
+		creationTime: now,
+		reserved:     reserved,
+		deadline:     now.Add(monitor.connectTimeout + monitor.readyTimeout),
 		connected:    make(chan struct{}, 1),
+		heartbeat:    make(chan struct{}, 1),
 		ready:        make(chan struct{}, 1),
 		timeout:      make(chan struct{}, 1),
 	}
 	runCtx.monitor = monitor
+	if reserved {
+		inflight.deadline = monitor.reservationDeadline(runner, now)
+	} else {
+		runCtx.dispatchTime = inflight.creationTime
+	}
 	monitor.mapping[runCtx.RunInfo.Run.AttemptID] = inflight
+	connectTimeout := monitor.connectTimeout
+	heartbeatTimeout := monitor.heartbeatTimeout
+	deadline := inflight.deadline
 	go func() {
 		defer close(inflight.timeout)
 
-		connectTimer := time.NewTimer(monitor.connectTimeout)
-		defer func() {
-			if !connectTimer.Stop() {
-				<-connectTimer.C
-			}
-		}()
-		select {
-		case <-inflight.connected:
-		case <-connectTimer.C:
-			monitor.timeout(runCtx, inflight.timeout)
-			return
+		deadlineTimer := time.NewTimer(time.Until(deadline))
+		defer deadlineTimer.Stop()
+		// Until the first heartbeat arrives, the runner only has to connect
+		// within connectTimeout.
+		heartbeatTimer := time.NewTimer(connectTimeout)
+		defer heartbeatTimer.Stop()
+		heartbeatExpired := heartbeatTimer.C
+		if reserved {
+			heartbeatTimer.Stop()
+			heartbeatExpired = nil
 		}
 
-		readyTimer := time.NewTimer(monitor.readyTimeout)
-		defer func() {
-			if !readyTimer.Stop() {
-				<-readyTimer.C
+		for {
+			select {
+			case <-inflight.ready:
+				return
+			case <-inflight.heartbeat:
+				// Reserved runs are also signalled when their reservation is
+				// extended, but they don't expect heartbeats until they start.
+				if !monitor.isReserved(inflight) {
+					resetTimer(heartbeatTimer, heartbeatTimeout)
+					heartbeatExpired = heartbeatTimer.C
+				}
+				resetTimer(deadlineTimer, time.Until(monitor.runDeadline(inflight)))
+			case <-inflight.connected:
+				if !monitor.sentHeartbeat(inflight) {
+					// This runner does not send heartbeats, so only the
+					// readyTimeout deadline applies from now on.
+					heartbeatExpired = nil
+				}
+				resetTimer(deadlineTimer, time.Until(monitor.runDeadline(inflight)))
+			case <-heartbeatExpired:
+				monitor.timeout(inflight, "heartbeat")
+				return
+			case <-deadlineTimer.C:
+				if monitor.isReserved(inflight) {
+					monitor.timeout(inflight, "reservation")
+				} else {
+					monitor.timeout(inflight, "deadline")
+				}
+				return
 			}
-		}()
-		select {
-		case <-inflight.ready:
-		case <-readyTimer.C:
-			monitor.timeout(runCtx, inflight.timeout)
-			return
 		}
 	}()
 	return inflight
 }
 
-func (monitor *InflightMonitor) timeout(
-	runCtx *RunContext,
-	timeout chan<- struct{},
-) {
+// resetTimer stops the timer, drains its channel if needed, and makes it fire
+// after the provided duration.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// runDeadline returns the time by which the in-flight run has to be finished.
+func (monitor *InflightMonitor) runDeadline(inflight *InflightRun) time.Time {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	return inflight.deadline
+}
+
+// isReserved returns whether the in-flight run is reserved and the runner has
+// not started it yet.
+func (monitor *InflightMonitor) isReserved(inflight *InflightRun) bool {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	return inflight.reserved
+}
+
+// reservationDeadline returns the time by which a run reserved by the runner
+// has to be started: deadlineBase after the latest deadline of the runs that
+// the runner is currently grading. The caller must hold the lock.
+func (monitor *InflightMonitor) reservationDeadline(runner string, now time.Time) time.Time {
+	deadline := now
+	for _, inflight := range monitor.mapping {
+		if inflight.runner != runner || inflight.reserved {
+			continue
+		}
+		if inflight.deadline.After(deadline) {
+			deadline = inflight.deadline
+		}
+	}
+	return deadline.Add(monitor.deadlineBase)
+}
+
+// start marks a reserved run as started, since the runner is now grading it.
+// The caller must hold the lock.
+func (monitor *InflightMonitor) start(inflight *InflightRun) {
+	if !inflight.reserved {
+		return
+	}
+	now := time.Now()
+	inflight.reserved = false
+	inflight.creationTime = now
+	inflight.deadline = now.Add(monitor.connectTimeout + monitor.readyTimeout)
+	inflight.runCtx.dispatchTime = now
+}
+
+// sentHeartbeat returns whether the runner has sent any heartbeat for the
+// in-flight run.
+func (monitor *InflightMonitor) sentHeartbeat(inflight *InflightRun) bool {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	return inflight.progress != nil
+}
+
+// Heartbeat records that the runner is still working on the specified attempt
+// ID, and what it is currently doing. It returns false if the attempt ID is
+// not in-flight, or if it was assigned to a different runner.
+func (monitor *InflightMonitor) Heartbeat(
+	attemptID uint64,
+	runnerName string,
+	progress *runner.RunProgress,
+) bool {
+	monitor.Lock()
+	defer monitor.Unlock()
+	inflight, ok := monitor.mapping[attemptID]
+	if !ok {
+		return false
+	}
+	if inflight.runner != runnerName {
+		inflight.runCtx.Log.Warn(
+			"heartbeat from a runner that does not own the run",
+			map[string]any{
+				"context": inflight.runCtx,
+				"runner":  inflight.runner,
+				"sender":  runnerName,
+			},
+		)
+		return false
+	}
+	if progress == nil {
+		progress = &runner.RunProgress{}
+	}
+	monitor.start(inflight)
+	firstHeartbeat := inflight.progress == nil
+	inflight.progress = progress
+	inflight.lastHeartbeat = time.Now()
+	// Long runs get more time, proportional to the problem's limits. The
+	// first heartbeat replaces the deadline for runners that don't send
+	// heartbeats, and later ones can only extend it.
+	deadline := inflight.creationTime.Add(
+		monitor.deadlineBase +
+			time.Duration(monitor.wallTimeFactor*float64(progress.OverallWallTimeLimit)),
+	)
+	if firstHeartbeat || deadline.After(inflight.deadline) {
+		inflight.deadline = deadline
+	}
+	select {
+	case inflight.heartbeat <- struct{}{}:
+	default:
+	}
+
+	// The runs that the runner reserved cannot start until this one is done.
+	reservationDeadline := monitor.reservationDeadline(inflight.runner, inflight.lastHeartbeat)
+	for _, reserved := range monitor.mapping {
+		if reserved.runner != inflight.runner || !reserved.reserved ||
+			!reservationDeadline.After(reserved.deadline) {
+			continue
+		}
+		reserved.deadline = reservationDeadline
+		select {
+		case reserved.heartbeat <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+func (monitor *InflightMonitor) timeout(inflight *InflightRun, reason string) {
+	runCtx := inflight.runCtx
 	runCtx.Log.Warn(
 		"run timed out. retrying",
 		map[string]any{
 			"context": runCtx,
+			"runner":  inflight.runner,
+			"reason":  reason,
 		},
 	)
+	monitor.Lock()
+	runnerHealth := monitor.runnerHealth
+	monitor.Unlock()
+	// Reservations that expire are a consequence of the runner's current run
+	// taking too long, which is already accounted for.
+	if runnerHealth != nil && reason != "reservation" {
+		runnerHealth.Record(inflight.runner, runCtx.RunInfo.ID, RunnerOutcomeTimeout)
+	}
 	runCtx.Requeue(false)
-	timeout <- struct{}{}
+	inflight.timeout <- struct{}{}
 }
 
 // Get returns the RunContext associated with the specified attempt ID.
@@ -784,6 +1461,12 @@ func (monitor *InflightMonitor) Get(attemptID uint64) (*RunContext, <-chan struc
 	if !ok {
 		return nil, nil, ok
 	}
+	monitor.start(inflight)
+	if inflight.progress == nil {
+		// Runners that don't send heartbeats have readyTimeout to finish
+		// uploading the results once they connect.
+		inflight.deadline = time.Now().Add(monitor.readyTimeout)
+	}
 	// Try to signal that the runner has connected, unless it was already
 	// signalled before.
 	select {
@@ -804,6 +1487,7 @@ func (monitor *InflightMonitor) Remove(attemptID uint64) {
 			Delta:    time.Now().Sub(inflight.runCtx.RunInfo.QueueTime),
 			Priority: inflight.runCtx.RunInfo.Priority,
 			Type:     QueueEventTypeQueueRemoved,
+			RunID:    inflight.runCtx.RunInfo.ID,
 		})
 		inflight.runCtx.monitor = nil
 		select {
@@ -838,6 +1522,12 @@ func (monitor *InflightMonitor) GetRunData() []*RunData {
 			Runner:       inflight.runner,
 			Time:         inflight.creationTime.Unix(),
 			Elapsed:      now.Sub(inflight.creationTime).Nanoseconds(),
+			Deadline:     inflight.deadline.Unix(),
+			Reserved:     inflight.reserved,
+			Progress:     inflight.progress,
+		}
+		if inflight.progress != nil {
+			data[idx].LastHeartbeat = inflight.lastHeartbeat.Unix()
 		}
 		idx++
 	}
@@ -925,6 +1615,8 @@ type QueueEvent struct {
 	Delta    time.Duration
 	Priority QueuePriority
 	Type     QueueEventType
+	// RunID is the ID of the run that the event refers to.
+	RunID int64
 }
 
 type queueEventListener struct {
@@ -932,6 +1624,17 @@ type queueEventListener struct {
 	added    *chan struct{}
 }
 
+// runnerInputsExpiration is the amount of time after which the inputs reported
+// by a runner are no longer considered for dispatching.
+const runnerInputsExpiration = time.Duration(10) * time.Minute
+
+// runnerInputs is the set of inputs that a runner reported as being cached
+// the last time it requested a run.
+type runnerInputs struct {
+	hashes   map[string]struct{}
+	lastSeen time.Time
+}
+
 // QueueManager is an expvar-friendly manager for Queues.
 type QueueManager struct {
 	sync.Mutex
@@ -942,6 +1645,23 @@ type QueueManager struct {
 	events        chan *QueueEvent
 	listenerChan  chan queueEventListener
 	listeners     []chan<- *QueueEvent
+	runtimePath   string
+	journal       *queueJournal
+	fairShareKey  string
+	maxQueueWait  [QueueCount]time.Duration
+	done          chan struct{}
+	agingDone     chan struct{}
+
+	// gradingDurations is the history of how long it takes to grade runs,
+	// used to estimate when queued runs will be dispatched.
+	gradingDurations *gradingDurations
+
+	// inputAffinityDelay is the maximum amount of time that a run will be
+	// held back for a runner that has its input cached.
+	inputAffinityDelay time.Duration
+	runnerInputsLock   sync.Mutex
+	runnerInputs       map[string]*runnerInputs
+	runnersSeen        map[string]time.Time
 }
 
 // QueueInfo has information about one queue.
@@ -958,10 +1678,19 @@ func NewQueueManager(channelLength int, graderRuntimePath string) *QueueManager
 		events:        make(chan *QueueEvent, 1),
 		listenerChan:  make(chan queueEventListener, 1),
 		listeners:     make([]chan<- *QueueEvent, 0),
+		runtimePath:   graderRuntimePath,
+		fairShareKey:  FairShareKeyNone,
+		done:          make(chan struct{}),
+		agingDone:     make(chan struct{}),
+		runnerInputs:  make(map[string]*runnerInputs),
+		runnersSeen:   make(map[string]time.Time),
+
+		gradingDurations: newGradingDurations(),
 	}
 	manager.Add(DefaultQueueName)
 	go manager.run()
 	go manager.PostProcessor.run()
+	go manager.agingLoop()
 	return manager
 }
 
@@ -972,9 +1701,12 @@ func (manager *QueueManager) Add(name string) *Queue {
 		Name:         name,
 		ready:        make(chan struct{}, QueueCount*manager.channelLength),
 		queueManager: manager,
+		enqueued:     make(chan struct{}),
 	}
-	for r := range queue.runs {
-		queue.runs[r] = make(chan *RunContext, manager.channelLength)
+	for r := range queue.slots {
+		queue.slots[r] = make(chan struct{}, manager.channelLength)
+		queue.served[r] = make(map[string]uint64)
+		queue.pending[r] = make(map[string]int)
 	}
 	manager.Lock()
 	defer manager.Unlock()
@@ -1002,17 +1734,193 @@ func (manager *QueueManager) GetQueueInfo() map[string]QueueInfo {
 	queues := make(map[string]QueueInfo)
 	for name, queue := range manager.mapping {
 		queues[name] = QueueInfo{
-			Lengths: [QueueCount]int{
-				len(queue.runs[0]),
-				len(queue.runs[1]),
-				len(queue.runs[2]),
-				len(queue.runs[3]),
-			},
+			Lengths: queue.lengths(),
 		}
 	}
 	return queues
 }
 
+// setJournal makes the QueueManager record all state changes of its runs in
+// the provided journal.
+func (manager *QueueManager) setJournal(journal *queueJournal) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	manager.journal = journal
+}
+
+// getJournal returns the journal where state changes are recorded. The result
+// might be nil, which is safe to use.
+func (manager *QueueManager) getJournal() *queueJournal {
+	manager.Lock()
+	defer manager.Unlock()
+
+	return manager.journal
+}
+
+// SetMaxQueueWait sets the maximum amount of time that a run can wait in each
+// priority before it is promoted to the next higher priority. A non-positive
+// duration disables aging for that priority. The wait for QueuePriorityHigh
+// is ignored, since there is no higher priority.
+func (manager *QueueManager) SetMaxQueueWait(maxWait [QueueCount]time.Duration) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	manager.maxQueueWait = maxWait
+}
+
+// getMaxQueueWait returns the maximum wait of each priority.
+func (manager *QueueManager) getMaxQueueWait() [QueueCount]time.Duration {
+	manager.Lock()
+	defer manager.Unlock()
+
+	return manager.maxQueueWait
+}
+
+// agingLoop periodically promotes the runs that have waited for too long in
+// all the queues, even if no runner is requesting runs from them.
+func (manager *QueueManager) agingLoop() {
+	defer close(manager.agingDone)
+	ticker := time.NewTicker(agingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-manager.done:
+			return
+		case now := <-ticker.C:
+			manager.Lock()
+			queues := make([]*Queue, 0, len(manager.mapping))
+			for _, queue := range manager.mapping {
+				queues = append(queues, queue)
+			}
+			manager.Unlock()
+
+			for _, queue := range queues {
+				queue.age(now)
+			}
+		}
+	}
+}
+
+// SetFairShareKey sets the attribute of the runs that is used to group them
+// into buckets for fair-share scheduling. It must be one of FairShareKeyNone,
+// FairShareKeyUser, FairShareKeyProblemset, or FairShareKeyContest, and only
+// affects runs that are queued afterwards.
+func (manager *QueueManager) SetFairShareKey(key string) error {
+	switch key {
+	case FairShareKeyNone, FairShareKeyUser, FairShareKeyProblemset, FairShareKeyContest:
+	default:
+		return errors.Errorf("invalid fair-share key %q", key)
+	}
+
+	manager.Lock()
+	defer manager.Unlock()
+
+	manager.fairShareKey = key
+	return nil
+}
+
+// fairShareBucket returns the fair-share scheduling bucket of the run.
+func (manager *QueueManager) fairShareBucket(runInfo *RunInfo) string {
+	manager.Lock()
+	key := manager.fairShareKey
+	manager.Unlock()
+
+	switch key {
+	case FairShareKeyUser:
+		return runInfo.Username
+	case FairShareKeyProblemset:
+		if runInfo.Problemset != nil {
+			return strconv.FormatInt(*runInfo.Problemset, 10)
+		}
+	case FairShareKeyContest:
+		if runInfo.Contest != nil {
+			return *runInfo.Contest
+		}
+	}
+	return ""
+}
+
+// SetInputAffinityDelay sets the maximum amount of time that a run will be
+// held back for a runner that has its input cached, before it can be
+// dispatched to any other runner.
+func (manager *QueueManager) SetInputAffinityDelay(delay time.Duration) {
+	manager.runnerInputsLock.Lock()
+	defer manager.runnerInputsLock.Unlock()
+
+	manager.inputAffinityDelay = delay
+}
+
+// updateRunnerInputs records the set of inputs that a runner has cached.
+func (manager *QueueManager) updateRunnerInputs(
+	runner string,
+	hashes map[string]struct{},
+) {
+	manager.runnerInputsLock.Lock()
+	defer manager.runnerInputsLock.Unlock()
+
+	now := time.Now()
+	manager.runnerInputs[runner] = &runnerInputs{
+		hashes:   hashes,
+		lastSeen: now,
+	}
+	for name, inputs := range manager.runnerInputs {
+		if now.Sub(inputs.lastSeen) > runnerInputsExpiration {
+			delete(manager.runnerInputs, name)
+		}
+	}
+}
+
+// pickRun returns the index of the first run in runs (visited in the provided
+// order) that should be dispatched to the runner: either one whose input the
+// runner has cached, or one that is not being held back for another runner.
+// If all runs are being held back, it returns -1 and the time until the first
+// of them is released.
+func (manager *QueueManager) pickRun(
+	runner string,
+	cachedInputs map[string]struct{},
+	runs []*RunContext,
+	order []int,
+) (int, time.Duration) {
+	manager.runnerInputsLock.Lock()
+	defer manager.runnerInputsLock.Unlock()
+
+	for _, idx := range order {
+		if _, ok := cachedInputs[runs[idx].RunInfo.Run.InputHash]; ok {
+			return idx, 0
+		}
+	}
+
+	now := time.Now()
+	wait := manager.inputAffinityDelay
+	for _, idx := range order {
+		runCtx := runs[idx]
+		remaining := manager.inputAffinityDelay - now.Sub(runCtx.RunInfo.QueueTime)
+		if remaining <= 0 || !manager.isCachedElsewhere(runner, runCtx.RunInfo.Run.InputHash) {
+			return idx, 0
+		}
+		if remaining < wait {
+			wait = remaining
+		}
+	}
+	return -1, wait
+}
+
+// isCachedElsewhere returns whether any runner other than the provided one has
+// reported having the input cached. The caller must hold the
+// runnerInputsLock.
+func (manager *QueueManager) isCachedElsewhere(runner, hash string) bool {
+	for name, inputs := range manager.runnerInputs {
+		if name == runner {
+			continue
+		}
+		if _, ok := inputs.hashes[hash]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // MarshalJSON returns a JSON representation of the queue lengths for reporting
 // purposes.
 func (manager *QueueManager) MarshalJSON() ([]byte, error) {
@@ -1038,8 +1946,11 @@ func (manager *QueueManager) AddEvent(event *QueueEvent) {
 
 // Close terminates the event listener goroutine.
 func (manager *QueueManager) Close() {
+	close(manager.done)
+	<-manager.agingDone
 	close(manager.events)
 	manager.PostProcessor.Close()
+	manager.getJournal().Close()
 }
 
 func (manager *QueueManager) run() {
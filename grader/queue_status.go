@@ -0,0 +1,236 @@
+package grader
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultGradingDuration is the estimated amount of time it takes to grade a
+// run when there is no history at all.
+const defaultGradingDuration = time.Duration(10) * time.Second
+
+// gradingDurationSmoothing is the inverse of the weight that the most recent
+// sample has in the moving average of the grading durations.
+const gradingDurationSmoothing = 8
+
+// QueuedRunData represents the data of a single run that is waiting in a
+// queue.
+type QueuedRunData struct {
+	ID           int64
+	GUID         string
+	Position     int
+	Priority     QueuePriority
+	Problem      string
+	Language     string
+	AttemptsLeft int
+	Age          time.Duration
+
+	// ETA is the estimated amount of time until the run is dispatched to a
+	// runner.
+	ETA time.Duration
+	// EstimatedDuration is the estimated amount of time it will take to grade
+	// the run once it is dispatched.
+	EstimatedDuration time.Duration
+}
+
+// QueueStatus has the list of runs that are waiting in one queue, in the order
+// in which they are expected to be dispatched.
+type QueueStatus struct {
+	Name    string
+	Runners int
+	Runs    []*QueuedRunData
+}
+
+// durationEstimate is an exponential moving average of durations.
+type durationEstimate struct {
+	mean    time.Duration
+	samples int64
+}
+
+func (e *durationEstimate) observe(duration time.Duration) {
+	if e.samples == 0 {
+		e.mean = duration
+	} else {
+		e.mean += (duration - e.mean) / gradingDurationSmoothing
+	}
+	e.samples++
+}
+
+type gradingDurationKey struct {
+	problem  string
+	language string
+}
+
+// gradingDurations keeps track of how long it has historically taken to grade
+// runs for each problem and language.
+type gradingDurations struct {
+	sync.Mutex
+	byLanguage map[gradingDurationKey]*durationEstimate
+	byProblem  map[string]*durationEstimate
+	overall    durationEstimate
+}
+
+func newGradingDurations() *gradingDurations {
+	return &gradingDurations{
+		byLanguage: make(map[gradingDurationKey]*durationEstimate),
+		byProblem:  make(map[string]*durationEstimate),
+	}
+}
+
+// observe records that grading a run for the provided problem and language
+// took the provided duration.
+func (d *gradingDurations) observe(problem, language string, duration time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+
+	key := gradingDurationKey{problem: problem, language: language}
+	if _, ok := d.byLanguage[key]; !ok {
+		d.byLanguage[key] = &durationEstimate{}
+	}
+	d.byLanguage[key].observe(duration)
+	if _, ok := d.byProblem[problem]; !ok {
+		d.byProblem[problem] = &durationEstimate{}
+	}
+	d.byProblem[problem].observe(duration)
+	d.overall.observe(duration)
+}
+
+// estimate returns the expected amount of time it takes to grade a run for the
+// provided problem and language. If there is no history for that combination,
+// it falls back to the history of the problem, then to the history of all
+// problems.
+func (d *gradingDurations) estimate(problem, language string) time.Duration {
+	d.Lock()
+	defer d.Unlock()
+
+	if e, ok := d.byLanguage[gradingDurationKey{problem: problem, language: language}]; ok {
+		return e.mean
+	}
+	if e, ok := d.byProblem[problem]; ok {
+		return e.mean
+	}
+	if d.overall.samples != 0 {
+		return d.overall.mean
+	}
+	return defaultGradingDuration
+}
+
+// EstimateGradingDuration returns the expected amount of time it takes to
+// grade a run for the provided problem and language, based on the runs that
+// have been graded so far.
+func (manager *QueueManager) EstimateGradingDuration(problem, language string) time.Duration {
+	return manager.gradingDurations.estimate(problem, language)
+}
+
+// observeRunner records that the runner just requested a run.
+func (manager *QueueManager) observeRunner(runner string, now time.Time) {
+	manager.runnerInputsLock.Lock()
+	defer manager.runnerInputsLock.Unlock()
+
+	manager.runnersSeen[runner] = now
+	for name, lastSeen := range manager.runnersSeen {
+		if now.Sub(lastSeen) > runnerInputsExpiration {
+			delete(manager.runnersSeen, name)
+		}
+	}
+}
+
+// activeRunners returns the names of the runners that have requested a run
+// recently.
+func (manager *QueueManager) activeRunners(now time.Time) map[string]struct{} {
+	manager.runnerInputsLock.Lock()
+	defer manager.runnerInputsLock.Unlock()
+
+	runners := make(map[string]struct{})
+	for name, lastSeen := range manager.runnersSeen {
+		if now.Sub(lastSeen) <= runnerInputsExpiration {
+			runners[name] = struct{}{}
+		}
+	}
+	return runners
+}
+
+// GetQueueStatus returns the runs that are waiting in each queue, together
+// with an estimate of how long it will take for each of them to be
+// dispatched. The estimate assumes that all the runners that have been seen
+// recently share the work, and that the in-flight runs take as long as runs
+// for the same problem and language have historically taken.
+func (manager *QueueManager) GetQueueStatus(monitor *InflightMonitor) map[string]*QueueStatus {
+	manager.Lock()
+	queues := make([]*Queue, 0, len(manager.mapping))
+	for _, queue := range manager.mapping {
+		queues = append(queues, queue)
+	}
+	manager.Unlock()
+
+	now := time.Now()
+	runners := manager.activeRunners(now)
+	pending := make(map[*Queue]time.Duration)
+	for _, inflight := range monitor.inflightRuns() {
+		runners[inflight.runner] = struct{}{}
+		run := inflight.runCtx.RunInfo.Run
+		remaining := manager.EstimateGradingDuration(run.ProblemName, run.Language) -
+			now.Sub(inflight.creationTime)
+		if remaining > 0 {
+			pending[inflight.runCtx.queue] += remaining
+		}
+	}
+	runnerCount := len(runners)
+	if runnerCount == 0 {
+		runnerCount = 1
+	}
+
+	status := make(map[string]*QueueStatus)
+	for _, queue := range queues {
+		queueStatus := &QueueStatus{
+			Name:    queue.Name,
+			Runners: runnerCount,
+			Runs:    queue.queuedRuns(now),
+		}
+		ahead := pending[queue]
+		for _, data := range queueStatus.Runs {
+			data.EstimatedDuration = manager.EstimateGradingDuration(data.Problem, data.Language)
+			data.ETA = ahead / time.Duration(runnerCount)
+			ahead += data.EstimatedDuration
+		}
+		status[queue.Name] = queueStatus
+	}
+	return status
+}
+
+// queuedRuns returns the runs that are waiting in the queue, in the order in
+// which they will be dispatched.
+func (queue *Queue) queuedRuns(now time.Time) []*QueuedRunData {
+	queue.Lock()
+	defer queue.Unlock()
+
+	runs := make([]*QueuedRunData, 0)
+	for priority := range queue.runs {
+		for _, idx := range queue.fairOrder(QueuePriority(priority)) {
+			runCtx := queue.runs[priority][idx]
+			runs = append(runs, &QueuedRunData{
+				ID:           runCtx.RunInfo.ID,
+				GUID:         runCtx.RunInfo.GUID,
+				Position:     len(runs),
+				Priority:     QueuePriority(priority),
+				Problem:      runCtx.RunInfo.Run.ProblemName,
+				Language:     runCtx.RunInfo.Run.Language,
+				AttemptsLeft: runCtx.attemptsLeft,
+				Age:          now.Sub(runCtx.RunInfo.QueueTime),
+			})
+		}
+	}
+	return runs
+}
+
+// inflightRuns returns a copy of the list of in-flight runs.
+func (monitor *InflightMonitor) inflightRuns() []*InflightRun {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	runs := make([]*InflightRun, 0, len(monitor.mapping))
+	for _, inflight := range monitor.mapping {
+		runs = append(runs, inflight)
+	}
+	return runs
+}
@@ -1,11 +1,17 @@
 package grader
 
 import (
+	"fmt"
+	base "github.com/omegaup/go-base/v3"
 	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
 	"math/big"
 	"os"
+	"reflect"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -18,6 +24,42 @@ func addRun(
 	queue *Queue,
 	priority QueuePriority,
 ) *RunInfo {
+	return addUserRun(t, ctx, queue, priority, "")
+}
+
+func addUserRun(
+	t *testing.T,
+	ctx *Context,
+	queue *Queue,
+	priority QueuePriority,
+	username string,
+) *RunInfo {
+	originalLength := len(queue.runs[priority])
+
+	runInfo, inputRef := newTestRun(t, ctx, priority, username)
+	if err := queue.AddRun(&ctx.Context, runInfo, inputRef); err != nil {
+		t.Fatalf("AddRunContext failed with %q", err)
+	}
+
+	if len(queue.runs[priority]) != originalLength+1 {
+		t.Fatalf(
+			"expected len(queue.runs[%d]) == %d, got %d",
+			priority,
+			originalLength+1,
+			len(queue.runs[priority]),
+		)
+	}
+	return runInfo
+}
+
+// newTestRun returns a new run and a reference to its input, ready to be
+// added to a queue.
+func newTestRun(
+	t *testing.T,
+	ctx *Context,
+	priority QueuePriority,
+	username string,
+) (*RunInfo, *common.InputRef) {
 	AplusB, err := common.NewLiteralInputFactory(
 		&common.LiteralInput{
 			Cases: map[string]*common.LiteralCaseSettings{
@@ -39,28 +81,15 @@ func addRun(
 		t.Fatalf("Failed to get input back: %q", err)
 	}
 
-	originalLength := len(queue.runs[priority])
-
 	artifactManager := NewArtifactManager(nil)
 	runInfo := NewRunInfo()
 	runInfo.ID = atomic.AddInt64(&runID, 1)
+	runInfo.Username = username
 	runInfo.Priority = priority
 	runInfo.Run.InputHash = inputRef.Input.Hash()
 	runInfo.Run.Source = "print 3"
 	runInfo.Artifacts = artifactManager.Grader(&ctx.Context, runInfo.ID)
-	if err := queue.AddRun(&ctx.Context, runInfo, inputRef); err != nil {
-		t.Fatalf("AddRunContext failed with %q", err)
-	}
-
-	if len(queue.runs[priority]) != originalLength+1 {
-		t.Fatalf(
-			"expected len(queue.runs[%d]) == %d, got %d",
-			priority,
-			originalLength+1,
-			len(queue.runs[priority]),
-		)
-	}
-	return runInfo
+	return runInfo, inputRef
 }
 
 func TestMonitorSerializability(t *testing.T) {
@@ -147,6 +176,170 @@ func TestQueue(t *testing.T) {
 	}
 }
 
+func TestInflightMonitorHeartbeat(t *testing.T) {
+	ctx, err := newGraderContext(t)
+	if err != nil {
+		t.Fatalf("GraderContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Grader.RuntimePath)
+	}
+
+	queue, err := ctx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+	closeNotifier := make(chan bool, 1)
+
+	ctx.InflightMonitor.SetTimeouts(100*time.Millisecond, 200*time.Millisecond, 2)
+	addRun(t, ctx, queue, QueuePriorityNormal)
+	addRun(t, ctx, queue, QueuePriorityNormal)
+	runCtx, timeout, _ := queue.GetRun("test", ctx.InflightMonitor, closeNotifier)
+
+	// Heartbeats keep the run alive for longer than the heartbeat timeout, and
+	// extend the deadline proportionally to the overall wall time limit.
+	attemptID := runCtx.RunInfo.Run.AttemptID
+	if ctx.InflightMonitor.Heartbeat(attemptID, "other", nil) {
+		t.Errorf("Heartbeat(%d) succeeded for a runner that does not own the run", attemptID)
+	}
+	for i := 0; i < 10; i++ {
+		if !ctx.InflightMonitor.Heartbeat(attemptID, "test", &runner.RunProgress{
+			Phase:                runner.ProgressPhaseRun,
+			Case:                 fmt.Sprintf("%d", i),
+			CasesDone:            i,
+			CasesTotal:           10,
+			OverallWallTimeLimit: base.Duration(time.Second),
+		}) {
+			t.Fatalf("Heartbeat(%d) failed", attemptID)
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("run timed out while sending heartbeats")
+		case <-time.After(30 * time.Millisecond):
+		}
+	}
+	runData := ctx.InflightMonitor.GetRunData()
+	if len(runData) != 1 || runData[0].Progress == nil || runData[0].Progress.Case != "9" {
+		t.Errorf("GetRunData() == %v, want the progress of case 9", runData)
+	}
+
+	// Connecting does not stop the heartbeat timeout for runners that send
+	// heartbeats, so they are detected as dead quickly.
+	ctx.InflightMonitor.Get(attemptID)
+	select {
+	case _, didTimeout := <-timeout:
+		if !didTimeout {
+			t.Fatalf("expected timeout but did not happen")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("run did not time out after the heartbeats stopped")
+	}
+	if ctx.InflightMonitor.Heartbeat(attemptID, "test", nil) {
+		t.Errorf("Heartbeat(%d) succeeded for a timed out run", attemptID)
+	}
+
+	// Runners that do not send heartbeats are not subject to the heartbeat
+	// timeout nor to deadlineBase, and only have to meet readyTimeout once they
+	// connect.
+	ctx.InflightMonitor.SetTimeouts(50*time.Millisecond, 50*time.Millisecond, 0)
+	ctx.InflightMonitor.connectTimeout = 200 * time.Millisecond
+	ctx.InflightMonitor.readyTimeout = 200 * time.Millisecond
+	runCtx, timeout, _ = queue.GetRun("test", ctx.InflightMonitor, closeNotifier)
+	select {
+	case <-timeout:
+		t.Fatalf("run without heartbeats timed out before connecting")
+	case <-time.After(100 * time.Millisecond):
+	}
+	ctx.InflightMonitor.Get(runCtx.RunInfo.Run.AttemptID)
+	start := time.Now()
+	if _, didTimeout := <-timeout; !didTimeout {
+		t.Fatalf("expected timeout but did not happen")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("run timed out after %v, want the 200ms deadline", elapsed)
+	}
+}
+
+func TestInflightMonitorReservation(t *testing.T) {
+	ctx, err := newGraderContext(t)
+	if err != nil {
+		t.Fatalf("GraderContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Grader.RuntimePath)
+	}
+
+	queue, err := ctx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+	closeNotifier := make(chan bool, 1)
+
+	ctx.InflightMonitor.SetTimeouts(50*time.Millisecond, 200*time.Millisecond, 1)
+	addRun(t, ctx, queue, QueuePriorityNormal)
+	addRun(t, ctx, queue, QueuePriorityNormal)
+	currentCtx, _, _ := queue.GetRun("test", ctx.InflightMonitor, closeNotifier)
+	reservedCtx, timeout, ok := queue.ReserveRunWithInputAffinity(
+		"test",
+		nil,
+		ctx.InflightMonitor,
+		closeNotifier,
+	)
+	if !ok {
+		t.Fatalf("ReserveRunWithInputAffinity() failed")
+	}
+	currentAttemptID := currentCtx.RunInfo.Run.AttemptID
+	reservedAttemptID := reservedCtx.RunInfo.Run.AttemptID
+
+	reserved := func() bool {
+		for _, data := range ctx.InflightMonitor.GetRunData() {
+			if data.AttemptID == reservedAttemptID {
+				return data.Reserved
+			}
+		}
+		t.Fatalf("GetRunData() does not contain attempt %d", reservedAttemptID)
+		return false
+	}
+
+	// Reserved runs don't need heartbeats, and their reservation lasts for as
+	// long as the runner keeps working on its current run.
+	for i := 0; i < 10; i++ {
+		if !ctx.InflightMonitor.Heartbeat(currentAttemptID, "test", &runner.RunProgress{
+			OverallWallTimeLimit: base.Duration(time.Second),
+		}) {
+			t.Fatalf("Heartbeat(%d) failed", currentAttemptID)
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("reserved run timed out while the current run was being graded")
+		case <-time.After(30 * time.Millisecond):
+		}
+	}
+	if !reserved() {
+		t.Errorf("run %d is not reserved", reservedAttemptID)
+	}
+	ctx.InflightMonitor.Remove(currentAttemptID)
+
+	// The first heartbeat starts the run, and from then on heartbeats are
+	// expected.
+	if !ctx.InflightMonitor.Heartbeat(reservedAttemptID, "test", nil) {
+		t.Fatalf("Heartbeat(%d) failed", reservedAttemptID)
+	}
+	if reserved() {
+		t.Errorf("run %d is still reserved after it started", reservedAttemptID)
+	}
+	select {
+	case _, didTimeout := <-timeout:
+		if !didTimeout {
+			t.Fatalf("expected timeout but did not happen")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("started run did not time out after the heartbeats stopped")
+	}
+}
+
 func TestQueueRetry(t *testing.T) {
 	ctx, err := newGraderContext(t)
 	if err != nil {
@@ -256,6 +449,305 @@ func TestQueuePriorities(t *testing.T) {
 	}
 }
 
+func TestQueueInputAffinity(t *testing.T) {
+	ctx, err := newGraderContext(t)
+	if err != nil {
+		t.Fatalf("GraderContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Grader.RuntimePath)
+	}
+
+	queue, err := ctx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+
+	closeNotifier := make(chan bool, 1)
+	hashA := strings.Repeat("a", 40)
+	hashB := strings.Repeat("b", 40)
+
+	runA := addRun(t, ctx, queue, QueuePriorityNormal)
+	runA.Run.InputHash = hashA
+	runB := addRun(t, ctx, queue, QueuePriorityNormal)
+	runB.Run.InputHash = hashB
+	highPriority := addRun(t, ctx, queue, QueuePriorityHigh)
+
+	// Affinity never overrides priorities.
+	runCtx, _, _ := queue.GetRunWithInputAffinity(
+		"runner-b",
+		map[string]struct{}{hashB: {}},
+		ctx.InflightMonitor,
+		closeNotifier,
+	)
+	if highPriority != runCtx.RunInfo {
+		t.Fatalf("expected runCtx.RunInfo == %v, got %v", highPriority, runCtx.RunInfo)
+	}
+
+	// The run with the cached input is preferred, even if it's not at the head
+	// of the queue.
+	runCtx, _, _ = queue.GetRunWithInputAffinity(
+		"runner-b",
+		map[string]struct{}{hashB: {}},
+		ctx.InflightMonitor,
+		closeNotifier,
+	)
+	if runB != runCtx.RunInfo {
+		t.Fatalf("expected runCtx.RunInfo == %v, got %v", runB, runCtx.RunInfo)
+	}
+
+	// A run whose input is cached by another runner is held back for a bounded
+	// amount of time, after which any runner can take it.
+	ctx.QueueManager.SetInputAffinityDelay(time.Hour)
+	ctx.QueueManager.updateRunnerInputs("runner-a", map[string]struct{}{hashA: {}})
+	if runCtx, wait := queue.dequeue("runner-c", map[string]struct{}{}); runCtx != nil || wait <= 0 {
+		t.Fatalf("expected run to be held back for runner-a, got %v (wait %v)", runCtx, wait)
+	}
+
+	// A runner that is waiting for the held back run picks up a new run as
+	// soon as it is added.
+	waitingRun := make(chan *RunContext, 1)
+	go func() {
+		runCtx, _, _ := queue.GetRunWithInputAffinity(
+			"runner-c",
+			map[string]struct{}{},
+			ctx.InflightMonitor,
+			closeNotifier,
+		)
+		waitingRun <- runCtx
+	}()
+	time.Sleep(50 * time.Millisecond)
+	newRun, inputRef := newTestRun(t, ctx, QueuePriorityNormal, "")
+	if err := queue.AddRun(&ctx.Context, newRun, inputRef); err != nil {
+		t.Fatalf("AddRunContext failed with %q", err)
+	}
+	select {
+	case runCtx := <-waitingRun:
+		if newRun != runCtx.RunInfo {
+			t.Fatalf("expected runCtx.RunInfo == %v, got %v", newRun, runCtx.RunInfo)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the waiting runner did not pick up the new run")
+	}
+
+	ctx.QueueManager.SetInputAffinityDelay(0)
+	runCtx, _, _ = queue.GetRunWithInputAffinity(
+		"runner-c",
+		map[string]struct{}{},
+		ctx.InflightMonitor,
+		closeNotifier,
+	)
+	if runA != runCtx.RunInfo {
+		t.Fatalf("expected runCtx.RunInfo == %v, got %v", runA, runCtx.RunInfo)
+	}
+}
+
+func TestQueueFairShare(t *testing.T) {
+	ctx, err := newGraderContext(t)
+	if err != nil {
+		t.Fatalf("GraderContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Grader.RuntimePath)
+	}
+
+	if err := ctx.QueueManager.SetFairShareKey("invalid"); err == nil {
+		t.Fatalf("SetFairShareKey(\"invalid\") succeeded, expected failure")
+	}
+	if err := ctx.QueueManager.SetFairShareKey(FairShareKeyUser); err != nil {
+		t.Fatalf("SetFairShareKey() failed: %v", err)
+	}
+	queue, err := ctx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+
+	closeNotifier := make(chan bool, 1)
+	getUser := func() string {
+		runCtx, _, _ := queue.GetRun("test", ctx.InflightMonitor, closeNotifier)
+		runCtx.Close()
+		return runCtx.RunInfo.Username
+	}
+
+	// A user with many runs does not delay the other users.
+	for i := 0; i < 3; i++ {
+		addUserRun(t, ctx, queue, QueuePriorityNormal, "flood")
+	}
+	addUserRun(t, ctx, queue, QueuePriorityNormal, "alice")
+	addUserRun(t, ctx, queue, QueuePriorityNormal, "bob")
+	// Priorities are still respected.
+	addUserRun(t, ctx, queue, QueuePriorityLow, "carol")
+
+	var users []string
+	for i := 0; i < 6; i++ {
+		users = append(users, getUser())
+	}
+	expected := []string{"flood", "alice", "bob", "flood", "flood", "carol"}
+	if !reflect.DeepEqual(expected, users) {
+		t.Fatalf("dispatch order == %v, want %v", users, expected)
+	}
+
+	// A user that joins later does not have to wait for all the runs that
+	// were queued before, but does not get to go first either.
+	addUserRun(t, ctx, queue, QueuePriorityNormal, "flood")
+	getUser()
+	for i := 0; i < 2; i++ {
+		addUserRun(t, ctx, queue, QueuePriorityNormal, "flood")
+	}
+	addUserRun(t, ctx, queue, QueuePriorityNormal, "dave")
+	users = nil
+	for i := 0; i < 3; i++ {
+		users = append(users, getUser())
+	}
+	expected = []string{"flood", "dave", "flood"}
+	if !reflect.DeepEqual(expected, users) {
+		t.Fatalf("dispatch order == %v, want %v", users, expected)
+	}
+}
+
+func TestQueueAging(t *testing.T) {
+	ctx, err := newGraderContext(t)
+	if err != nil {
+		t.Fatalf("GraderContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Grader.RuntimePath)
+	}
+
+	events := make(chan *QueueEvent, 16)
+	ctx.QueueManager.AddEventListener(events)
+	ctx.QueueManager.SetMaxQueueWait([QueueCount]time.Duration{
+		QueuePriorityLow:       time.Hour,
+		QueuePriorityEphemeral: time.Hour,
+	})
+
+	queue, err := ctx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+
+	ephemeralRun := addRun(t, ctx, queue, QueuePriorityEphemeral)
+	lowRun := addRun(t, ctx, queue, QueuePriorityLow)
+	normalRun := addRun(t, ctx, queue, QueuePriorityNormal)
+
+	// Nothing has waited long enough yet.
+	queue.age(time.Now())
+	if lengths := queue.lengths(); lengths != [QueueCount]int{0, 1, 1, 1} {
+		t.Fatalf("lengths() == %v, want [0 1 1 1]", lengths)
+	}
+
+	// After waiting for longer than the target, runs are promoted by one level.
+	// The low priority run was queued before the normal priority one, so it
+	// goes first.
+	queue.age(time.Now().Add(90 * time.Minute))
+	if lengths := queue.lengths(); lengths != [QueueCount]int{0, 2, 1, 0} {
+		t.Fatalf("lengths() == %v, want [0 2 1 0]", lengths)
+	}
+	promotions := 0
+	for promotions < 2 {
+		select {
+		case event := <-events:
+			if event.Type == QueueEventTypePromoted {
+				promotions++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("promotions == %d, want 2", promotions)
+		}
+	}
+
+	closeNotifier := make(chan bool, 1)
+	for _, expected := range []*RunInfo{lowRun, normalRun, ephemeralRun} {
+		runCtx, _, _ := queue.GetRun("test", ctx.InflightMonitor, closeNotifier)
+		if runCtx.RunInfo != expected {
+			t.Fatalf("expected runCtx.RunInfo == %v, got %v", expected, runCtx.RunInfo)
+		}
+		runCtx.Close()
+	}
+}
+
+func TestGradingDurations(t *testing.T) {
+	durations := newGradingDurations()
+	if estimate := durations.estimate("sumas", "py3"); estimate != defaultGradingDuration {
+		t.Errorf("estimate() == %v, want %v", estimate, defaultGradingDuration)
+	}
+
+	durations.observe("sumas", "py3", 8*time.Second)
+	durations.observe("sumas", "py3", 16*time.Second)
+	durations.observe("sumas", "cpp17-gcc", 2*time.Second)
+	for _, tc := range []struct {
+		problem, language string
+		expected          time.Duration
+	}{
+		{"sumas", "py3", 9 * time.Second},
+		{"sumas", "cpp17-gcc", 2 * time.Second},
+		{"sumas", "java", 8125 * time.Millisecond},
+		{"restas", "py3", 8125 * time.Millisecond},
+	} {
+		if estimate := durations.estimate(tc.problem, tc.language); estimate != tc.expected {
+			t.Errorf("estimate(%q, %q) == %v, want %v", tc.problem, tc.language, estimate, tc.expected)
+		}
+	}
+}
+
+func TestQueueStatus(t *testing.T) {
+	ctx, err := newGraderContext(t)
+	if err != nil {
+		t.Fatalf("GraderContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Grader.RuntimePath)
+	}
+
+	queue, err := ctx.QueueManager.Get(DefaultQueueName)
+	if err != nil {
+		t.Fatalf("default queue not found")
+	}
+	var runs []*RunInfo
+	for i := 0; i < 4; i++ {
+		runs = append(runs, addRun(t, ctx, queue, QueuePriorityNormal))
+	}
+
+	closeNotifier := make(chan bool, 1)
+	runCtx, _, _ := queue.GetRun("runner1", ctx.InflightMonitor, closeNotifier)
+	runCtx.dispatchTime = time.Now().Add(-20 * time.Second)
+	runCtx.RunInfo.Result.Verdict = "AC"
+	runCtx.Close()
+	runCtx, _, _ = queue.GetRun("runner2", ctx.InflightMonitor, closeNotifier)
+	defer runCtx.Close()
+
+	status, ok := ctx.QueueManager.GetQueueStatus(ctx.InflightMonitor)[DefaultQueueName]
+	if !ok {
+		t.Fatalf("default queue status not found")
+	}
+	if status.Runners != 2 {
+		t.Errorf("status.Runners == %d, want 2", status.Runners)
+	}
+	if len(status.Runs) != 2 {
+		t.Fatalf("len(status.Runs) == %d, want 2", len(status.Runs))
+	}
+	for i, data := range status.Runs {
+		if data.ID != runs[i+2].ID || data.Position != i || data.Priority != QueuePriorityNormal {
+			t.Errorf("status.Runs[%d] == %+v, want run %d at position %d", i, data, runs[i+2].ID, i)
+		}
+		if data.EstimatedDuration < 20*time.Second || data.EstimatedDuration >= 21*time.Second {
+			t.Errorf("status.Runs[%d].EstimatedDuration == %v, want ~20s", i, data.EstimatedDuration)
+		}
+	}
+
+	// The in-flight run is expected to take 20s, and the two runners share the
+	// load.
+	if eta := status.Runs[0].ETA; eta <= 9*time.Second || eta >= 11*time.Second {
+		t.Errorf("status.Runs[0].ETA == %v, want ~10s", eta)
+	}
+	if eta := status.Runs[1].ETA; eta <= 19*time.Second || eta >= 21*time.Second {
+		t.Errorf("status.Runs[1].ETA == %v, want ~20s", eta)
+	}
+}
+
 type listener struct {
 	c         chan *RunInfo
 	done      chan struct{}
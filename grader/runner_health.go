@@ -0,0 +1,262 @@
+package grader
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RunnerOutcome is the outcome of a single attempt to grade a run on a
+// runner.
+type RunnerOutcome int
+
+const (
+	// RunnerOutcomeOK means that the runner sent a verdict other than JE.
+	RunnerOutcomeOK RunnerOutcome = iota
+	// RunnerOutcomeJE means that the runner sent a JE verdict.
+	RunnerOutcomeJE
+	// RunnerOutcomeTimeout means that the runner did not finish the run in
+	// time.
+	RunnerOutcomeTimeout
+)
+
+type runnerOutcomeSample struct {
+	time    time.Time
+	outcome RunnerOutcome
+	runID   int64
+}
+
+// RunnerQuarantine describes why a runner was quarantined.
+type RunnerQuarantine struct {
+	Runner      string    `json:"runner"`
+	Time        time.Time `json:"time"`
+	Samples     int       `json:"samples"`
+	JERate      float64   `json:"je_rate"`
+	TimeoutRate float64   `json:"timeout_rate"`
+	// RecentRunIDs are the runs that the runner graded without a JE verdict
+	// during the window. Their results are also suspicious.
+	RecentRunIDs []int64 `json:"recent_run_ids,omitempty"`
+}
+
+type runnerHealth struct {
+	samples    []runnerOutcomeSample
+	quarantine *RunnerQuarantine
+	// released is closed when the runner is no longer quarantined.
+	released chan struct{}
+}
+
+// RunnerHealthMonitor keeps track of the JE and timeout rates of each runner
+// over a sliding window, and quarantines the runners whose combined rate
+// exceeds a threshold so that no more runs are dispatched to them. A runner is
+// only quarantined if the rest of the fleet is below the threshold, since
+// otherwise the problem is likely not the runner's fault (e.g. a broken
+// problem).
+type RunnerHealthMonitor struct {
+	sync.Mutex
+	window       time.Duration
+	minSamples   int
+	threshold    float64
+	runners      map[string]*runnerHealth
+	onQuarantine func(*RunnerQuarantine)
+}
+
+// NewRunnerHealthMonitor returns a new RunnerHealthMonitor. Runners are not
+// quarantined until SetThresholds is called with a positive threshold.
+func NewRunnerHealthMonitor() *RunnerHealthMonitor {
+	return &RunnerHealthMonitor{
+		window:     time.Duration(10) * time.Minute,
+		minSamples: 10,
+		runners:    make(map[string]*runnerHealth),
+	}
+}
+
+// SetThresholds sets the sliding window over which the outcomes are
+// considered, the minimum number of outcomes in that window needed to make a
+// decision, and the fraction of JE and timeout outcomes at or above which the
+// runner is quarantined. A non-positive threshold disables quarantines.
+func (h *RunnerHealthMonitor) SetThresholds(
+	window time.Duration,
+	minSamples int,
+	threshold float64,
+) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.window = window
+	h.minSamples = minSamples
+	h.threshold = threshold
+}
+
+// SetQuarantineHandler sets a function that is called in its own goroutine
+// whenever a runner is quarantined.
+func (h *RunnerHealthMonitor) SetQuarantineHandler(f func(*RunnerQuarantine)) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.onQuarantine = f
+}
+
+func (h *RunnerHealthMonitor) get(runner string) *runnerHealth {
+	health, ok := h.runners[runner]
+	if !ok {
+		health = &runnerHealth{}
+		h.runners[runner] = health
+	}
+	return health
+}
+
+// prune removes the samples that fell out of the window. Must be called with
+// the lock held.
+func (h *RunnerHealthMonitor) prune(health *runnerHealth, now time.Time) {
+	cutoff := now.Add(-h.window)
+	i := 0
+	for i < len(health.samples) && health.samples[i].time.Before(cutoff) {
+		i++
+	}
+	health.samples = health.samples[i:]
+}
+
+// fleetFailureRate returns the number of samples and the fraction of JE and
+// timeout outcomes among the samples of all the runners but the provided one.
+// Must be called with the lock held.
+func (h *RunnerHealthMonitor) fleetFailureRate(except string, now time.Time) (int, float64) {
+	total, failures := 0, 0
+	for runner, health := range h.runners {
+		if runner == except || health.quarantine != nil {
+			continue
+		}
+		h.prune(health, now)
+		for _, sample := range health.samples {
+			total++
+			if sample.outcome != RunnerOutcomeOK {
+				failures++
+			}
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return total, float64(failures) / float64(total)
+}
+
+// Record adds the outcome of an attempt to grade a run on a runner, and
+// quarantines the runner if needed.
+func (h *RunnerHealthMonitor) Record(runner string, runID int64, outcome RunnerOutcome) {
+	h.Lock()
+	now := time.Now()
+	health := h.get(runner)
+	h.prune(health, now)
+	health.samples = append(health.samples, runnerOutcomeSample{
+		time:    now,
+		outcome: outcome,
+		runID:   runID,
+	})
+	if h.threshold <= 0 || health.quarantine != nil || len(health.samples) < h.minSamples {
+		h.Unlock()
+		return
+	}
+
+	jeCount, timeoutCount := 0, 0
+	var recentRunIDs []int64
+	for _, sample := range health.samples {
+		switch sample.outcome {
+		case RunnerOutcomeJE:
+			jeCount++
+		case RunnerOutcomeTimeout:
+			timeoutCount++
+		default:
+			if sample.runID != 0 {
+				recentRunIDs = append(recentRunIDs, sample.runID)
+			}
+		}
+	}
+	samples := len(health.samples)
+	if float64(jeCount+timeoutCount)/float64(samples) < h.threshold {
+		h.Unlock()
+		return
+	}
+	if fleetSamples, fleetRate := h.fleetFailureRate(runner, now); fleetSamples >= h.minSamples && fleetRate >= h.threshold {
+		h.Unlock()
+		return
+	}
+
+	quarantine := &RunnerQuarantine{
+		Runner:       runner,
+		Time:         now,
+		Samples:      samples,
+		JERate:       float64(jeCount) / float64(samples),
+		TimeoutRate:  float64(timeoutCount) / float64(samples),
+		RecentRunIDs: recentRunIDs,
+	}
+	health.quarantine = quarantine
+	health.released = make(chan struct{})
+	onQuarantine := h.onQuarantine
+	h.Unlock()
+
+	if onQuarantine != nil {
+		go onQuarantine(quarantine)
+	}
+}
+
+// Quarantined returns whether the runner is currently quarantined.
+func (h *RunnerHealthMonitor) Quarantined(runner string) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	health, ok := h.runners[runner]
+	return ok && health.quarantine != nil
+}
+
+// WaitUntilHealthy blocks while the runner is quarantined. It returns false if
+// closeNotifier fires before that.
+func (h *RunnerHealthMonitor) WaitUntilHealthy(runner string, closeNotifier <-chan bool) bool {
+	h.Lock()
+	health, ok := h.runners[runner]
+	if !ok || health.quarantine == nil {
+		h.Unlock()
+		return true
+	}
+	released := health.released
+	h.Unlock()
+
+	select {
+	case <-released:
+		return true
+	case <-closeNotifier:
+		return false
+	}
+}
+
+// Unquarantine lets the runner receive runs again, and forgets its previous
+// outcomes. It returns false if the runner was not quarantined.
+func (h *RunnerHealthMonitor) Unquarantine(runner string) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	health, ok := h.runners[runner]
+	if !ok || health.quarantine == nil {
+		return false
+	}
+	health.quarantine = nil
+	health.samples = nil
+	close(health.released)
+	return true
+}
+
+// Quarantines returns the runners that are currently quarantined, sorted by
+// name.
+func (h *RunnerHealthMonitor) Quarantines() []*RunnerQuarantine {
+	h.Lock()
+	defer h.Unlock()
+
+	quarantines := make([]*RunnerQuarantine, 0)
+	for _, health := range h.runners {
+		if health.quarantine != nil {
+			quarantines = append(quarantines, health.quarantine)
+		}
+	}
+	sort.Slice(quarantines, func(i, j int) bool {
+		return quarantines[i].Runner < quarantines[j].Runner
+	})
+	return quarantines
+}
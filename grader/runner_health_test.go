@@ -0,0 +1,90 @@
+package grader
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunnerHealthMonitor(t *testing.T) {
+	health := NewRunnerHealthMonitor()
+	health.SetThresholds(time.Minute, 4, 0.5)
+	quarantined := make(chan *RunnerQuarantine, 1)
+	health.SetQuarantineHandler(func(quarantine *RunnerQuarantine) {
+		quarantined <- quarantine
+	})
+
+	for i := int64(1); i <= 4; i++ {
+		health.Record("healthy", 100+i, RunnerOutcomeOK)
+	}
+	health.Record("broken", 1, RunnerOutcomeOK)
+	health.Record("broken", 2, RunnerOutcomeJE)
+	health.Record("broken", 3, RunnerOutcomeOK)
+	if health.Quarantined("broken") {
+		t.Fatalf("runner quarantined before reaching the minimum number of samples")
+	}
+	health.Record("broken", 4, RunnerOutcomeTimeout)
+
+	select {
+	case quarantine := <-quarantined:
+		if quarantine.Runner != "broken" {
+			t.Errorf("quarantine.Runner = %q, want %q", quarantine.Runner, "broken")
+		}
+		if quarantine.JERate != 0.25 || quarantine.TimeoutRate != 0.25 {
+			t.Errorf(
+				"quarantine rates = %v, %v, want 0.25, 0.25",
+				quarantine.JERate,
+				quarantine.TimeoutRate,
+			)
+		}
+		if !reflect.DeepEqual(quarantine.RecentRunIDs, []int64{1, 3}) {
+			t.Errorf("quarantine.RecentRunIDs = %v, want [1 3]", quarantine.RecentRunIDs)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("quarantine handler not called")
+	}
+	if !health.Quarantined("broken") || health.Quarantined("healthy") {
+		t.Errorf("unexpected quarantines: %v", health.Quarantines())
+	}
+
+	closeNotifier := make(chan bool, 1)
+	closeNotifier <- true
+	if health.WaitUntilHealthy("broken", closeNotifier) {
+		t.Errorf("WaitUntilHealthy() = true for a quarantined runner")
+	}
+	if !health.WaitUntilHealthy("healthy", nil) {
+		t.Errorf("WaitUntilHealthy() = false for a healthy runner")
+	}
+
+	released := make(chan bool, 1)
+	go func() {
+		released <- health.WaitUntilHealthy("broken", nil)
+	}()
+	if !health.Unquarantine("broken") {
+		t.Errorf("Unquarantine() = false, want true")
+	}
+	select {
+	case ok := <-released:
+		if !ok {
+			t.Errorf("WaitUntilHealthy() = false after unquarantining")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WaitUntilHealthy() did not return after unquarantining")
+	}
+	if health.Unquarantine("broken") {
+		t.Errorf("Unquarantine() = true for a runner that is not quarantined")
+	}
+
+	// If the whole fleet is failing, the runners are not at fault.
+	health = NewRunnerHealthMonitor()
+	health.SetThresholds(time.Minute, 4, 0.5)
+	runners := []string{"runner-1", "runner-2", "runner-3"}
+	for i := int64(0); i < 4; i++ {
+		for _, runner := range runners {
+			health.Record(runner, i, RunnerOutcomeJE)
+		}
+	}
+	if quarantines := health.Quarantines(); len(quarantines) != 0 {
+		t.Errorf("runners quarantined while the whole fleet is failing: %v", quarantines)
+	}
+}
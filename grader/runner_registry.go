@@ -0,0 +1,370 @@
+package grader
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// RunnerRegistryFilename is the name of the file in the grader runtime path
+	// where the runner registry is stored.
+	RunnerRegistryFilename = "runners.json"
+
+	// runnerSecretSize is the number of random bytes in join tokens and
+	// credentials.
+	runnerSecretSize = 32
+
+	// runnerLastSeenSaveInterval is how often the time a runner was last seen
+	// is written to disk, since runners talk to the grader too often to write
+	// the registry every time.
+	runnerLastSeenSaveInterval = time.Minute
+)
+
+var (
+	// ErrInvalidJoinToken is returned when a runner tries to register with a
+	// join token that does not exist, has already been used, or has expired.
+	ErrInvalidJoinToken = errors.New("invalid join token")
+	// ErrUnknownRunnerCredential is returned when a runner presents a
+	// credential that was never issued.
+	ErrUnknownRunnerCredential = errors.New("unknown runner credential")
+	// ErrRunnerRevoked is returned when a runner presents a credential that has
+	// been revoked.
+	ErrRunnerRevoked = errors.New("runner credential revoked")
+	// ErrRunnerDisabled is returned when a runner that has been disabled tries
+	// to talk to the grader.
+	ErrRunnerDisabled = errors.New("runner disabled")
+	// ErrRunnerNotFound is returned when an operation refers to a runner that
+	// is not in the registry.
+	ErrRunnerNotFound = errors.New("runner not found")
+)
+
+// RunnerRegistration is the information that the grader keeps about a runner.
+// LastSeen is written to disk at most every runnerLastSeenSaveInterval, so it
+// can be that much older after the grader restarts.
+type RunnerRegistration struct {
+	Name             string    `json:"name"`
+	PublicIP         string    `json:"public_ip,omitempty"`
+	Capabilities     []string  `json:"capabilities,omitempty"`
+	RegistrationTime time.Time `json:"registration_time"`
+	LastSeen         time.Time `json:"last_seen"`
+	Disabled         bool      `json:"disabled,omitempty"`
+	Revoked          bool      `json:"revoked,omitempty"`
+}
+
+// registeredRunner is a RunnerRegistration together with the hash of the
+// credential that the runner uses to authenticate.
+type registeredRunner struct {
+	RunnerRegistration
+	CredentialHash string `json:"credential_hash,omitempty"`
+
+	// savedLastSeen is the LastSeen that was last written to disk.
+	savedLastSeen time.Time
+}
+
+// runnerRegistryState is the serialized contents of the runner registry.
+type runnerRegistryState struct {
+	Runners map[string]*registeredRunner `json:"runners"`
+	// JoinTokens maps the hashes of the join tokens that have not been used
+	// yet to their expiration time.
+	JoinTokens map[string]time.Time `json:"join_tokens"`
+}
+
+// RunnerRegistry keeps track of the runners that enrolled by exchanging a
+// one-time join token for a credential, and of the runners that have been
+// disabled or revoked by an administrator. Only the hashes of the join tokens
+// and credentials are stored.
+type RunnerRegistry struct {
+	sync.Mutex
+	filename string
+	state    runnerRegistryState
+	// credentials maps the credential hashes to runner names.
+	credentials map[string]string
+}
+
+// NewRunnerRegistry returns a RunnerRegistry that is persisted in the
+// provided file. Any previous contents of the file are loaded.
+func NewRunnerRegistry(filename string) (*RunnerRegistry, error) {
+	registry := &RunnerRegistry{
+		filename: filename,
+		state: runnerRegistryState{
+			Runners:    make(map[string]*registeredRunner),
+			JoinTokens: make(map[string]time.Time),
+		},
+		credentials: make(map[string]string),
+	}
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open the runner registry")
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&registry.state); err != nil {
+		return nil, errors.Wrap(err, "failed to read the runner registry")
+	}
+	if registry.state.Runners == nil {
+		registry.state.Runners = make(map[string]*registeredRunner)
+	}
+	if registry.state.JoinTokens == nil {
+		registry.state.JoinTokens = make(map[string]time.Time)
+	}
+	for name, runner := range registry.state.Runners {
+		runner.savedLastSeen = runner.LastSeen
+		if runner.CredentialHash != "" && !runner.Revoked {
+			registry.credentials[runner.CredentialHash] = name
+		}
+	}
+	return registry, nil
+}
+
+// newRunnerSecret returns a random string suitable for join tokens and
+// credentials.
+func newRunnerSecret() (string, error) {
+	buf := make([]byte, runnerSecretSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashRunnerSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// save writes the registry to disk. Must be called with the lock held.
+func (r *RunnerRegistry) save() error {
+	tmpFilename := r.filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the runner registry")
+	}
+	if err := json.NewEncoder(f).Encode(&r.state); err != nil {
+		f.Close()
+		os.Remove(tmpFilename)
+		return errors.Wrap(err, "failed to write the runner registry")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return errors.Wrap(err, "failed to write the runner registry")
+	}
+	return errors.Wrap(
+		os.Rename(tmpFilename, r.filename),
+		"failed to replace the runner registry",
+	)
+}
+
+// removeExpiredJoinTokens forgets all the join tokens that expired before
+// now. Must be called with the lock held.
+func (r *RunnerRegistry) removeExpiredJoinTokens(now time.Time) {
+	for hash, expiration := range r.state.JoinTokens {
+		if !now.Before(expiration) {
+			delete(r.state.JoinTokens, hash)
+		}
+	}
+}
+
+// CreateJoinToken returns a new join token that can be used exactly once to
+// register a runner before ttl elapses.
+func (r *RunnerRegistry) CreateJoinToken(ttl time.Duration) (string, time.Time, error) {
+	token, err := newRunnerSecret()
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "failed to create the join token")
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	expiration := now.Add(ttl)
+	r.removeExpiredJoinTokens(now)
+	r.state.JoinTokens[hashRunnerSecret(token)] = expiration
+	if err := r.save(); err != nil {
+		delete(r.state.JoinTokens, hashRunnerSecret(token))
+		return "", time.Time{}, err
+	}
+	return token, expiration, nil
+}
+
+// Register consumes the join token and returns a credential that the runner
+// can use from then on to authenticate. If the runner had registered before,
+// its previous credential stops being valid.
+func (r *RunnerRegistry) Register(
+	joinToken string,
+	name string,
+	publicIP string,
+	capabilities []string,
+) (string, error) {
+	credential, err := newRunnerSecret()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create the credential")
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	r.removeExpiredJoinTokens(now)
+	tokenHash := hashRunnerSecret(joinToken)
+	if _, ok := r.state.JoinTokens[tokenHash]; !ok {
+		return "", ErrInvalidJoinToken
+	}
+	previous, ok := r.state.Runners[name]
+	if ok && previous.Disabled {
+		return "", ErrRunnerDisabled
+	}
+	delete(r.state.JoinTokens, tokenHash)
+	if ok {
+		delete(r.credentials, previous.CredentialHash)
+	}
+
+	credentialHash := hashRunnerSecret(credential)
+	r.state.Runners[name] = &registeredRunner{
+		RunnerRegistration: RunnerRegistration{
+			Name:             name,
+			PublicIP:         publicIP,
+			Capabilities:     capabilities,
+			RegistrationTime: now,
+			LastSeen:         now,
+		},
+		CredentialHash: credentialHash,
+		savedLastSeen:  now,
+	}
+	r.credentials[credentialHash] = name
+	if err := r.save(); err != nil {
+		return "", err
+	}
+	return credential, nil
+}
+
+// Authenticate returns the name of the runner that was issued the provided
+// credential, and records that it was seen from publicIP.
+func (r *RunnerRegistry) Authenticate(credential string, publicIP string) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	credentialHash := hashRunnerSecret(credential)
+	name, ok := r.credentials[credentialHash]
+	if !ok {
+		for _, runner := range r.state.Runners {
+			if runner.Revoked && runner.CredentialHash == credentialHash {
+				return "", ErrRunnerRevoked
+			}
+		}
+		return "", ErrUnknownRunnerCredential
+	}
+	runner := r.state.Runners[name]
+	if runner.Disabled {
+		return "", ErrRunnerDisabled
+	}
+	r.seen(runner, publicIP)
+	return name, nil
+}
+
+// seen records that the runner was seen from publicIP. The registry is only
+// written when the address changes or LastSeen has not been written for a
+// while. Must be called with the lock held.
+func (r *RunnerRegistry) seen(runner *registeredRunner, publicIP string) {
+	now := time.Now()
+	runner.LastSeen = now
+	ipChanged := publicIP != "" && publicIP != runner.PublicIP
+	if ipChanged {
+		runner.PublicIP = publicIP
+	}
+	if !ipChanged && now.Sub(runner.savedLastSeen) < runnerLastSeenSaveInterval {
+		return
+	}
+	// A failure to write the registry is not a reason to reject the runner,
+	// and it will be retried the next time the runner is seen.
+	if err := r.save(); err == nil {
+		runner.savedLastSeen = now
+	}
+}
+
+// Check returns an error if the runner with the provided name was disabled or
+// revoked. This applies to runners that authenticate some other way, like
+// with a TLS client certificate, even if they never registered.
+func (r *RunnerRegistry) Check(name string, publicIP string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	runner, ok := r.state.Runners[name]
+	if !ok {
+		return nil
+	}
+	if runner.Revoked {
+		return ErrRunnerRevoked
+	}
+	if runner.Disabled {
+		return ErrRunnerDisabled
+	}
+	r.seen(runner, publicIP)
+	return nil
+}
+
+// SetDisabled disables or re-enables a runner. A runner that is not in the
+// registry yet is added to it, so that runners that authenticate with TLS
+// client certificates can also be disabled.
+func (r *RunnerRegistry) SetDisabled(name string, disabled bool) error {
+	r.Lock()
+	defer r.Unlock()
+
+	runner, ok := r.state.Runners[name]
+	if !ok {
+		if !disabled {
+			return ErrRunnerNotFound
+		}
+		runner = &registeredRunner{
+			RunnerRegistration: RunnerRegistration{
+				Name:             name,
+				RegistrationTime: time.Now(),
+			},
+		}
+		r.state.Runners[name] = runner
+	}
+	runner.Disabled = disabled
+	return r.save()
+}
+
+// Revoke permanently invalidates the runner's credential. The runner needs a
+// new join token to register again.
+func (r *RunnerRegistry) Revoke(name string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	runner, ok := r.state.Runners[name]
+	if !ok {
+		return ErrRunnerNotFound
+	}
+	delete(r.credentials, runner.CredentialHash)
+	runner.Revoked = true
+	return r.save()
+}
+
+// List returns all the runners in the registry, sorted by name.
+func (r *RunnerRegistry) List() []*RunnerRegistration {
+	r.Lock()
+	defer r.Unlock()
+
+	registrations := make([]*RunnerRegistration, 0, len(r.state.Runners))
+	for _, runner := range r.state.Runners {
+		registration := runner.RunnerRegistration
+		registration.Capabilities = append([]string(nil), runner.Capabilities...)
+		registrations = append(registrations, &registration)
+	}
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].Name < registrations[j].Name
+	})
+	return registrations
+}
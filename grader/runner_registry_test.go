@@ -0,0 +1,135 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRunnerRegistry(t *testing.T) {
+	dirname, err := ioutil.TempDir("/tmp", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dirname)
+	filename := path.Join(dirname, RunnerRegistryFilename)
+
+	registry, err := NewRunnerRegistry(filename)
+	if err != nil {
+		t.Fatalf("Failed to create the registry: %s", err)
+	}
+
+	if _, err := registry.Register("bogus", "runner-1", "", nil); err != ErrInvalidJoinToken {
+		t.Errorf("Register with a bogus token: err = %v, want %v", err, ErrInvalidJoinToken)
+	}
+
+	token, _, err := registry.CreateJoinToken(time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create a join token: %s", err)
+	}
+	credential, err := registry.Register(token, "runner-1", "10.0.0.1", []string{"arch:amd64"})
+	if err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+	if _, err := registry.Register(token, "runner-2", "", nil); err != ErrInvalidJoinToken {
+		t.Errorf("Register with a used token: err = %v, want %v", err, ErrInvalidJoinToken)
+	}
+	expiredToken, _, err := registry.CreateJoinToken(-time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create a join token: %s", err)
+	}
+	if _, err := registry.Register(expiredToken, "runner-2", "", nil); err != ErrInvalidJoinToken {
+		t.Errorf("Register with an expired token: err = %v, want %v", err, ErrInvalidJoinToken)
+	}
+
+	if name, err := registry.Authenticate(credential, "10.0.0.2"); err != nil || name != "runner-1" {
+		t.Errorf("Authenticate() = %q, %v, want %q, nil", name, err, "runner-1")
+	}
+	// A new address is written to disk right away, together with LastSeen.
+	reloaded, err := NewRunnerRegistry(filename)
+	if err != nil {
+		t.Fatalf("Failed to reload the registry: %s", err)
+	}
+	if got, want := reloaded.List(), registry.List(); len(got) != 1 ||
+		got[0].PublicIP != "10.0.0.2" ||
+		!got[0].LastSeen.Equal(want[0].LastSeen) {
+		t.Errorf("List() after reload = %v, want %v", got, want)
+	}
+	if _, err := registry.Authenticate("bogus", ""); err != ErrUnknownRunnerCredential {
+		t.Errorf("Authenticate with a bogus credential: err = %v, want %v", err, ErrUnknownRunnerCredential)
+	}
+
+	// Runners that authenticate with a certificate can also be disabled.
+	if err := registry.Check("cert-runner", ""); err != nil {
+		t.Errorf("Check() = %v, want nil", err)
+	}
+	if err := registry.SetDisabled("cert-runner", true); err != nil {
+		t.Fatalf("Failed to disable the runner: %s", err)
+	}
+	if err := registry.Check("cert-runner", ""); err != ErrRunnerDisabled {
+		t.Errorf("Check() = %v, want %v", err, ErrRunnerDisabled)
+	}
+	if err := registry.SetDisabled("cert-runner", false); err != nil {
+		t.Fatalf("Failed to enable the runner: %s", err)
+	}
+	if err := registry.Check("cert-runner", ""); err != nil {
+		t.Errorf("Check() = %v, want nil", err)
+	}
+	if err := registry.SetDisabled("missing", false); err != ErrRunnerNotFound {
+		t.Errorf("SetDisabled(missing) = %v, want %v", err, ErrRunnerNotFound)
+	}
+
+	if err := registry.SetDisabled("runner-1", true); err != nil {
+		t.Fatalf("Failed to disable the runner: %s", err)
+	}
+	if _, err := registry.Authenticate(credential, ""); err != ErrRunnerDisabled {
+		t.Errorf("Authenticate a disabled runner: err = %v, want %v", err, ErrRunnerDisabled)
+	}
+	if err := registry.SetDisabled("runner-1", false); err != nil {
+		t.Fatalf("Failed to enable the runner: %s", err)
+	}
+
+	// The registry survives restarts.
+	registry, err = NewRunnerRegistry(filename)
+	if err != nil {
+		t.Fatalf("Failed to reload the registry: %s", err)
+	}
+	if name, err := registry.Authenticate(credential, ""); err != nil || name != "runner-1" {
+		t.Errorf("Authenticate() after reload = %q, %v, want %q, nil", name, err, "runner-1")
+	}
+	registrations := registry.List()
+	if len(registrations) != 2 ||
+		registrations[0].Name != "cert-runner" ||
+		registrations[1].Name != "runner-1" ||
+		registrations[1].PublicIP != "10.0.0.2" {
+		t.Errorf("List() = %v, want cert-runner and runner-1", registrations)
+	}
+
+	if err := registry.Revoke("runner-1"); err != nil {
+		t.Fatalf("Failed to revoke the runner: %s", err)
+	}
+	if _, err := registry.Authenticate(credential, ""); err != ErrRunnerRevoked {
+		t.Errorf("Authenticate a revoked runner: err = %v, want %v", err, ErrRunnerRevoked)
+	}
+	if err := registry.Check("runner-1", ""); err != ErrRunnerRevoked {
+		t.Errorf("Check() a revoked runner = %v, want %v", err, ErrRunnerRevoked)
+	}
+
+	// A revoked runner can register again with a new token.
+	token, _, err = registry.CreateJoinToken(time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create a join token: %s", err)
+	}
+	newCredential, err := registry.Register(token, "runner-1", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to register again: %s", err)
+	}
+	if name, err := registry.Authenticate(newCredential, ""); err != nil || name != "runner-1" {
+		t.Errorf("Authenticate() with the new credential = %q, %v, want %q, nil", name, err, "runner-1")
+	}
+	if _, err := registry.Authenticate(credential, ""); err == nil {
+		t.Errorf("Authenticate() with the revoked credential succeeded")
+	}
+}
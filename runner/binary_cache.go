@@ -0,0 +1,266 @@
+package runner
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/quark/common"
+
+	"github.com/pkg/errors"
+)
+
+var errBinaryNotCached = errors.New("binary not cached")
+
+// A CompilerVersioner is a Sandbox that can tell which version of the compiler
+// it uses for a language. Only binaries compiled by sandboxes that implement
+// it can be cached, since the cached binaries need to be discarded whenever
+// the compiler changes.
+type CompilerVersioner interface {
+	CompilerVersion(lang string) (string, error)
+}
+
+// BinaryCache is a size-bounded cache of the compiled problemsetter binaries
+// (custom validators and libinteractive parents). These only depend on the
+// problem's input, so they can be compiled once per runner and reused by all
+// the runs of the same problem.
+type BinaryCache struct {
+	root     string
+	lruCache *base.LRUCache[*cachedBinary]
+	nextID   uint64
+}
+
+// cachedBinary is the directory of a binary, with its compilation outputs.
+type cachedBinary struct {
+	path string
+	size base.Byte
+	meta RunMetadata
+}
+
+func (b *cachedBinary) Release() {
+	os.RemoveAll(b.path)
+}
+
+func (b *cachedBinary) Size() base.Byte {
+	return b.size
+}
+
+// NewBinaryCache returns a BinaryCache that stores the binaries in root. Any
+// binaries left there by a previous process are removed, since they are not
+// accounted for.
+func NewBinaryCache(root string, sizeLimit base.Byte) (*BinaryCache, error) {
+	if err := os.RemoveAll(root); err != nil {
+		return nil, errors.Wrap(err, "failed to clear the binary cache")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create the binary cache")
+	}
+	return &BinaryCache{
+		root:     root,
+		lruCache: base.NewLRUCache[*cachedBinary](sizeLimit),
+	}, nil
+}
+
+// binaryCacheKey returns the key of a binary compiled from the provided input
+// with the provided compiler.
+func binaryCacheKey(inputHash string, b *binary, lang string, compilerVersion string) string {
+	hasher := sha1.New()
+	for _, field := range []string{
+		inputHash,
+		b.name,
+		b.target,
+		lang,
+		compilerVersion,
+		strings.Join(b.extraFlags, " "),
+	} {
+		io.WriteString(hasher, field)
+		hasher.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
+// restore copies the cached binary with the provided key into binRoot, and
+// returns its compilation metadata. It returns false if the binary is not
+// cached.
+func (c *BinaryCache) restore(key string, binRoot string) (*RunMetadata, bool, error) {
+	ref, err := c.lruCache.Get(key, func(key string) (*cachedBinary, error) {
+		return nil, errBinaryNotCached
+	})
+	if err == errBinaryNotCached {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.lruCache.Put(ref)
+
+	if _, err := copyTree(ref.Value.path, binRoot); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to restore binary %s", key)
+	}
+	meta := ref.Value.meta
+	return &meta, true, nil
+}
+
+// store adds a copy of the binary that was successfully compiled into binRoot
+// to the cache. If another run stored the same binary in the meantime, the
+// copy is discarded.
+func (c *BinaryCache) store(key string, binRoot string, meta *RunMetadata) error {
+	tmpPath := path.Join(c.root, fmt.Sprintf(".tmp-%d", atomic.AddUint64(&c.nextID, 1)))
+	defer os.RemoveAll(tmpPath)
+	size, err := copyTree(binRoot, tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to copy binary %s", key)
+	}
+	ref, err := c.lruCache.Get(key, func(key string) (*cachedBinary, error) {
+		cachedPath := path.Join(c.root, key)
+		if err := os.Rename(tmpPath, cachedPath); err != nil {
+			return nil, err
+		}
+		return &cachedBinary{
+			path: cachedPath,
+			size: size,
+			meta: *meta,
+		}, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to store binary %s", key)
+	}
+	c.lruCache.Put(ref)
+	return nil
+}
+
+// copyTree copies the regular files, directories and symlinks in src into
+// dst, overwriting any existing files, and returns the total size of the
+// copied files.
+func copyTree(src string, dst string) (base.Byte, error) {
+	var size base.Byte
+	err := filepath.WalkDir(src, func(srcPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := path.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(dstPath, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			os.Remove(dstPath)
+			return os.Symlink(target, dstPath)
+		case d.Type().IsRegular():
+			size += base.Byte(info.Size())
+			return copyRegularFile(srcPath, dstPath, info.Mode().Perm())
+		default:
+			// Pipes and other special files are created for every run.
+			return nil
+		}
+	})
+	return size, err
+}
+
+// copyRegularFile physically copies one file, so that the copies can be
+// modified independently.
+func copyRegularFile(src string, dst string, mode fs.FileMode) error {
+	srcFd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFd.Close()
+
+	dstFd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dstFd, srcFd); err != nil {
+		dstFd.Close()
+		return err
+	}
+	return dstFd.Close()
+}
+
+// compileCached compiles the problemsetter binary, or restores it from the
+// cache if it was already compiled for the same input. The cache can be nil,
+// in which case the binary is always compiled.
+func (c *BinaryCache) compileCached(
+	ctx *common.Context,
+	sandbox Sandbox,
+	inputHash string,
+	b *binary,
+	lang string,
+	binRoot string,
+	compile func() (*RunMetadata, error),
+) (*RunMetadata, error) {
+	versioner, ok := sandbox.(CompilerVersioner)
+	if c == nil || !ok {
+		return compile()
+	}
+	compilerVersion, err := versioner.CompilerVersion(lang)
+	if err != nil {
+		ctx.Log.Warn(
+			"Failed to get the compiler version, not caching the binary",
+			map[string]any{
+				"binary": b.name,
+				"lang":   lang,
+				"err":    err,
+			},
+		)
+		return compile()
+	}
+
+	key := binaryCacheKey(inputHash, b, lang, compilerVersion)
+	meta, found, err := c.restore(key, binRoot)
+	if err != nil {
+		ctx.Log.Error(
+			"Failed to restore the cached binary, compiling it again",
+			map[string]any{
+				"binary": b.name,
+				"key":    key,
+				"err":    err,
+			},
+		)
+	} else if found {
+		ctx.Metrics.CounterAdd("runner_binary_cache_hits", 1)
+		ctx.Log.Debug(
+			"Reusing cached binary",
+			map[string]any{
+				"binary": b.name,
+				"key":    key,
+			},
+		)
+		return meta, nil
+	}
+	ctx.Metrics.CounterAdd("runner_binary_cache_misses", 1)
+
+	meta, err = compile()
+	if err != nil || meta == nil || meta.Verdict != "OK" {
+		return meta, err
+	}
+	if err := c.store(key, binRoot, meta); err != nil {
+		ctx.Log.Error(
+			"Failed to cache the binary",
+			map[string]any{
+				"binary": b.name,
+				"key":    key,
+				"err":    err,
+			},
+		)
+	}
+	return meta, nil
+}
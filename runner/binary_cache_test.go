@@ -0,0 +1,122 @@
+package runner
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/quark/common"
+)
+
+// versionedSandbox is a NoopSandbox that reports a compiler version and
+// counts the compilations.
+type versionedSandbox struct {
+	NoopSandbox
+	version     string
+	compilation int
+}
+
+func (s *versionedSandbox) CompilerVersion(lang string) (string, error) {
+	return s.version, nil
+}
+
+func (s *versionedSandbox) Compile(
+	ctx *common.Context,
+	lang string,
+	inputFiles []string,
+	chdir, outputFile, errorFile, metaFile, target string,
+	extraFlags []string,
+) (*RunMetadata, error) {
+	s.compilation++
+	if err := os.WriteFile(path.Join(chdir, target), []byte("binary"), 0755); err != nil {
+		return nil, err
+	}
+	return s.NoopSandbox.Compile(ctx, lang, inputFiles, chdir, outputFile, errorFile, metaFile, target, extraFlags)
+}
+
+func TestBinaryCache(t *testing.T) {
+	ctx, err := newRunnerContext(t)
+	if err != nil {
+		t.Fatalf("RunnerContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	defer os.RemoveAll(ctx.Config.Runner.RuntimePath)
+
+	cache, err := NewBinaryCache(
+		path.Join(ctx.Config.Runner.RuntimePath, "binaries"),
+		base.Kibibyte,
+	)
+	if err != nil {
+		t.Fatalf("Failed to create the binary cache: %v", err)
+	}
+	sandbox := &versionedSandbox{version: "1"}
+	validator := &binary{
+		name:   "validator",
+		target: "validator",
+	}
+
+	compile := func(inputHash string, runName string) {
+		t.Helper()
+		binRoot := path.Join(ctx.Config.Runner.RuntimePath, runName, "validator")
+		binPath := path.Join(binRoot, "bin")
+		if err := os.MkdirAll(binPath, 0755); err != nil {
+			t.Fatalf("Failed to create the bin directory: %v", err)
+		}
+		meta, err := cache.compileCached(
+			ctx,
+			sandbox,
+			inputHash,
+			validator,
+			"cpp11",
+			binRoot,
+			func() (*RunMetadata, error) {
+				return sandbox.Compile(
+					ctx,
+					"cpp11",
+					nil,
+					binPath,
+					path.Join(binRoot, "compile.out"),
+					path.Join(binRoot, "compile.err"),
+					path.Join(binRoot, "compile.meta"),
+					validator.target,
+					nil,
+				)
+			},
+		)
+		if err != nil || meta.Verdict != "OK" {
+			t.Fatalf("compileCached() = %v, %v, want an OK verdict", meta, err)
+		}
+		info, err := os.Stat(path.Join(binPath, validator.target))
+		if err != nil {
+			t.Fatalf("The binary is missing: %v", err)
+		}
+		if info.Mode().Perm()&0100 == 0 {
+			t.Errorf("The binary is not executable: %v", info.Mode())
+		}
+		if _, err := os.Stat(path.Join(binRoot, "compile.meta")); err != nil {
+			t.Errorf("The compilation metadata is missing: %v", err)
+		}
+	}
+
+	compile("input1", "run1")
+	compile("input1", "run2")
+	if sandbox.compilation != 1 {
+		t.Errorf("binary compiled %d times, want 1", sandbox.compilation)
+	}
+
+	// A different input or compiler needs a new compilation.
+	compile("input2", "run3")
+	sandbox.version = "2"
+	compile("input2", "run4")
+	if sandbox.compilation != 3 {
+		t.Errorf("binary compiled %d times, want 3", sandbox.compilation)
+	}
+
+	// Without a cache, the binary is always compiled.
+	cache = nil
+	compile("input2", "run5")
+	if sandbox.compilation != 4 {
+		t.Errorf("binary compiled %d times, want 4", sandbox.compilation)
+	}
+}
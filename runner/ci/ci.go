@@ -13,7 +13,9 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	base "github.com/omegaup/go-base/v3"
@@ -180,6 +182,7 @@ type ReportTest struct {
 	SolutionSetting        *common.SolutionSettings        `json:"solution,omitempty"`
 	InputsValidatorSetting *common.InputsValidatorSettings `json:"inputs,omitempty"`
 	Result                 *runner.RunResult               `json:"result,omitempty"`
+	StressResult           *StressResult                   `json:"stress,omitempty"`
 }
 
 // SetResult sets the result of running the test. It also updates the state of
@@ -225,7 +228,19 @@ func (t *ReportTest) SetResult(result *runner.RunResult) {
 			t.State = StateFailed
 			return
 		}
+		if err := checkGroupResults(t.SolutionSetting.Groups, result.Groups); err != nil {
+			t.ReportError = &ReportError{Error: err}
+			t.State = StateFailed
+			return
+		}
 	} else {
+		if t.Type == "outputs" {
+			if err := checkOutputsResult(result); err != nil {
+				t.ReportError = &ReportError{Error: err}
+				t.State = StateFailed
+				return
+			}
+		}
 		if result.Verdict != "AC" {
 			t.ReportError = &ReportError{
 				Error: errors.Errorf(
@@ -240,6 +255,113 @@ func (t *ReportTest) SetResult(result *runner.RunResult) {
 	t.State = StatePassed
 }
 
+// checkOutputsResult returns an error if the official solution did not
+// reproduce the committed outputs. Only the cases with a WA or PA verdict are
+// mismatches, since the rest of the verdicts mean that the official solution
+// could not be run to completion, which is reported separately.
+func checkOutputsResult(result *runner.RunResult) error {
+	var mismatchedCases, failedCases []string
+	for _, group := range result.Groups {
+		for _, c := range group.Cases {
+			switch c.Verdict {
+			case "AC":
+			case "WA", "PA":
+				mismatchedCases = append(mismatchedCases, c.Name)
+			default:
+				failedCases = append(failedCases, fmt.Sprintf("%s (%s)", c.Name, c.Verdict))
+			}
+		}
+	}
+	var messages []string
+	if len(mismatchedCases) > 0 {
+		messages = append(messages, fmt.Sprintf(
+			"the official solution does not match the committed outputs of %d cases: %s",
+			len(mismatchedCases),
+			strings.Join(mismatchedCases, ", "),
+		))
+	}
+	if len(failedCases) > 0 {
+		messages = append(messages, fmt.Sprintf(
+			"the official solution failed to run %d cases: %s",
+			len(failedCases),
+			strings.Join(failedCases, ", "),
+		))
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// groupVerdict returns the worst verdict of the cases in the group.
+func groupVerdict(group *runner.GroupResult) string {
+	verdict := "AC"
+	verdictIndex := len(common.VerdictList)
+	for _, c := range group.Cases {
+		for i, v := range common.VerdictList {
+			if v == c.Verdict && i < verdictIndex {
+				verdict = v
+				verdictIndex = i
+				break
+			}
+		}
+	}
+	return verdict
+}
+
+// checkGroupResults checks that the results of every group match all the
+// group settings whose pattern matches the group name. Every pattern must
+// match at least one group.
+func checkGroupResults(
+	groupSettings []common.GroupSolutionSettings,
+	groupResults []runner.GroupResult,
+) error {
+	for _, groupSetting := range groupSettings {
+		matched := false
+		for i := range groupResults {
+			groupResult := &groupResults[i]
+			if ok, _ := path.Match(groupSetting.Group, groupResult.Group); !ok {
+				continue
+			}
+			matched = true
+
+			if groupSetting.Verdict != "" {
+				if verdict := groupVerdict(groupResult); verdict != groupSetting.Verdict {
+					return errors.Errorf(
+						"group %q: expected verdict to be %q, got %q",
+						groupResult.Group,
+						groupSetting.Verdict,
+						verdict,
+					)
+				}
+			}
+			if groupSetting.ScoreRange != nil {
+				score := &big.Rat{}
+				if groupResult.Score != nil && groupResult.MaxScore != nil && groupResult.MaxScore.Sign() != 0 {
+					score.Quo(groupResult.Score, groupResult.MaxScore)
+				}
+				if groupSetting.ScoreRange.Min.Cmp(score) > 0 ||
+					groupSetting.ScoreRange.Max.Cmp(score) < 0 {
+					return errors.Errorf(
+						"group %q: expected score to be in range [%.3f, %.3f], got %.3f",
+						groupResult.Group,
+						base.RationalToFloat(groupSetting.ScoreRange.Min),
+						base.RationalToFloat(groupSetting.ScoreRange.Max),
+						base.RationalToFloat(score),
+					)
+				}
+			}
+		}
+		if !matched {
+			return errors.Errorf(
+				"no group matches the pattern %q",
+				groupSetting.Group,
+			)
+		}
+	}
+	return nil
+}
+
 // String implements the fmt.Stringer interface.
 func (t *ReportTest) String() string {
 	if t == nil {
@@ -258,6 +380,18 @@ type Report struct {
 	State       State          `json:"state"`
 	ReportError *ReportError   `json:"error,omitempty"`
 	Tests       []*ReportTest  `json:"tests,omitempty"`
+
+	// QueuePosition is the 1-based position of the request in the CI queue
+	// while it is in StateWaiting.
+	QueuePosition *int `json:"queue_position,omitempty"`
+
+	// TimeLimitAnalysis summarizes the timings of the solutions, once all the
+	// tests have finished running.
+	TimeLimitAnalysis *TimeLimitAnalysis `json:"time_limit_analysis,omitempty"`
+
+	// TestSuiteStrength summarizes which cases are failed by the wrong
+	// solutions, once all the tests have finished running.
+	TestSuiteStrength *TestSuiteStrength `json:"test_suite_strength,omitempty"`
 }
 
 // UpdateState should be called when all of the tests have finished running.
@@ -269,6 +403,302 @@ func (r *Report) UpdateState() {
 	}
 }
 
+// SolutionTimes are the timings of one of the solutions in tests/tests.json,
+// or of the official solution.
+type SolutionTimes struct {
+	Filename string `json:"filename"`
+	Language string `json:"language"`
+	Verdict  string `json:"verdict"`
+
+	// MaxTime is the maximum CPU time that the solution took in any case.
+	MaxTime base.Duration `json:"max_time"`
+
+	// FailingTime is the minimum CPU time of the cases in which the solution
+	// exceeded the time limit. It is only present for the solutions that are
+	// expected to get a TLE verdict.
+	FailingTime *base.Duration `json:"failing_time,omitempty"`
+}
+
+// LanguageTimes are the timings of the solutions written in one language.
+type LanguageTimes struct {
+	// MaxAcceptedTime is the maximum CPU time that any of the accepted
+	// solutions took in any case.
+	MaxAcceptedTime *base.Duration `json:"max_accepted_time,omitempty"`
+
+	// MinFailingTime is the minimum FailingTime of the solutions that are
+	// expected to get a TLE verdict.
+	MinFailingTime *base.Duration `json:"min_failing_time,omitempty"`
+}
+
+// TimeLimitAnalysis summarizes how long the solutions took to run, so that
+// problemsetters can choose a time limit that accepts all the solutions that
+// are expected to be accepted and rejects the ones that are expected to
+// exceed it.
+type TimeLimitAnalysis struct {
+	TimeLimit base.Duration `json:"time_limit"`
+
+	// MaxAcceptedTime is the maximum CPU time that any of the accepted
+	// solutions took in any case.
+	MaxAcceptedTime *base.Duration `json:"max_accepted_time,omitempty"`
+
+	// MinFailingTime is the minimum FailingTime of the solutions that are
+	// expected to get a TLE verdict. Since solutions are stopped once they
+	// exceed the time limit, this is a lower bound of how long they take.
+	MinFailingTime *base.Duration `json:"min_failing_time,omitempty"`
+
+	// RecommendedTimeLimit is MaxAcceptedTime plus the safety margin, rounded
+	// up to the nearest 100ms, as long as that does not accept the solutions
+	// that are expected to get a TLE verdict.
+	RecommendedTimeLimit *base.Duration `json:"recommended_time_limit,omitempty"`
+
+	// Headroom is the fraction of the time limit that the slowest accepted
+	// solution left unused.
+	Headroom *float64 `json:"headroom,omitempty"`
+
+	// InsufficientHeadroom is set when Headroom is less than the minimum
+	// configured headroom.
+	InsufficientHeadroom bool `json:"insufficient_headroom,omitempty"`
+
+	// Overlapping is set when a solution that is expected to get a TLE
+	// verdict failed in less time than an accepted solution took, so no time
+	// limit can tell them apart.
+	Overlapping bool `json:"overlapping,omitempty"`
+
+	Languages map[string]*LanguageTimes `json:"languages,omitempty"`
+	Solutions []*SolutionTimes          `json:"solutions,omitempty"`
+}
+
+// timeLimitGranularity is the granularity of the recommended time limits.
+const timeLimitGranularity = 100 * time.Millisecond
+
+func secondsToDuration(seconds float64) base.Duration {
+	return base.Duration(time.Duration(seconds * float64(time.Second)))
+}
+
+func maxDuration(a *base.Duration, b base.Duration) *base.Duration {
+	if a != nil && *a >= b {
+		return a
+	}
+	return &b
+}
+
+func minDuration(a *base.Duration, b base.Duration) *base.Duration {
+	if a != nil && *a <= b {
+		return a
+	}
+	return &b
+}
+
+// newSolutionTimes returns the timings of a solution test, or nil if the test
+// did not produce a result or the solution is not expected to be accepted or
+// to exceed the time limit. The official solution's run that checks the
+// committed outputs is always expected to be accepted.
+func newSolutionTimes(testConfig *TestConfig) *SolutionTimes {
+	test := testConfig.Test
+	if test.Result == nil {
+		return nil
+	}
+	verdict := "AC"
+	switch test.Type {
+	case "solutions":
+		if test.SolutionSetting != nil {
+			verdict = test.SolutionSetting.Verdict
+		}
+	case "outputs":
+	default:
+		return nil
+	}
+	return solutionTimes(test.Filename, testConfig.Solution.Language, verdict, test.Result)
+}
+
+// newOfficialSolutionTimes returns the timings of the official solution when
+// it was used to generate the .out files, or nil if it was not.
+func newOfficialSolutionTimes(config *OutGeneratorConfig) *SolutionTimes {
+	if config == nil || config.Result == nil {
+		return nil
+	}
+	return solutionTimes(
+		fmt.Sprintf("solutions/solution.%s", config.Solution.Language),
+		config.Solution.Language,
+		"AC",
+		config.Result,
+	)
+}
+
+func solutionTimes(filename, language, verdict string, result *runner.RunResult) *SolutionTimes {
+	if verdict != "AC" && verdict != "TLE" {
+		return nil
+	}
+
+	times := &SolutionTimes{
+		Filename: filename,
+		Language: language,
+		Verdict:  verdict,
+	}
+	for _, group := range result.Groups {
+		for _, c := range group.Cases {
+			caseTime := secondsToDuration(c.Meta.Time)
+			times.MaxTime = *maxDuration(&times.MaxTime, caseTime)
+			if verdict == "TLE" && c.Verdict == "TLE" {
+				times.FailingTime = minDuration(times.FailingTime, caseTime)
+			}
+		}
+	}
+	return times
+}
+
+// AnalyzeTimeLimits fills the TimeLimitAnalysis of the report from the
+// results of the tests in config, including the official solution. If the
+// problem is configured to fail when the accepted solutions run too close to
+// the time limit, the report is marked as failed.
+func (r *Report) AnalyzeTimeLimits(config *RunConfig) {
+	settings := common.TimeLimitSettings{}
+	if config.TestsSettings.TimeLimit != nil {
+		settings = *config.TestsSettings.TimeLimit
+	}
+	if settings.SafetyMargin == 0 {
+		settings.SafetyMargin = common.DefaultTimeLimitSafetyMargin
+	}
+	if settings.MinHeadroom == 0 {
+		settings.MinHeadroom = common.DefaultTimeLimitMinHeadroom
+	}
+
+	analysis := &TimeLimitAnalysis{
+		Languages: make(map[string]*LanguageTimes),
+	}
+	if config.Input != nil && config.Input.Limits != nil {
+		analysis.TimeLimit = config.Input.Limits.TimeLimit
+	}
+	var solutions []*SolutionTimes
+	for _, testConfig := range config.TestConfigs {
+		solutions = append(solutions, newSolutionTimes(testConfig))
+	}
+	solutions = append(solutions, newOfficialSolutionTimes(config.OutGeneratorConfig))
+	for _, times := range solutions {
+		if times == nil {
+			continue
+		}
+		analysis.Solutions = append(analysis.Solutions, times)
+		languageTimes, ok := analysis.Languages[times.Language]
+		if !ok {
+			languageTimes = &LanguageTimes{}
+			analysis.Languages[times.Language] = languageTimes
+		}
+		if times.Verdict == "AC" {
+			analysis.MaxAcceptedTime = maxDuration(analysis.MaxAcceptedTime, times.MaxTime)
+			languageTimes.MaxAcceptedTime = maxDuration(languageTimes.MaxAcceptedTime, times.MaxTime)
+		} else if times.FailingTime != nil {
+			analysis.MinFailingTime = minDuration(analysis.MinFailingTime, *times.FailingTime)
+			languageTimes.MinFailingTime = minDuration(languageTimes.MinFailingTime, *times.FailingTime)
+		}
+	}
+	r.TimeLimitAnalysis = analysis
+	if analysis.MaxAcceptedTime == nil {
+		return
+	}
+
+	maxAcceptedTime := time.Duration(*analysis.MaxAcceptedTime)
+	recommended := time.Duration(float64(maxAcceptedTime) * (1 + settings.SafetyMargin))
+	recommended = (recommended + timeLimitGranularity - 1) / timeLimitGranularity * timeLimitGranularity
+	if analysis.MinFailingTime != nil {
+		minFailingTime := time.Duration(*analysis.MinFailingTime)
+		if minFailingTime <= maxAcceptedTime {
+			analysis.Overlapping = true
+		} else if recommended >= minFailingTime {
+			// Leave the same margin on both sides.
+			recommended = (maxAcceptedTime + minFailingTime) / 2
+		}
+	}
+	if !analysis.Overlapping {
+		analysis.RecommendedTimeLimit = (*base.Duration)(&recommended)
+	}
+
+	if analysis.TimeLimit == 0 {
+		return
+	}
+	headroom := 1 - float64(maxAcceptedTime)/float64(analysis.TimeLimit)
+	analysis.Headroom = &headroom
+	if headroom >= settings.MinHeadroom {
+		return
+	}
+	analysis.InsufficientHeadroom = true
+	if !settings.FailOnInsufficientHeadroom {
+		return
+	}
+	// Failures in the tests themselves take precedence.
+	r.UpdateState()
+	if r.State == StatePassed {
+		r.State = StateFailed
+		r.ReportError = &ReportError{
+			Error: errors.Errorf(
+				"the slowest accepted solution took %v, which leaves less than %.0f%% of the time limit of %v unused",
+				*analysis.MaxAcceptedTime,
+				settings.MinHeadroom*100,
+				analysis.TimeLimit,
+			),
+		}
+	}
+}
+
+// ReportSummary is a summary of a Report, without the individual tests.
+type ReportSummary struct {
+	Problem     string         `json:"problem"`
+	CommitHash  string         `json:"commit_hash"`
+	StartTime   time.Time      `json:"start_time"`
+	FinishTime  *time.Time     `json:"finish_time,omitempty"`
+	Duration    *base.Duration `json:"duration,omitempty"`
+	State       State          `json:"state"`
+	ReportError *ReportError   `json:"error,omitempty"`
+
+	// Tests is the number of tests in each state.
+	Tests map[string]int `json:"tests,omitempty"`
+}
+
+// Summary returns a summary of the report.
+func (r *Report) Summary() *ReportSummary {
+	summary := &ReportSummary{
+		Problem:     r.Problem,
+		CommitHash:  r.CommitHash,
+		StartTime:   r.StartTime,
+		FinishTime:  r.FinishTime,
+		Duration:    r.Duration,
+		State:       r.State,
+		ReportError: r.ReportError,
+	}
+	if len(r.Tests) > 0 {
+		summary.Tests = make(map[string]int)
+		for _, test := range r.Tests {
+			summary.Tests[test.State.String()]++
+		}
+	}
+	return summary
+}
+
+// ReadReport deserializes the gzipped report in the specified path.
+func ReadReport(reportPath string) (*Report, error) {
+	fd, err := os.Open(reportPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	zr, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to open the gzip stream",
+		)
+	}
+	defer zr.Close()
+	var report Report
+	if err := json.NewDecoder(zr).Decode(&report); err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to deserialize JSON report",
+		)
+	}
+	return &report, nil
+}
+
 // Write serializes the gzipped report to the specified path. It does so by
 // writing the report first to a temporary file and then atomically renames it
 // to replace any pre-existing report.
@@ -333,6 +763,10 @@ type TestConfig struct {
 	Test     *ReportTest
 	Solution SolutionConfig
 	Input    *common.LiteralInput
+
+	// Stress is set for the stress tests, which are run with RunStressTest
+	// instead of a single run of the solution against Input.
+	Stress *StressConfig
 }
 
 // String implements the fmt.Stringer interface.
@@ -347,6 +781,11 @@ func (c *TestConfig) String() string {
 type OutGeneratorConfig struct {
 	Solution SolutionConfig
 	Input    *common.LiteralInput
+
+	// Result is the result of running the official solution to generate the
+	// .out files, so that its timings are included in the time limit
+	// analysis. It is set once the .out files have been generated.
+	Result *runner.RunResult
 }
 
 // String implements the fmt.Stringer interface.
@@ -621,6 +1060,25 @@ func NewRunConfig(files common.ProblemFiles, generateOutputFiles bool) (*RunConf
 
 	// Report tests
 	for _, solutionSetting := range config.TestsSettings.Solutions {
+		for _, groupSetting := range solutionSetting.Groups {
+			if _, err := path.Match(groupSetting.Group, ""); err != nil {
+				return nil, errors.Wrapf(
+					err,
+					"invalid group pattern %q for %s in %s",
+					groupSetting.Group,
+					solutionSetting.Filename,
+					files.String(),
+				)
+			}
+			if groupSetting.Verdict == "" && groupSetting.ScoreRange == nil {
+				return nil, errors.Errorf(
+					"missing expected verdict or score range of group %q for %s in %s",
+					groupSetting.Group,
+					solutionSetting.Filename,
+					files.String(),
+				)
+			}
+		}
 		language := solutionSetting.Language
 		if language == "" {
 			ext := filepath.Ext(solutionSetting.Filename)
@@ -654,6 +1112,20 @@ func NewRunConfig(files common.ProblemFiles, generateOutputFiles bool) (*RunConf
 		config.TestConfigs = append(config.TestConfigs, testConfig)
 	}
 
+	// Consistency of the committed .out files with the official solution. This
+	// is not needed when the .out files are generated from it.
+	if solution != nil && !generateOutputFiles {
+		config.TestConfigs = append(config.TestConfigs, &TestConfig{
+			Test: &ReportTest{
+				Index:    len(config.TestConfigs),
+				Type:     "outputs",
+				Filename: fmt.Sprintf("solutions/solution.%s", solution.Language),
+			},
+			Input:    config.Input,
+			Solution: *solution,
+		})
+	}
+
 	if config.TestsSettings.InputsValidator != nil {
 		language := config.TestsSettings.InputsValidator.Language
 		if language == "" {
@@ -715,6 +1187,15 @@ func NewRunConfig(files common.ProblemFiles, generateOutputFiles bool) (*RunConf
 		}
 	}
 
+	// Stress test
+	if config.TestsSettings.Stress != nil {
+		testConfig, err := newStressTestConfig(files, config, solution)
+		if err != nil {
+			return nil, err
+		}
+		config.TestConfigs = append(config.TestConfigs, testConfig)
+	}
+
 	// .out generation
 	if generateOutputFiles {
 		if solution == nil {
@@ -763,14 +1244,18 @@ func NewRunConfig(files common.ProblemFiles, generateOutputFiles bool) (*RunConf
 }
 
 type sizedEntry struct {
-	path string
-	size base.Byte
-	log  logging.Logger
+	path    string
+	size    base.Byte
+	log     logging.Logger
+	release func()
 }
 
 var _ base.SizedEntry = (*sizedEntry)(nil)
 
 func (e *sizedEntry) Release() {
+	if e.release != nil {
+		e.release()
+	}
 	if err := os.RemoveAll(e.path); err != nil {
 		e.log.Error(
 			"Evicting CI run failed",
@@ -800,10 +1285,17 @@ func getDirectorySize(root string) (base.Byte, error) {
 	return base.Byte(size), nil
 }
 
-// LRUCache is a base.LRUCache specialized for CI runs.
+// LRUCache is a base.LRUCache specialized for CI runs. It also keeps the
+// summaries of the runs in the cache, so that the history of each problem can
+// be listed.
 type LRUCache struct {
 	*base.LRUCache[*sizedEntry]
 	log logging.Logger
+
+	historyLock sync.Mutex
+	// history has the summaries of the runs in the cache, indexed by problem
+	// and key.
+	history map[string]map[string]*ReportSummary
 }
 
 // NewLRUCache returns a new LRUCache with the specified size limit.
@@ -811,10 +1303,18 @@ func NewLRUCache(sizeLimit base.Byte, log logging.Logger) *LRUCache {
 	return &LRUCache{
 		LRUCache: base.NewLRUCache[*sizedEntry](sizeLimit),
 		log:      log,
+		history:  make(map[string]map[string]*ReportSummary),
 	}
 }
 
+// problemFromKey returns the problem name of a key of the form
+// problem/commit.
+func problemFromKey(key string) string {
+	return strings.SplitN(key, "/", 2)[0]
+}
+
 // AddRun adds a run (which is a directory name with files) into the LRUCache.
+// The key must be of the form problem/commit.
 func (l *LRUCache) AddRun(currentPath string, key string) {
 	ref, err := l.Get(
 		key,
@@ -827,6 +1327,9 @@ func (l *LRUCache) AddRun(currentPath string, key string) {
 				path: currentPath,
 				size: size,
 				log:  l.log,
+				release: func() {
+					l.removeSummary(key)
+				},
 			}, nil
 		},
 	)
@@ -849,10 +1352,80 @@ func (l *LRUCache) AddRun(currentPath string, key string) {
 		}
 		return
 	}
+
+	// The summary is added while the entry is still referenced, so that it
+	// cannot be evicted before its summary is added.
+	reportPath := path.Join(currentPath, "report.json.gz")
+	if report, err := ReadReport(reportPath); err != nil {
+		l.log.Error(
+			"Failed to read the CI report",
+			map[string]any{
+				"path": reportPath,
+				"err":  err,
+			},
+		)
+	} else {
+		l.addSummary(key, report.Summary())
+	}
+
 	// Release immediately so that the entry can be evicted.
 	l.Put(ref)
 }
 
+func (l *LRUCache) addSummary(key string, summary *ReportSummary) {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+
+	problem := problemFromKey(key)
+	problemHistory, ok := l.history[problem]
+	if !ok {
+		problemHistory = make(map[string]*ReportSummary)
+		l.history[problem] = problemHistory
+	}
+	problemHistory[key] = summary
+}
+
+func (l *LRUCache) removeSummary(key string) {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+
+	problem := problemFromKey(key)
+	delete(l.history[problem], key)
+	if len(l.history[problem]) == 0 {
+		delete(l.history, problem)
+	}
+}
+
+// SortReportSummaries sorts the summaries from the most recent to the oldest
+// run.
+func SortReportSummaries(summaries []*ReportSummary) {
+	sort.Slice(summaries, func(i, j int) bool {
+		if !summaries[i].StartTime.Equal(summaries[j].StartTime) {
+			return summaries[i].StartTime.After(summaries[j].StartTime)
+		}
+		return summaries[i].CommitHash < summaries[j].CommitHash
+	})
+}
+
+// History returns the summaries of up to limit of the most recent runs of the
+// problem that are in the cache, most recent first. A non-positive limit
+// returns all of them. Only finished runs are added to the cache, so runs
+// that are still waiting or running are not included.
+func (l *LRUCache) History(problem string, limit int) []*ReportSummary {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+
+	summaries := make([]*ReportSummary, 0, len(l.history[problem]))
+	for _, summary := range l.history[problem] {
+		summaries = append(summaries, summary)
+	}
+	SortReportSummaries(summaries)
+	if limit > 0 && len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+	return summaries
+}
+
 // ReloadRuns adds all CI runs that are in the ciRoot directory to the LRUCache.
 func (l *LRUCache) ReloadRuns(ciRoot string) error {
 	return filepath.Walk(ciRoot, func(currentPath string, info os.FileInfo, err error) error {
@@ -1,16 +1,51 @@
 package ci
 
 import (
+	"fmt"
+	"io"
 	"math/big"
+	"os"
+	"path"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/go-base/v3/logging"
 	"github.com/omegaup/quark/common"
 	"github.com/omegaup/quark/runner"
 )
 
+// newGroupsRunResult returns a RunResult in which the first group is accepted,
+// and the second one only gets half of its points, with a TLE.
+func newGroupsRunResult() *runner.RunResult {
+	return &runner.RunResult{
+		Verdict: "PA",
+		Score:   big.NewRat(3, 4),
+		Groups: []runner.GroupResult{
+			{
+				Group:    "sub1",
+				Score:    big.NewRat(1, 2),
+				MaxScore: big.NewRat(1, 2),
+				Cases: []runner.CaseResult{
+					{Name: "sub1.1", Verdict: "AC"},
+				},
+			},
+			{
+				Group:    "sub2",
+				Score:    big.NewRat(1, 4),
+				MaxScore: big.NewRat(1, 2),
+				Cases: []runner.CaseResult{
+					{Name: "sub2.1", Verdict: "AC"},
+					{Name: "sub2.2", Verdict: "TLE"},
+					{Name: "sub2.3", Verdict: "WA"},
+				},
+			},
+		},
+	}
+}
+
 func TestReportTestSetResult(t *testing.T) {
 	for _, tt := range []struct {
 		name          string
@@ -104,6 +139,74 @@ func TestReportTestSetResult(t *testing.T) {
 			&runner.RunResult{Verdict: "PA", Score: big.NewRat(1, 3)},
 			StatePassed,
 		},
+		{
+			"official solution outputs mismatch",
+			ReportTest{Type: "outputs"},
+			&runner.RunResult{
+				Verdict: "WA",
+				Score:   big.NewRat(1, 2),
+				Groups: []runner.GroupResult{
+					{
+						Group: "0",
+						Cases: []runner.CaseResult{
+							{Name: "0", Verdict: "AC"},
+							{Name: "1", Verdict: "WA"},
+						},
+					},
+				},
+			},
+			StateFailed,
+		},
+		{
+			"expected group results",
+			ReportTest{
+				SolutionSetting: &common.SolutionSettings{
+					Verdict: "PA",
+					Groups: []common.GroupSolutionSettings{
+						{Group: "sub1", Verdict: "AC"},
+						{Group: "sub2", Verdict: "TLE", ScoreRange: &common.ScoreRange{Min: big.NewRat(0, 1), Max: big.NewRat(1, 2)}},
+					},
+				},
+			},
+			newGroupsRunResult(),
+			StatePassed,
+		},
+		{
+			"unexpected group verdict",
+			ReportTest{
+				SolutionSetting: &common.SolutionSettings{
+					Groups: []common.GroupSolutionSettings{
+						{Group: "sub2", Verdict: "WA"},
+					},
+				},
+			},
+			newGroupsRunResult(),
+			StateFailed,
+		},
+		{
+			"unexpected group score with wildcard",
+			ReportTest{
+				SolutionSetting: &common.SolutionSettings{
+					Groups: []common.GroupSolutionSettings{
+						{Group: "sub*", ScoreRange: &common.ScoreRange{Min: big.NewRat(1, 1), Max: big.NewRat(1, 1)}},
+					},
+				},
+			},
+			newGroupsRunResult(),
+			StateFailed,
+		},
+		{
+			"unmatched group pattern",
+			ReportTest{
+				SolutionSetting: &common.SolutionSettings{
+					Groups: []common.GroupSolutionSettings{
+						{Group: "sub3", Verdict: "AC"},
+					},
+				},
+			},
+			newGroupsRunResult(),
+			StateFailed,
+		},
 	} {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
@@ -120,6 +223,68 @@ func TestReportTestSetResult(t *testing.T) {
 	}
 }
 
+func TestReportTestSetResultOutputs(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		cases         []runner.CaseResult
+		expectedError string
+	}{
+		{
+			"matching outputs",
+			[]runner.CaseResult{{Name: "0", Verdict: "AC"}},
+			"",
+		},
+		{
+			"mismatched outputs",
+			[]runner.CaseResult{
+				{Name: "0", Verdict: "WA"},
+				{Name: "1", Verdict: "PA"},
+			},
+			"the official solution does not match the committed outputs of 2 cases: 0, 1",
+		},
+		{
+			"execution failures",
+			[]runner.CaseResult{
+				{Name: "0", Verdict: "AC"},
+				{Name: "1", Verdict: "TLE"},
+				{Name: "2", Verdict: "RTE"},
+			},
+			"the official solution failed to run 2 cases: 1 (TLE), 2 (RTE)",
+		},
+		{
+			"mismatches and execution failures",
+			[]runner.CaseResult{
+				{Name: "0", Verdict: "WA"},
+				{Name: "1", Verdict: "MLE"},
+			},
+			"the official solution does not match the committed outputs of 1 cases: 0; " +
+				"the official solution failed to run 1 cases: 1 (MLE)",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			reportTest := ReportTest{Type: "outputs"}
+			reportTest.SetResult(&runner.RunResult{
+				Verdict: "AC",
+				Score:   big.NewRat(1, 1),
+				Groups:  []runner.GroupResult{{Group: "0", Cases: tt.cases}},
+			})
+			if tt.expectedError == "" {
+				if reportTest.State != StatePassed {
+					t.Errorf("expected ReportTest.State = %v, got %v (%v)", StatePassed, reportTest.State, reportTest.ReportError)
+				}
+				return
+			}
+			if reportTest.State != StateFailed || reportTest.ReportError == nil {
+				t.Fatalf("expected ReportTest.State = %v, got %v", StateFailed, reportTest.State)
+			}
+			if reportTest.ReportError.Error.Error() != tt.expectedError {
+				t.Errorf("expected error %q, got %q", tt.expectedError, reportTest.ReportError.Error)
+			}
+		})
+	}
+}
+
 func TestReportUpdateState(t *testing.T) {
 	for _, tt := range []struct {
 		name          string
@@ -371,6 +536,69 @@ func TestNewRunConfig(t *testing.T) {
 			nil,
 			"\"tests/validator.py\" in \":memory:\": file does not exist",
 		},
+		{
+			"invalid group pattern",
+			common.NewProblemFilesFromMap(
+				map[string]string{
+					"tests/tests.json": `{
+						"solutions": [
+							{
+								"filename": "ac.py",
+								"groups": [{"group": "sub[", "verdict": "AC"}]
+							}
+						]
+					}`,
+					"tests/ac.py":   "print(3)",
+					"settings.json": "{}",
+				},
+				":memory:",
+			),
+			false,
+			nil,
+			"invalid group pattern \"sub[\" for ac.py",
+		},
+		{
+			"stress, missing official solution",
+			common.NewProblemFilesFromMap(
+				map[string]string{
+					"tests/tests.json": `{
+						"stress": {
+							"generator": "gen.py",
+							"brute_force": "brute.py",
+							"min_seed": 1,
+							"max_seed": 10
+						}
+					}`,
+					"tests/gen.py":   "print(3)",
+					"tests/brute.py": "print(3)",
+					"settings.json":  "{}",
+				},
+				":memory:",
+			),
+			false,
+			nil,
+			"missing solutions/solution.* files for the stress test",
+		},
+		{
+			"stress, invalid seed range",
+			common.NewProblemFilesFromMap(
+				map[string]string{
+					"tests/tests.json": `{
+						"stress": {
+							"generator": "gen.py",
+							"brute_force": "brute.py",
+							"min_seed": 10,
+							"max_seed": 1
+						}
+					}`,
+					"settings.json": "{}",
+				},
+				":memory:",
+			),
+			false,
+			nil,
+			"invalid stress test seed range [10, 1]",
+		},
 		{
 			"input validator",
 			common.NewProblemFilesFromMap(
@@ -606,6 +834,43 @@ func TestNewRunConfig(t *testing.T) {
 			},
 			"",
 		},
+		{
+			"official solution outputs",
+			common.NewProblemFilesFromMap(
+				map[string]string{
+					"tests/tests.json":      "{}",
+					"solutions/solution.py": "print(3)",
+					"settings.json":         "{}",
+				},
+				":memory:",
+			),
+			false,
+			&RunConfig{
+				TestConfigs: []*TestConfig{
+					{
+						Test: &ReportTest{
+							Type:     "outputs",
+							Filename: "solutions/solution.py",
+						},
+						Solution: SolutionConfig{
+							Language: "py",
+							Source:   "print(3)",
+						},
+						Input: &common.LiteralInput{
+							Cases:     map[string]*common.LiteralCaseSettings{},
+							Limits:    &common.DefaultLimits,
+							Validator: &common.LiteralValidatorSettings{},
+						},
+					},
+				},
+				Input: &common.LiteralInput{
+					Cases:     map[string]*common.LiteralCaseSettings{},
+					Limits:    &common.DefaultLimits,
+					Validator: &common.LiteralValidatorSettings{},
+				},
+			},
+			"",
+		},
 		{
 			"explicit cases, missing .in",
 			common.NewProblemFilesFromMap(
@@ -1073,3 +1338,239 @@ func TestNewRunConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestReportAnalyzeTimeLimits(t *testing.T) {
+	newTestConfig := func(filename, language, verdict string, caseVerdict string, times ...float64) *TestConfig {
+		var cases []runner.CaseResult
+		for _, caseTime := range times {
+			cases = append(cases, runner.CaseResult{
+				Verdict: caseVerdict,
+				Meta:    runner.RunMetadata{Time: caseTime},
+			})
+		}
+		return &TestConfig{
+			Test: &ReportTest{
+				Type:            "solutions",
+				Filename:        filename,
+				SolutionSetting: &common.SolutionSettings{Filename: filename, Verdict: verdict},
+				Result: &runner.RunResult{
+					Groups: []runner.GroupResult{{Cases: cases}},
+				},
+			},
+			Solution: SolutionConfig{Language: language},
+		}
+	}
+	newRunConfig := func(settings *common.TimeLimitSettings, testConfigs ...*TestConfig) *RunConfig {
+		return &RunConfig{
+			TestsSettings: common.TestsSettings{TimeLimit: settings},
+			TestConfigs:   testConfigs,
+			Input: &common.LiteralInput{
+				Limits: &common.LimitsSettings{
+					TimeLimit: base.Duration(time.Second),
+				},
+			},
+		}
+	}
+	duration := func(d time.Duration) *base.Duration {
+		return (*base.Duration)(&d)
+	}
+
+	t.Run("recommendation", func(t *testing.T) {
+		report := &Report{State: StatePassed}
+		report.AnalyzeTimeLimits(newRunConfig(
+			nil,
+			newTestConfig("solutions/ac.cpp", "cpp17-gcc", "AC", "AC", 0.1, 0.3),
+			newTestConfig("solutions/ac.py", "py3", "AC", "AC", 0.2, 0.25),
+			newTestConfig("solutions/wa.cpp", "cpp17-gcc", "WA", "WA", 0.9),
+			newTestConfig("solutions/tle.py", "py3", "TLE", "TLE", 1.0, 1.1),
+		))
+		analysis := report.TimeLimitAnalysis
+		if analysis == nil {
+			t.Fatalf("missing time limit analysis")
+		}
+		if !reflect.DeepEqual(duration(300*time.Millisecond), analysis.MaxAcceptedTime) {
+			t.Errorf("MaxAcceptedTime = %v, want 300ms", analysis.MaxAcceptedTime)
+		}
+		if !reflect.DeepEqual(duration(time.Second), analysis.MinFailingTime) {
+			t.Errorf("MinFailingTime = %v, want 1s", analysis.MinFailingTime)
+		}
+		if !reflect.DeepEqual(duration(500*time.Millisecond), analysis.RecommendedTimeLimit) {
+			t.Errorf("RecommendedTimeLimit = %v, want 500ms", analysis.RecommendedTimeLimit)
+		}
+		if len(analysis.Solutions) != 3 {
+			t.Errorf("len(Solutions) = %d, want 3", len(analysis.Solutions))
+		}
+		if !reflect.DeepEqual(duration(250*time.Millisecond), analysis.Languages["py3"].MaxAcceptedTime) {
+			t.Errorf("py3 MaxAcceptedTime = %v, want 250ms", analysis.Languages["py3"].MaxAcceptedTime)
+		}
+		if analysis.InsufficientHeadroom || analysis.Overlapping {
+			t.Errorf("unexpected analysis flags: %+v", analysis)
+		}
+		if report.State != StatePassed {
+			t.Errorf("State = %v, want %v", report.State, StatePassed)
+		}
+	})
+
+	t.Run("capped by failing time", func(t *testing.T) {
+		report := &Report{State: StatePassed}
+		report.AnalyzeTimeLimits(newRunConfig(
+			nil,
+			newTestConfig("solutions/ac.cpp", "cpp17-gcc", "AC", "AC", 0.6),
+			newTestConfig("solutions/tle.cpp", "cpp17-gcc", "TLE", "TLE", 0.8),
+		))
+		if !reflect.DeepEqual(duration(700*time.Millisecond), report.TimeLimitAnalysis.RecommendedTimeLimit) {
+			t.Errorf("RecommendedTimeLimit = %v, want 700ms", report.TimeLimitAnalysis.RecommendedTimeLimit)
+		}
+	})
+
+	t.Run("official solution", func(t *testing.T) {
+		outputsTest := newTestConfig("solutions/solution.cpp", "cpp17-gcc", "", "AC", 0.4)
+		outputsTest.Test.Type = "outputs"
+		outputsTest.Test.SolutionSetting = nil
+		report := &Report{State: StatePassed}
+		report.AnalyzeTimeLimits(newRunConfig(
+			nil,
+			newTestConfig("solutions/ac.cpp", "cpp17-gcc", "AC", "AC", 0.2),
+			outputsTest,
+		))
+		if !reflect.DeepEqual(duration(400*time.Millisecond), report.TimeLimitAnalysis.MaxAcceptedTime) {
+			t.Errorf("MaxAcceptedTime = %v, want 400ms", report.TimeLimitAnalysis.MaxAcceptedTime)
+		}
+
+		// The official solution generated the .out files instead.
+		generatedConfig := newRunConfig(
+			nil,
+			newTestConfig("solutions/ac.cpp", "cpp17-gcc", "AC", "AC", 0.2),
+		)
+		generatedConfig.OutGeneratorConfig = &OutGeneratorConfig{
+			Solution: SolutionConfig{Language: "py3"},
+			Result:   outputsTest.Test.Result,
+		}
+		report = &Report{State: StatePassed}
+		report.AnalyzeTimeLimits(generatedConfig)
+		analysis := report.TimeLimitAnalysis
+		if !reflect.DeepEqual(duration(400*time.Millisecond), analysis.MaxAcceptedTime) {
+			t.Errorf("MaxAcceptedTime = %v, want 400ms", analysis.MaxAcceptedTime)
+		}
+		if len(analysis.Solutions) != 2 || analysis.Solutions[1].Filename != "solutions/solution.py3" {
+			t.Errorf("Solutions = %v, want the official solution last", analysis.Solutions)
+		}
+	})
+
+	t.Run("insufficient headroom", func(t *testing.T) {
+		for _, fail := range []bool{false, true} {
+			report := &Report{State: StatePassed}
+			report.AnalyzeTimeLimits(newRunConfig(
+				&common.TimeLimitSettings{MinHeadroom: 0.5, FailOnInsufficientHeadroom: fail},
+				newTestConfig("solutions/ac.cpp", "cpp17-gcc", "AC", "AC", 0.6),
+			))
+			if !report.TimeLimitAnalysis.InsufficientHeadroom {
+				t.Errorf("InsufficientHeadroom = false, want true")
+			}
+			expectedState := StatePassed
+			if fail {
+				expectedState = StateFailed
+			}
+			if report.State != expectedState {
+				t.Errorf("State = %v, want %v", report.State, expectedState)
+			}
+		}
+
+		// A failure in the tests is not replaced by the time limit failure.
+		failedTest := newTestConfig("solutions/ac.cpp", "cpp17-gcc", "AC", "AC", 0.6)
+		failedTest.Test.State = StateFailed
+		report := &Report{State: StatePassed, Tests: []*ReportTest{failedTest.Test}}
+		report.AnalyzeTimeLimits(newRunConfig(
+			&common.TimeLimitSettings{MinHeadroom: 0.5, FailOnInsufficientHeadroom: true},
+			failedTest,
+		))
+		if report.State != StateFailed || report.ReportError != nil {
+			t.Errorf("State = %v, ReportError = %v, want %v without an error", report.State, report.ReportError, StateFailed)
+		}
+	})
+}
+
+func TestLRUCacheHistory(t *testing.T) {
+	dirname, err := os.MkdirTemp("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	startTime := time.Unix(1600000000, 0).UTC()
+	type run struct {
+		key  string
+		path string
+		size base.Byte
+	}
+	var runs []run
+	for i, problem := range []string{"a", "a", "b", "a"} {
+		commit := fmt.Sprintf("%040d", i)
+		currentPath := path.Join(dirname, problem, commit[:2], commit[2:])
+		report := &Report{
+			Problem:    problem,
+			CommitHash: commit,
+			StartTime:  startTime.Add(time.Duration(i) * time.Minute),
+			State:      StatePassed,
+			Tests: []*ReportTest{
+				{Type: "solutions", Filename: "solutions/ac.py", State: StatePassed},
+				{Type: "solutions", Filename: "solutions/wa.py", State: StateFailed},
+			},
+		}
+		if err := report.Write(path.Join(currentPath, "report.json.gz")); err != nil {
+			t.Fatalf("Failed to write report: %v", err)
+		}
+		size, err := getDirectorySize(currentPath)
+		if err != nil {
+			t.Fatalf("Failed to get the size of %q: %v", currentPath, err)
+		}
+		runs = append(runs, run{
+			key:  fmt.Sprintf("%s/%s", problem, commit),
+			path: currentPath,
+			size: size,
+		})
+	}
+
+	// The cache fits all but one of the runs, so adding the last one evicts the
+	// first one.
+	var sizeLimit base.Byte
+	for _, r := range runs {
+		sizeLimit += r.size
+	}
+	cache := NewLRUCache(sizeLimit-1, logging.NewInMemoryLogfmtLogger(io.Discard))
+	for _, r := range runs[:3] {
+		cache.AddRun(r.path, r.key)
+	}
+
+	commits := func(summaries []*ReportSummary) []string {
+		result := []string{}
+		for _, summary := range summaries {
+			result = append(result, summary.CommitHash)
+		}
+		return result
+	}
+	if got, want := commits(cache.History("a", 0)), []string{runs[1].key[2:], runs[0].key[2:]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("History(a) = %v, want %v", got, want)
+	}
+	if got, want := commits(cache.History("a", 1)), []string{runs[1].key[2:]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("History(a, 1) = %v, want %v", got, want)
+	}
+	summaries := cache.History("b", 0)
+	if len(summaries) != 1 {
+		t.Fatalf("History(b) = %v, want a single run", summaries)
+	}
+	if want := map[string]int{"passed": 1, "failed": 1}; !reflect.DeepEqual(summaries[0].Tests, want) {
+		t.Errorf("History(b)[0].Tests = %v, want %v", summaries[0].Tests, want)
+	}
+
+	cache.AddRun(runs[3].path, runs[3].key)
+	if got, want := commits(cache.History("a", 0)), []string{runs[3].key[2:], runs[1].key[2:]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("History(a) after eviction = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(runs[0].path); !os.IsNotExist(err) {
+		t.Errorf("%q was not evicted: %v", runs[0].path, err)
+	}
+	if summaries := cache.History("c", 0); len(summaries) != 0 {
+		t.Errorf("History(c) = %v, want empty", summaries)
+	}
+}
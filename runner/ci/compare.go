@@ -0,0 +1,227 @@
+package ci
+
+import (
+	"math/big"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+)
+
+// ResultDiff is the difference between the results of a solution, or of one of
+// its groups, in two commits. Scores are relative to the maximum score, so
+// they are in the [0, 1] range, and times are the maximum time of any case, in
+// seconds. The fields of a commit without results are omitted.
+type ResultDiff struct {
+	BaseVerdict string   `json:"base_verdict,omitempty"`
+	HeadVerdict string   `json:"head_verdict,omitempty"`
+	BaseScore   *float64 `json:"base_score,omitempty"`
+	HeadScore   *float64 `json:"head_score,omitempty"`
+	BaseMaxTime *float64 `json:"base_max_time,omitempty"`
+	HeadMaxTime *float64 `json:"head_max_time,omitempty"`
+
+	// Changed is whether the verdict or the score changed.
+	Changed bool `json:"changed"`
+
+	// Regression is whether the result got worse. For solutions that are
+	// expected to be accepted that means getting a worse verdict or a lower
+	// score, and for wrong solutions it means getting a higher score, since
+	// the cases no longer catch them as well.
+	Regression bool `json:"regression"`
+}
+
+// GroupDiff is the difference between the results of a group in two commits.
+type GroupDiff struct {
+	Group string `json:"group"`
+	ResultDiff
+}
+
+// SolutionDiff is the difference between the results of a test in two commits.
+// Besides its own results, the test is considered a regression if it passed in
+// the base commit and no longer does, or if any of its groups regressed.
+type SolutionDiff struct {
+	Type      string `json:"type"`
+	Filename  string `json:"filename"`
+	BaseState *State `json:"base_state,omitempty"`
+	HeadState *State `json:"head_state,omitempty"`
+	ResultDiff
+	Groups []*GroupDiff `json:"groups,omitempty"`
+}
+
+// ReportComparison is the per-solution and per-group difference between the
+// reports of two commits of the same problem.
+type ReportComparison struct {
+	Problem        string          `json:"problem"`
+	BaseCommitHash string          `json:"base_commit_hash"`
+	HeadCommitHash string          `json:"head_commit_hash"`
+	Solutions      []*SolutionDiff `json:"solutions"`
+
+	// Regressions are the filenames of the tests that regressed.
+	Regressions []string `json:"regressions,omitempty"`
+}
+
+// verdictIndex returns the index of the verdict in common.VerdictList, where
+// lower indices are worse verdicts.
+func verdictIndex(verdict string) int {
+	for i, v := range common.VerdictList {
+		if v == verdict {
+			return i
+		}
+	}
+	return len(common.VerdictList)
+}
+
+// maxCaseTime returns the maximum time of any case in the groups.
+func maxCaseTime(groups []runner.GroupResult) float64 {
+	var maxTime float64
+	for _, group := range groups {
+		for _, c := range group.Cases {
+			maxTime = base.Max(maxTime, c.Meta.Time)
+		}
+	}
+	return maxTime
+}
+
+// relativeScore returns the score as a fraction of the maximum score.
+func relativeScore(score, maxScore *big.Rat) *float64 {
+	if score == nil {
+		return nil
+	}
+	relative := new(big.Rat).Set(score)
+	if maxScore != nil && maxScore.Sign() != 0 {
+		relative.Quo(score, maxScore)
+	}
+	result := base.RationalToFloat(relative)
+	return &result
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+// compareResults fills the Changed and Regression fields of the diff.
+func (d *ResultDiff) compareResults(expectAccepted bool) {
+	if d.BaseVerdict == "" || d.HeadVerdict == "" {
+		// Nothing to compare against.
+		return
+	}
+	scoreCmp := 0
+	if d.BaseScore != nil && d.HeadScore != nil {
+		switch {
+		case *d.HeadScore < *d.BaseScore:
+			scoreCmp = -1
+		case *d.HeadScore > *d.BaseScore:
+			scoreCmp = 1
+		}
+	}
+	d.Changed = d.BaseVerdict != d.HeadVerdict || scoreCmp != 0
+	if expectAccepted {
+		d.Regression = scoreCmp < 0 || verdictIndex(d.HeadVerdict) < verdictIndex(d.BaseVerdict)
+	} else {
+		d.Regression = scoreCmp > 0 || (d.HeadVerdict == "AC" && d.BaseVerdict != "AC")
+	}
+}
+
+func testKey(testType, filename string) string {
+	return testType + ":" + filename
+}
+
+// CompareReports returns the difference between the results of the tests of
+// the base and head reports. Tests are matched by their type and filename.
+func CompareReports(baseReport, headReport *Report) *ReportComparison {
+	comparison := &ReportComparison{
+		Problem:        headReport.Problem,
+		BaseCommitHash: baseReport.CommitHash,
+		HeadCommitHash: headReport.CommitHash,
+		Solutions:      []*SolutionDiff{},
+	}
+
+	diffs := make(map[string]*SolutionDiff)
+	groupDiffs := make(map[string]map[string]*GroupDiff)
+	getDiff := func(test *ReportTest) *SolutionDiff {
+		key := testKey(test.Type, test.Filename)
+		if diff, ok := diffs[key]; ok {
+			return diff
+		}
+		diff := &SolutionDiff{
+			Type:     test.Type,
+			Filename: test.Filename,
+		}
+		diffs[key] = diff
+		groupDiffs[key] = make(map[string]*GroupDiff)
+		comparison.Solutions = append(comparison.Solutions, diff)
+		return diff
+	}
+	getGroupDiff := func(test *ReportTest, group string) *GroupDiff {
+		diff := getDiff(test)
+		key := testKey(test.Type, test.Filename)
+		if groupDiff, ok := groupDiffs[key][group]; ok {
+			return groupDiff
+		}
+		groupDiff := &GroupDiff{Group: group}
+		groupDiffs[key][group] = groupDiff
+		diff.Groups = append(diff.Groups, groupDiff)
+		return groupDiff
+	}
+
+	for _, test := range baseReport.Tests {
+		diff := getDiff(test)
+		state := test.State
+		diff.BaseState = &state
+		if test.Result == nil {
+			continue
+		}
+		diff.BaseVerdict = test.Result.Verdict
+		diff.BaseScore = relativeScore(test.Result.Score, test.Result.MaxScore)
+		diff.BaseMaxTime = floatPtr(maxCaseTime(test.Result.Groups))
+		for i := range test.Result.Groups {
+			group := &test.Result.Groups[i]
+			groupDiff := getGroupDiff(test, group.Group)
+			groupDiff.BaseVerdict = groupVerdict(group)
+			groupDiff.BaseScore = relativeScore(group.Score, group.MaxScore)
+			groupDiff.BaseMaxTime = floatPtr(maxCaseTime(test.Result.Groups[i : i+1]))
+		}
+	}
+
+	solutionSettings := make(map[string]*common.SolutionSettings)
+	for _, test := range headReport.Tests {
+		diff := getDiff(test)
+		state := test.State
+		diff.HeadState = &state
+		solutionSettings[testKey(test.Type, test.Filename)] = test.SolutionSetting
+		if test.Result == nil {
+			continue
+		}
+		diff.HeadVerdict = test.Result.Verdict
+		diff.HeadScore = relativeScore(test.Result.Score, test.Result.MaxScore)
+		diff.HeadMaxTime = floatPtr(maxCaseTime(test.Result.Groups))
+		for i := range test.Result.Groups {
+			group := &test.Result.Groups[i]
+			groupDiff := getGroupDiff(test, group.Group)
+			groupDiff.HeadVerdict = groupVerdict(group)
+			groupDiff.HeadScore = relativeScore(group.Score, group.MaxScore)
+			groupDiff.HeadMaxTime = floatPtr(maxCaseTime(test.Result.Groups[i : i+1]))
+		}
+	}
+
+	for _, diff := range comparison.Solutions {
+		setting, ok := solutionSettings[testKey(diff.Type, diff.Filename)]
+		if !ok {
+			// The test was removed, so it cannot regress.
+			continue
+		}
+		diff.compareResults(expectsAccepted(setting))
+		if diff.BaseState != nil && *diff.BaseState == StatePassed && *diff.HeadState != StatePassed {
+			diff.Regression = true
+		}
+		for _, groupDiff := range diff.Groups {
+			groupDiff.compareResults(expectsGroupAccepted(setting, groupDiff.Group))
+			diff.Regression = diff.Regression || groupDiff.Regression
+		}
+		if diff.Regression {
+			comparison.Regressions = append(comparison.Regressions, diff.Filename)
+		}
+	}
+
+	return comparison
+}
@@ -0,0 +1,256 @@
+package ci
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+)
+
+func TestCompareReports(t *testing.T) {
+	acceptedResult := func(time float64) *runner.RunResult {
+		result := newGroupsRunResult()
+		result.Verdict = "AC"
+		result.Score = big.NewRat(1, 1)
+		for i := range result.Groups {
+			group := &result.Groups[i]
+			group.Score = group.MaxScore
+			for j := range group.Cases {
+				group.Cases[j].Verdict = "AC"
+				group.Cases[j].Meta.Time = time
+			}
+		}
+		return result
+	}
+	wrongResult := func() *runner.RunResult {
+		result := newGroupsRunResult()
+		result.Groups[1].Score = &big.Rat{}
+		result.Score = big.NewRat(1, 2)
+		return result
+	}
+
+	baseReport := &Report{
+		Problem:    "sumas",
+		CommitHash: "base",
+		Tests: []*ReportTest{
+			{
+				Type:     "solutions",
+				Filename: "solutions/ac.py",
+				State:    StatePassed,
+				Result:   acceptedResult(0.5),
+			},
+			{
+				Type:            "solutions",
+				Filename:        "solutions/pa.py",
+				SolutionSetting: &common.SolutionSettings{Verdict: "PA"},
+				State:           StatePassed,
+				Result:          newGroupsRunResult(),
+			},
+			{
+				Type:            "solutions",
+				Filename:        "solutions/wa.py",
+				SolutionSetting: &common.SolutionSettings{Verdict: "PA"},
+				State:           StatePassed,
+				Result:          wrongResult(),
+			},
+			{
+				Type:     "solutions",
+				Filename: "solutions/removed.py",
+				State:    StatePassed,
+				Result:   acceptedResult(0.1),
+			},
+		},
+	}
+	headReport := &Report{
+		Problem:    "sumas",
+		CommitHash: "head",
+		Tests: []*ReportTest{
+			{
+				// Slower, but otherwise the same.
+				Type:     "solutions",
+				Filename: "solutions/ac.py",
+				State:    StatePassed,
+				Result:   acceptedResult(0.75),
+			},
+			{
+				// Gets fewer points, which is not a regression for a wrong
+				// solution.
+				Type:            "solutions",
+				Filename:        "solutions/pa.py",
+				SolutionSetting: &common.SolutionSettings{Verdict: "PA"},
+				State:           StatePassed,
+				Result:          wrongResult(),
+			},
+			{
+				// The new data no longer catches it.
+				Type:            "solutions",
+				Filename:        "solutions/wa.py",
+				SolutionSetting: &common.SolutionSettings{Verdict: "PA"},
+				State:           StateFailed,
+				Result:          acceptedResult(0.1),
+			},
+			{
+				Type:     "solutions",
+				Filename: "solutions/added.py",
+				State:    StatePassed,
+				Result:   acceptedResult(0.1),
+			},
+		},
+	}
+
+	comparison := CompareReports(baseReport, headReport)
+	if comparison.BaseCommitHash != "base" || comparison.HeadCommitHash != "head" {
+		t.Errorf("commits = %q..%q, want base..head", comparison.BaseCommitHash, comparison.HeadCommitHash)
+	}
+	if want := []string{"solutions/wa.py"}; !reflect.DeepEqual(comparison.Regressions, want) {
+		t.Errorf("Regressions = %v, want %v", comparison.Regressions, want)
+	}
+
+	diffs := make(map[string]*SolutionDiff)
+	for _, diff := range comparison.Solutions {
+		diffs[diff.Filename] = diff
+	}
+	if len(diffs) != 5 {
+		t.Fatalf("Solutions = %v, want 5 entries", comparison.Solutions)
+	}
+
+	ac := diffs["solutions/ac.py"]
+	if ac.Changed || ac.Regression {
+		t.Errorf("ac.py: Changed = %v, Regression = %v, want false, false", ac.Changed, ac.Regression)
+	}
+	if *ac.BaseMaxTime != 0.5 || *ac.HeadMaxTime != 0.75 {
+		t.Errorf("ac.py: max times = %v, %v, want 0.5, 0.75", *ac.BaseMaxTime, *ac.HeadMaxTime)
+	}
+
+	pa := diffs["solutions/pa.py"]
+	if !pa.Changed || pa.Regression {
+		t.Errorf("pa.py: Changed = %v, Regression = %v, want true, false", pa.Changed, pa.Regression)
+	}
+	if len(pa.Groups) != 2 {
+		t.Fatalf("pa.py: Groups = %v, want 2 entries", pa.Groups)
+	}
+	if sub1 := pa.Groups[0]; sub1.Group != "sub1" || sub1.Changed {
+		t.Errorf("pa.py: sub1 = %+v, want unchanged", sub1)
+	}
+	if sub2 := pa.Groups[1]; sub2.Group != "sub2" || !sub2.Changed || *sub2.BaseScore != 0.5 || *sub2.HeadScore != 0 {
+		t.Errorf("pa.py: sub2 = %+v, want a score change from 0.5 to 0", sub2)
+	}
+
+	wa := diffs["solutions/wa.py"]
+	if !wa.Regression || *wa.BaseState != StatePassed || *wa.HeadState != StateFailed {
+		t.Errorf("wa.py = %+v, want a regression from passed to failed", wa)
+	}
+	if sub2 := wa.Groups[1]; !sub2.Regression || sub2.BaseVerdict != "TLE" || sub2.HeadVerdict != "AC" {
+		t.Errorf("wa.py: sub2 = %+v, want a regression from TLE to AC", sub2)
+	}
+
+	if removed := diffs["solutions/removed.py"]; removed.HeadState != nil || removed.Regression {
+		t.Errorf("removed.py = %+v, want no head state and no regression", removed)
+	}
+	if added := diffs["solutions/added.py"]; added.BaseState != nil || added.Changed || added.Regression {
+		t.Errorf("added.py = %+v, want no base state and no changes", added)
+	}
+}
+
+func TestCompareReportsMaxScore(t *testing.T) {
+	result := func(score int64) *runner.RunResult {
+		return &runner.RunResult{
+			Verdict:  "PA",
+			Score:    big.NewRat(score, 1),
+			MaxScore: big.NewRat(100, 1),
+		}
+	}
+	report := func(commitHash string, score int64) *Report {
+		return &Report{
+			Problem:    "sumas",
+			CommitHash: commitHash,
+			Tests: []*ReportTest{
+				{
+					Type:            "solutions",
+					Filename:        "solutions/pa.py",
+					SolutionSetting: &common.SolutionSettings{Verdict: "PA"},
+					State:           StatePassed,
+					Result:          result(score),
+				},
+			},
+		}
+	}
+
+	comparison := CompareReports(report("base", 75), report("head", 50))
+	if len(comparison.Solutions) != 1 {
+		t.Fatalf("Solutions = %v, want 1 entry", comparison.Solutions)
+	}
+	diff := comparison.Solutions[0]
+	if diff.BaseScore == nil || *diff.BaseScore != 0.75 {
+		t.Errorf("BaseScore = %v, want 0.75", diff.BaseScore)
+	}
+	if diff.HeadScore == nil || *diff.HeadScore != 0.5 {
+		t.Errorf("HeadScore = %v, want 0.5", diff.HeadScore)
+	}
+}
+
+func TestCompareReportsGroupExpectations(t *testing.T) {
+	// The subtask solution is only expected to pass the first group.
+	setting := &common.SolutionSettings{
+		Verdict: "PA",
+		Groups:  []common.GroupSolutionSettings{{Group: "sub1", Verdict: "AC"}},
+	}
+	failingResult := func() *runner.RunResult {
+		result := newGroupsRunResult()
+		result.Score = big.NewRat(1, 2)
+		result.Groups[0].Score = big.NewRat(1, 4)
+		result.Groups[0].Cases[0].Verdict = "WA"
+		return result
+	}
+	report := func(commitHash string, result *runner.RunResult) *Report {
+		return &Report{
+			Problem:    "sumas",
+			CommitHash: commitHash,
+			Tests: []*ReportTest{
+				{
+					Type:            "solutions",
+					Filename:        "solutions/subtask.py",
+					SolutionSetting: setting,
+					State:           StatePassed,
+					Result:          result,
+				},
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		name                string
+		base, head          *runner.RunResult
+		expectedRegressions map[string]bool
+	}{
+		{
+			"score drop in a group that is expected to pass",
+			newGroupsRunResult(),
+			failingResult(),
+			map[string]bool{"sub1": true, "sub2": false},
+		},
+		{
+			"score gain in a group that is expected to pass",
+			failingResult(),
+			newGroupsRunResult(),
+			map[string]bool{"sub1": false, "sub2": false},
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			comparison := CompareReports(report("base", tt.base), report("head", tt.head))
+			if len(comparison.Solutions) != 1 {
+				t.Fatalf("Solutions = %v, want 1 entry", comparison.Solutions)
+			}
+			regressions := make(map[string]bool)
+			for _, groupDiff := range comparison.Solutions[0].Groups {
+				regressions[groupDiff.Group] = groupDiff.Regression
+			}
+			if !reflect.DeepEqual(tt.expectedRegressions, regressions) {
+				t.Errorf("group regressions = %v, want %v", regressions, tt.expectedRegressions)
+			}
+		})
+	}
+}
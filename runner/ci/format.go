@@ -0,0 +1,227 @@
+package ci
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	base "github.com/omegaup/go-base/v3"
+)
+
+// ExitCode returns the exit code that a process that ran the CI tests should
+// return when the run ended in this state, so that CI pipelines can tell the
+// outcomes apart.
+func (s State) ExitCode() int {
+	switch s {
+	case StatePassed:
+		return 0
+	case StateFailed:
+		return 1
+	case StateError:
+		return 2
+	case StateSkipped:
+		return 3
+	default:
+		// The run did not finish.
+		return 4
+	}
+}
+
+// formattedTest is a single entry in the machine-readable outputs of a
+// Report.
+type formattedTest struct {
+	className string
+	name      string
+	state     State
+	message   string
+	details   []string
+	duration  *base.Duration
+}
+
+// formattedTests returns one entry per test in the report, plus one for the
+// report itself if it has an error that is not attributable to any test.
+func formattedTests(r *Report) []formattedTest {
+	var tests []formattedTest
+	for _, test := range r.Tests {
+		t := formattedTest{
+			className: fmt.Sprintf("%s.%s", r.Problem, test.Type),
+			name:      test.Filename,
+			state:     test.State,
+			duration:  test.Duration,
+		}
+		if test.ReportError != nil && test.ReportError.Error != nil {
+			t.message = test.ReportError.Error.Error()
+		} else if test.State == StateWaiting || test.State == StateRunning {
+			t.message = "the test did not run"
+		}
+		if test.Result != nil {
+			t.details = append(t.details, fmt.Sprintf("verdict: %s", test.Result.Verdict))
+			if test.Result.Score != nil {
+				t.details = append(
+					t.details,
+					fmt.Sprintf("score: %.3f", base.RationalToFloat(test.Result.Score)),
+				)
+			}
+		}
+		if test.StressResult != nil {
+			t.details = append(t.details, fmt.Sprintf("iterations: %d", test.StressResult.Iterations))
+			if test.StressResult.Seed != nil {
+				t.details = append(t.details, fmt.Sprintf("seed: %d", *test.StressResult.Seed))
+			}
+		}
+		tests = append(tests, t)
+	}
+	if r.ReportError != nil && r.ReportError.Error != nil {
+		tests = append(tests, formattedTest{
+			className: r.Problem,
+			name:      "report",
+			state:     r.State,
+			message:   r.ReportError.Error.Error(),
+			duration:  r.Duration,
+		})
+	}
+	return tests
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	ClassName string       `xml:"classname,attr"`
+	Name      string       `xml:"name,attr"`
+	Time      string       `xml:"time,attr"`
+	Failure   *junitResult `xml:"failure,omitempty"`
+	Error     *junitResult `xml:"error,omitempty"`
+	Skipped   *junitResult `xml:"skipped,omitempty"`
+	SystemOut string       `xml:"system-out,omitempty"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+func junitTime(duration *base.Duration) string {
+	if duration == nil {
+		return "0.000"
+	}
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
+
+// WriteJUnit writes the report as a JUnit XML document, with one test case per
+// ReportTest.
+func WriteJUnit(w io.Writer, r *Report) error {
+	suite := junitTestSuite{
+		Name: r.Problem,
+		Time: junitTime(r.Duration),
+	}
+	if !r.StartTime.IsZero() {
+		suite.Timestamp = r.StartTime.UTC().Format(time.RFC3339)
+	}
+	for _, test := range formattedTests(r) {
+		testCase := junitTestCase{
+			ClassName: test.className,
+			Name:      test.name,
+			Time:      junitTime(test.duration),
+			SystemOut: strings.Join(test.details, "\n"),
+		}
+		result := &junitResult{
+			Message: test.message,
+			Type:    test.state.String(),
+			Body:    strings.TrimSpace(strings.Join(append([]string{test.message}, test.details...), "\n")),
+		}
+		switch test.state {
+		case StatePassed:
+		case StateFailed:
+			testCase.Failure = result
+			suite.Failures++
+		case StateSkipped:
+			testCase.Skipped = &junitResult{Message: test.message}
+			suite.Skipped++
+		default:
+			testCase.Error = result
+			suite.Errors++
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	suite.Tests = len(suite.TestCases)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(&junitTestSuites{
+		Name:     r.Problem,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteTAP writes the report in the Test Anything Protocol version 13 format,
+// with one test point per ReportTest.
+func WriteTAP(w io.Writer, r *Report) error {
+	tests := formattedTests(r)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "TAP version 13\n1..%d\n", len(tests))
+	for i, test := range tests {
+		status := "ok"
+		if test.state != StatePassed && test.state != StateSkipped {
+			status = "not ok"
+		}
+		fmt.Fprintf(&sb, "%s %d - %s/%s", status, i+1, test.className, test.name)
+		if test.state == StateSkipped {
+			sb.WriteString(" # SKIP")
+			if test.message != "" {
+				fmt.Fprintf(&sb, " %s", test.message)
+			}
+		}
+		sb.WriteString("\n")
+
+		sb.WriteString("  ---\n")
+		fmt.Fprintf(&sb, "  state: %s\n", test.state)
+		if test.message != "" {
+			fmt.Fprintf(&sb, "  message: %s\n", strconv.Quote(test.message))
+		}
+		for _, detail := range test.details {
+			fmt.Fprintf(&sb, "  %s\n", detail)
+		}
+		if test.duration != nil {
+			fmt.Fprintf(&sb, "  duration_ms: %.3f\n", test.duration.Milliseconds())
+		}
+		sb.WriteString("  ...\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,125 @@
+package ci
+
+import (
+	"bytes"
+	"encoding/xml"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/quark/runner"
+
+	"github.com/pkg/errors"
+)
+
+func newFormatTestReport() *Report {
+	duration := base.Duration(1500 * time.Millisecond)
+	return &Report{
+		Problem:   "sumas",
+		StartTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		Duration:  &duration,
+		State:     StateFailed,
+		Tests: []*ReportTest{
+			{
+				Type:     "solutions",
+				Filename: "solutions/ac.cpp",
+				State:    StatePassed,
+				Duration: &duration,
+				Result:   &runner.RunResult{Verdict: "AC", Score: big.NewRat(1, 1)},
+			},
+			{
+				Type:        "solutions",
+				Filename:    "solutions/wa.cpp",
+				State:       StateFailed,
+				ReportError: &ReportError{Error: errors.New(`expected verdict to be "AC", got "WA"`)},
+				Result:      &runner.RunResult{Verdict: "WA", Score: big.NewRat(1, 2)},
+			},
+			{
+				Type:     "inputs",
+				Filename: "validator.py",
+				State:    StateSkipped,
+			},
+		},
+	}
+}
+
+func TestStateExitCode(t *testing.T) {
+	if code := StatePassed.ExitCode(); code != 0 {
+		t.Errorf("StatePassed.ExitCode() = %d, want 0", code)
+	}
+	codes := make(map[int]State)
+	for _, state := range []State{StateWaiting, StateSkipped, StateError, StateFailed} {
+		code := state.ExitCode()
+		if code == 0 {
+			t.Errorf("%v.ExitCode() = 0, want non-zero", state)
+		}
+		if other, ok := codes[code]; ok {
+			t.Errorf("%v.ExitCode() = %v.ExitCode() = %d", state, other, code)
+		}
+		codes[code] = state
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJUnit(&buf, newFormatTestReport()); err != nil {
+		t.Fatalf("WriteJUnit() failed: %v", err)
+	}
+
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("Failed to parse the JUnit report %q: %v", buf.String(), err)
+	}
+	if suites.Tests != 3 || suites.Failures != 1 || suites.Skipped != 1 || suites.Errors != 0 {
+		t.Errorf("unexpected counts: %+v", suites)
+	}
+	if len(suites.Suites) != 1 || len(suites.Suites[0].TestCases) != 3 {
+		t.Fatalf("unexpected test suites: %+v", suites.Suites)
+	}
+	testCases := suites.Suites[0].TestCases
+	if testCases[0].Time != "1.500" || testCases[0].Failure != nil {
+		t.Errorf("unexpected passing test case: %+v", testCases[0])
+	}
+	if testCases[1].Failure == nil ||
+		!strings.Contains(testCases[1].Failure.Message, "expected verdict") ||
+		!strings.Contains(testCases[1].Failure.Body, "score: 0.500") {
+		t.Errorf("unexpected failing test case: %+v", testCases[1])
+	}
+	if testCases[2].Skipped == nil || testCases[2].ClassName != "sumas.inputs" {
+		t.Errorf("unexpected skipped test case: %+v", testCases[2])
+	}
+}
+
+func TestWriteTAP(t *testing.T) {
+	report := newFormatTestReport()
+	report.ReportError = &ReportError{Error: errors.New("insufficient headroom")}
+
+	var buf bytes.Buffer
+	if err := WriteTAP(&buf, report); err != nil {
+		t.Fatalf("WriteTAP() failed: %v", err)
+	}
+
+	var testPoints []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "ok ") || strings.HasPrefix(line, "not ok ") {
+			testPoints = append(testPoints, line)
+		}
+	}
+	expected := []string{
+		"ok 1 - sumas.solutions/solutions/ac.cpp",
+		"not ok 2 - sumas.solutions/solutions/wa.cpp",
+		"ok 3 - sumas.inputs/validator.py # SKIP",
+		"not ok 4 - sumas/report",
+	}
+	if strings.Join(expected, "\n") != strings.Join(testPoints, "\n") {
+		t.Errorf("test points = %q, want %q", testPoints, expected)
+	}
+	if !strings.HasPrefix(buf.String(), "TAP version 13\n1..4\n") {
+		t.Errorf("unexpected TAP header: %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), "  duration_ms: 1500.000\n") {
+		t.Errorf("missing duration in %q", buf.String())
+	}
+}
@@ -0,0 +1,156 @@
+package ci
+
+import (
+	"math/big"
+	"path"
+	"sort"
+
+	"github.com/omegaup/quark/common"
+)
+
+// WrongSolutionCases are the cases that a wrong solution fails.
+type WrongSolutionCases struct {
+	Filename    string   `json:"filename"`
+	FailedCases []string `json:"failed_cases"`
+}
+
+// TestSuiteStrength summarizes how well the cases of a problem tell the wrong
+// solutions in tests/tests.json apart from the correct ones. A wrong solution
+// is one that is not expected to get an AC verdict, and it fails a case if it
+// does not get an AC verdict in it.
+type TestSuiteStrength struct {
+	Solutions []*WrongSolutionCases `json:"solutions"`
+
+	// UnusedCases are the cases that no wrong solution fails, so they are
+	// possibly redundant.
+	UnusedCases []string `json:"unused_cases,omitempty"`
+
+	// FragileSolutions are the wrong solutions that fail a single case.
+	FragileSolutions []string `json:"fragile_solutions,omitempty"`
+
+	// UncaughtSolutions are the wrong solutions that do not fail any case.
+	UncaughtSolutions []string `json:"uncaught_solutions,omitempty"`
+
+	// UndistinguishedGroups are the groups in which no wrong solution fails
+	// any case.
+	UndistinguishedGroups []string `json:"undistinguished_groups,omitempty"`
+}
+
+// expectsAccepted returns whether a solution with the provided settings is
+// expected to get an AC verdict. A solution that only has expectations for its
+// groups is expected to get an AC verdict if all of them expect the full score.
+func expectsAccepted(setting *common.SolutionSettings) bool {
+	if setting == nil {
+		return true
+	}
+	if setting.Verdict != "" || setting.ScoreRange != nil || len(setting.Groups) == 0 {
+		return expectsFullScore(setting.Verdict, setting.ScoreRange)
+	}
+	for _, group := range setting.Groups {
+		if !expectsFullScore(group.Verdict, group.ScoreRange) {
+			return false
+		}
+	}
+	return true
+}
+
+// expectsGroupAccepted returns whether the solution is expected to get the
+// full score in the group. The group settings that match the group take
+// precedence over the expectation for the whole solution.
+func expectsGroupAccepted(setting *common.SolutionSettings, group string) bool {
+	if setting == nil {
+		return true
+	}
+	matched := false
+	for _, groupSetting := range setting.Groups {
+		if ok, _ := path.Match(groupSetting.Group, group); !ok {
+			continue
+		}
+		matched = true
+		if !expectsFullScore(groupSetting.Verdict, groupSetting.ScoreRange) {
+			return false
+		}
+	}
+	if matched {
+		return true
+	}
+	return expectsAccepted(setting)
+}
+
+// expectsFullScore returns whether the expected verdict or score range of a
+// solution or group can only be met with the full score.
+func expectsFullScore(verdict string, scoreRange *common.ScoreRange) bool {
+	if verdict == "AC" {
+		return true
+	}
+	if verdict != "" {
+		return false
+	}
+	return scoreRange != nil && scoreRange.Min.Cmp(big.NewRat(1, 1)) >= 0
+}
+
+// AnalyzeTestSuiteStrength fills the TestSuiteStrength of the report from the
+// per-case results of the solution tests. It is not filled if there are no
+// wrong solutions with results.
+func (r *Report) AnalyzeTestSuiteStrength() {
+	strength := &TestSuiteStrength{}
+
+	// The group of every case, and whether any wrong solution failed it.
+	caseGroups := make(map[string]string)
+	failedCases := make(map[string]bool)
+	for _, test := range r.Tests {
+		if test.Type != "solutions" || test.Result == nil {
+			continue
+		}
+		if test.Result.Verdict == "CE" {
+			// Solutions that do not compile have no case results.
+			continue
+		}
+		wrongSolution := !expectsAccepted(test.SolutionSetting)
+		solutionCases := &WrongSolutionCases{
+			Filename:    test.Filename,
+			FailedCases: []string{},
+		}
+		for _, group := range test.Result.Groups {
+			for _, c := range group.Cases {
+				caseGroups[c.Name] = group.Group
+				if !wrongSolution || c.Verdict == "AC" {
+					continue
+				}
+				failedCases[c.Name] = true
+				solutionCases.FailedCases = append(solutionCases.FailedCases, c.Name)
+			}
+		}
+		if !wrongSolution {
+			continue
+		}
+		sort.Strings(solutionCases.FailedCases)
+		strength.Solutions = append(strength.Solutions, solutionCases)
+		switch len(solutionCases.FailedCases) {
+		case 0:
+			strength.UncaughtSolutions = append(strength.UncaughtSolutions, test.Filename)
+		case 1:
+			strength.FragileSolutions = append(strength.FragileSolutions, test.Filename)
+		}
+	}
+	if len(strength.Solutions) == 0 {
+		return
+	}
+
+	groupFailed := make(map[string]bool)
+	for caseName, groupName := range caseGroups {
+		groupFailed[groupName] = groupFailed[groupName] || failedCases[caseName]
+		if !failedCases[caseName] {
+			strength.UnusedCases = append(strength.UnusedCases, caseName)
+		}
+	}
+	sort.Strings(strength.UnusedCases)
+	for groupName, failed := range groupFailed {
+		if !failed {
+			strength.UndistinguishedGroups = append(strength.UndistinguishedGroups, groupName)
+		}
+	}
+	sort.Strings(strength.UndistinguishedGroups)
+
+	r.TestSuiteStrength = strength
+}
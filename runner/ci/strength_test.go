@@ -0,0 +1,131 @@
+package ci
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+)
+
+func TestReportAnalyzeTestSuiteStrength(t *testing.T) {
+	newTest := func(filename string, verdict string, caseVerdicts map[string]string) *ReportTest {
+		result := &runner.RunResult{}
+		for _, groupName := range []string{"easy", "hard", "samples"} {
+			group := runner.GroupResult{Group: groupName}
+			for _, caseName := range []string{groupName + ".1", groupName + ".2"} {
+				caseVerdict, ok := caseVerdicts[caseName]
+				if !ok {
+					caseVerdict = "AC"
+				}
+				group.Cases = append(group.Cases, runner.CaseResult{Name: caseName, Verdict: caseVerdict})
+			}
+			result.Groups = append(result.Groups, group)
+		}
+		return &ReportTest{
+			Type:            "solutions",
+			Filename:        filename,
+			SolutionSetting: &common.SolutionSettings{Filename: filename, Verdict: verdict},
+			Result:          result,
+		}
+	}
+
+	report := &Report{}
+	report.AnalyzeTestSuiteStrength()
+	if report.TestSuiteStrength != nil {
+		t.Errorf("TestSuiteStrength = %v, want nil without wrong solutions", report.TestSuiteStrength)
+	}
+
+	report = &Report{
+		Tests: []*ReportTest{
+			newTest("ac.cpp", "AC", nil),
+			newTest("greedy.cpp", "WA", map[string]string{"hard.1": "WA", "hard.2": "WA", "easy.1": "WA"}),
+			newTest("slow.cpp", "TLE", map[string]string{"hard.2": "TLE"}),
+			newTest("lucky.cpp", "WA", nil),
+		},
+	}
+	report.AnalyzeTestSuiteStrength()
+	expected := &TestSuiteStrength{
+		Solutions: []*WrongSolutionCases{
+			{Filename: "greedy.cpp", FailedCases: []string{"easy.1", "hard.1", "hard.2"}},
+			{Filename: "slow.cpp", FailedCases: []string{"hard.2"}},
+			{Filename: "lucky.cpp", FailedCases: []string{}},
+		},
+		UnusedCases:           []string{"easy.2", "samples.1", "samples.2"},
+		FragileSolutions:      []string{"slow.cpp"},
+		UncaughtSolutions:     []string{"lucky.cpp"},
+		UndistinguishedGroups: []string{"samples"},
+	}
+	if !reflect.DeepEqual(expected, report.TestSuiteStrength) {
+		t.Errorf("TestSuiteStrength = %+v, want %+v", report.TestSuiteStrength, expected)
+	}
+}
+
+func TestReportAnalyzeTestSuiteStrengthGroups(t *testing.T) {
+	newResult := func(caseVerdicts map[string]string) *runner.RunResult {
+		result := &runner.RunResult{Verdict: "AC"}
+		for _, groupName := range []string{"easy", "hard"} {
+			group := runner.GroupResult{Group: groupName}
+			caseName := groupName + ".1"
+			caseVerdict, ok := caseVerdicts[caseName]
+			if !ok {
+				caseVerdict = "AC"
+			}
+			if caseVerdict != "AC" {
+				result.Verdict = "PA"
+			}
+			group.Cases = append(group.Cases, runner.CaseResult{Name: caseName, Verdict: caseVerdict})
+			result.Groups = append(result.Groups, group)
+		}
+		return result
+	}
+
+	report := &Report{
+		Tests: []*ReportTest{
+			{
+				// Only expects the full score in the groups, so it is a correct
+				// solution.
+				Type:     "solutions",
+				Filename: "groups-ac.cpp",
+				SolutionSetting: &common.SolutionSettings{
+					Filename: "groups-ac.cpp",
+					Groups: []common.GroupSolutionSettings{
+						{Group: "easy", Verdict: "AC"},
+						{Group: "hard", Verdict: "AC"},
+					},
+				},
+				Result: newResult(nil),
+			},
+			{
+				Type:     "solutions",
+				Filename: "groups-pa.cpp",
+				SolutionSetting: &common.SolutionSettings{
+					Filename: "groups-pa.cpp",
+					Groups: []common.GroupSolutionSettings{
+						{Group: "easy", Verdict: "AC"},
+						{Group: "hard", Verdict: "WA"},
+					},
+				},
+				Result: newResult(map[string]string{"hard.1": "WA"}),
+			},
+			{
+				Type:            "solutions",
+				Filename:        "ce.cpp",
+				SolutionSetting: &common.SolutionSettings{Filename: "ce.cpp", Verdict: "CE"},
+				Result:          &runner.RunResult{Verdict: "CE"},
+			},
+		},
+	}
+	report.AnalyzeTestSuiteStrength()
+	expected := &TestSuiteStrength{
+		Solutions: []*WrongSolutionCases{
+			{Filename: "groups-pa.cpp", FailedCases: []string{"hard.1"}},
+		},
+		UnusedCases:           []string{"easy.1"},
+		FragileSolutions:      []string{"groups-pa.cpp"},
+		UndistinguishedGroups: []string{"easy"},
+	}
+	if !reflect.DeepEqual(expected, report.TestSuiteStrength) {
+		t.Errorf("TestSuiteStrength = %+v, want %+v", report.TestSuiteStrength, expected)
+	}
+}
@@ -0,0 +1,423 @@
+package ci
+
+import (
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// stressCasePrefix is the prefix of the names of the cases created by the
+	// stress tests. The rest of the name is the seed.
+	stressCasePrefix = "seed-"
+
+	// stressOverallWallTimeLimit is the overall wall time limit of each of the
+	// runs of a stress test, since they have one case per seed.
+	stressOverallWallTimeLimit = base.Duration(5 * time.Minute)
+)
+
+// StressConfig represents the configuration of a stress test. The solution
+// that is tested is the one in the TestConfig.
+type StressConfig struct {
+	Generator  SolutionConfig
+	BruteForce SolutionConfig
+	Seeds      []int64
+
+	// InputsValidator validates the generated inputs. It is nil if the problem
+	// does not have an inputs validator.
+	InputsValidator *common.LiteralValidatorSettings
+
+	// Limits and Validator are the ones of the problem, which are used to run
+	// and validate the tested solution.
+	Limits    *common.LimitsSettings
+	Validator *common.LiteralValidatorSettings
+}
+
+// String implements the fmt.Stringer interface.
+func (c *StressConfig) String() string {
+	if c == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%+v", *c)
+}
+
+// StressResult is the result of a stress test.
+type StressResult struct {
+	// Iterations is the number of generated inputs for which the outputs of
+	// the tested solution were compared against the ones of the brute-force
+	// solution.
+	Iterations int `json:"iterations"`
+
+	// The smallest input that made the stress test fail, if any.
+	Seed           *int64 `json:"seed,omitempty"`
+	Input          string `json:"input,omitempty"`
+	ExpectedOutput string `json:"expected_output,omitempty"`
+	Verdict        string `json:"verdict,omitempty"`
+}
+
+// A StressStageRunner runs a solution against an input, and returns its
+// result together with the output of each one of the cases that produced one.
+type StressStageRunner func(
+	solution *SolutionConfig,
+	input *common.LiteralInput,
+) (*runner.RunResult, map[string]string, error)
+
+// getLanguage returns the language of the file in tests/. If language is not
+// empty, it is returned as-is.
+func getLanguage(files common.ProblemFiles, filename, language string) (string, error) {
+	if language != "" {
+		return language, nil
+	}
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		return "", errors.Errorf(
+			"failed to get language for %s in %s",
+			filename,
+			files.String(),
+		)
+	}
+	return common.FileExtensionLanguage(ext[1:]), nil
+}
+
+// getStressSolutionConfig returns the SolutionConfig of a file in tests/.
+func getStressSolutionConfig(files common.ProblemFiles, filename, language string) (*SolutionConfig, error) {
+	var err error
+	solution := &SolutionConfig{}
+	if solution.Language, err = getLanguage(files, filename, language); err != nil {
+		return nil, err
+	}
+	if solution.Source, err = files.GetStringContents(
+		fmt.Sprintf("tests/%s", filename),
+	); err != nil {
+		return nil, err
+	}
+	return solution, nil
+}
+
+// newStressTestConfig creates the TestConfig of the stress test described in
+// the tests settings of config. officialSolution can be nil if the problem
+// does not have one.
+func newStressTestConfig(
+	files common.ProblemFiles,
+	config *RunConfig,
+	officialSolution *SolutionConfig,
+) (*TestConfig, error) {
+	settings := config.TestsSettings.Stress
+	if config.Input.Interactive != nil {
+		return nil, errors.Errorf(
+			"stress tests are not supported for interactive problems in %s",
+			files.String(),
+		)
+	}
+	if settings.MinSeed < 0 || settings.MaxSeed < settings.MinSeed {
+		return nil, errors.Errorf(
+			"invalid stress test seed range [%d, %d] in %s",
+			settings.MinSeed,
+			settings.MaxSeed,
+			files.String(),
+		)
+	}
+	iterations := settings.Iterations
+	if iterations <= 0 {
+		iterations = common.DefaultStressIterations
+	}
+
+	testConfig := &TestConfig{
+		Test: &ReportTest{
+			Index: len(config.TestConfigs),
+			Type:  "stress",
+		},
+		Stress: &StressConfig{
+			Limits:    config.Input.Limits,
+			Validator: config.Input.Validator,
+		},
+	}
+	for seed := settings.MinSeed; seed <= settings.MaxSeed && int64(len(testConfig.Stress.Seeds)) < iterations; seed++ {
+		testConfig.Stress.Seeds = append(testConfig.Stress.Seeds, seed)
+	}
+
+	if settings.Solution == "" {
+		if officialSolution == nil {
+			return nil, errors.Errorf(
+				"missing solutions/solution.* files for the stress test in %s",
+				files.String(),
+			)
+		}
+		testConfig.Test.Filename = fmt.Sprintf("solutions/solution.%s", officialSolution.Language)
+		testConfig.Solution = *officialSolution
+	} else {
+		solution, err := getStressSolutionConfig(files, settings.Solution, settings.SolutionLanguage)
+		if err != nil {
+			return nil, err
+		}
+		testConfig.Test.Filename = settings.Solution
+		testConfig.Solution = *solution
+	}
+
+	generator, err := getStressSolutionConfig(files, settings.Generator, settings.GeneratorLanguage)
+	if err != nil {
+		return nil, err
+	}
+	testConfig.Stress.Generator = *generator
+
+	bruteForce, err := getStressSolutionConfig(files, settings.BruteForce, settings.BruteForceLanguage)
+	if err != nil {
+		return nil, err
+	}
+	testConfig.Stress.BruteForce = *bruteForce
+
+	if config.TestsSettings.InputsValidator != nil {
+		inputsValidator, err := getStressSolutionConfig(
+			files,
+			config.TestsSettings.InputsValidator.Filename,
+			config.TestsSettings.InputsValidator.Language,
+		)
+		if err != nil {
+			return nil, err
+		}
+		testConfig.Stress.InputsValidator = &common.LiteralValidatorSettings{
+			Name: common.ValidatorNameCustom,
+			CustomValidator: &common.LiteralCustomValidatorSettings{
+				Source:   inputsValidator.Source,
+				Language: inputsValidator.Language,
+			},
+		}
+	}
+
+	return testConfig, nil
+}
+
+// stressLimits returns a copy of limits that allows all the cases of a stress
+// test stage to run.
+func stressLimits(limits *common.LimitsSettings) *common.LimitsSettings {
+	result := *limits
+	result.OverallWallTimeLimit = base.Max(result.OverallWallTimeLimit, stressOverallWallTimeLimit)
+	return &result
+}
+
+// stressCases returns the LiteralCaseSettings of the provided seeds, whose
+// inputs are obtained with getInput.
+func stressCases(seeds []int64, getInput func(seed int64) string) map[string]*common.LiteralCaseSettings {
+	cases := make(map[string]*common.LiteralCaseSettings)
+	for _, seed := range seeds {
+		cases[stressCaseName(seed)] = &common.LiteralCaseSettings{
+			Input:  getInput(seed),
+			Weight: big.NewRat(1, 1),
+		}
+	}
+	return cases
+}
+
+func stressCaseName(seed int64) string {
+	return fmt.Sprintf("%s%d", stressCasePrefix, seed)
+}
+
+// stressCaseResults returns the results of the cases of a stress test stage,
+// indexed by seed.
+func stressCaseResults(result *runner.RunResult) map[int64]*runner.CaseResult {
+	caseResults := make(map[int64]*runner.CaseResult)
+	for i := range result.Groups {
+		for j := range result.Groups[i].Cases {
+			caseResult := &result.Groups[i].Cases[j]
+			seed, err := strconv.ParseInt(strings.TrimPrefix(caseResult.Name, stressCasePrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			caseResults[seed] = caseResult
+		}
+	}
+	return caseResults
+}
+
+// runStressStage runs one of the stages of a stress test, and fails if the
+// program could not even be compiled.
+func runStressStage(
+	run StressStageRunner,
+	stage string,
+	solution *SolutionConfig,
+	input *common.LiteralInput,
+) (map[int64]*runner.CaseResult, map[string]string, error) {
+	result, outputs, err := run(solution, input)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to run the %s", stage)
+	}
+	if result.CompileError != nil {
+		return nil, nil, errors.Errorf("failed to compile the %s:\n%s", stage, *result.CompileError)
+	}
+	if result.Verdict == "JE" || result.Verdict == "CE" {
+		return nil, nil, errors.Errorf("failed to run the %s: got %s", stage, result.Verdict)
+	}
+	return stressCaseResults(result), outputs, nil
+}
+
+// RunStressTest runs the stress test in testConfig, using run to run each of
+// its stages: the generator creates one input per seed, the inputs validator
+// (if any) checks them, the brute-force solution produces the expected outputs
+// and finally the tested solution is validated against them. If the tested
+// solution does not get an AC verdict in all the inputs, the test fails and
+// the smallest failing input is reported. The returned error is only set if
+// the stress test could not be performed.
+func RunStressTest(testConfig *TestConfig, run StressStageRunner) error {
+	test := testConfig.Test
+	config := testConfig.Stress
+	test.StressResult = &StressResult{}
+
+	fail := func(seed int64, input string, verdict string, err error) {
+		test.StressResult.Seed = &seed
+		test.StressResult.Input = input
+		test.StressResult.Verdict = verdict
+		test.State = StateFailed
+		test.ReportError = &ReportError{Error: err}
+	}
+
+	// Generate the inputs.
+	generatorResults, generatorOutputs, err := runStressStage(
+		run,
+		"generator",
+		&config.Generator,
+		&common.LiteralInput{
+			Cases: stressCases(config.Seeds, func(seed int64) string {
+				return fmt.Sprintf("%d\n", seed)
+			}),
+			Limits: stressLimits(&common.DefaultLiteralLimitSettings),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	inputs := make(map[int64]string)
+	for _, seed := range config.Seeds {
+		caseResult, ok := generatorResults[seed]
+		if !ok || caseResult.Meta.Verdict != "OK" {
+			verdict := "JE"
+			if ok {
+				verdict = caseResult.Meta.Verdict
+			}
+			fail(seed, fmt.Sprintf("%d\n", seed), verdict, errors.Errorf(
+				"the generator failed for seed %d: got %s",
+				seed,
+				verdict,
+			))
+			return nil
+		}
+		inputs[seed] = generatorOutputs[stressCaseName(seed)]
+	}
+	getInput := func(seed int64) string {
+		return inputs[seed]
+	}
+
+	// Seeds are tried in order of the size of their input, so that the first
+	// failure is also the smallest one.
+	seeds := make([]int64, len(config.Seeds))
+	copy(seeds, config.Seeds)
+	sort.SliceStable(seeds, func(i, j int) bool {
+		return len(inputs[seeds[i]]) < len(inputs[seeds[j]])
+	})
+
+	// Validate the inputs.
+	if config.InputsValidator != nil {
+		validatorResults, _, err := runStressStage(
+			run,
+			"inputs validator",
+			&SolutionConfig{
+				Source:   CopyStdinToStdoutSource,
+				Language: "cpp11",
+			},
+			&common.LiteralInput{
+				Cases:     stressCases(seeds, getInput),
+				Limits:    stressLimits(&common.DefaultLiteralLimitSettings),
+				Validator: config.InputsValidator,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		for _, seed := range seeds {
+			caseResult, ok := validatorResults[seed]
+			if !ok || caseResult.Verdict != "AC" {
+				verdict := "JE"
+				if ok {
+					verdict = caseResult.Verdict
+				}
+				fail(seed, inputs[seed], verdict, errors.Errorf(
+					"the generator created an invalid input for seed %d",
+					seed,
+				))
+				return nil
+			}
+		}
+	}
+
+	// Generate the expected outputs. The inputs for which the brute-force
+	// solution does not finish are not compared.
+	bruteForceResults, bruteForceOutputs, err := runStressStage(
+		run,
+		"brute-force solution",
+		&config.BruteForce,
+		&common.LiteralInput{
+			Cases:  stressCases(seeds, getInput),
+			Limits: stressLimits(&common.DefaultLiteralLimitSettings),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	var comparedSeeds []int64
+	for _, seed := range seeds {
+		if caseResult, ok := bruteForceResults[seed]; ok && caseResult.Meta.Verdict == "OK" {
+			comparedSeeds = append(comparedSeeds, seed)
+		}
+	}
+	if len(comparedSeeds) == 0 {
+		return errors.New("the brute-force solution did not finish for any of the generated inputs")
+	}
+
+	// Compare the tested solution against the brute-force solution.
+	cases := stressCases(comparedSeeds, getInput)
+	for _, seed := range comparedSeeds {
+		cases[stressCaseName(seed)].ExpectedOutput = bruteForceOutputs[stressCaseName(seed)]
+	}
+	solutionResults, _, err := runStressStage(
+		run,
+		"solution",
+		&testConfig.Solution,
+		&common.LiteralInput{
+			Cases:     cases,
+			Limits:    stressLimits(config.Limits),
+			Validator: config.Validator,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	test.StressResult.Iterations = len(comparedSeeds)
+	for _, seed := range comparedSeeds {
+		caseResult, ok := solutionResults[seed]
+		if ok && caseResult.Verdict == "AC" {
+			continue
+		}
+		verdict := "JE"
+		if ok {
+			verdict = caseResult.Verdict
+		}
+		fail(seed, inputs[seed], verdict, errors.Errorf(
+			"expected verdict to be \"AC\" for seed %d, got %q",
+			seed,
+			verdict,
+		))
+		test.StressResult.ExpectedOutput = bruteForceOutputs[stressCaseName(seed)]
+		return nil
+	}
+	test.State = StatePassed
+	return nil
+}
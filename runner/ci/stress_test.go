@@ -0,0 +1,187 @@
+package ci
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/omegaup/quark/common"
+	"github.com/omegaup/quark/runner"
+)
+
+// fakeStressStageRunner runs the programs of a stress test, which are Go
+// functions named by their source.
+func fakeStressStageRunner(
+	programs map[string]func(input string) (string, string),
+	inputsValidator func(input string) bool,
+	stages *int,
+) StressStageRunner {
+	return func(
+		solution *SolutionConfig,
+		input *common.LiteralInput,
+	) (*runner.RunResult, map[string]string, error) {
+		*stages++
+		result := runner.NewRunResult("AC", nil)
+		outputs := make(map[string]string)
+		group := runner.GroupResult{}
+		for caseName, caseSettings := range input.Cases {
+			caseResult := runner.CaseResult{
+				Name: caseName,
+				Meta: runner.RunMetadata{Verdict: "OK"},
+			}
+			var output string
+			if solution.Source == CopyStdinToStdoutSource {
+				output = caseSettings.Input
+			} else {
+				output, caseResult.Meta.Verdict = programs[solution.Source](caseSettings.Input)
+			}
+			if caseResult.Meta.Verdict == "OK" {
+				outputs[caseName] = output
+			}
+			switch {
+			case caseResult.Meta.Verdict != "OK":
+				caseResult.Verdict = caseResult.Meta.Verdict
+			case input.Validator != nil && input.Validator.Name == common.ValidatorNameCustom:
+				caseResult.Verdict = "WA"
+				if inputsValidator(caseSettings.Input) {
+					caseResult.Verdict = "AC"
+				}
+			case output == caseSettings.ExpectedOutput:
+				caseResult.Verdict = "AC"
+			default:
+				caseResult.Verdict = "WA"
+			}
+			group.Cases = append(group.Cases, caseResult)
+		}
+		result.Groups = append(result.Groups, group)
+		return result, outputs, nil
+	}
+}
+
+func TestRunStressTest(t *testing.T) {
+	newTestConfig := func(withInputsValidator bool) *TestConfig {
+		testConfig := &TestConfig{
+			Test:     &ReportTest{Type: "stress", Filename: "solutions/solution.py"},
+			Solution: SolutionConfig{Source: "solution", Language: "py"},
+			Stress: &StressConfig{
+				Generator:  SolutionConfig{Source: "generator", Language: "py"},
+				BruteForce: SolutionConfig{Source: "brute", Language: "py"},
+				Limits:     &common.DefaultLimits,
+			},
+		}
+		for seed := int64(1); seed <= 10; seed++ {
+			testConfig.Stress.Seeds = append(testConfig.Stress.Seeds, seed)
+		}
+		if withInputsValidator {
+			testConfig.Stress.InputsValidator = &common.LiteralValidatorSettings{
+				Name: common.ValidatorNameCustom,
+			}
+		}
+		return testConfig
+	}
+	// The generator creates a list of 11 - seed ones, so the inputs get
+	// smaller as the seed increases. The expected output is their sum.
+	generator := func(input string) (string, string) {
+		seed, _ := strconv.Atoi(strings.TrimSpace(input))
+		return strings.TrimSpace(strings.Repeat("1 ", 11-seed)) + "\n", "OK"
+	}
+	length := func(input string) int {
+		return len(strings.Fields(input))
+	}
+	brute := func(input string) (string, string) {
+		if length(input) == 10 {
+			return "", "TLE"
+		}
+		return fmt.Sprintf("%d\n", length(input)), "OK"
+	}
+
+	for _, tt := range []struct {
+		name               string
+		solution           func(input string) (string, string)
+		inputsValidator    func(input string) bool
+		expectedState      State
+		expectedSeed       int64
+		expectedIterations int
+	}{
+		{
+			"passing",
+			func(input string) (string, string) {
+				return fmt.Sprintf("%d\n", strings.Count(input, "1")), "OK"
+			},
+			nil,
+			StatePassed,
+			0,
+			9,
+		},
+		{
+			"smallest failing input",
+			func(input string) (string, string) {
+				// Fails for seeds 2 and 10, but the input of seed 10 is smaller.
+				if length(input) == 9 || length(input) == 1 {
+					return "0\n", "OK"
+				}
+				return fmt.Sprintf("%d\n", length(input)), "OK"
+			},
+			nil,
+			StateFailed,
+			10,
+			9,
+		},
+		{
+			"invalid input",
+			func(input string) (string, string) {
+				return fmt.Sprintf("%d\n", length(input)), "OK"
+			},
+			func(input string) bool {
+				return length(input) != 8
+			},
+			StateFailed,
+			3,
+			0,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig := newTestConfig(tt.inputsValidator != nil)
+			stages := 0
+			err := RunStressTest(
+				testConfig,
+				fakeStressStageRunner(
+					map[string]func(string) (string, string){
+						"generator": generator,
+						"brute":     brute,
+						"solution":  tt.solution,
+					},
+					tt.inputsValidator,
+					&stages,
+				),
+			)
+			if err != nil {
+				t.Fatalf("RunStressTest() failed: %v", err)
+			}
+			test := testConfig.Test
+			if test.State != tt.expectedState {
+				t.Errorf("State = %v, want %v (%v)", test.State, tt.expectedState, test.ReportError)
+			}
+			if test.StressResult.Iterations != tt.expectedIterations {
+				t.Errorf("Iterations = %d, want %d", test.StressResult.Iterations, tt.expectedIterations)
+			}
+			if tt.expectedState == StatePassed {
+				if test.StressResult.Seed != nil {
+					t.Errorf("Seed = %d, want nil", *test.StressResult.Seed)
+				}
+				if stages != 3 {
+					t.Errorf("stages = %d, want 3", stages)
+				}
+				return
+			}
+			if test.StressResult.Seed == nil || *test.StressResult.Seed != tt.expectedSeed {
+				t.Fatalf("Seed = %v, want %d", test.StressResult.Seed, tt.expectedSeed)
+			}
+			if expectedInput, _ := generator(fmt.Sprintf("%d\n", tt.expectedSeed)); test.StressResult.Input != expectedInput {
+				t.Errorf("Input = %q, want %q", test.StressResult.Input, expectedInput)
+			}
+		})
+	}
+}
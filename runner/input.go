@@ -3,6 +3,7 @@ package runner
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"crypto/sha1"
@@ -17,10 +18,47 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// maxDownloadAttempts is the number of times that the download of an Input
+	// will be attempted (and resumed) before giving up.
+	maxDownloadAttempts = 5
+)
+
+var (
+	inputHashRe = regexp.MustCompile("^[a-f0-9]{40}$")
+
+	// downloadRetryDelay is the amount of time to wait before resuming an
+	// interrupted download.
+	downloadRetryDelay = time.Duration(1) * time.Second
+
+	// latestLocks has one lock per latest/<problem> file, since the slots of a
+	// runner can persist Inputs of the same problem concurrently.
+	latestLocks     = make(map[string]*sync.Mutex)
+	latestLocksLock sync.Mutex
+)
+
+// lockLatest acquires the lock of the latest/<problem> file, and returns the
+// function that releases it.
+func lockLatest(latestPath string) func() {
+	latestLocksLock.Lock()
+	lock, ok := latestLocks[latestPath]
+	if !ok {
+		lock = &sync.Mutex{}
+		latestLocks[latestPath] = lock
+	}
+	latestLocksLock.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
 // InputFactory is a common.InputFactory that can fetch the test case data from
 // the grader.
 type InputFactory struct {
@@ -60,6 +98,15 @@ func (factory *InputFactory) NewInput(
 	if err != nil {
 		panic(err)
 	}
+	var latestPath string
+	if factory.problem != "" {
+		latestPath = path.Join(
+			factory.config.Runner.RuntimePath,
+			"input",
+			"latest",
+			factory.problem,
+		)
+	}
 	return &Input{
 		runnerBaseInput: runnerBaseInput{
 			BaseInput: *common.NewBaseInput(
@@ -74,6 +121,7 @@ func (factory *InputFactory) NewInput(
 		},
 		client:     factory.client,
 		requestURL: requestURL.String(),
+		latestPath: latestPath,
 	}
 }
 
@@ -282,21 +330,402 @@ func (input *runnerBaseInput) persistFromTarStream(
 	return nil
 }
 
+// getRelativeStoredHashes returns the stored hashes of all the files in the
+// Input, with paths relative to the root of the Input.
+func (input *runnerBaseInput) getRelativeStoredHashes() (map[string]string, error) {
+	hashes, err := input.getStoredHashes()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(hashes))
+	for filePath, hash := range hashes {
+		relativePath, err := filepath.Rel(input.path, filePath)
+		if err != nil {
+			return nil, err
+		}
+		result[filepath.ToSlash(relativePath)] = hash
+	}
+	return result, nil
+}
+
+// persistFromDeltaStream assembles the Input from a .tar.gz stream that
+// contains a common.InputDelta, taking all the files that were not modified
+// from another Input that is already in the filesystem.
+func (input *runnerBaseInput) persistFromDeltaStream(
+	r io.Reader,
+	base *runnerBaseInput,
+	baseHashes map[string]string,
+) error {
+	tmpPath := fmt.Sprintf("%s.tmp", input.path)
+	if err := os.MkdirAll(tmpPath, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	archive := tar.NewReader(gz)
+
+	hdr, err := archive.Next()
+	if err != nil {
+		return errors.Wrap(err, "failed to read the input delta")
+	}
+	if hdr.Name != common.InputDeltaManifestName {
+		return errors.Errorf("unexpected first entry in input delta: %q", hdr.Name)
+	}
+	var delta common.InputDelta
+	if err := json.NewDecoder(archive).Decode(&delta); err != nil {
+		return errors.Wrap(err, "failed to decode the input delta")
+	}
+
+	filePathForName := func(root, filename string) (string, error) {
+		filePath := path.Join(root, filename)
+		if !strings.HasPrefix(filePath, root+"/") {
+			return "", errors.Errorf("path is outside expected directory: %q", filename)
+		}
+		return filePath, nil
+	}
+
+	written := make(map[string]struct{})
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		filename := path.Clean(hdr.Name)
+		expectedHash, ok := delta.Files[filename]
+		if !ok {
+			return errors.Errorf("unexpected file in input delta: %q", filename)
+		}
+		filePath, err := filePathForName(tmpPath, filename)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+			return err
+		}
+		fd, err := os.Create(filePath)
+		if err != nil {
+			return err
+		}
+		hasher := common.NewHashReader(archive, sha1.New())
+		_, err = io.Copy(fd, hasher)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+		if actualHash := fmt.Sprintf("%0x", hasher.Sum(nil)); actualHash != expectedHash {
+			return errors.Errorf(
+				"hash mismatch for %q == %q, want %q",
+				filename,
+				actualHash,
+				expectedHash,
+			)
+		}
+		written[filename] = struct{}{}
+	}
+
+	// All the files that were not sent are identical to the ones in the base
+	// Input, so they can be hardlinked instead of copied.
+	filenames := make([]string, 0, len(delta.Files))
+	for filename, expectedHash := range delta.Files {
+		filenames = append(filenames, filename)
+		if _, ok := written[filename]; ok {
+			continue
+		}
+		if baseHash, ok := baseHashes[filename]; !ok || baseHash != expectedHash {
+			return errors.Errorf("file missing from input delta: %q", filename)
+		}
+		basePath, err := filePathForName(base.path, filename)
+		if err != nil {
+			return err
+		}
+		filePath, err := filePathForName(tmpPath, filename)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(basePath, filePath); err != nil {
+			return err
+		}
+	}
+	sort.Strings(filenames)
+
+	sha1sumFile, err := os.Create(fmt.Sprintf("%s.sha1", input.path))
+	if err != nil {
+		return err
+	}
+	defer sha1sumFile.Close()
+
+	var size int64
+	for _, filename := range filenames {
+		stat, err := os.Stat(path.Join(tmpPath, filename))
+		if err != nil {
+			return err
+		}
+		size += stat.Size()
+		_, err = fmt.Fprintf(
+			sha1sumFile,
+			"%s *%s/%s\n",
+			delta.Files[filename],
+			input.Hash()[2:],
+			filename,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	settingsFd, err := os.Open(path.Join(tmpPath, "settings.json"))
+	if err != nil {
+		return err
+	}
+	defer settingsFd.Close()
+	decoder := json.NewDecoder(settingsFd)
+	if err := decoder.Decode(input.Settings()); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, input.path); err != nil {
+		return err
+	}
+
+	input.Commit(size)
+
+	return nil
+}
+
 // Input is a common.Input that can fetch the test case data from the grader.
 type Input struct {
 	runnerBaseInput
 	requestURL string
 	client     *http.Client
+
+	// latestPath is the path of the file that holds the hash of the most
+	// recent Input of the same problem. That Input is used as the base to only
+	// transfer the files that changed.
+	latestPath string
 }
 
-// Persist stores the Input into the filesystem.
+// Persist stores the Input into the filesystem. Inputs of the same problem are
+// persisted one at a time, so that the latest Input of the problem does not
+// change while it is being used as the base of another one.
 func (input *Input) Persist() error {
-	resp, err := input.client.Get(input.requestURL)
+	if input.latestPath != "" {
+		defer lockLatest(input.latestPath)()
+	}
+	if base, baseHashes, ok := input.getDeltaBase(); ok {
+		// Any failure here is not fatal, since the whole Input can still be
+		// requested.
+		if err := input.persistDelta(base, baseHashes); err == nil {
+			input.updateLatest()
+			return nil
+		}
+	}
+
+	metadata, err := input.download()
+	if err != nil {
+		return err
+	}
+
+	// Whatever happens next, the staging file is no longer useful: it either
+	// is successfully unpacked or is corrupted.
+	defer input.removeStagingFiles()
+	f, err := os.Open(input.stagingPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := input.persistFromTarStream(
+		f,
+		"gzip",
+		metadata.UncompressedSize,
+		metadata.ContentSHA1,
+	); err != nil {
+		return err
+	}
+	input.updateLatest()
+	return nil
+}
+
+// downloadMetadata holds the information about a download that is needed to
+// resume it later.
+type downloadMetadata struct {
+	ETag             string
+	ContentSHA1      string
+	UncompressedSize int64
+}
+
+// stagingPath is the path where the .tar.gz file is downloaded before being
+// unpacked. It is only removed once the download completes, or when it is
+// known to be unusable, so that failed downloads can be resumed the next time
+// the Input is persisted.
+func (input *Input) stagingPath() string {
+	return fmt.Sprintf("%s.tar.gz.partial", input.path)
+}
+
+func (input *Input) stagingMetadataPath() string {
+	return fmt.Sprintf("%s.json", input.stagingPath())
+}
+
+func (input *Input) removeStagingFiles() {
+	os.Remove(input.stagingPath())
+	os.Remove(input.stagingMetadataPath())
+}
+
+// download fetches the whole .tar.gz file into the staging file. Interrupted
+// transfers are resumed using HTTP range requests, validated with the ETag of
+// the original response.
+func (input *Input) download() (*downloadMetadata, error) {
+	var err error
+	for attempt := 0; attempt < maxDownloadAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(downloadRetryDelay)
+		}
+		var metadata *downloadMetadata
+		var resumable bool
+		metadata, resumable, err = input.downloadAttempt()
+		if err == nil {
+			return metadata, nil
+		}
+		if !resumable {
+			return nil, err
+		}
+	}
+	return nil, errors.Wrapf(err, "failed to download input after %d attempts", maxDownloadAttempts)
+}
+
+// downloadAttempt tries to complete the download of the staging file. It
+// returns whether the download can be resumed in case of failure.
+func (input *Input) downloadAttempt() (*downloadMetadata, bool, error) {
+	if err := os.MkdirAll(path.Dir(input.stagingPath()), 0755); err != nil {
+		return nil, false, err
+	}
+
+	var metadata *downloadMetadata
+	var offset int64
+	if contents, err := os.ReadFile(input.stagingMetadataPath()); err == nil {
+		metadata = &downloadMetadata{}
+		if err := json.Unmarshal(contents, metadata); err != nil || metadata.ETag == "" {
+			metadata = nil
+		} else if stat, err := os.Stat(input.stagingPath()); err == nil {
+			offset = stat.Size()
+		}
+	}
+
+	req, err := http.NewRequest("GET", input.requestURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if metadata != nil && offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", metadata.ETag)
+	}
+	resp, err := input.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	var f *os.File
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			input.removeStagingFiles()
+			return nil, false, errors.Errorf(
+				"unexpected Content-Range header: %q",
+				resp.Header.Get("Content-Range"),
+			)
+		}
+		f, err = os.OpenFile(input.stagingPath(), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, false, err
+		}
+	case http.StatusOK:
+		// Either this is a new download, or the Input changed in the grader
+		// since the last attempt. Start over.
+		uncompressedSize, err := strconv.ParseInt(
+			resp.Header.Get("X-Content-Uncompressed-Size"), 10, 64,
+		)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "failed to parse the X-Content-Uncompressed-Size header")
+		}
+		metadata = &downloadMetadata{
+			ETag:             resp.Header.Get("ETag"),
+			ContentSHA1:      resp.Header.Get("Content-SHA1"),
+			UncompressedSize: uncompressedSize,
+		}
+		encodedMetadata, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := os.WriteFile(input.stagingMetadataPath(), encodedMetadata, 0644); err != nil {
+			return nil, false, err
+		}
+		f, err = os.Create(input.stagingPath())
+		if err != nil {
+			return nil, false, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The staging file is somehow larger than the Input. Start over.
+		input.removeStagingFiles()
+		return nil, true, errors.Errorf("unexpected error code returned: %d", resp.StatusCode)
+	default:
+		return nil, false, errors.Errorf("unexpected error code returned: %d", resp.StatusCode)
+	}
+
+	_, err = io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Only downloads that have a validator can be resumed.
+		return nil, metadata.ETag != "", err
+	}
+	return metadata, false, nil
+}
+
+// persistDelta sends the manifest of the base Input to the grader so that only
+// the files that changed are transmitted back.
+func (input *Input) persistDelta(
+	base *runnerBaseInput,
+	baseHashes map[string]string,
+) error {
+	var body bytes.Buffer
+	if err := common.WriteInputManifest(&body, baseHashes); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", input.requestURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := input.client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("non-200 error code returned: %d", resp.StatusCode)
+	}
 
+	if resp.Header.Get(common.InputDeltaHeader) == "" {
+		// Older graders ignore the manifest and send the whole Input.
+		return input.persistFromResponse(resp)
+	}
+	return input.persistFromDeltaStream(resp.Body, base, baseHashes)
+}
+
+func (input *Input) persistFromResponse(resp *http.Response) error {
 	uncompressedSize, err := strconv.ParseInt(
 		resp.Header.Get("X-Content-Uncompressed-Size"), 10, 64,
 	)
@@ -312,12 +741,62 @@ func (input *Input) Persist() error {
 	)
 }
 
+// getDeltaBase returns the most recent Input of the same problem, if it is
+// still present in the filesystem.
+func (input *Input) getDeltaBase() (*runnerBaseInput, map[string]string, bool) {
+	if input.latestPath == "" {
+		return nil, nil, false
+	}
+	contents, err := os.ReadFile(input.latestPath)
+	if err != nil {
+		return nil, nil, false
+	}
+	hash := strings.TrimSpace(string(contents))
+	if !inputHashRe.MatchString(hash) || hash == input.Hash() {
+		return nil, nil, false
+	}
+	base := &runnerBaseInput{
+		BaseInput: *common.NewBaseInput(hash, nil),
+		path: path.Join(
+			path.Dir(path.Dir(input.path)),
+			fmt.Sprintf("%s/%s", hash[:2], hash[2:]),
+		),
+	}
+	if _, err := os.Stat(base.path); err != nil {
+		return nil, nil, false
+	}
+	baseHashes, err := base.getRelativeStoredHashes()
+	if err != nil {
+		return nil, nil, false
+	}
+	return base, baseHashes, true
+}
+
+// updateLatest marks this Input as the most recent one for its problem. The
+// file is replaced atomically so that it is never read partially written.
+func (input *Input) updateLatest() {
+	if input.latestPath == "" {
+		return
+	}
+	if err := os.MkdirAll(path.Dir(input.latestPath), 0755); err != nil {
+		return
+	}
+	tmpPath := input.latestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(input.Hash()+"\n"), 0644); err != nil {
+		return
+	}
+	if err := os.Rename(tmpPath, input.latestPath); err != nil {
+		os.Remove(tmpPath)
+	}
+}
+
 // Delete removes the filesystem files for the Input.
 func (input *Input) Delete() error {
 	return input.runnerBaseInput.Delete()
 }
 
-// Release removes the filesystem files for the Input.
+// Release removes the filesystem files for the Input. Partial downloads are
+// kept so that they can be resumed if the Input is requested again.
 func (input *Input) Release() {
 	input.Delete()
 }
@@ -1,7 +1,13 @@
 package runner
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/omegaup/quark/common"
 	"io/ioutil"
 	"math/big"
@@ -10,9 +16,13 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 	"unicode"
 )
 
@@ -328,3 +338,298 @@ func TestInputFactory(t *testing.T) {
 		}
 	}
 }
+
+func writeTestTarGz(t *testing.T, files map[string]string, manifest *common.InputDelta) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	addFile := func(name string, contents []byte) {
+		if err := archive.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+		}); err != nil {
+			t.Fatalf("Failed to write header for %q: %v", name, err)
+		}
+		if _, err := archive.Write(contents); err != nil {
+			t.Fatalf("Failed to write %q: %v", name, err)
+		}
+	}
+	if manifest != nil {
+		encoded, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatalf("Failed to marshal delta: %v", err)
+		}
+		addFile(common.InputDeltaManifestName, encoded)
+	}
+	filenames := make([]string, 0, len(files))
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		addFile(filename, []byte(files[filename]))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("Failed to close gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestInputFactoryDelta(t *testing.T) {
+	ctx, err := newRunnerContext(t)
+	if err != nil {
+		t.Fatalf("RunnerContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Runner.RuntimePath)
+	}
+
+	sha1Hex := func(contents string) string {
+		return fmt.Sprintf("%0x", sha1.Sum([]byte(contents)))
+	}
+	oldHash := strings.Repeat("a", 40)
+	oldFiles := map[string]string{
+		"settings.json": "{}",
+		"cases/0.in":    "1 2",
+		"cases/0.out":   "3",
+		"cases/1.in":    "2 3",
+		"cases/1.out":   "5",
+	}
+	newHash := strings.Repeat("b", 40)
+	newFiles := map[string]string{
+		"settings.json": "{}",
+		"cases/0.in":    "1 2",
+		"cases/0.out":   "3",
+		"cases/2.in":    "3 4",
+		"cases/2.out":   "7",
+	}
+	oldArchive := writeTestTarGz(t, oldFiles, nil)
+
+	var receivedManifest map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/input/test/%s/", oldHash):
+			w.Header().Add("Content-SHA1", fmt.Sprintf("%0x", sha1.Sum(oldArchive)))
+			w.Header().Add("X-Content-Uncompressed-Size", strconv.Itoa(len(oldArchive)))
+			w.Write(oldArchive)
+		case fmt.Sprintf("/input/test/%s/", newHash):
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			manifest, err := common.ReadInputManifest(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			receivedManifest = manifest
+			newHashes := make(map[string]string)
+			for filename, contents := range newFiles {
+				newHashes[filename] = sha1Hex(contents)
+			}
+			delta, modified := common.NewInputDelta(receivedManifest, newHashes)
+			modifiedFiles := make(map[string]string)
+			for _, filename := range modified {
+				modifiedFiles[filename] = newFiles[filename]
+			}
+			w.Header().Add(common.InputDeltaHeader, "1")
+			w.Write(writeTestTarGz(t, modifiedFiles, delta))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	baseURL, err := url.Parse(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	inputManager := common.NewInputManager(ctx)
+	factory := NewInputFactory(http.DefaultClient, &ctx.Config, baseURL, "test")
+
+	oldInputRef, err := inputManager.Add(oldHash, factory)
+	if err != nil {
+		t.Fatalf("Failed to add the old input: %v", err)
+	}
+	defer oldInputRef.Release()
+
+	newInputRef, err := inputManager.Add(newHash, factory)
+	if err != nil {
+		t.Fatalf("Failed to add the new input: %v", err)
+	}
+	defer newInputRef.Release()
+
+	if len(receivedManifest) != len(oldFiles) {
+		t.Errorf("grader received manifest %v, want %d entries", receivedManifest, len(oldFiles))
+	}
+	for filename, contents := range newFiles {
+		actual, err := ioutil.ReadFile(path.Join(newInputRef.Input.Path(), filename))
+		if err != nil {
+			t.Errorf("Failed to read %q: %v", filename, err)
+			continue
+		}
+		if string(actual) != contents {
+			t.Errorf("%q == %q, want %q", filename, string(actual), contents)
+		}
+	}
+	if _, err := os.Stat(path.Join(newInputRef.Input.Path(), "cases/1.in")); !os.IsNotExist(err) {
+		t.Errorf("deleted file cases/1.in still present: %v", err)
+	}
+
+	oldStat, err := os.Stat(path.Join(oldInputRef.Input.Path(), "cases/0.in"))
+	if err != nil {
+		t.Fatalf("Failed to stat old file: %v", err)
+	}
+	newStat, err := os.Stat(path.Join(newInputRef.Input.Path(), "cases/0.in"))
+	if err != nil {
+		t.Fatalf("Failed to stat new file: %v", err)
+	}
+	if !os.SameFile(oldStat, newStat) {
+		t.Errorf("unchanged file cases/0.in was not hardlinked")
+	}
+
+	if err := newInputRef.Input.Verify(); err != nil {
+		t.Errorf("Failed to verify the new input: %v", err)
+	}
+}
+
+func TestInputFactoryResume(t *testing.T) {
+	ctx, err := newRunnerContext(t)
+	if err != nil {
+		t.Fatalf("RunnerContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Runner.RuntimePath)
+	}
+
+	originalDownloadRetryDelay := downloadRetryDelay
+	downloadRetryDelay = 0
+	defer func() { downloadRetryDelay = originalDownloadRetryDelay }()
+
+	hash := strings.Repeat("a", 40)
+	archive := writeTestTarGz(t, map[string]string{
+		"settings.json": "{}",
+		"cases/0.in":    strings.Repeat("1 2\n", 1024),
+		"cases/0.out":   "3",
+	}, nil)
+	etag := fmt.Sprintf("\"%0x-%d\"", sha1.Sum(archive), len(archive))
+
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("Range"))
+		w.Header().Add("Content-SHA1", fmt.Sprintf("%0x", sha1.Sum(archive)))
+		w.Header().Add("X-Content-Uncompressed-Size", strconv.Itoa(len(archive)))
+		w.Header().Set("ETag", etag)
+		if len(requests) == 1 {
+			// Simulate a broken connection in the middle of the transfer.
+			w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(archive[:len(archive)/2])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer ts.Close()
+
+	baseURL, err := url.Parse(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	inputManager := common.NewInputManager(ctx)
+	factory := NewInputFactory(http.DefaultClient, &ctx.Config, baseURL, "test")
+
+	inputRef, err := inputManager.Add(hash, factory)
+	if err != nil {
+		t.Fatalf("Failed to add the input: %v", err)
+	}
+	defer inputRef.Release()
+
+	expectedRequests := []string{"", fmt.Sprintf("bytes=%d-", len(archive)/2)}
+	if !reflect.DeepEqual(expectedRequests, requests) {
+		t.Errorf("requests == %q, want %q", requests, expectedRequests)
+	}
+	if _, err := os.Stat(inputRef.Input.(*Input).stagingPath()); !os.IsNotExist(err) {
+		t.Errorf("staging file still present: %v", err)
+	}
+}
+
+func TestInputFactoryResumeAcrossPersist(t *testing.T) {
+	ctx, err := newRunnerContext(t)
+	if err != nil {
+		t.Fatalf("RunnerContext creation failed with %q", err)
+	}
+	defer ctx.Close()
+	if !ctx.Config.Runner.PreserveFiles {
+		defer os.RemoveAll(ctx.Config.Runner.RuntimePath)
+	}
+
+	originalDownloadRetryDelay := downloadRetryDelay
+	downloadRetryDelay = 0
+	defer func() { downloadRetryDelay = originalDownloadRetryDelay }()
+
+	hash := strings.Repeat("b", 40)
+	archive := writeTestTarGz(t, map[string]string{
+		"settings.json": "{}",
+		"cases/0.in":    strings.Repeat("1 2\n", 1024),
+		"cases/0.out":   "3",
+	}, nil)
+	etag := fmt.Sprintf("\"%0x-%d\"", sha1.Sum(archive), len(archive))
+
+	var requests []string
+	unavailable := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("Range"))
+		w.Header().Add("Content-SHA1", fmt.Sprintf("%0x", sha1.Sum(archive)))
+		w.Header().Add("X-Content-Uncompressed-Size", strconv.Itoa(len(archive)))
+		w.Header().Set("ETag", etag)
+		if len(requests) == 1 {
+			// Simulate a broken connection in the middle of the transfer.
+			w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(archive[:len(archive)/2])
+			return
+		}
+		if unavailable {
+			// The grader goes away, so the whole Persist attempt fails.
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer ts.Close()
+
+	baseURL, err := url.Parse(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	inputManager := common.NewInputManager(ctx)
+	factory := NewInputFactory(http.DefaultClient, &ctx.Config, baseURL, "test")
+
+	if inputRef, err := inputManager.Add(hash, factory); err == nil {
+		inputRef.Release()
+		t.Fatalf("Adding the input unexpectedly succeeded")
+	}
+
+	unavailable = false
+	inputRef, err := inputManager.Add(hash, factory)
+	if err != nil {
+		t.Fatalf("Failed to add the input: %v", err)
+	}
+	defer inputRef.Release()
+
+	resumed := fmt.Sprintf("bytes=%d-", len(archive)/2)
+	expectedRequests := []string{"", resumed, resumed}
+	if !reflect.DeepEqual(expectedRequests, requests) {
+		t.Errorf("requests == %q, want %q", requests, expectedRequests)
+	}
+	if _, err := os.Stat(inputRef.Input.(*Input).stagingPath()); !os.IsNotExist(err) {
+		t.Errorf("staging file still present: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package runner
+
+import (
+	"time"
+
+	"github.com/omegaup/quark/common"
+)
+
+const (
+	// ConnectionSubprotocol is the WebSocket subprotocol spoken over the
+	// persistent connection between a runner and the grader.
+	ConnectionSubprotocol = "com.omegaup.runner"
+
+	// ConnectionPingPeriod is how often the grader pings the runners over the
+	// persistent connection. Either side considers the connection dead if
+	// nothing is received for twice this amount of time.
+	ConnectionPingPeriod = time.Duration(30) * time.Second
+)
+
+// ConnectionMessageType is the type of a message sent over the persistent
+// connection between a runner and the grader.
+type ConnectionMessageType string
+
+const (
+	// ConnectionMessageTypeReady is sent by the runner when it is ready to
+	// receive a run. InputHashes has the inputs that it has cached. If Reserve
+	// is set, the runner is still grading another run and wants to reserve the
+	// next one, so that it can fetch its input in the meantime.
+	ConnectionMessageTypeReady = ConnectionMessageType("ready")
+	// ConnectionMessageTypeHeartbeat is sent by the runner periodically while
+	// it grades the run with AttemptID. Progress has how far along it is.
+	ConnectionMessageTypeHeartbeat = ConnectionMessageType("heartbeat")
+	// ConnectionMessageTypeResult is sent by the runner once it finishes
+	// grading the run with AttemptID. If HasFiles is set, the next message is
+	// a binary message with the contents of files.zip.
+	ConnectionMessageTypeResult = ConnectionMessageType("result")
+	// ConnectionMessageTypeDraining is sent by the runner once it stops
+	// accepting runs, so that the grader no longer dispatches runs to it. The
+	// runner closes the connection once it finishes the current run.
+	ConnectionMessageTypeDraining = ConnectionMessageType("draining")
+
+	// ConnectionMessageTypeAssignment is sent by the grader with the Run that
+	// the runner should grade.
+	ConnectionMessageTypeAssignment = ConnectionMessageType("assignment")
+	// ConnectionMessageTypeCancel is sent by the grader when the run with
+	// AttemptID is no longer assigned to the runner, so its results should not
+	// be sent.
+	ConnectionMessageTypeCancel = ConnectionMessageType("cancel")
+	// ConnectionMessageTypeReloadConfig is sent by the grader to ask the runner
+	// to reload its configuration file.
+	ConnectionMessageTypeReloadConfig = ConnectionMessageType("reload_config")
+	// ConnectionMessageTypeDrain is sent by the grader to ask the runner to
+	// stop requesting runs once it finishes the current one.
+	ConnectionMessageTypeDrain = ConnectionMessageType("drain")
+)
+
+// ConnectionMessage is a message sent over the persistent connection between
+// a runner and the grader. Only the fields that are relevant to the message
+// type are set.
+type ConnectionMessage struct {
+	Type        ConnectionMessageType `json:"type"`
+	AttemptID   uint64                `json:"attempt_id,omitempty"`
+	Run         *common.Run           `json:"run,omitempty"`
+	Progress    *RunProgress          `json:"progress,omitempty"`
+	Result      *RunResult            `json:"result,omitempty"`
+	Logs        string                `json:"logs,omitempty"`
+	HasFiles    bool                  `json:"has_files,omitempty"`
+	InputHashes []string              `json:"input_hashes,omitempty"`
+	Reserve     bool                  `json:"reserve,omitempty"`
+}
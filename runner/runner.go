@@ -585,6 +585,27 @@ func copyFile(src string, dst string) error {
 	return err
 }
 
+// RunProgress represents how far along the grading of a run is.
+type RunProgress struct {
+	Phase      string `json:"phase"`
+	Case       string `json:"case,omitempty"`
+	CasesDone  int    `json:"cases_done"`
+	CasesTotal int    `json:"cases_total"`
+
+	// OverallWallTimeLimit is the problem's overall wall time limit, which
+	// lets the grader know how long the run is expected to take at most.
+	OverallWallTimeLimit base.Duration `json:"overall_wall_time_limit"`
+}
+
+const (
+	// ProgressPhaseCompile is the phase in which the binaries are compiled.
+	ProgressPhaseCompile = "compile"
+	// ProgressPhaseRun is the phase in which the cases are run.
+	ProgressPhaseRun = "run"
+	// ProgressPhaseValidate is the phase in which the outputs are validated.
+	ProgressPhaseValidate = "validate"
+)
+
 // Grade compiles and runs a contestant-provided program, supplies it with the
 // Input-specified inputs, and computes its final score and verdict.
 func Grade(
@@ -593,6 +614,21 @@ func Grade(
 	run *common.Run,
 	input common.Input,
 	sandbox Sandbox,
+) (*RunResult, error) {
+	return GradeWithProgress(ctx, filesWriter, run, input, sandbox, nil, nil)
+}
+
+// GradeWithProgress is like Grade, but calls progress every time a new phase
+// or case starts, and reuses the problemsetter binaries in binaryCache.
+// Either of them can be nil.
+func GradeWithProgress(
+	ctx *common.Context,
+	filesWriter io.Writer,
+	run *common.Run,
+	input common.Input,
+	sandbox Sandbox,
+	progress func(*RunProgress),
+	binaryCache *BinaryCache,
 ) (*RunResult, error) {
 	runResult := NewRunResult("JE", run.MaxScore)
 	if !sandbox.Supported() {
@@ -641,10 +677,24 @@ func Grade(
 
 	// totalWeightFactor is used to normalize all the weights in the case data.
 	totalWeightFactor := new(big.Rat)
+	casesTotal := 0
 	for _, group := range settings.Cases {
 		for _, caseData := range group.Cases {
 			totalWeightFactor.Add(totalWeightFactor, caseData.Weight)
+			casesTotal++
+		}
+	}
+	reportProgress := func(phase string, caseName string, casesDone int) {
+		if progress == nil {
+			return
 		}
+		progress(&RunProgress{
+			Phase:                phase,
+			Case:                 caseName,
+			CasesDone:            casesDone,
+			CasesTotal:           casesTotal,
+			OverallWallTimeLimit: settings.Limits.OverallWallTimeLimit,
+		})
 	}
 	if totalWeightFactor.Cmp(new(big.Rat)) <= 0 {
 		totalWeightFactor = big.NewRat(1, 1)
@@ -916,6 +966,7 @@ func Grade(
 		)
 	}
 
+	reportProgress(ProgressPhaseCompile, "", 0)
 	compileSegment := ctx.Transaction.StartSegment("compile")
 	for _, b := range binaries {
 		binRoot := path.Join(runRoot, b.name)
@@ -927,17 +978,35 @@ func Grade(
 			// Let's not make problemsetters be forced to use old languages.
 			lang = "cpp11"
 		}
-		compileMeta, err := sandbox.Compile(
-			ctx,
-			lang,
-			b.sourceFiles,
-			binPath,
-			path.Join(binRoot, "compile.out"),
-			path.Join(binRoot, "compile.err"),
-			path.Join(binRoot, "compile.meta"),
-			b.target,
-			b.extraFlags,
-		)
+		compile := func() (*RunMetadata, error) {
+			return sandbox.Compile(
+				ctx,
+				lang,
+				b.sourceFiles,
+				binPath,
+				path.Join(binRoot, "compile.out"),
+				path.Join(binRoot, "compile.err"),
+				path.Join(binRoot, "compile.meta"),
+				b.target,
+				b.extraFlags,
+			)
+		}
+		var compileMeta *RunMetadata
+		var err error
+		if b.binaryType == binaryContestant {
+			compileMeta, err = compile()
+		} else {
+			// Problemsetter binaries only depend on the input.
+			compileMeta, err = binaryCache.compileCached(
+				ctx,
+				sandbox,
+				input.Hash(),
+				b,
+				lang,
+				binRoot,
+				compile,
+			)
+		}
 		singleCompileSegment.End()
 		generatedFiles = append(
 			generatedFiles,
@@ -981,9 +1050,15 @@ func Grade(
 	groupResults := make([]GroupResult, 0, len(settings.Cases))
 	runResult.Verdict = "OK"
 	runSegment := ctx.Transaction.StartSegment("run")
+	casesDone := 0
 	for _, group := range settings.Cases {
 		caseResults := make([]CaseResult, 0, len(group.Cases))
 		for _, caseData := range group.Cases {
+			if err := ctx.Context.Err(); err != nil {
+				return runResult, fmt.Errorf("grading was cancelled: %w", err)
+			}
+			reportProgress(ProgressPhaseRun, caseData.Name, casesDone)
+			casesDone++
 			var runMeta *RunMetadata
 			var individualMeta = make(map[string]RunMetadata)
 			if runResult.WallTime > settings.Limits.OverallWallTimeLimit.Seconds() {
@@ -1259,6 +1334,7 @@ func Grade(
 	runSegment.End()
 
 	// Validate outputs.
+	reportProgress(ProgressPhaseValidate, "", casesTotal)
 	validateSegment := ctx.Transaction.StartSegment("validate")
 	for i, group := range settings.Cases {
 		correct := true
@@ -2,8 +2,10 @@ package runner
 
 import (
 	"bufio"
+	"crypto/sha1"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -11,6 +13,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	base "github.com/omegaup/go-base/v3"
@@ -142,12 +145,30 @@ type OmegajailSandbox struct {
 	AllowSigsysFallback bool
 
 	DisableSandboxing bool
+
+	// CPUs, if not empty, are the only CPUs that omegajail and the programs it
+	// runs are allowed to use.
+	CPUs []int
+
+	// rootfsVersion is shared by all the copies of the sandbox, so that the
+	// root filesystems are only fingerprinted once.
+	rootfsVersion *omegajailRootfsVersion
+}
+
+// omegajailRootfsVersion caches the fingerprint of the omegajail root
+// filesystems. They are only replaced while the runner is stopped, so it is
+// only recomputed when the omegajail binary changes.
+type omegajailRootfsVersion struct {
+	sync.Mutex
+	binaryVersion string
+	version       string
 }
 
 // NewOmegajailSandbox creates a new OmegajailSandbox.
 func NewOmegajailSandbox(omegajailRoot string) *OmegajailSandbox {
 	return &OmegajailSandbox{
 		omegajailRoot: omegajailRoot,
+		rootfsVersion: &omegajailRootfsVersion{},
 	}
 }
 
@@ -157,6 +178,58 @@ func (o *OmegajailSandbox) Supported() bool {
 	return err == nil
 }
 
+// CompilerVersion returns the version of the compilers in the omegajail
+// installation. The compilers live in the root filesystems, which can be
+// upgraded independently of the omegajail binary, so the version is derived
+// from both.
+func (o *OmegajailSandbox) CompilerVersion(lang string) (string, error) {
+	info, err := os.Stat(path.Join(o.omegajailRoot, "bin/omegajail"))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to stat the omegajail binary")
+	}
+	binaryVersion := fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+
+	if o.rootfsVersion == nil {
+		return fmt.Sprintf("%s-%s", binaryVersion, rootfsFingerprint(o.omegajailRoot)), nil
+	}
+	o.rootfsVersion.Lock()
+	defer o.rootfsVersion.Unlock()
+	if o.rootfsVersion.binaryVersion != binaryVersion {
+		o.rootfsVersion.binaryVersion = binaryVersion
+		o.rootfsVersion.version = rootfsFingerprint(o.omegajailRoot)
+	}
+	return fmt.Sprintf("%s-%s", binaryVersion, o.rootfsVersion.version), nil
+}
+
+// rootfsFingerprint returns a fingerprint of the root filesystems in the
+// omegajail installation, which is where the compilers are. Reading all of
+// their files would take too long, so only their paths, sizes and
+// modification times are used. Files that cannot be read are skipped.
+func rootfsFingerprint(omegajailRoot string) string {
+	h := sha1.New()
+	entries, _ := os.ReadDir(omegajailRoot)
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "root") {
+			continue
+		}
+		filepath.WalkDir(
+			path.Join(omegajailRoot, entry.Name()),
+			func(filename string, d fs.DirEntry, err error) error {
+				if err != nil || !d.Type().IsRegular() {
+					return nil
+				}
+				info, err := d.Info()
+				if err != nil {
+					return nil
+				}
+				fmt.Fprintf(h, "%s %d %d\n", filename, info.Size(), info.ModTime().UnixNano())
+				return nil
+			},
+		)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 // Compile compiles the contestant-supplied program using the specified
 // configuration using the omegajail sandbox.
 func (o *OmegajailSandbox) Compile(
@@ -411,7 +484,18 @@ func (o *OmegajailSandbox) Run(
 }
 
 func (o *OmegajailSandbox) invokeOmegajail(ctx *common.Context, omegajailParams []string, errorFile string) {
-	omegajailFullParams := []string{path.Join(o.omegajailRoot, "bin/omegajail")}
+	var omegajailFullParams []string
+	if len(o.CPUs) > 0 {
+		cpus := make([]string, len(o.CPUs))
+		for i, cpu := range o.CPUs {
+			cpus[i] = strconv.Itoa(cpu)
+		}
+		omegajailFullParams = append(
+			omegajailFullParams,
+			"taskset", "--cpu-list", strings.Join(cpus, ","),
+		)
+	}
+	omegajailFullParams = append(omegajailFullParams, path.Join(o.omegajailRoot, "bin/omegajail"))
 	if o.AllowSigsysFallback {
 		omegajailFullParams = append(omegajailFullParams, "--allow-sigsys-fallback")
 	}
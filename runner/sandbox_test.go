@@ -3,7 +3,9 @@ package runner
 import (
 	"bytes"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/omegaup/quark/common"
 )
@@ -23,6 +25,44 @@ func TestOmegajail(t *testing.T) {
 	}
 }
 
+func TestOmegajailCompilerVersion(t *testing.T) {
+	omegajailRoot := t.TempDir()
+	for _, filename := range []string{"bin/omegajail", "root-gcc/usr/bin/gcc"} {
+		if err := os.MkdirAll(path.Dir(path.Join(omegajailRoot, filename)), 0755); err != nil {
+			t.Fatalf("Failed to create the directory for %q: %v", filename, err)
+		}
+		if err := os.WriteFile(path.Join(omegajailRoot, filename), []byte("1"), 0644); err != nil {
+			t.Fatalf("Failed to write %q: %v", filename, err)
+		}
+	}
+
+	sandbox := NewOmegajailSandbox(omegajailRoot)
+	version, err := sandbox.CompilerVersion("cpp17-gcc")
+	if err != nil {
+		t.Fatalf("CompilerVersion() failed: %v", err)
+	}
+	if cachedVersion, err := sandbox.CompilerVersion("cpp17-gcc"); err != nil || cachedVersion != version {
+		t.Errorf("CompilerVersion() = %q, %v, want %q", cachedVersion, err, version)
+	}
+
+	// Upgrading the compiler without touching the omegajail binary must change
+	// the version.
+	compilerPath := path.Join(omegajailRoot, "root-gcc/usr/bin/gcc")
+	if err := os.WriteFile(compilerPath, []byte("22"), 0644); err != nil {
+		t.Fatalf("Failed to upgrade the compiler: %v", err)
+	}
+	if err := os.Chtimes(compilerPath, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to upgrade the compiler: %v", err)
+	}
+	upgradedVersion, err := NewOmegajailSandbox(omegajailRoot).CompilerVersion("cpp17-gcc")
+	if err != nil {
+		t.Fatalf("CompilerVersion() failed: %v", err)
+	}
+	if upgradedVersion == version {
+		t.Errorf("CompilerVersion() = %q after upgrading the compiler, want a different version", upgradedVersion)
+	}
+}
+
 func TestParseMetaFile(t *testing.T) {
 	ctx, err := newRunnerContext(t)
 	if err != nil {